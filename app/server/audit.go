@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"medods-auth/persistance/postgres"
+	"medods-auth/service/audit"
+	"medods-auth/service/auth"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type auditLog interface {
+	auth.AuditSink
+	audit.Reader
+}
+
+// setupAudit returns a nil log when auditing is disabled.
+func setupAudit(conf *AuditConfig) (auditLog, func() error, error) {
+	switch conf.Sink {
+	case AuditFile:
+		sink, err := audit.NewFileSink(conf.FilePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sink, sink.Close, nil
+	case AuditPostgres:
+		pgConf := *Config().Postgres
+		pgConf.HashDatabase = false
+		pgConf.BlackListDatabase = false
+		pgConf.UserDatabase = false
+		pgConf.AuditDatabase = true
+		db, err := postgres.InitDatabase(&pgConf)
+		if err != nil {
+			return nil, nil, err
+		}
+		return postgres.NewAuditRepository(db), db.Close, nil
+	default:
+		return nil, func() error { return nil }, nil
+	}
+}
+
+const maxAuditEntries = 1000
+
+func newAuditHandler(log audit.Reader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter, err := parseAuditFilter(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		entries, err := log.Query(c.Request.Context(), filter)
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query audit log"})
+			return
+		}
+		if entries == nil {
+			entries = []audit.Entry{}
+		}
+		c.JSON(http.StatusOK, gin.H{"entries": entries})
+	}
+}
+
+// newAuditVerifyHandler checks the hash chain of the whole log.
+func newAuditVerifyHandler(log audit.Reader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		entries, err := log.Query(c.Request.Context(), audit.Filter{})
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query audit log"})
+			return
+		}
+		err = audit.Verify(entries)
+		if err != nil {
+			c.JSON(http.StatusConflict, gin.H{"valid": false, "entries": len(entries), "error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"valid": true, "entries": len(entries)})
+	}
+}
+
+func parseAuditFilter(c *gin.Context) (audit.Filter, error) {
+	filter := audit.Filter{Limit: maxAuditEntries}
+	if id := c.Query("user_id"); id != "" {
+		userID, err := uuid.Parse(id)
+		if err != nil {
+			return filter, errors.New("invalid user_id format")
+		}
+		filter.UserID = &userID
+	}
+	if since := c.Query("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return filter, errors.New("invalid since format, RFC 3339 expected")
+		}
+		filter.Since = t
+	}
+	if until := c.Query("until"); until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return filter, errors.New("invalid until format, RFC 3339 expected")
+		}
+		filter.Until = t
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > maxAuditEntries {
+			return filter, errors.New("invalid limit")
+		}
+		filter.Limit = n
+	}
+	return filter, nil
+}
@@ -1,41 +1,587 @@
 package server
 
 import (
-	"log"
+	"errors"
+	"log/slog"
+	"medods-auth/logging"
+	"medods-auth/persistance/bolt"
+	"medods-auth/persistance/memory"
 	"medods-auth/persistance/postgres"
+	"medods-auth/persistance/redis"
+	"medods-auth/persistance/sqlite"
+	"medods-auth/service/auth"
+	"medods-auth/service/events"
+	"medods-auth/service/lockout"
+	"medods-auth/service/outbox"
+	"medods-auth/service/password"
+	"medods-auth/service/ratelimit"
+	"medods-auth/service/webauthn"
+	"medods-auth/token"
+	"medods-auth/tracing"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 var once sync.Once
 var conf ServerConfig
 
 const defaultPort = "8080"
+const defaultSQLitePath = "jwt.db"
+const defaultBoltPath = "jwt.bolt"
+const defaultAuditPath = "audit.jsonl"
+
+const (
+	StoragePostgres = "postgres"
+	StorageSQLite   = "sqlite"
+	StorageMemory   = "memory"
+	StorageRedis    = "redis"
+	StorageBolt     = "bolt"
+)
+
+const (
+	EventsSync  = "sync"
+	EventsAsync = "async"
+)
+
+const (
+	RateLimitNone     = "none"
+	RateLimitMemory   = "memory"
+	RateLimitRedis    = "redis"
+	RateLimitPostgres = "postgres"
+)
+
+const (
+	RateLimitByIP   = "ip"
+	RateLimitByUser = "user"
+)
+
+const (
+	LockoutNone     = "none"
+	LockoutMemory   = "memory"
+	LockoutRedis    = "redis"
+	LockoutPostgres = "postgres"
+)
+
+const (
+	AuditNone     = "none"
+	AuditFile     = "file"
+	AuditPostgres = "postgres"
+)
 
 type ServerConfig struct {
 	Port       string
 	HashSecret []byte
-	Postgres   *postgres.PostgresConfig
+	// TrustedProxies are the IPs and CIDRs of reverse proxies whose
+	// X-Forwarded-For is believed. With none, the client IP is the address
+	// of the connection.
+	TrustedProxies []string
+
+	// SessionLimit caps the sessions of a user when Max is positive.
+	SessionLimit auth.SessionLimit
+	// SessionLifetime and SessionIdleTimeout are disabled when zero.
+	SessionLifetime    time.Duration
+	SessionIdleTimeout time.Duration
+
+	// Argon2 is the work factor of password hashes. Raising it rehashes
+	// passwords on their next login.
+	Argon2 password.Params
+	// TOTP configures the second factor of users who enroll one.
+	TOTP auth.TOTPOptions
+	// WebAuthn enables passkeys when set.
+	WebAuthn *webauthn.Config
+	// OAuth enables the OAuth endpoints and client registry when set.
+	OAuth *OAuthConfig
+
+	Logging logging.Config
+
+	// AdminAPIKey enables the /admin endpoints when set.
+	AdminAPIKey []byte
+	Audit       *AuditConfig
+	Events      *EventsConfig
+	Outbox      *OutboxConfig
+	RateLimit   *RateLimitConfig
+	Lockout     *LockoutConfig
+
+	MetricsEnabled bool
+	Tracing        *tracing.Config
+
+	Storage  string
+	Postgres *postgres.PostgresConfig
+	SQLite   *sqlite.SQLiteConfig
+	Memory   *MemoryConfig
+	Redis    *redis.RedisConfig
+	Bolt     *bolt.BoltConfig
+}
+
+type EventsConfig struct {
+	Dispatch string
+	events.AsyncOptions
+}
+
+// OutboxConfig enables the outbox relay when any sink is set.
+type OutboxConfig struct {
+	WebhookURLs   []string
+	WebhookSecret []byte
+	FilePath      string
+	outbox.RelayOptions
+}
+
+func (c *OutboxConfig) enabled() bool {
+	return len(c.WebhookURLs) > 0 || c.FilePath != ""
+}
+
+type RateLimitConfig struct {
+	Backend string
+	// Limits are keyed by "<route>.ip" and "<route>.user", falling back
+	// to "ip" and "user" for routes without their own.
+	Limits map[string]ratelimit.Limit
+}
+
+func (c *RateLimitConfig) limit(route, by string) ratelimit.Limit {
+	if l, ok := c.Limits[route+"."+by]; ok {
+		return l
+	}
+	return c.Limits[by]
+}
+
+// LockoutConfig slows down and locks out password and MFA code guessing.
+type LockoutConfig struct {
+	Backend string
+	Account lockout.Policy
+	IP      lockout.Policy
+}
+
+type OAuthConfig struct {
+	auth.OAuthOptions
+	// LoginURL is the page GET /oauth/authorize sends users to, with the
+	// parameters of the request. It signs them in and asks for consent
+	// through POST /oauth/authorize.
+	LoginURL string
+	// DeviceURL is the verification URI of the device authorization grant,
+	// the /device page of the server on the host of the request when empty.
+	DeviceURL string
+}
+
+type AuditConfig struct {
+	Sink     string
+	FilePath string
+}
+
+type MemoryConfig struct {
+	memory.Options
+
+	// SnapshotDir, when set, is restored from on start and saved to on shutdown.
+	SnapshotDir string
+}
+
+func (c *MemoryConfig) snapshotPaths() (hashes, blacklist, users string) {
+	return filepath.Join(c.SnapshotDir, "tokens.json"),
+		filepath.Join(c.SnapshotDir, "blacklist.json"),
+		filepath.Join(c.SnapshotDir, "users.json")
 }
 
 func Config() ServerConfig {
 	once.Do(func() {
+		// logging goes first so the rest of the config is parsed with it
+		logConf, logErr := loggingConfig()
+		logging.Setup(logConf)
+		logger := logging.For("config")
+		if logErr != nil {
+			logger.Warn("invalid log level configuration", "error", logErr)
+		}
+
 		port := os.Getenv("JWT_PORT")
 		if port == "" {
-			log.Printf("JWT_PORT env variable not specified, defaulting to %s", defaultPort)
+			logger.Warn("JWT_PORT env variable not specified", "default", defaultPort)
 			port = defaultPort
 		}
 		_, err := strconv.Atoi(port)
 		if err != nil {
-			log.Printf("failed to parse port: %s, defaulting to %s", port, defaultPort)
+			logger.Warn("failed to parse JWT_PORT", "value", port, "default", defaultPort)
 			port = defaultPort
 		}
 		conf = ServerConfig{
 			Port:     port,
+			Logging:  logConf,
 			Postgres: &postgres.PostgresConfig{},
 		}
 		conf.HashSecret = []byte(os.Getenv("HASH_SECRET"))
+		conf.MetricsEnabled = os.Getenv("METRICS_ENABLED") != "false"
+		conf.AdminAPIKey = []byte(os.Getenv("ADMIN_API_KEY"))
+		for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+			if proxy = strings.TrimSpace(proxy); proxy == "" {
+				continue
+			}
+			_, _, cidrErr := net.ParseCIDR(proxy)
+			if cidrErr != nil && net.ParseIP(proxy) == nil {
+				logger.Warn("invalid address in TRUSTED_PROXIES, ignoring", "value", proxy)
+				continue
+			}
+			conf.TrustedProxies = append(conf.TrustedProxies, proxy)
+		}
+
+		conf.SessionLimit.Policy = auth.SessionPolicy(os.Getenv("SESSION_POLICY"))
+		switch conf.SessionLimit.Policy {
+		case auth.RejectNewSession, auth.EvictOldest, auth.EvictLeastRecentlyUsed:
+		case "":
+			conf.SessionLimit.Policy = auth.RejectNewSession
+		default:
+			logger.Warn("unknown SESSION_POLICY", "value", conf.SessionLimit.Policy, "default", auth.RejectNewSession)
+			conf.SessionLimit.Policy = auth.RejectNewSession
+		}
+		if max := os.Getenv("SESSION_MAX"); max != "" {
+			n, err := strconv.Atoi(max)
+			if err != nil || n < 0 {
+				logger.Warn("failed to parse SESSION_MAX, sessions are not limited", "value", max)
+			} else {
+				conf.SessionLimit.Max = n
+			}
+		}
+
+		conf.Argon2 = password.DefaultParams
+		for _, param := range []struct {
+			env string
+			dst *uint32
+		}{
+			{"ARGON2_MEMORY", &conf.Argon2.Memory},
+			{"ARGON2_ITERATIONS", &conf.Argon2.Iterations},
+		} {
+			if v := os.Getenv(param.env); v != "" {
+				n, err := strconv.ParseUint(v, 10, 32)
+				if err != nil || n == 0 {
+					logger.Warn("failed to parse "+param.env, "value", v, "default", *param.dst)
+				} else {
+					*param.dst = uint32(n)
+				}
+			}
+		}
+		if v := os.Getenv("ARGON2_PARALLELISM"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 8)
+			if err != nil || n == 0 {
+				logger.Warn("failed to parse ARGON2_PARALLELISM", "value", v, "default", conf.Argon2.Parallelism)
+			} else {
+				conf.Argon2.Parallelism = uint8(n)
+			}
+		}
+
+		conf.SessionLifetime = 30 * 24 * time.Hour
+		if lifetime := os.Getenv("SESSION_LIFETIME"); lifetime != "" {
+			d, err := time.ParseDuration(lifetime)
+			if err != nil || d < 0 {
+				logger.Warn("failed to parse SESSION_LIFETIME", "value", lifetime, "default", conf.SessionLifetime)
+			} else {
+				conf.SessionLifetime = d
+			}
+		}
+		if idle := os.Getenv("SESSION_IDLE_TIMEOUT"); idle != "" {
+			d, err := time.ParseDuration(idle)
+			if err != nil || d < 0 {
+				logger.Warn("failed to parse SESSION_IDLE_TIMEOUT, sessions don't time out", "value", idle)
+			} else {
+				conf.SessionIdleTimeout = d
+			}
+		}
+
+		conf.TOTP.Issuer = os.Getenv("TOTP_ISSUER")
+		if v := os.Getenv("TOTP_SKEW"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				logger.Warn("failed to parse TOTP_SKEW", "value", v, "default", 1)
+			} else {
+				conf.TOTP.Skew = &n
+			}
+		}
+		if v := os.Getenv("MFA_TOKEN_TTL"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				logger.Warn("failed to parse MFA_TOKEN_TTL", "value", v, "default", 5*time.Minute)
+			} else {
+				conf.TOTP.MFATokenTTL = &d
+			}
+		}
+
+		if rpID := os.Getenv("WEBAUTHN_RP_ID"); rpID != "" {
+			conf.WebAuthn = &webauthn.Config{
+				RPID:   rpID,
+				RPName: os.Getenv("WEBAUTHN_RP_NAME"),
+			}
+			if conf.WebAuthn.RPName == "" {
+				conf.WebAuthn.RPName = rpID
+			}
+			for _, origin := range strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",") {
+				if origin = strings.TrimSpace(origin); origin != "" {
+					conf.WebAuthn.Origins = append(conf.WebAuthn.Origins, origin)
+				}
+			}
+			if len(conf.WebAuthn.Origins) == 0 {
+				conf.WebAuthn.Origins = []string{"https://" + rpID}
+			}
+			if v := os.Getenv("WEBAUTHN_TIMEOUT"); v != "" {
+				d, err := time.ParseDuration(v)
+				if err != nil || d <= 0 {
+					logger.Warn("failed to parse WEBAUTHN_TIMEOUT", "value", v, "default", 5*time.Minute)
+				} else {
+					conf.WebAuthn.Timeout = d
+				}
+			}
+		}
+
+		if os.Getenv("OAUTH_ENABLED") == "true" {
+			conf.OAuth = &OAuthConfig{
+				OAuthOptions: auth.OAuthOptions{
+					Scopes: strings.FieldsFunc(os.Getenv("OAUTH_SCOPES"), func(r rune) bool { return r == ',' || r == ' ' }),
+					Issuer: strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/"),
+				},
+				LoginURL:  os.Getenv("OAUTH_LOGIN_URL"),
+				DeviceURL: os.Getenv("OAUTH_DEVICE_URL"),
+			}
+			if v := os.Getenv("OAUTH_CODE_TTL"); v != "" {
+				d, err := time.ParseDuration(v)
+				if err != nil || d <= 0 {
+					logger.Warn("failed to parse OAUTH_CODE_TTL", "value", v, "default", time.Minute)
+				} else {
+					conf.OAuth.CodeTTL = d
+				}
+			}
+			if v := os.Getenv("OAUTH_DEVICE_CODE_TTL"); v != "" {
+				d, err := time.ParseDuration(v)
+				if err != nil || d <= 0 {
+					logger.Warn("failed to parse OAUTH_DEVICE_CODE_TTL", "value", v, "default", 10*time.Minute)
+				} else {
+					conf.OAuth.DeviceCodeTTL = d
+				}
+			}
+			if v := os.Getenv("OAUTH_DEVICE_INTERVAL"); v != "" {
+				d, err := time.ParseDuration(v)
+				if err != nil || d <= 0 {
+					logger.Warn("failed to parse OAUTH_DEVICE_INTERVAL", "value", v, "default", 5*time.Second)
+				} else {
+					conf.OAuth.DeviceInterval = d
+				}
+			}
+			if conf.OAuth.LoginURL == "" {
+				logger.Warn("OAUTH_LOGIN_URL is not set, GET /oauth/authorize is disabled")
+			}
+			if v := conf.OAuth.Issuer; v != "" {
+				if u, err := url.Parse(v); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+					logger.Warn("failed to parse OIDC_ISSUER, OpenID Connect is disabled", "value", v)
+					conf.OAuth.Issuer = ""
+				}
+			}
+			if conf.OAuth.Issuer != "" {
+				if path := os.Getenv("OIDC_SIGNING_KEY_FILE"); path != "" {
+					data, err := os.ReadFile(path)
+					if err == nil {
+						conf.OAuth.SigningKey, err = token.ParseSigningKey(data)
+					}
+					if err != nil {
+						logger.Warn("failed to read OIDC_SIGNING_KEY_FILE, OpenID Connect is disabled", "path", path, "error", err)
+						conf.OAuth.Issuer = ""
+					}
+				} else {
+					key, err := token.GenerateSigningKey()
+					if err != nil {
+						logger.Warn("failed to generate an ID token signing key, OpenID Connect is disabled", "error", err)
+						conf.OAuth.Issuer = ""
+					} else {
+						// fine for a single replica, ID tokens just stop verifying after a restart
+						logger.Warn("OIDC_SIGNING_KEY_FILE is not set, ID tokens are signed with a key generated on start", "kid", key.ID)
+						conf.OAuth.SigningKey = key
+					}
+				}
+			}
+		}
+
+		conf.Audit = &AuditConfig{
+			Sink:     os.Getenv("AUDIT_SINK"),
+			FilePath: os.Getenv("AUDIT_FILE"),
+		}
+		switch conf.Audit.Sink {
+		case AuditNone, AuditFile, AuditPostgres:
+		case "":
+			conf.Audit.Sink = AuditNone
+		default:
+			logger.Warn("unknown AUDIT_SINK", "value", conf.Audit.Sink, "default", AuditNone)
+			conf.Audit.Sink = AuditNone
+		}
+		if conf.Audit.FilePath == "" {
+			conf.Audit.FilePath = defaultAuditPath
+		}
+
+		conf.Events = &EventsConfig{
+			Dispatch: os.Getenv("EVENTS_DISPATCH"),
+			AsyncOptions: events.AsyncOptions{
+				QueueSize: 1024,
+				Workers:   1,
+				Overflow:  events.Drop,
+			},
+		}
+		switch conf.Events.Dispatch {
+		case EventsSync, EventsAsync:
+		case "":
+			conf.Events.Dispatch = EventsAsync
+		default:
+			logger.Warn("unknown EVENTS_DISPATCH", "value", conf.Events.Dispatch, "default", EventsAsync)
+			conf.Events.Dispatch = EventsAsync
+		}
+		if size := os.Getenv("EVENTS_QUEUE_SIZE"); size != "" {
+			n, err := strconv.Atoi(size)
+			if err != nil || n <= 0 {
+				logger.Warn("failed to parse EVENTS_QUEUE_SIZE", "value", size, "default", conf.Events.QueueSize)
+			} else {
+				conf.Events.QueueSize = n
+			}
+		}
+		switch overflow := os.Getenv("EVENTS_OVERFLOW"); overflow {
+		case "", "drop":
+		case "block":
+			conf.Events.Overflow = events.Block
+		default:
+			logger.Warn("unknown EVENTS_OVERFLOW", "value", overflow, "default", "drop")
+		}
+
+		conf.Outbox = &OutboxConfig{
+			WebhookSecret: []byte(os.Getenv("OUTBOX_WEBHOOK_SECRET")),
+			FilePath:      os.Getenv("OUTBOX_FILE"),
+		}
+		for _, url := range strings.Split(os.Getenv("OUTBOX_WEBHOOK_URLS"), ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				conf.Outbox.WebhookURLs = append(conf.Outbox.WebhookURLs, url)
+			}
+		}
+		if interval := os.Getenv("OUTBOX_INTERVAL"); interval != "" {
+			d, err := time.ParseDuration(interval)
+			if err != nil {
+				logger.Warn("failed to parse OUTBOX_INTERVAL", "value", interval, "default", time.Second)
+			} else {
+				conf.Outbox.Interval = d
+			}
+		}
+		if attempts := os.Getenv("OUTBOX_MAX_ATTEMPTS"); attempts != "" {
+			n, err := strconv.Atoi(attempts)
+			if err != nil || n <= 0 {
+				logger.Warn("failed to parse OUTBOX_MAX_ATTEMPTS", "value", attempts, "default", 10)
+			} else {
+				conf.Outbox.Backoff.MaxAttempts = n
+			}
+		}
+
+		conf.RateLimit = &RateLimitConfig{
+			Backend: os.Getenv("RATE_LIMIT_BACKEND"),
+			Limits: map[string]ratelimit.Limit{
+				RateLimitByIP:   {Burst: 60, Period: time.Minute},
+				RateLimitByUser: {Burst: 10, Period: time.Minute},
+			},
+		}
+		switch conf.RateLimit.Backend {
+		case RateLimitNone, RateLimitMemory, RateLimitRedis, RateLimitPostgres:
+		case "":
+			conf.RateLimit.Backend = RateLimitMemory
+		default:
+			logger.Warn("unknown RATE_LIMIT_BACKEND", "value", conf.RateLimit.Backend, "default", RateLimitMemory)
+			conf.RateLimit.Backend = RateLimitMemory
+		}
+		for by, env := range map[string]string{RateLimitByIP: "RATE_LIMIT_IP", RateLimitByUser: "RATE_LIMIT_USER"} {
+			if spec := os.Getenv(env); spec != "" {
+				l, err := ratelimit.ParseLimit(spec)
+				if err != nil {
+					logger.Warn("failed to parse "+env, "value", spec, "default", conf.RateLimit.Limits[by].String())
+				} else {
+					conf.RateLimit.Limits[by] = l
+				}
+			}
+		}
+		overrides, err := ratelimit.ParseLimits(os.Getenv("RATE_LIMITS"))
+		if err != nil {
+			logger.Warn("failed to parse RATE_LIMITS, ignoring", "error", err)
+		}
+		for name, l := range overrides {
+			conf.RateLimit.Limits[name] = l
+		}
+
+		conf.Lockout = &LockoutConfig{
+			Backend: os.Getenv("LOCKOUT_BACKEND"),
+			Account: lockout.Policy{
+				MaxFailures: 10,
+				Lockout:     15 * time.Minute,
+				Delay:       time.Second,
+				MaxDelay:    30 * time.Second,
+				Decay:       5 * time.Minute,
+			},
+			IP: lockout.Policy{
+				MaxFailures: 50,
+				Lockout:     15 * time.Minute,
+				Decay:       time.Minute,
+			},
+		}
+		switch conf.Lockout.Backend {
+		case LockoutNone, LockoutMemory, LockoutRedis, LockoutPostgres:
+		case "":
+			conf.Lockout.Backend = LockoutMemory
+		default:
+			logger.Warn("unknown LOCKOUT_BACKEND", "value", conf.Lockout.Backend, "default", LockoutMemory)
+			conf.Lockout.Backend = LockoutMemory
+		}
+		for _, param := range []struct {
+			env string
+			dst *int
+		}{
+			{"LOCKOUT_MAX_FAILURES", &conf.Lockout.Account.MaxFailures},
+			{"LOCKOUT_IP_MAX_FAILURES", &conf.Lockout.IP.MaxFailures},
+		} {
+			if v := os.Getenv(param.env); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 {
+					logger.Warn("failed to parse "+param.env, "value", v, "default", *param.dst)
+				} else {
+					*param.dst = n
+				}
+			}
+		}
+		for _, param := range []struct {
+			env string
+			dst *time.Duration
+		}{
+			{"LOCKOUT_DURATION", &conf.Lockout.Account.Lockout},
+			{"LOCKOUT_DELAY", &conf.Lockout.Account.Delay},
+			{"LOCKOUT_MAX_DELAY", &conf.Lockout.Account.MaxDelay},
+			{"LOCKOUT_DECAY", &conf.Lockout.Account.Decay},
+			{"LOCKOUT_IP_DURATION", &conf.Lockout.IP.Lockout},
+			{"LOCKOUT_IP_DELAY", &conf.Lockout.IP.Delay},
+			{"LOCKOUT_IP_MAX_DELAY", &conf.Lockout.IP.MaxDelay},
+			{"LOCKOUT_IP_DECAY", &conf.Lockout.IP.Decay},
+		} {
+			if v := os.Getenv(param.env); v != "" {
+				d, err := time.ParseDuration(v)
+				if err != nil || d < 0 {
+					logger.Warn("failed to parse "+param.env, "value", v, "default", *param.dst)
+				} else {
+					*param.dst = d
+				}
+			}
+		}
+
+		conf.Tracing = &tracing.Config{
+			Exporter:     os.Getenv("TRACING_EXPORTER"),
+			ServiceName:  "jwt-auth",
+			OTLPEndpoint: os.Getenv("TRACING_OTLP_ENDPOINT"),
+			OTLPInsecure: os.Getenv("TRACING_OTLP_INSECURE") == "true",
+			SampleRatio:  1,
+		}
+		if ratio := os.Getenv("TRACING_SAMPLE_RATIO"); ratio != "" {
+			r, err := strconv.ParseFloat(ratio, 64)
+			if err != nil {
+				logger.Warn("failed to parse TRACING_SAMPLE_RATIO", "value", ratio, "default", 1)
+			} else {
+				conf.Tracing.SampleRatio = r
+			}
+		}
 
 		// TODO: Validation
 		conf.Postgres.Host = os.Getenv("POSTGRES_HOST")
@@ -45,9 +591,91 @@ func Config() ServerConfig {
 		conf.Postgres.Name = os.Getenv("POSTGRES_DB")
 		conf.Postgres.HashDatabase = true
 		conf.Postgres.BlackListDatabase = true
+		conf.Postgres.UserDatabase = true
 		if os.Getenv("JWT_SERVER_MODE") == "test" {
 			conf.Postgres.SkipSSL = true
 		}
+
+		conf.Storage = os.Getenv("STORAGE_BACKEND")
+		switch conf.Storage {
+		case StoragePostgres, StorageSQLite, StorageMemory, StorageRedis, StorageBolt:
+		case "":
+			conf.Storage = StoragePostgres
+		default:
+			logger.Warn("unknown STORAGE_BACKEND", "value", conf.Storage, "default", StoragePostgres)
+			conf.Storage = StoragePostgres
+		}
+
+		conf.SQLite = &sqlite.SQLiteConfig{
+			Path: os.Getenv("SQLITE_PATH"),
+		}
+		if conf.SQLite.Path == "" {
+			conf.SQLite.Path = defaultSQLitePath
+		}
+
+		conf.Bolt = &bolt.BoltConfig{
+			Path:               os.Getenv("BOLT_PATH"),
+			CompactionInterval: 10 * time.Minute,
+		}
+		if conf.Bolt.Path == "" {
+			conf.Bolt.Path = defaultBoltPath
+		}
+		if interval := os.Getenv("BOLT_COMPACTION_INTERVAL"); interval != "" {
+			d, err := time.ParseDuration(interval)
+			if err != nil {
+				logger.Warn("failed to parse BOLT_COMPACTION_INTERVAL", "value", interval, "default", conf.Bolt.CompactionInterval)
+			} else {
+				conf.Bolt.CompactionInterval = d
+			}
+		}
+
+		conf.Redis = &redis.RedisConfig{
+			Addr:     os.Getenv("REDIS_ADDR"),
+			Password: os.Getenv("REDIS_PASSWORD"),
+			Prefix:   os.Getenv("REDIS_PREFIX"),
+		}
+		if db := os.Getenv("REDIS_DB"); db != "" {
+			n, err := strconv.Atoi(db)
+			if err != nil {
+				logger.Warn("failed to parse REDIS_DB", "value", db, "default", 0)
+			} else {
+				conf.Redis.DB = n
+			}
+		}
+
+		conf.Memory = &MemoryConfig{
+			SnapshotDir: os.Getenv("MEMORY_SNAPSHOT_DIR"),
+			Options: memory.Options{
+				CleanupInterval: time.Minute,
+			},
+		}
+		if max := os.Getenv("MEMORY_MAX_ENTRIES"); max != "" {
+			n, err := strconv.Atoi(max)
+			if err != nil {
+				logger.Warn("failed to parse MEMORY_MAX_ENTRIES, ignoring", "value", max)
+			} else {
+				conf.Memory.MaxEntries = n
+			}
+		}
 	})
 	return conf
 }
+
+// loggingConfig reads LOG_LEVEL and LOG_LEVELS, e.g. "postgres=debug,http=warn".
+// Invalid values fall back to info and are reported once logging is set up.
+func loggingConfig() (logging.Config, error) {
+	conf := logging.Config{Level: slog.LevelInfo}
+	var errs []error
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		if err := conf.Level.UnmarshalText([]byte(level)); err != nil {
+			conf.Level = slog.LevelInfo
+			errs = append(errs, err)
+		}
+	}
+	subsystems, err := logging.ParseLevels(os.Getenv("LOG_LEVELS"))
+	if err != nil {
+		errs = append(errs, err)
+	}
+	conf.Subsystems = subsystems
+	return conf, errors.Join(errs...)
+}
@@ -0,0 +1,347 @@
+package server
+
+import (
+	"errors"
+	"html/template"
+	"math"
+	"medods-auth/service/auth"
+	"medods-auth/token"
+	"medods-auth/user"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// newDeviceAuthorizationHandler starts the device authorization grant of
+// RFC 8628 section 3.1. verificationURI is where users enter the user
+// code, the /device page on the host of the request when empty.
+func newDeviceAuthorizationHandler(authservice *auth.AuthService, verificationURI string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.Header("Pragma", "no-cache")
+		if err := c.Request.ParseForm(); err != nil {
+			oauthError(c, http.StatusBadRequest, "invalid_request", "invalid form body")
+			return
+		}
+		id, secret, basic, ok := clientAuth(c)
+		if !ok {
+			return
+		}
+		device, err := authservice.AuthorizeDevice(c.Request.Context(), id, secret, c.PostForm("scope"))
+		if err != nil {
+			tokenError(c, err, basic)
+			return
+		}
+
+		uri := verificationURI
+		if uri == "" {
+			scheme := "http"
+			if c.Request.TLS != nil {
+				scheme = "https"
+			}
+			uri = scheme + "://" + c.Request.Host + "/device"
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"device_code":               device.DeviceCode,
+			"user_code":                 device.UserCode,
+			"verification_uri":          uri,
+			"verification_uri_complete": authorizeRedirect(uri, "", url.Values{"user_code": {device.UserCode}}),
+			"expires_in":                int(time.Until(device.ExpiresAt).Seconds()),
+			"interval":                  int(math.Ceil(device.Interval.Seconds())),
+		})
+	}
+}
+
+func deviceCodeGrant(c *gin.Context, authservice *auth.AuthService) {
+	id, secret, basic, ok := clientAuth(c)
+	if !ok {
+		return
+	}
+	deviceCode := c.PostForm("device_code")
+	if deviceCode == "" {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "missing device_code")
+		return
+	}
+	granted, err := authservice.PollDevice(c.Request.Context(), id, secret, deviceCode, requestUser(c))
+	if err != nil {
+		tokenError(c, err, basic)
+		return
+	}
+	grantedTokensResponse(c, granted)
+}
+
+// DeviceVerifyRequest lets a page of its own decide on a device for a
+// signed in user, in place of the /device page.
+type DeviceVerifyRequest struct {
+	AccessToken string `json:"access_token"`
+	UserCode    string `json:"user_code"`
+	// Consent is "allow" or "deny". Without it the request of the device
+	// is only looked up, to show it to the user.
+	Consent string `json:"consent"`
+}
+
+func newDeviceVerifyHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req DeviceVerifyRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.UserCode == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		var err error
+		switch req.Consent {
+		case "":
+			var d *auth.DeviceCode
+			var client *auth.Client
+			d, client, err = authservice.DeviceRequest(c.Request.Context(), req.UserCode)
+			if err == nil {
+				c.JSON(http.StatusOK, gin.H{
+					"user_code":  auth.FormatUserCode(d.UserCode),
+					"client":     gin.H{"id": client.ID, "name": client.Name},
+					"scope":      d.Scope,
+					"expires_in": int(time.Until(d.ExpiresAt).Seconds()),
+				})
+				return
+			}
+		case "allow", "deny":
+			err = authservice.DecideDevice(c.Request.Context(), requestUser(c), token.EncodedToken(req.AccessToken), req.UserCode, req.Consent == "allow")
+			if err == nil {
+				c.Status(http.StatusNoContent)
+				return
+			}
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		c.Error(err)
+		switch {
+		case errors.Is(err, auth.ErrDeviceCodeNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, auth.ErrUserDisabled), errors.Is(err, auth.ErrUserLocked):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		case auth.ErrorCode(err) != auth.CodeInternal:
+			oauthError(c, http.StatusUnauthorized, "login_required", err.Error())
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "device authorization error"})
+		}
+	}
+}
+
+// devicePage is the state of the /device page, which walks the user
+// through entering the user code, signing in and, with TOTP, the second
+// factor.
+type devicePage struct {
+	Step     string
+	UserCode string
+	Client   string
+	Scope    []string
+	MFAToken string
+	Approve  bool
+	Error    string
+}
+
+var devicePageTemplate = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Connect a device</title>
+</head>
+<body>
+<h1>Connect a device</h1>
+{{with .Error}}<p role="alert">{{.}}</p>{{end}}
+{{- if eq .Step "code"}}
+<form method="get">
+<label>Code shown on the device <input name="user_code" value="{{.UserCode}}" autocomplete="off" autofocus required></label>
+<button>Continue</button>
+</form>
+{{- else if eq .Step "login"}}
+<p><b>{{.Client}}</b> asks for access to your account{{with .Scope}}: {{range $i, $s := .}}{{if $i}}, {{end}}{{$s}}{{end}}{{end}}.</p>
+<p>Only continue if you started this yourself and the device shows the code <b>{{.UserCode}}</b>.</p>
+<form method="post">
+<input type="hidden" name="user_code" value="{{.UserCode}}">
+<label>Login <input name="login" autocomplete="username" required></label>
+<label>Password <input type="password" name="password" autocomplete="current-password" required></label>
+<button name="action" value="approve">Allow</button>
+<button name="action" value="deny">Deny</button>
+</form>
+{{- else if eq .Step "mfa"}}
+<form method="post">
+<input type="hidden" name="user_code" value="{{.UserCode}}">
+<input type="hidden" name="mfa_token" value="{{.MFAToken}}">
+<input type="hidden" name="action" value="{{if .Approve}}approve{{else}}deny{{end}}">
+<label>Code from your authenticator app <input name="code" inputmode="numeric" autocomplete="one-time-code" autofocus required></label>
+<button>Continue</button>
+</form>
+{{- else if .Approve}}
+<p>The device is connected, you can return to it.</p>
+{{- else}}
+<p>Access was denied, the device won't be connected.</p>
+{{- end}}
+</body>
+</html>
+`))
+
+func renderDevicePage(c *gin.Context, status int, page devicePage) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(status)
+	if err := devicePageTemplate.Execute(c.Writer, page); err != nil {
+		c.Error(err)
+	}
+}
+
+func deviceLoginPage(d *auth.DeviceCode, client *auth.Client) devicePage {
+	name := client.Name
+	if name == "" {
+		name = client.ID
+	}
+	return devicePage{
+		Step:     "login",
+		UserCode: auth.FormatUserCode(d.UserCode),
+		Client:   name,
+		Scope:    strings.Fields(d.Scope),
+	}
+}
+
+// deviceCodeError sends the user back to entering the code.
+func deviceCodeError(c *gin.Context, userCode string, err error) {
+	c.Error(err)
+	page := devicePage{Step: "code", UserCode: userCode}
+	if errors.Is(err, auth.ErrDeviceCodeNotFound) {
+		page.Error = "This code is unknown or expired, check the device for a new one."
+		renderDevicePage(c, http.StatusNotFound, page)
+		return
+	}
+	page.Error = "Something went wrong, try again later."
+	renderDevicePage(c, http.StatusInternalServerError, page)
+}
+
+// deviceLoginError sends the user back to signing in.
+func deviceLoginError(c *gin.Context, page devicePage, err error) {
+	c.Error(err)
+	page.Step = "login"
+	var locked *auth.LockedOutError
+	status := http.StatusInternalServerError
+	switch {
+	case errors.As(err, &locked):
+		c.Header("Retry-After", ceilSeconds(locked.RetryAfter))
+		status = http.StatusTooManyRequests
+		page.Error = "Too many attempts, try again later."
+	case errors.Is(err, auth.ErrInvalidCredentials):
+		status = http.StatusUnauthorized
+		page.Error = "Wrong login or password."
+	case errors.Is(err, auth.ErrUserDisabled), errors.Is(err, auth.ErrUserLocked):
+		status = http.StatusForbidden
+		page.Error = "This account is disabled."
+	case errors.Is(err, auth.ErrTooManySessions):
+		status = http.StatusForbidden
+		page.Error = "Too many active sessions, sign out on another device first."
+	case auth.ErrorCode(err) != auth.CodeInternal:
+		// an expired or otherwise invalid MFA token
+		status = http.StatusUnauthorized
+		page.Error = "Signing in took too long, try again."
+	default:
+		page.Error = "Something went wrong, try again later."
+	}
+	renderDevicePage(c, status, page)
+}
+
+func newDevicePageHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userCode := c.Query("user_code")
+		if userCode == "" {
+			renderDevicePage(c, http.StatusOK, devicePage{Step: "code"})
+			return
+		}
+		d, client, err := authservice.DeviceRequest(c.Request.Context(), userCode)
+		if err != nil {
+			deviceCodeError(c, userCode, err)
+			return
+		}
+		renderDevicePage(c, http.StatusOK, deviceLoginPage(d, client))
+	}
+}
+
+// newDeviceDecisionHandler signs the user in with a password and, if they
+// have one, a TOTP code, and approves or denies the device. Users whose
+// second factor is a passkey need a page of their own, see
+// DeviceVerifyRequest. The session signed in for the decision is ended
+// right after it.
+func newDeviceDecisionHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		userCode := c.PostForm("user_code")
+		approve := c.PostForm("action") == "approve"
+		d, client, err := authservice.DeviceRequest(ctx, userCode)
+		if err != nil {
+			deviceCodeError(c, userCode, err)
+			return
+		}
+		page := deviceLoginPage(d, client)
+		page.Approve = approve
+
+		u := requestUser(c)
+		var pair auth.TokenPair
+		if mfaToken := c.PostForm("mfa_token"); mfaToken != "" {
+			pair, err = authservice.VerifyMFA(ctx, u, token.EncodedToken(mfaToken), c.PostForm("code"))
+			if errors.Is(err, auth.ErrInvalidMFACode) {
+				c.Error(err)
+				page.Step = "mfa"
+				page.MFAToken = mfaToken
+				page.Error = "Wrong code, try again."
+				renderDevicePage(c, http.StatusUnauthorized, page)
+				return
+			}
+			if err != nil {
+				deviceLoginError(c, page, err)
+				return
+			}
+		} else {
+			res, err := authservice.Login(ctx, c.PostForm("login"), c.PostForm("password"), u)
+			if err != nil {
+				deviceLoginError(c, page, err)
+				return
+			}
+			if res.MFAToken != nil {
+				if !slices.Contains(res.MFAMethods, "otp") {
+					page.Error = "Your account signs in with a passkey, which this page doesn't support."
+					renderDevicePage(c, http.StatusForbidden, page)
+					return
+				}
+				page.Step = "mfa"
+				page.MFAToken = string(*res.MFAToken)
+				renderDevicePage(c, http.StatusOK, page)
+				return
+			}
+			pair = res.Tokens
+		}
+
+		err = authservice.DecideDevice(ctx, u, *pair.Access, userCode, approve)
+		endDeviceSession(c, authservice, u, pair)
+		if err != nil {
+			deviceCodeError(c, userCode, err)
+			return
+		}
+		renderDevicePage(c, http.StatusOK, devicePage{Step: "done", Approve: approve})
+	}
+}
+
+func endDeviceSession(c *gin.Context, authservice *auth.AuthService, u user.User, pair auth.TokenPair) {
+	id, err := authservice.ExtractUserID(c.Request.Context(), pair.Access)
+	if err == nil {
+		u.Id = id
+		err = authservice.RevokeSession(c.Request.Context(), u, pair)
+	}
+	if err != nil {
+		c.Error(err)
+	}
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"medods-auth/logging"
+	"medods-auth/metrics"
+	"medods-auth/service/events"
+)
+
+type eventBus interface {
+	events.Publisher
+	events.Subscriber
+}
+
+func setupEvents(conf *EventsConfig) (eventBus, func() error) {
+	if conf.Dispatch == EventsSync {
+		return events.NewSyncDispatcher(), func() error { return nil }
+	}
+	bus := events.NewAsyncDispatcher(conf.AsyncOptions)
+	return bus, bus.Close
+}
+
+// registerSubscribers is where integrations hook into AuthService events.
+func registerSubscribers(bus events.Subscriber, m *metrics.Metrics) {
+	if m != nil {
+		m.Subscribe(bus)
+	}
+
+	security := logging.For("security")
+	events.On(bus, func(ctx context.Context, e events.SuspiciousActivity) {
+		security.WarnContext(ctx, "suspicious activity",
+			"kind", e.Kind, "user_id", e.UserID, "jti", e.JTI, "ip", e.IP)
+	})
+	events.On(bus, func(ctx context.Context, e events.LoginFailed) {
+		security.InfoContext(ctx, "login failed",
+			"method", e.Method, "user_id", e.UserID, "ip", e.IP)
+	})
+	events.On(bus, func(ctx context.Context, e events.LockedOut) {
+		security.WarnContext(ctx, "locked out after failed logins",
+			"scope", e.Scope, "user_id", e.UserID, "ip", e.IP, "until", e.Until)
+	})
+}
@@ -1,10 +1,13 @@
 package server
 
 import (
+	"errors"
+	"medods-auth/logging"
 	"medods-auth/service/auth"
 	"medods-auth/token"
 	"medods-auth/user"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -21,40 +24,81 @@ type LogoutRequest struct {
 	AccessToken string    `json:"access_token"`
 }
 
+type LoginRequest struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
 type MeRequest struct {
 	AccessToken string `json:"access_token"`
 }
 
-func newGenerateHandler(authservice *auth.AuthService) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		guid := c.Query("guid")
-		if guid == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "missing guid parameter"})
-			return
-		}
+// tokenResponse reports the remaining lifetimes in seconds,
+// session_expires_in only when sessions have an absolute lifetime.
+func tokenResponse(pair auth.TokenPair) gin.H {
+	resp := gin.H{
+		"access_token":       string(*pair.Access),
+		"refresh_token":      string(*pair.Refresh),
+		"refresh_expires_in": int(time.Until(pair.RefreshExpiresAt).Seconds()),
+	}
+	if !pair.SessionExpiresAt.IsZero() {
+		resp["session_expires_in"] = int(time.Until(pair.SessionExpiresAt).Seconds())
+	}
+	return resp
+}
 
-		userID, err := uuid.Parse(guid)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid guid format"})
+func newLoginHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req LoginRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
 			return
 		}
 
 		u := user.User{
-			Id:        userID,
 			UserAgent: c.Request.UserAgent(),
+			IP:        c.ClientIP(),
+		}
+		res, err := authservice.Login(c.Request.Context(), req.Login, req.Password, u)
+		if lockedOut(c, err) {
+			return
 		}
-
-		pair, err := authservice.GenerateTokens(u)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Error(err)
+			status := http.StatusInternalServerError
+			switch err {
+			case auth.ErrInvalidCredentials:
+				status = http.StatusUnauthorized
+			case auth.ErrTooManySessions, auth.ErrUserDisabled, auth.ErrUserLocked:
+				status = http.StatusForbidden
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{
-			"access_token":  string(*pair.Access),
-			"refresh_token": string(*pair.Refresh),
-		})
+		if res.MFAToken != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"mfa_required":   true,
+				"mfa_token":      string(*res.MFAToken),
+				"mfa_expires_in": int(time.Until(res.MFAExpiresAt).Seconds()),
+				"mfa_methods":    res.MFAMethods,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, tokenResponse(res.Tokens))
+	}
+}
+
+// lockedOut responds 429 with Retry-After if err is a lockout.
+func lockedOut(c *gin.Context, err error) bool {
+	var locked *auth.LockedOutError
+	if !errors.As(err, &locked) {
+		return false
 	}
+	c.Error(err)
+	c.Header("Retry-After", ceilSeconds(locked.RetryAfter))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": auth.ErrLockedOut.Error()})
+	return true
 }
 
 func newRefreshHandler(authservice *auth.AuthService) gin.HandlerFunc {
@@ -68,7 +112,9 @@ func newRefreshHandler(authservice *auth.AuthService) gin.HandlerFunc {
 		u := user.User{
 			Id:        req.UserID,
 			UserAgent: c.Request.UserAgent(),
+			IP:        c.ClientIP(),
 		}
+		logging.SetUserID(c.Request.Context(), u.Id.String())
 
 		accessTok := token.EncodedToken(req.AccessToken)
 		refreshTok := token.EncodedToken(req.RefreshToken)
@@ -77,23 +123,24 @@ func newRefreshHandler(authservice *auth.AuthService) gin.HandlerFunc {
 			Refresh: &refreshTok,
 		}
 
-		newPair, err := authservice.Refresh(u, pair)
+		newPair, err := authservice.Refresh(c.Request.Context(), u, pair)
 		if err != nil {
+			c.Error(err)
 			status := http.StatusInternalServerError
-			if err == auth.ErrUserAgentChanged ||
-				err == auth.ErrUserIDMissmatch ||
-				err == auth.ErrTokenExpired ||
-				err == auth.ErrBlackListedToken {
+			switch {
+			case errors.Is(err, auth.ErrUserDisabled),
+				errors.Is(err, auth.ErrUserLocked),
+				errors.Is(err, auth.ErrUserNotFound):
+				status = http.StatusForbidden
+			case auth.ErrorCode(err) != auth.CodeInternal:
+				// the tokens or their session didn't check out
 				status = http.StatusUnauthorized
 			}
 			c.JSON(status, gin.H{"error": err.Error()})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{
-			"access_token":  string(*newPair.Access),
-			"refresh_token": string(*newPair.Refresh),
-		})
+		c.JSON(http.StatusOK, tokenResponse(newPair))
 	}
 }
 
@@ -106,17 +153,21 @@ func newMeHandler(authSvc *auth.AuthService) gin.HandlerFunc {
 		}
 
 		tokenStr := token.EncodedToken(req.AccessToken)
-		id, err := authSvc.ExtractUserID(&tokenStr)
+		id, err := authSvc.ExtractUserID(c.Request.Context(), &tokenStr)
 		if err != nil {
+			c.Error(err)
 			status := http.StatusUnauthorized
 			if err == auth.ErrTokenExpired ||
-				err == auth.ErrBlackListedToken {
+				err == auth.ErrBlackListedToken ||
+				err == auth.ErrUserDisabled ||
+				err == auth.ErrUserLocked {
 				status = http.StatusForbidden
 			}
 			c.JSON(status, gin.H{"error": "invalid token: " + err.Error()})
 			return
 		}
 
+		logging.SetUserID(c.Request.Context(), id.String())
 		c.JSON(http.StatusOK, gin.H{"user_id": id})
 	}
 }
@@ -132,13 +183,14 @@ func newLogoutHandler(authservice *auth.AuthService) gin.HandlerFunc {
 		u := user.User{
 			Id:        req.UserID,
 			UserAgent: c.Request.UserAgent(),
+			IP:        c.ClientIP(),
 		}
+		logging.SetUserID(c.Request.Context(), u.Id.String())
 
-		if err := authservice.RevokeTokens(u, token.EncodedToken(req.AccessToken)); err != nil {
+		if err := authservice.RevokeTokens(c.Request.Context(), u, token.EncodedToken(req.AccessToken)); err != nil {
+			c.Error(err)
 			status := http.StatusInternalServerError
-			if err == auth.ErrUserAgentChanged ||
-				err == auth.ErrUserIDMissmatch ||
-				err == auth.ErrTokenExpired {
+			if auth.ErrorCode(err) != auth.CodeInternal {
 				status = http.StatusUnauthorized
 			}
 			c.JSON(status, gin.H{"error": err.Error()})
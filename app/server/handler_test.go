@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"medods-auth/persistance/memory"
+	"medods-auth/service/auth"
+	"medods-auth/service/lockout"
+	"medods-auth/service/password"
+	"medods-auth/token"
+	"medods-auth/user"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginLockoutForwardedFor(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.TestMode)
+	passwords, err := password.NewHasher(password.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	assert.NoError(err)
+	store := memory.NewLockoutRepository(memory.Options{})
+	defer store.Close()
+	accessTTL := time.Minute
+	refreshTTL := time.Hour
+	service, err := auth.NewAuthService(auth.AuthServiceOptions{
+		RefreshTokenRepo: memory.NewHashRepository(memory.Options{}),
+		Blacklist:        memory.NewBlackListRepository(memory.Options{}),
+		Users:            memory.NewUserRepository(),
+		Passwords:        passwords,
+		Lockout: &auth.LockoutOptions{
+			Store: store,
+			IP:    &lockout.Policy{MaxFailures: 3, Lockout: time.Hour, Decay: time.Hour},
+		},
+		Generator:  &token.SHA512Generator{},
+		Hasher:     &token.BcryptHasher{},
+		Secret:     []byte("test_secret"),
+		AccessTTL:  &accessTTL,
+		RefreshTTL: &refreshTTL,
+	})
+	assert.NoError(err)
+
+	router, err := newRouter(nil)
+	assert.NoError(err)
+	router.POST("/login", newLoginHandler(service))
+
+	// every attempt guesses another login from a new X-Forwarded-For, so
+	// only the lockout of the connection's IP can stop it
+	var codes []int
+	for i := range 4 {
+		body, err := json.Marshal(LoginRequest{Login: "user" + strconv.Itoa(i) + "@example.com", Password: "guess"})
+		assert.NoError(err)
+		req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", "198.51.100."+strconv.Itoa(i))
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		codes = append(codes, rec.Code)
+	}
+	assert.Equal([]int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}, codes)
+}
+
+func TestRefreshTokenErrors(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.TestMode)
+	generator := &token.SHA512Generator{}
+	secret := []byte("test_secret")
+	accessTTL := time.Minute
+	refreshTTL := time.Hour
+	service, err := auth.NewAuthService(auth.AuthServiceOptions{
+		RefreshTokenRepo: memory.NewHashRepository(memory.Options{}),
+		Blacklist:        memory.NewBlackListRepository(memory.Options{}),
+		Generator:        generator,
+		Hasher:           &token.BcryptHasher{},
+		Secret:           secret,
+		AccessTTL:        &accessTTL,
+		RefreshTTL:       &refreshTTL,
+	})
+	assert.NoError(err)
+
+	router, err := newRouter(nil)
+	assert.NoError(err)
+	router.POST("/refresh", newRefreshHandler(service))
+	router.POST("/logout", newLogoutHandler(service))
+	post := func(target string, req any) int {
+		body, err := json.Marshal(req)
+		assert.NoError(err)
+		r := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	u := user.User{Id: uuid.New()}
+	pair, err := service.GenerateTokens(context.Background(), u)
+	assert.NoError(err)
+	sign := func(ttl time.Duration, key []byte) string {
+		enc, err := generator.Encode(generator.Generate(token.Options{User: u, TTL: ttl, Type: token.TokenTypeRefresh}), key)
+		assert.NoError(err)
+		return enc
+	}
+	expired := sign(-time.Minute, secret)
+	forged := sign(time.Minute, []byte("other_secret"))
+
+	// failures wrapped by the jwt parser are the client's, not ours
+	for name, refresh := range map[string]string{"malformed": "garbage", "expired": expired, "forged": forged} {
+		code := post("/refresh", RefreshRequest{UserID: u.Id, AccessToken: pair.Access.String(), RefreshToken: refresh})
+		assert.Equal(http.StatusUnauthorized, code, name)
+	}
+	assert.Equal(http.StatusUnauthorized, post("/logout", LogoutRequest{UserID: u.Id, AccessToken: "garbage"}))
+	assert.Equal(http.StatusOK, post("/refresh", RefreshRequest{UserID: u.Id, AccessToken: pair.Access.String(), RefreshToken: pair.Refresh.String()}))
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"medods-auth/persistance/memory"
+	"medods-auth/persistance/postgres"
+	"medods-auth/persistance/redis"
+	"medods-auth/service/auth"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupLockout returns nil options when lockout is disabled.
+func setupLockout(conf *LockoutConfig) (*auth.LockoutOptions, func() error, error) {
+	opts := &auth.LockoutOptions{Account: &conf.Account, IP: &conf.IP}
+	switch conf.Backend {
+	case LockoutMemory:
+		repo := memory.NewLockoutRepository(memory.Options{CleanupInterval: time.Minute})
+		opts.Store = repo
+		return opts, repo.Close, nil
+	case LockoutRedis:
+		client, err := redis.Connect(Config().Redis)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts.Store = redis.NewLockoutRepository(client, Config().Redis.Prefix)
+		return opts, client.Close, nil
+	case LockoutPostgres:
+		pgConf := *Config().Postgres
+		pgConf.HashDatabase = false
+		pgConf.BlackListDatabase = false
+		pgConf.UserDatabase = false
+		pgConf.LockoutDatabase = true
+		db, err := postgres.InitDatabase(&pgConf)
+		if err != nil {
+			return nil, nil, err
+		}
+		repo := postgres.NewLockoutRepository(db)
+		opts.Store = repo
+		stop := startSweeper("lockout", repo.Sweep, time.Minute)
+		return opts, func() error {
+			stop()
+			return db.Close()
+		}, nil
+	default:
+		return nil, func() error { return nil }, nil
+	}
+}
+
+func newUnlockUserHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return userStatusHandler(authservice, authservice.UnlockUser)
+}
+
+func newUnlockIPHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip, err := netip.ParseAddr(c.Param("ip"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ip"})
+			return
+		}
+		err = authservice.UnlockIP(c.Request.Context(), ip.String())
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "lockout error"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
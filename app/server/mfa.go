@@ -0,0 +1,135 @@
+package server
+
+import (
+	"errors"
+	"medods-auth/service/auth"
+	"medods-auth/token"
+	"medods-auth/user"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type EnrollTOTPRequest struct {
+	AccessToken string `json:"access_token"`
+}
+
+type ActivateTOTPRequest struct {
+	AccessToken string `json:"access_token"`
+	Code        string `json:"code"`
+}
+
+type VerifyMFARequest struct {
+	MFAToken string `json:"mfa_token"`
+	// Code is a TOTP or recovery code.
+	Code string `json:"code"`
+}
+
+// mfaError writes the response for an error of the TOTP and passkey
+// endpoints.
+func mfaError(c *gin.Context, err error) {
+	if lockedOut(c, err) {
+		return
+	}
+	c.Error(err)
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, auth.ErrInvalidMFACode),
+		errors.Is(err, auth.ErrMFATokenExpected),
+		errors.Is(err, auth.ErrAccessTokenExpected),
+		errors.Is(err, auth.ErrTokenExpired),
+		errors.Is(err, auth.ErrBlackListedToken),
+		errors.Is(err, auth.ErrUserAgentChanged),
+		errors.Is(err, auth.ErrInvalidPasskey),
+		errors.Is(err, auth.ErrPasskeyNotFound),
+		errors.Is(err, auth.ErrPasskeySignCount),
+		errors.Is(err, auth.ErrChallengeNotFound),
+		auth.ErrorCode(err) == auth.CodeInvalidToken:
+		status = http.StatusUnauthorized
+	case errors.Is(err, auth.ErrTooManySessions),
+		errors.Is(err, auth.ErrUserDisabled),
+		errors.Is(err, auth.ErrUserLocked):
+		status = http.StatusForbidden
+	case errors.Is(err, auth.ErrTOTPNotEnrolled), errors.Is(err, auth.ErrUserNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, auth.ErrTOTPAlreadyActive), errors.Is(err, auth.ErrPasskeyExists):
+		status = http.StatusConflict
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+}
+
+func requestUser(c *gin.Context) user.User {
+	return user.User{
+		UserAgent: c.Request.UserAgent(),
+		IP:        c.ClientIP(),
+	}
+}
+
+func newEnrollTOTPHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req EnrollTOTPRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		enrollment, err := authservice.EnrollTOTP(c.Request.Context(), requestUser(c), token.EncodedToken(req.AccessToken))
+		if err != nil {
+			mfaError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"secret":      enrollment.Secret,
+			"otpauth_uri": enrollment.URI,
+		})
+	}
+}
+
+func newActivateTOTPHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ActivateTOTPRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		codes, err := authservice.ActivateTOTP(c.Request.Context(), requestUser(c), token.EncodedToken(req.AccessToken), req.Code)
+		if err != nil {
+			mfaError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+	}
+}
+
+func newVerifyMFAHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req VerifyMFARequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		pair, err := authservice.VerifyMFA(c.Request.Context(), requestUser(c), token.EncodedToken(req.MFAToken), req.Code)
+		if err != nil {
+			mfaError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, tokenResponse(pair))
+	}
+}
+
+func newResetTOTPHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := userIDParam(c)
+		if !ok {
+			return
+		}
+		err := authservice.ResetTOTP(c.Request.Context(), id)
+		if err != nil {
+			mfaError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,523 @@
+package server
+
+import (
+	"errors"
+	"medods-auth/service/auth"
+	"medods-auth/token"
+	"medods-auth/user"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CreateClientRequest struct {
+	// ID is optional, a random one is assigned without it.
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Public clients get no secret and only use the authorization code
+	// grant.
+	Public       bool     `json:"public"`
+	Scopes       []string `json:"scopes"`
+	RedirectURIs []string `json:"redirect_uris"`
+	// PostLogoutRedirectURIs are only used with OpenID Connect.
+	PostLogoutRedirectURIs []string `json:"post_logout_redirect_uris"`
+	// AccessTTL in seconds overrides the access token TTL when positive.
+	AccessTTL int `json:"access_ttl"`
+}
+
+func clientResponse(client *auth.Client) gin.H {
+	return gin.H{
+		"id":                        client.ID,
+		"name":                      client.Name,
+		"public":                    client.Public,
+		"scopes":                    client.Scopes,
+		"redirect_uris":             client.RedirectURIs,
+		"post_logout_redirect_uris": client.PostLogoutRedirectURIs,
+		"access_ttl":                int(client.AccessTTL.Seconds()),
+		"created_at":                client.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// oauthError writes an error response of RFC 6749 section 5.2.
+func oauthError(c *gin.Context, status int, code, description string) {
+	resp := gin.H{"error": code}
+	if description != "" {
+		resp["error_description"] = description
+	}
+	c.JSON(status, resp)
+}
+
+// clientAuth reads the credentials of a client from the Authorization
+// header or, with client_secret_post, the form. basic reports which. ok is
+// false after responding if the client used both.
+func clientAuth(c *gin.Context) (id, secret string, basic, ok bool) {
+	formID, formSecret := c.PostForm("client_id"), c.PostForm("client_secret")
+	id, secret, basic = c.Request.BasicAuth()
+	if !basic {
+		return formID, formSecret, false, true
+	}
+	if formSecret != "" {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "multiple client authentication methods")
+		return "", "", true, false
+	}
+	// RFC 6749 section 2.3.1 form-encodes both before the Basic encoding
+	id, errID := url.QueryUnescape(id)
+	secret, errSecret := url.QueryUnescape(secret)
+	if errID != nil || errSecret != nil || formID != "" && formID != id {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "malformed client credentials")
+		return "", "", true, false
+	}
+	return id, secret, true, true
+}
+
+// tokenError writes the token endpoint response for err.
+func tokenError(c *gin.Context, err error, basic bool) {
+	c.Error(err)
+	switch {
+	case errors.Is(err, auth.ErrInvalidClient):
+		if basic {
+			c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		oauthError(c, http.StatusUnauthorized, "invalid_client", "")
+	case errors.Is(err, auth.ErrUnauthorizedClient):
+		oauthError(c, http.StatusBadRequest, "unauthorized_client", "")
+	case errors.Is(err, auth.ErrInvalidScope):
+		oauthError(c, http.StatusBadRequest, "invalid_scope", "")
+	case errors.Is(err, auth.ErrAuthorizationPending):
+		oauthError(c, http.StatusBadRequest, "authorization_pending", "")
+	case errors.Is(err, auth.ErrSlowDown):
+		oauthError(c, http.StatusBadRequest, "slow_down", "")
+	case errors.Is(err, auth.ErrDeviceCodeExpired):
+		oauthError(c, http.StatusBadRequest, "expired_token", "")
+	case errors.Is(err, auth.ErrAccessDenied):
+		oauthError(c, http.StatusBadRequest, "access_denied", "")
+	case auth.ErrorCode(err) != auth.CodeInternal:
+		// codes and refresh tokens that are unknown, expired, reused or
+		// issued to another client
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "")
+	default:
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+	}
+}
+
+func newTokenHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.Header("Pragma", "no-cache")
+		if err := c.Request.ParseForm(); err != nil {
+			oauthError(c, http.StatusBadRequest, "invalid_request", "invalid form body")
+			return
+		}
+
+		switch grant := c.PostForm("grant_type"); grant {
+		case "client_credentials":
+			clientCredentialsGrant(c, authservice)
+		case "authorization_code":
+			authorizationCodeGrant(c, authservice)
+		case "refresh_token":
+			refreshTokenGrant(c, authservice)
+		case deviceCodeGrantType:
+			deviceCodeGrant(c, authservice)
+		case "":
+			oauthError(c, http.StatusBadRequest, "invalid_request", "missing grant_type")
+		default:
+			oauthError(c, http.StatusBadRequest, "unsupported_grant_type", "")
+		}
+	}
+}
+
+func clientCredentialsGrant(c *gin.Context, authservice *auth.AuthService) {
+	id, secret, basic, ok := clientAuth(c)
+	if !ok {
+		return
+	}
+	u := user.User{
+		UserAgent: c.Request.UserAgent(),
+		IP:        c.ClientIP(),
+	}
+	issued, err := authservice.ClientCredentials(c.Request.Context(), id, secret, c.PostForm("scope"), u)
+	if err != nil {
+		tokenError(c, err, basic)
+		return
+	}
+	resp := gin.H{
+		"access_token": string(*issued.Access),
+		"token_type":   "Bearer",
+		"expires_in":   int(time.Until(issued.ExpiresAt).Seconds()),
+	}
+	if issued.Scope != "" {
+		resp["scope"] = issued.Scope
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func authorizationCodeGrant(c *gin.Context, authservice *auth.AuthService) {
+	id, secret, basic, ok := clientAuth(c)
+	if !ok {
+		return
+	}
+	code, verifier := c.PostForm("code"), c.PostForm("code_verifier")
+	if code == "" || verifier == "" {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "missing code or code_verifier")
+		return
+	}
+	granted, err := authservice.ExchangeCode(c.Request.Context(), id, secret, code, c.PostForm("redirect_uri"), verifier, requestUser(c))
+	if err != nil {
+		tokenError(c, err, basic)
+		return
+	}
+	grantedTokensResponse(c, granted)
+}
+
+func refreshTokenGrant(c *gin.Context, authservice *auth.AuthService) {
+	id, secret, basic, ok := clientAuth(c)
+	if !ok {
+		return
+	}
+	refresh := c.PostForm("refresh_token")
+	if refresh == "" {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "missing refresh_token")
+		return
+	}
+	granted, err := authservice.RefreshGrant(c.Request.Context(), id, secret, token.EncodedToken(refresh), c.PostForm("scope"), requestUser(c))
+	if err != nil {
+		tokenError(c, err, basic)
+		return
+	}
+	grantedTokensResponse(c, granted)
+}
+
+func grantedTokensResponse(c *gin.Context, granted auth.GrantedTokens) {
+	resp := gin.H{
+		"access_token":  string(*granted.Access),
+		"token_type":    "Bearer",
+		"expires_in":    int(time.Until(granted.AccessExpiresAt).Seconds()),
+		"refresh_token": string(*granted.Refresh),
+	}
+	if granted.Scope != "" {
+		resp["scope"] = granted.Scope
+	}
+	if granted.IDToken != "" {
+		resp["id_token"] = string(granted.IDToken)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// newIntrospectHandler describes a token to a confidential client, as in
+// RFC 7662. Inactive tokens get nothing but "active": false.
+func newIntrospectHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.Header("Pragma", "no-cache")
+		if err := c.Request.ParseForm(); err != nil {
+			oauthError(c, http.StatusBadRequest, "invalid_request", "invalid form body")
+			return
+		}
+		id, secret, basic, ok := clientAuth(c)
+		if !ok {
+			return
+		}
+		t := c.PostForm("token")
+		if t == "" {
+			oauthError(c, http.StatusBadRequest, "invalid_request", "missing token")
+			return
+		}
+		// token_type_hint is ignored, both kinds are checked the same way
+		info, err := authservice.Introspect(c.Request.Context(), id, secret, token.EncodedToken(t))
+		if err != nil {
+			tokenError(c, err, basic)
+			return
+		}
+		if !info.Active {
+			c.JSON(http.StatusOK, gin.H{"active": false})
+			return
+		}
+		resp := gin.H{
+			"active":     true,
+			"sub":        info.Subject,
+			"exp":        info.ExpiresAt.Unix(),
+			"iat":        info.IssuedAt.Unix(),
+			"jti":        info.JTI.String(),
+			"token_type": "Bearer",
+		}
+		if info.Refresh {
+			resp["token_type"] = "refresh_token"
+		}
+		if info.Scope != "" {
+			resp["scope"] = info.Scope
+		}
+		if info.ClientID != "" {
+			resp["client_id"] = info.ClientID
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// newRevokeHandler revokes a token of the calling client, as in RFC 7009.
+// Unknown and invalid tokens are not an error.
+func newRevokeHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.Header("Pragma", "no-cache")
+		if err := c.Request.ParseForm(); err != nil {
+			oauthError(c, http.StatusBadRequest, "invalid_request", "invalid form body")
+			return
+		}
+		id, secret, basic, ok := clientAuth(c)
+		if !ok {
+			return
+		}
+		t := c.PostForm("token")
+		if t == "" {
+			oauthError(c, http.StatusBadRequest, "invalid_request", "missing token")
+			return
+		}
+		// token_type_hint is ignored, the kind of a token is known from it
+		err := authservice.RevokeToken(c.Request.Context(), id, secret, token.EncodedToken(t), requestUser(c))
+		if err != nil {
+			tokenError(c, err, basic)
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+// AuthorizeRequest is sent by the login page once the user signed in,
+// with the parameters GET /oauth/authorize passed it.
+type AuthorizeRequest struct {
+	AccessToken         string `json:"access_token"`
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	Nonce               string `json:"nonce"`
+	// Consent is "allow" once the user agreed to the client and scopes,
+	// "deny" if they refused, and empty to use an earlier consent.
+	Consent string `json:"consent"`
+}
+
+func (r AuthorizeRequest) params() auth.AuthorizeRequest {
+	return auth.AuthorizeRequest{
+		ClientID:            r.ClientID,
+		RedirectURI:         r.RedirectURI,
+		Scope:               r.Scope,
+		CodeChallenge:       r.CodeChallenge,
+		CodeChallengeMethod: r.CodeChallengeMethod,
+		Nonce:               r.Nonce,
+	}
+}
+
+// authorizeRedirect returns redirectURI with params and state added to its
+// query, the response of RFC 6749 section 4.1.2.
+func authorizeRedirect(redirectURI, state string, params url.Values) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		// registered URIs were parsed before
+		return redirectURI
+	}
+	query := u.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	if state != "" {
+		query.Set("state", state)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// authorizeErrorParams returns the error of RFC 6749 section 4.1.2.1 for
+// err, to send to the redirect URI.
+func authorizeErrorParams(err error) url.Values {
+	params := url.Values{}
+	switch {
+	case errors.Is(err, auth.ErrInvalidScope):
+		params.Set("error", "invalid_scope")
+	case errors.Is(err, auth.ErrInvalidCodeChallenge):
+		params.Set("error", "invalid_request")
+		params.Set("error_description", err.Error())
+	default:
+		params.Set("error", "server_error")
+	}
+	return params
+}
+
+// authorizeError responds to an authorization request there is nowhere to
+// redirect, because the client or redirect URI is unknown.
+func authorizeError(c *gin.Context, err error) {
+	c.Error(err)
+	switch {
+	case errors.Is(err, auth.ErrInvalidClient):
+		oauthError(c, http.StatusBadRequest, "invalid_request", "unknown client")
+	case errors.Is(err, auth.ErrInvalidRedirectURI):
+		oauthError(c, http.StatusBadRequest, "invalid_request", "invalid redirect_uri")
+	default:
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+	}
+}
+
+// newAuthorizeRedirectHandler checks an authorization request and sends
+// the user to loginURL with its parameters. Errors go to the client when
+// its redirect URI is known.
+func newAuthorizeRedirectHandler(authservice *auth.AuthService, loginURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := c.Request.URL.Query()
+		req := AuthorizeRequest{
+			ResponseType:        query.Get("response_type"),
+			ClientID:            query.Get("client_id"),
+			RedirectURI:         query.Get("redirect_uri"),
+			Scope:               query.Get("scope"),
+			State:               query.Get("state"),
+			CodeChallenge:       query.Get("code_challenge"),
+			CodeChallengeMethod: query.Get("code_challenge_method"),
+			Nonce:               query.Get("nonce"),
+		}
+		_, redirectURI, err := authservice.CheckAuthorizeRequest(c.Request.Context(), req.params())
+		if redirectURI == "" {
+			authorizeError(c, err)
+			return
+		}
+		if err != nil {
+			c.Error(err)
+			c.Redirect(http.StatusFound, authorizeRedirect(redirectURI, req.State, authorizeErrorParams(err)))
+			return
+		}
+		if req.ResponseType != "code" {
+			c.Redirect(http.StatusFound, authorizeRedirect(redirectURI, req.State, url.Values{"error": {"unsupported_response_type"}}))
+			return
+		}
+		c.Redirect(http.StatusFound, authorizeRedirect(loginURL, "", query))
+	}
+}
+
+// newAuthorizeHandler issues a code to the user of the access token, and
+// responds with the URI to send them back to the client with. It responds
+// 403 with the client and scopes while the user has to consent to them.
+func newAuthorizeHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req AuthorizeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		client, redirectURI, err := authservice.CheckAuthorizeRequest(c.Request.Context(), req.params())
+		if redirectURI == "" {
+			authorizeError(c, err)
+			return
+		}
+		var params url.Values
+		switch {
+		case err != nil:
+			c.Error(err)
+			params = authorizeErrorParams(err)
+		case req.ResponseType != "code":
+			params = url.Values{"error": {"unsupported_response_type"}}
+		case req.Consent == "deny":
+			params = url.Values{"error": {"access_denied"}}
+		}
+		if params != nil {
+			c.JSON(http.StatusOK, gin.H{"redirect_to": authorizeRedirect(redirectURI, req.State, params)})
+			return
+		}
+
+		code, err := authservice.Authorize(c.Request.Context(), requestUser(c), token.EncodedToken(req.AccessToken), req.params(), req.Consent == "allow")
+		switch {
+		case err == nil:
+		case errors.Is(err, auth.ErrConsentRequired):
+			scope := req.Scope
+			if scope == "" {
+				scope = strings.Join(client.Scopes, " ")
+			}
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":  "consent_required",
+				"client": gin.H{"id": client.ID, "name": client.Name},
+				"scope":  scope,
+			})
+			return
+		case auth.ErrorCode(err) != auth.CodeInternal:
+			c.Error(err)
+			oauthError(c, http.StatusUnauthorized, "login_required", err.Error())
+			return
+		default:
+			c.Error(err)
+			oauthError(c, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"redirect_to": authorizeRedirect(redirectURI, req.State, url.Values{"code": {code}})})
+	}
+}
+
+// clientError writes the response for an error of the client registry.
+func clientError(c *gin.Context, err error) {
+	c.Error(err)
+	switch {
+	case errors.Is(err, auth.ErrClientNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, auth.ErrClientExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, auth.ErrInvalidScope), errors.Is(err, auth.ErrInvalidRedirectURI):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "client registry error"})
+	}
+}
+
+// newCreateClientHandler responds with the secret of the client, the only
+// time it is shown.
+func newCreateClientHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CreateClientRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.AccessTTL < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		client, secret, err := authservice.RegisterClient(c.Request.Context(), auth.ClientRegistration{
+			ID:                     req.ID,
+			Name:                   req.Name,
+			Public:                 req.Public,
+			Scopes:                 req.Scopes,
+			RedirectURIs:           req.RedirectURIs,
+			PostLogoutRedirectURIs: req.PostLogoutRedirectURIs,
+			AccessTTL:              time.Duration(req.AccessTTL) * time.Second,
+		})
+		if err != nil {
+			clientError(c, err)
+			return
+		}
+		resp := clientResponse(client)
+		if secret != "" {
+			resp["secret"] = secret
+		}
+		c.JSON(http.StatusCreated, resp)
+	}
+}
+
+func newGetClientHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, err := authservice.GetClient(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			clientError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, clientResponse(client))
+	}
+}
+
+func newDeleteClientHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := authservice.DeleteClient(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			clientError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
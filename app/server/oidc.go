@@ -0,0 +1,166 @@
+package server
+
+import (
+	"errors"
+	"html/template"
+	"medods-auth/service/auth"
+	"medods-auth/token"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newDiscoveryHandler serves the OpenID Provider metadata of OpenID
+// Connect Discovery, with the endpoints of the server under the issuer.
+func newDiscoveryHandler(conf *OAuthConfig) gin.HandlerFunc {
+	issuer := conf.Issuer
+	scopes := slices.Clone(auth.OpenIDScopes)
+	for _, scope := range conf.Scopes {
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	metadata := gin.H{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oauth/authorize",
+		"token_endpoint":                        issuer + "/oauth/token",
+		"userinfo_endpoint":                     issuer + "/userinfo",
+		"jwks_uri":                              issuer + "/oauth/jwks",
+		"end_session_endpoint":                  issuer + "/oauth/logout",
+		"introspection_endpoint":                issuer + "/oauth/introspect",
+		"revocation_endpoint":                   issuer + "/oauth/revoke",
+		"device_authorization_endpoint":         issuer + "/oauth/device_authorization",
+		"scopes_supported":                      scopes,
+		"response_types_supported":              []string{"code"},
+		"response_modes_supported":              []string{"query"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token", "client_credentials", deviceCodeGrantType},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{conf.SigningKey.JWK().Algorithm},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"acr_values_supported":                  []string{auth.ACRSingleFactor, auth.ACRMultiFactor},
+		"claims_supported": []string{
+			"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "acr", "amr", "at_hash",
+			"preferred_username", "email",
+		},
+	}
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, metadata)
+	}
+}
+
+// newJWKSHandler serves the public key ID tokens are signed with. The
+// other tokens are signed with a shared secret, which is not published.
+func newJWKSHandler(key *token.SigningKey) gin.HandlerFunc {
+	keys := gin.H{"keys": []token.JWK{key.JWK()}}
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, keys)
+	}
+}
+
+// bearerError writes the response of RFC 6750 section 3.1 for err.
+func bearerError(c *gin.Context, err error) {
+	c.Error(err)
+	switch {
+	case errors.Is(err, auth.ErrInsufficientScope):
+		c.Header("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		oauthError(c, http.StatusForbidden, "insufficient_scope", "")
+	case auth.ErrorCode(err) != auth.CodeInternal:
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		oauthError(c, http.StatusUnauthorized, "invalid_token", "")
+	default:
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+	}
+}
+
+// newUserInfoHandler returns the claims about the user of an access token
+// sent in the Authorization header or, on POST, the form.
+func newUserInfoHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.Header("Pragma", "no-cache")
+		access, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok && c.Request.Method == http.MethodPost {
+			access = c.PostForm("access_token")
+		}
+		if access == "" {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.Status(http.StatusUnauthorized)
+			return
+		}
+		info, err := authservice.UserInfo(c.Request.Context(), token.EncodedToken(access))
+		if err != nil {
+			bearerError(c, err)
+			return
+		}
+		resp := gin.H{"sub": info.Subject.String()}
+		if info.Login != "" {
+			resp["preferred_username"] = info.Login
+		}
+		if info.Email != "" {
+			resp["email"] = info.Email
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+var logoutPageTemplate = template.Must(template.New("logout").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign out</title>
+</head>
+<body>
+<h1>Sign out</h1>
+{{with .}}<p role="alert">{{.}}</p>{{else}}<p>You have been signed out.</p>{{end}}
+</body>
+</html>
+`))
+
+func renderLogoutPage(c *gin.Context, status int, message string) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(status)
+	if err := logoutPageTemplate.Execute(c.Writer, message); err != nil {
+		c.Error(err)
+	}
+}
+
+// newEndSessionHandler signs out the user of id_token_hint, as in OpenID
+// Connect RP-Initiated Logout, and sends them to post_logout_redirect_uri
+// with state, or shows that they were signed out.
+func newEndSessionHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := c.Request.ParseForm(); err != nil {
+			renderLogoutPage(c, http.StatusBadRequest, "The sign-out request is malformed.")
+			return
+		}
+		form := c.Request.Form
+		redirectURI := form.Get("post_logout_redirect_uri")
+		err := authservice.EndSession(c.Request.Context(), requestUser(c), token.EncodedToken(form.Get("id_token_hint")), redirectURI)
+		switch {
+		case err == nil:
+		case errors.Is(err, auth.ErrInvalidRedirectURI):
+			c.Error(err)
+			renderLogoutPage(c, http.StatusBadRequest, "The application asked to return to an address it did not register.")
+			return
+		case auth.ErrorCode(err) != auth.CodeInternal:
+			c.Error(err)
+			renderLogoutPage(c, http.StatusBadRequest, "The sign-out link is invalid, sign out in the application instead.")
+			return
+		default:
+			c.Error(err)
+			renderLogoutPage(c, http.StatusInternalServerError, "Something went wrong, please try again.")
+			return
+		}
+		if redirectURI != "" {
+			c.Redirect(http.StatusFound, authorizeRedirect(redirectURI, form.Get("state"), nil))
+			return
+		}
+		renderLogoutPage(c, http.StatusOK, "")
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"medods-auth/service/auth"
+	"medods-auth/token"
+	"medods-auth/user"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWKS(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.TestMode)
+	key, err := token.GenerateSigningKey()
+	require.NoError(t, err)
+	conf := &OAuthConfig{OAuthOptions: auth.OAuthOptions{Issuer: "https://auth.example.com", SigningKey: key}}
+	router, err := newRouter(nil)
+	require.NoError(t, err)
+	router.GET("/.well-known/openid-configuration", newDiscoveryHandler(conf))
+	router.GET("/oauth/jwks", newJWKSHandler(key))
+
+	get := func(target string, v any) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+	}
+	var metadata struct {
+		JWKSURI string   `json:"jwks_uri"`
+		Algs    []string `json:"id_token_signing_alg_values_supported"`
+	}
+	get("/.well-known/openid-configuration", &metadata)
+	assert.Equal("https://auth.example.com/oauth/jwks", metadata.JWKSURI)
+	assert.Equal([]string{"ES256"}, metadata.Algs)
+
+	var set struct {
+		Keys []token.JWK `json:"keys"`
+	}
+	get("/oauth/jwks", &set)
+	require.Len(t, set.Keys, 1)
+	jwk := set.Keys[0]
+	assert.Equal("EC", jwk.KeyType)
+	assert.Equal("sig", jwk.Use)
+	assert.Equal(key.ID, jwk.KeyID)
+
+	// a client verifies ID tokens with nothing but the published key
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	require.NoError(t, err)
+	y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+	require.NoError(t, err)
+	point, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...))
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(point)
+	require.NoError(t, err)
+	public, err := x509.ParsePKIXPublicKey(der)
+	require.NoError(t, err)
+	require.IsType(t, &ecdsa.PublicKey{}, public)
+
+	generator := &token.SHA512Generator{}
+	idToken, err := key.Sign(generator.Generate(token.Options{
+		User: user.User{Id: uuid.New()},
+		TTL:  time.Minute,
+		Type: token.TokenTypeID,
+	}))
+	require.NoError(t, err)
+	parsed, err := jwt.Parse(idToken, func(t *jwt.Token) (any, error) {
+		assert.Equal(jwk.KeyID, t.Header["kid"])
+		return public, nil
+	}, jwt.WithValidMethods([]string{jwk.Algorithm}))
+	assert.NoError(err)
+	assert.True(parsed.Valid)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"medods-auth/service/outbox"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// setupOutbox starts the relay over the storage outbox. It returns a nil
+// relay when no sink is configured.
+func setupOutbox(conf *OutboxConfig, store outbox.Store) (*outbox.Relay, func() error, error) {
+	if !conf.enabled() {
+		return nil, func() error { return nil }, nil
+	}
+	if store == nil {
+		return nil, nil, errors.New("outbox requires the sqlite or postgres storage backend")
+	}
+
+	var sinks []outbox.Sink
+	for _, url := range conf.WebhookURLs {
+		sinks = append(sinks, outbox.NewWebhookSink(url, conf.WebhookSecret, nil))
+	}
+	closeFile := func() error { return nil }
+	if conf.FilePath != "" {
+		file, err := outbox.NewFileSink(conf.FilePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		sinks = append(sinks, file)
+		closeFile = file.Close
+	}
+
+	relay := outbox.NewRelay(store, sinks, conf.RelayOptions)
+	relay.Start()
+	return relay, func() error {
+		return errors.Join(relay.Close(), closeFile())
+	}, nil
+}
+
+const maxOutboxMessages = 1000
+
+func newOutboxHandler(store outbox.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status := outbox.Status(c.DefaultQuery("status", string(outbox.StatusDead)))
+		if status != outbox.StatusPending && status != outbox.StatusDead {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status"})
+			return
+		}
+		limit := maxOutboxMessages
+		if l := c.Query("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n <= 0 || n > maxOutboxMessages {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+				return
+			}
+			limit = n
+		}
+
+		msgs, err := store.List(c.Request.Context(), status, limit)
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list outbox"})
+			return
+		}
+		if msgs == nil {
+			msgs = []outbox.Message{}
+		}
+		c.JSON(http.StatusOK, gin.H{"messages": msgs})
+	}
+}
+
+type replayRequest struct {
+	// IDs of dead messages to replay, all of them when empty.
+	IDs []uuid.UUID `json:"ids"`
+}
+
+func newOutboxReplayHandler(store outbox.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req replayRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+				return
+			}
+		}
+
+		n, err := store.Replay(c.Request.Context(), req.IDs)
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to replay outbox"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"replayed": n})
+	}
+}
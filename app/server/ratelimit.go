@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"medods-auth/logging"
+	"medods-auth/persistance/memory"
+	"medods-auth/persistance/postgres"
+	"medods-auth/persistance/redis"
+	"medods-auth/service/auth"
+	"medods-auth/service/ratelimit"
+	"medods-auth/service/webauthn"
+	"medods-auth/token"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// setupRateLimit returns a nil limiter when rate limiting is disabled.
+func setupRateLimit(conf *RateLimitConfig) (ratelimit.Limiter, func() error, error) {
+	switch conf.Backend {
+	case RateLimitMemory:
+		repo := memory.NewRateLimitRepository(memory.Options{CleanupInterval: time.Minute})
+		return repo, repo.Close, nil
+	case RateLimitRedis:
+		client, err := redis.Connect(Config().Redis)
+		if err != nil {
+			return nil, nil, err
+		}
+		return redis.NewRateLimitRepository(client, Config().Redis.Prefix), client.Close, nil
+	case RateLimitPostgres:
+		pgConf := *Config().Postgres
+		pgConf.HashDatabase = false
+		pgConf.BlackListDatabase = false
+		pgConf.UserDatabase = false
+		pgConf.RateLimitDatabase = true
+		db, err := postgres.InitDatabase(&pgConf)
+		if err != nil {
+			return nil, nil, err
+		}
+		repo := postgres.NewRateLimitRepository(db)
+		stop := startSweeper("ratelimit", repo.Sweep, time.Minute)
+		return repo, func() error {
+			stop()
+			return db.Close()
+		}, nil
+	default:
+		return nil, func() error { return nil }, nil
+	}
+}
+
+// startSweeper runs sweep every interval, for Postgres tables whose rows
+// nothing else deletes once they expire.
+func startSweeper(subsystem string, sweep func(context.Context, time.Time) (int, error), interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				_, err := sweep(context.Background(), now)
+				if err != nil {
+					logging.For(subsystem).Error("failed to sweep expired rows", "error", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+type rateLimitCheck struct {
+	key   string
+	limit ratelimit.Limit
+}
+
+// rateLimitMiddleware limits route by client IP and, when userID is set and
+// finds one, by user. Headers describe the tightest of the limits. Requests are let
+// through when the limiter fails, an outage shouldn't lock out every user.
+func rateLimitMiddleware(limiter ratelimit.Limiter, conf *RateLimitConfig, route string, userID func(*gin.Context) string) gin.HandlerFunc {
+	if limiter == nil {
+		return func(c *gin.Context) { c.Next() }
+	}
+	logger := logging.For("ratelimit")
+	ipLimit := conf.limit(route, RateLimitByIP)
+	userLimit := conf.limit(route, RateLimitByUser)
+	return func(c *gin.Context) {
+		now := time.Now()
+		checks := []rateLimitCheck{{route + ":ip:" + c.ClientIP(), ipLimit}}
+		if userID != nil {
+			if id := userID(c); id != "" {
+				checks = append(checks, rateLimitCheck{route + ":user:" + id, userLimit})
+			}
+		}
+
+		var tightest *ratelimit.Result
+		for _, check := range checks {
+			res, err := limiter.Allow(c.Request.Context(), check.key, check.limit, now)
+			if err != nil {
+				logger.ErrorContext(c.Request.Context(), "rate limiter failed", "route", route, "error", err)
+				continue
+			}
+			if tightest == nil || tighter(res, *tightest) {
+				tightest = &res
+			}
+		}
+		if tightest == nil {
+			c.Next()
+			return
+		}
+
+		c.Header("RateLimit-Limit", strconv.Itoa(tightest.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+		c.Header("RateLimit-Reset", ceilSeconds(tightest.Reset))
+		if !tightest.Allowed {
+			c.Header("Retry-After", ceilSeconds(tightest.RetryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func tighter(a, b ratelimit.Result) bool {
+	if a.Allowed != b.Allowed {
+		return !a.Allowed
+	}
+	if !a.Allowed {
+		return a.RetryAfter > b.RetryAfter
+	}
+	return a.Remaining < b.Remaining
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// bodyUserHandle reads the user handle of a WebAuthn assertion, which is
+// the ID of the user for passkeys registered here.
+func bodyUserHandle(c *gin.Context) string {
+	var req webauthn.AssertionResponse
+	if json.Unmarshal(peekBody(c), &req) != nil {
+		return ""
+	}
+	id, err := uuid.FromBytes(req.Response.UserHandle)
+	if err != nil {
+		return ""
+	}
+	return id.String()
+}
+
+// bodyLogin reads the login of a LoginRequest, limiting guesses per
+// account whether it exists or not.
+func bodyLogin(c *gin.Context) string {
+	var req struct {
+		Login string `json:"login"`
+	}
+	if json.Unmarshal(peekBody(c), &req) != nil {
+		return ""
+	}
+	return auth.NormalizeLogin(req.Login)
+}
+
+// formLogin is bodyLogin for form bodies.
+func formLogin(c *gin.Context) string {
+	form, err := url.ParseQuery(string(peekBody(c)))
+	if err != nil {
+		return ""
+	}
+	return auth.NormalizeLogin(form.Get("login"))
+}
+
+// bodyTokenUser reads the subject of a token of the service in field of a
+// JSON body. Only tokens with a valid signature count, anyone could put
+// the ID of someone else in a forged one and use up their limit, so
+// requests with other tokens are only limited by IP.
+func bodyTokenUser(authservice *auth.AuthService, field string) func(*gin.Context) string {
+	return func(c *gin.Context) string {
+		var req map[string]any
+		if json.Unmarshal(peekBody(c), &req) != nil {
+			return ""
+		}
+		raw, _ := req[field].(string)
+		id, err := authservice.Subject(token.EncodedToken(raw))
+		if err != nil {
+			return ""
+		}
+		return id.String()
+	}
+}
+
+// maxPeekedBody is far above any body the limited routes accept.
+const maxPeekedBody = 64 << 10
+
+// peekBody reads the request body and puts it back for the handler. Bodies
+// over maxPeekedBody are cut short, so the handler rejects them as
+// malformed.
+func peekBody(c *gin.Context) []byte {
+	if c.Request.Body == nil {
+		return nil
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxPeekedBody))
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+	return body
+}
+
+// formClientID reads the ID of an OAuth client from Basic credentials or a
+// form body.
+func formClientID(c *gin.Context) string {
+	if id, _, ok := c.Request.BasicAuth(); ok {
+		id, err := url.QueryUnescape(id)
+		if err != nil {
+			return ""
+		}
+		return id
+	}
+	form, err := url.ParseQuery(string(peekBody(c)))
+	if err != nil {
+		return ""
+	}
+	return form.Get("client_id")
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"medods-auth/persistance/memory"
+	"medods-auth/service/auth"
+	"medods-auth/service/ratelimit"
+	"medods-auth/token"
+	"medods-auth/user"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitForwardedFor(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.TestMode)
+	limiter := memory.NewRateLimitRepository(memory.Options{})
+	defer limiter.Close()
+	conf := &RateLimitConfig{Limits: map[string]ratelimit.Limit{
+		RateLimitByIP: {Burst: 2, Period: time.Hour},
+	}}
+
+	request := func(router *gin.Engine, forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodGet, "/limited", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// a new X-Forwarded-For on every request doesn't get a new bucket
+	router, err := newRouter(nil)
+	assert.NoError(err)
+	router.GET("/limited", rateLimitMiddleware(limiter, conf, "direct", nil), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	var codes []int
+	for i := range 3 {
+		codes = append(codes, request(router, "198.51.100."+strconv.Itoa(i)))
+	}
+	assert.Equal([]int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, codes)
+
+	// behind a trusted proxy, the clients it forwards for are limited apart
+	router, err = newRouter([]string{"192.0.2.0/24"})
+	assert.NoError(err)
+	router.GET("/limited", rateLimitMiddleware(limiter, conf, "proxied", nil), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	codes = nil
+	for i := range 3 {
+		codes = append(codes, request(router, "198.51.100."+strconv.Itoa(i)))
+	}
+	assert.Equal([]int{http.StatusOK, http.StatusOK, http.StatusOK}, codes)
+}
+
+func TestRateLimitTokenUser(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.TestMode)
+	limiter := memory.NewRateLimitRepository(memory.Options{})
+	defer limiter.Close()
+	conf := &RateLimitConfig{Limits: map[string]ratelimit.Limit{
+		RateLimitByIP:   {Burst: 10, Period: time.Hour},
+		RateLimitByUser: {Burst: 1, Period: time.Hour},
+	}}
+	generator := &token.SHA512Generator{}
+	accessTTL := time.Minute
+	refreshTTL := time.Hour
+	service, err := auth.NewAuthService(auth.AuthServiceOptions{
+		RefreshTokenRepo: memory.NewHashRepository(memory.Options{}),
+		Blacklist:        memory.NewBlackListRepository(memory.Options{}),
+		Generator:        generator,
+		Hasher:           &token.BcryptHasher{},
+		Secret:           []byte("test_secret"),
+		AccessTTL:        &accessTTL,
+		RefreshTTL:       &refreshTTL,
+	})
+	assert.NoError(err)
+
+	router, err := newRouter(nil)
+	assert.NoError(err)
+	var received int
+	router.POST("/limited", rateLimitMiddleware(limiter, conf, "token", bodyTokenUser(service, "access_token")), func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		received = len(body)
+		c.Status(http.StatusOK)
+	})
+	request := func(ip string, body []byte) int {
+		req := httptest.NewRequest(http.MethodPost, "/limited", bytes.NewReader(body))
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	withToken := func(access string) []byte {
+		body, err := json.Marshal(map[string]string{"access_token": access})
+		assert.NoError(err)
+		return body
+	}
+
+	// a forged token naming the victim doesn't use up their limit
+	victim := user.User{Id: uuid.New(), UserAgent: "test"}
+	forged, err := generator.Encode(generator.Generate(token.Options{User: victim, TTL: time.Minute, Type: token.TokenTypeAccess}), []byte("other_secret"))
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, request("192.0.2.1", withToken(forged)))
+	assert.Equal(http.StatusOK, request("192.0.2.1", withToken(forged)))
+	pair, err := service.GenerateTokens(context.Background(), victim)
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, request("192.0.2.2", withToken(pair.Access.String())))
+	// a genuine one does, whatever the IP
+	assert.Equal(http.StatusTooManyRequests, request("192.0.2.3", withToken(pair.Access.String())))
+
+	// the middleware doesn't read more of a body than any route accepts
+	assert.Equal(http.StatusOK, request("192.0.2.4", bytes.Repeat([]byte("x"), 2*maxPeekedBody)))
+	assert.Equal(maxPeekedBody, received)
+}
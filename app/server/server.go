@@ -2,9 +2,13 @@ package server
 
 import (
 	"context"
-	"medods-auth/persistance/postgres"
+	"errors"
+	"medods-auth/logging"
+	"medods-auth/metrics"
 	"medods-auth/service/auth"
+	"medods-auth/service/password"
 	"medods-auth/token"
+	"medods-auth/tracing"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,7 +18,7 @@ import (
 )
 
 func Start() error {
-	server := setupServer()
+	server, cleanup := setupServer()
 
 	osSignal := make(chan os.Signal, 1)
 	signal.Notify(osSignal, os.Interrupt)
@@ -27,49 +31,216 @@ func Start() error {
 
 	<-osSignal
 
-	return shutdownServer(server)
+	err := shutdownServer(server)
+	if cleanupErr := cleanup(); err == nil {
+		err = cleanupErr
+	}
+	return err
 }
 
-func setupServer() *http.Server {
-	db, err := postgres.InitDatabase(
-		Config().Postgres,
-	)
+// setupServer returns the server and a cleanup func releasing everything
+// it opened, to be called after the server is shut down.
+func setupServer() (*http.Server, func() error) {
+	tp, err := tracing.Setup(context.Background(), Config().Tracing)
+	if err != nil {
+		panic(err)
+	}
+	store, err := setupStorage()
+	if err != nil {
+		panic(err)
+	}
+	auditLog, closeAudit, err := setupAudit(Config().Audit)
+	if err != nil {
+		panic(err)
+	}
+	bus, closeEvents := setupEvents(Config().Events)
+	relay, closeOutbox, err := setupOutbox(Config().Outbox, store.outbox)
+	if err != nil {
+		panic(err)
+	}
+	limiter, closeRateLimit, err := setupRateLimit(Config().RateLimit)
+	if err != nil {
+		panic(err)
+	}
+	lockoutOptions, closeLockout, err := setupLockout(Config().Lockout)
 	if err != nil {
 		panic(err)
 	}
-	hashRepo := postgres.NewHashRepository(db)
-	blacklistRepo := postgres.NewBlackListRepository(db)
+	cleanup := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		// events are drained before the sinks they may write to are closed
+		return errors.Join(closeEvents(), closeOutbox(), store.Close(), closeAudit(), closeRateLimit(), closeLockout(), tp.Shutdown(ctx))
+	}
 
 	accessTTL := time.Minute * 5
 	refreshTTL := time.Hour * 48
 
+	var hashes auth.TokenHashRepository = store.hashes
+	var blacklist auth.TokenBlackList = store.blacklist
+	var hasher token.Hasher = token.BcryptHasher{}
+	var m *metrics.Metrics
+	if Config().MetricsEnabled {
+		m = metrics.New()
+		hashes = m.HashRepository(hashes)
+		blacklist = m.Blacklist(blacklist)
+		hasher = m.Hasher(hasher)
+		if store.db != nil {
+			err = m.RegisterDBStats(store.db, Config().Storage)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	registerSubscribers(bus, m)
+
+	passwords, err := password.NewHasher(Config().Argon2)
+	if err != nil {
+		panic(err)
+	}
+	sessionLimit := Config().SessionLimit
+	sessionLifetime := Config().SessionLifetime
+	sessionIdleTimeout := Config().SessionIdleTimeout
+	totpOptions := Config().TOTP
+	webauthnConfig := Config().WebAuthn
+	oauthConfig := Config().OAuth
+	var oauthOptions *auth.OAuthOptions
+	if oauthConfig != nil {
+		oauthOptions = &oauthConfig.OAuthOptions
+	}
 	authService, err := auth.NewAuthService(auth.AuthServiceOptions{
-		RefreshTokenRepo: hashRepo,
-		Blacklist:        blacklistRepo,
+		RefreshTokenRepo: hashes,
+		Blacklist:        blacklist,
+		Users:            store.users,
+		Passwords:        passwords,
+		TOTP:             &totpOptions,
+		WebAuthn:         webauthnConfig,
+		OAuth:            oauthOptions,
+		Lockout:          lockoutOptions,
 		Generator:        &token.SHA512Generator{},
-		Hasher:           token.BcryptHasher{},
+		Hasher:           hasher,
+		Audit:            auditLog,
+		Events:           bus,
+		UseOutbox:        relay != nil,
+		SessionLimit:     &sessionLimit,
 
 		Secret: Config().HashSecret,
 
 		// TODO: access TTL and refresh TTL from config
-		AccessTTL:  &accessTTL,
-		RefreshTTL: &refreshTTL,
+		AccessTTL:          &accessTTL,
+		RefreshTTL:         &refreshTTL,
+		SessionLifetime:    &sessionLifetime,
+		SessionIdleTimeout: &sessionIdleTimeout,
 	})
 	if err != nil {
 		panic(err)
 	}
 
-	router := gin.Default()
-	router.GET("/generate", newGenerateHandler(authService))
-	router.POST("/refresh", newRefreshHandler(authService))
+	if os.Getenv(gin.EnvGinMode) == "" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	httpLogger := logging.For("http")
+	router, err := newRouter(Config().TrustedProxies)
+	if err != nil {
+		panic(err)
+	}
+	router.Use(
+		recoveryMiddleware(httpLogger),
+		requestIDMiddleware(),
+		tracing.Middleware(),
+		accessLogMiddleware(httpLogger),
+	)
+	if m != nil {
+		router.Use(m.Middleware())
+		router.GET("/metrics", gin.WrapH(m.Handler()))
+	}
+	limit := func(route string, userID func(*gin.Context) string) gin.HandlerFunc {
+		return rateLimitMiddleware(limiter, Config().RateLimit, route, userID)
+	}
+	router.POST("/login", limit("login", bodyLogin), m.Count(metrics.OpIssued), newLoginHandler(authService))
+	router.POST("/login/mfa", limit("login_mfa", bodyTokenUser(authService, "mfa_token")), m.Count(metrics.OpIssued), newVerifyMFAHandler(authService))
+	router.POST("/mfa/totp/enroll", newEnrollTOTPHandler(authService))
+	router.POST("/mfa/totp/activate", limit("totp_activate", bodyTokenUser(authService, "access_token")), newActivateTOTPHandler(authService))
+	if webauthnConfig != nil {
+		router.POST("/webauthn/register/begin", newBeginPasskeyRegistrationHandler(authService))
+		router.POST("/webauthn/register/finish", limit("passkey_register", bodyTokenUser(authService, "access_token")), newFinishPasskeyRegistrationHandler(authService))
+		router.POST("/webauthn/login/begin", limit("passkey_login_begin", nil), newBeginPasskeyLoginHandler(authService))
+		router.POST("/webauthn/login/finish", limit("passkey_login", bodyUserHandle), m.Count(metrics.OpIssued), newFinishPasskeyLoginHandler(authService))
+		router.POST("/login/mfa/webauthn/begin", newBeginPasskeyMFAHandler(authService))
+		router.POST("/login/mfa/webauthn/finish", limit("login_mfa", bodyTokenUser(authService, "mfa_token")), m.Count(metrics.OpIssued), newFinishPasskeyMFAHandler(authService))
+	}
+	if oauthConfig != nil {
+		router.POST("/oauth/token", limit("oauth_token", formClientID), m.Count(metrics.OpIssued), newTokenHandler(authService))
+		router.POST("/oauth/introspect", limit("oauth_introspect", formClientID), newIntrospectHandler(authService))
+		router.POST("/oauth/revoke", limit("oauth_revoke", formClientID), newRevokeHandler(authService))
+		if oauthConfig.LoginURL != "" {
+			router.GET("/oauth/authorize", newAuthorizeRedirectHandler(authService, oauthConfig.LoginURL))
+		}
+		router.POST("/oauth/authorize", limit("oauth_authorize", bodyTokenUser(authService, "access_token")), newAuthorizeHandler(authService))
+		router.POST("/oauth/device_authorization", limit("oauth_device", formClientID), newDeviceAuthorizationHandler(authService, oauthConfig.DeviceURL))
+		router.POST("/oauth/device/verify", limit("oauth_device_verify", bodyTokenUser(authService, "access_token")), newDeviceVerifyHandler(authService))
+		router.GET("/device", limit("device", nil), newDevicePageHandler(authService))
+		router.POST("/device", limit("device", formLogin), newDeviceDecisionHandler(authService))
+		if oauthConfig.Issuer != "" {
+			router.GET("/.well-known/openid-configuration", newDiscoveryHandler(oauthConfig))
+			router.GET("/oauth/jwks", newJWKSHandler(oauthConfig.SigningKey))
+			router.GET("/userinfo", limit("userinfo", nil), newUserInfoHandler(authService))
+			router.POST("/userinfo", limit("userinfo", nil), newUserInfoHandler(authService))
+			router.GET("/oauth/logout", limit("oauth_logout", nil), newEndSessionHandler(authService))
+			router.POST("/oauth/logout", limit("oauth_logout", nil), newEndSessionHandler(authService))
+		}
+	}
+	router.POST("/refresh", limit("refresh", bodyTokenUser(authService, "refresh_token")), m.Count(metrics.OpRefreshed), newRefreshHandler(authService))
 	router.POST("/me", newMeHandler(authService))
-	router.POST("/logout", newLogoutHandler(authService))
+	router.POST("/logout", limit("logout", bodyTokenUser(authService, "access_token")), m.Count(metrics.OpRevoked), newLogoutHandler(authService))
+
+	if len(Config().AdminAPIKey) > 0 {
+		admin := router.Group("/admin", adminAuthMiddleware(Config().AdminAPIKey))
+		if auditLog != nil {
+			admin.GET("/audit", newAuditHandler(auditLog))
+			admin.GET("/audit/verify", newAuditVerifyHandler(auditLog))
+		}
+		admin.POST("/users", newCreateUserHandler(authService))
+		admin.GET("/users/:id", newGetUserHandler(authService))
+		admin.POST("/users/:id/disable", newDisableUserHandler(authService))
+		admin.POST("/users/:id/enable", newEnableUserHandler(authService))
+		admin.DELETE("/users/:id", newDeleteUserHandler(authService))
+		admin.PUT("/users/:id/password", newSetPasswordHandler(authService))
+		admin.POST("/users/:id/tokens", m.Count(metrics.OpIssued), newIssueTokensHandler(authService))
+		admin.DELETE("/users/:id/totp", newResetTOTPHandler(authService))
+		if lockoutOptions != nil {
+			admin.POST("/users/:id/unlock", newUnlockUserHandler(authService))
+			admin.DELETE("/lockout/ips/:ip", newUnlockIPHandler(authService))
+		}
+		if oauthConfig != nil {
+			admin.POST("/clients", newCreateClientHandler(authService))
+			admin.GET("/clients/:id", newGetClientHandler(authService))
+			admin.DELETE("/clients/:id", newDeleteClientHandler(authService))
+		}
+		if relay != nil {
+			admin.GET("/outbox", newOutboxHandler(store.outbox))
+			admin.POST("/outbox/replay", newOutboxReplayHandler(store.outbox))
+		}
+	}
 
 	server := http.Server{
 		Addr:    ":" + Config().Port,
 		Handler: router,
 	}
-	return &server
+	return &server, cleanup
+}
+
+// newRouter returns a router believing X-Forwarded-For only from
+// trustedProxies, so that clients can't choose the IP rate limits and
+// lockout see.
+func newRouter(trustedProxies []string) (*gin.Engine, error) {
+	router := gin.New()
+	err := router.SetTrustedProxies(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return router, nil
 }
 
 func shutdownServer(server *http.Server) error {
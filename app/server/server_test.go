@@ -0,0 +1,57 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIssueTokensRequiresAdmin(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.TestMode)
+	t.Setenv("STORAGE_BACKEND", StorageMemory)
+	t.Setenv("HASH_SECRET", "secret")
+	t.Setenv("ADMIN_API_KEY", "admin-key")
+	t.Setenv("METRICS_ENABLED", "false")
+	t.Setenv("RATE_LIMIT_BACKEND", "none")
+	server, cleanup := setupServer()
+	defer func() { assert.NoError(cleanup()) }()
+
+	request := func(method, target, key string, body any) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			assert.NoError(json.NewEncoder(&buf).Encode(body))
+		}
+		req := httptest.NewRequest(method, target, &buf)
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		rec := httptest.NewRecorder()
+		server.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	id := uuid.New()
+	assert.Equal(http.StatusCreated, request(http.MethodPost, "/admin/users", "admin-key", CreateUserRequest{ID: id}).Code)
+
+	// the old unauthenticated endpoint is gone
+	assert.Equal(http.StatusNotFound, request(http.MethodGet, "/generate?guid="+id.String(), "", nil).Code)
+
+	target := "/admin/users/" + id.String() + "/tokens"
+	assert.Equal(http.StatusUnauthorized, request(http.MethodPost, target, "", nil).Code)
+	assert.Equal(http.StatusUnauthorized, request(http.MethodPost, target, "wrong-key", nil).Code)
+
+	rec := request(http.MethodPost, target, "admin-key", IssueTokensRequest{UserAgent: "test"})
+	assert.Equal(http.StatusOK, rec.Code)
+	var tokens map[string]any
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &tokens))
+	assert.NotEmpty(tokens["access_token"])
+	assert.NotEmpty(tokens["refresh_token"])
+}
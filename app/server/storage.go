@@ -0,0 +1,127 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"medods-auth/persistance/bolt"
+	"medods-auth/persistance/memory"
+	"medods-auth/persistance/postgres"
+	"medods-auth/persistance/redis"
+	"medods-auth/persistance/sqlite"
+	"medods-auth/service/auth"
+	"medods-auth/service/outbox"
+)
+
+type storage struct {
+	hashes    auth.TokenHashRepository
+	blacklist auth.TokenBlackList
+	users     auth.UserRepository
+
+	// db is set for SQL backends to export connection pool stats.
+	db *sql.DB
+	// outbox is set for backends that write events transactionally.
+	outbox outbox.Store
+
+	closers []func() error
+}
+
+func (s *storage) Close() error {
+	var errs []error
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		errs = append(errs, s.closers[i]())
+	}
+	return errors.Join(errs...)
+}
+
+func setupStorage() (*storage, error) {
+	switch Config().Storage {
+	case StorageMemory:
+		return setupMemoryStorage(Config().Memory)
+	case StorageBolt:
+		db, err := bolt.InitDatabase(Config().Bolt)
+		if err != nil {
+			return nil, err
+		}
+		compactor := bolt.StartCompactor(db, Config().Bolt.CompactionInterval)
+		return &storage{
+			hashes:    bolt.NewHashRepository(db),
+			blacklist: bolt.NewBlackListRepository(db),
+			users:     bolt.NewUserRepository(db),
+			closers:   []func() error{db.Close, compactor.Close},
+		}, nil
+	case StorageRedis:
+		client, err := redis.Connect(Config().Redis)
+		if err != nil {
+			return nil, err
+		}
+		return &storage{
+			hashes:    redis.NewHashRepository(client, Config().Redis.Prefix),
+			blacklist: redis.NewBlackListRepository(client, Config().Redis.Prefix),
+			users:     redis.NewUserRepository(client, Config().Redis.Prefix),
+			closers:   []func() error{client.Close},
+		}, nil
+	case StorageSQLite:
+		db, err := sqlite.InitDatabase(Config().SQLite)
+		if err != nil {
+			return nil, err
+		}
+		return &storage{
+			hashes:    sqlite.NewHashRepository(db),
+			blacklist: sqlite.NewBlackListRepository(db),
+			users:     sqlite.NewUserRepository(db),
+			db:        db.DB,
+			outbox:    sqlite.NewOutboxRepository(db),
+			closers:   []func() error{db.Close},
+		}, nil
+	default:
+		db, err := postgres.InitDatabase(Config().Postgres)
+		if err != nil {
+			return nil, err
+		}
+		return &storage{
+			hashes:    postgres.NewHashRepository(db),
+			blacklist: postgres.NewBlackListRepository(db),
+			users:     postgres.NewUserRepository(db),
+			db:        db.DB,
+			outbox:    postgres.NewOutboxRepository(db),
+			closers:   []func() error{db.Close},
+		}, nil
+	}
+}
+
+func setupMemoryStorage(conf *MemoryConfig) (*storage, error) {
+	hashes := memory.NewHashRepository(conf.Options)
+	blacklist := memory.NewBlackListRepository(conf.Options)
+	users := memory.NewUserRepository()
+	store := &storage{
+		hashes:    hashes,
+		blacklist: blacklist,
+		users:     users,
+		closers:   []func() error{hashes.Close, blacklist.Close},
+	}
+	if conf.SnapshotDir == "" {
+		return store, nil
+	}
+
+	hashesPath, blacklistPath, usersPath := conf.snapshotPaths()
+	err := memory.LoadFile(hashesPath, hashes)
+	if err != nil {
+		return nil, err
+	}
+	err = memory.LoadFile(blacklistPath, blacklist)
+	if err != nil {
+		return nil, err
+	}
+	err = memory.LoadFile(usersPath, users)
+	if err != nil {
+		return nil, err
+	}
+	store.closers = append(store.closers, func() error {
+		return errors.Join(
+			memory.SaveFile(hashesPath, hashes),
+			memory.SaveFile(blacklistPath, blacklist),
+			memory.SaveFile(usersPath, users),
+		)
+	})
+	return store, nil
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"medods-auth/logging"
+	"medods-auth/service/auth"
+	"medods-auth/user"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type CreateUserRequest struct {
+	// ID is optional, a random one is assigned without it.
+	ID uuid.UUID `json:"id"`
+}
+
+type SetPasswordRequest struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+type IssueTokensRequest struct {
+	// UserAgent the tokens are bound to, that of the request when empty.
+	UserAgent string `json:"user_agent"`
+}
+
+func accountResponse(account *user.Account) gin.H {
+	return gin.H{
+		"id":         account.Id,
+		"status":     account.Status,
+		"created_at": account.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// userError writes the response for an error of the user directory.
+func userError(c *gin.Context, err error) {
+	c.Error(err)
+	switch {
+	case errors.Is(err, auth.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, auth.ErrUserExists), errors.Is(err, auth.ErrLoginTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, auth.ErrInvalidCredentials):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "login and password required"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "user directory error"})
+	}
+}
+
+// userIDParam reads the :id path parameter, responding 400 if it is invalid.
+func userIDParam(c *gin.Context) (uuid.UUID, bool) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return uuid.Nil, false
+	}
+	return id, true
+}
+
+func newCreateUserHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CreateUserRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+				return
+			}
+		}
+
+		account, err := authservice.CreateUser(c.Request.Context(), req.ID)
+		if err != nil {
+			userError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, accountResponse(account))
+	}
+}
+
+func newGetUserHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := userIDParam(c)
+		if !ok {
+			return
+		}
+		account, err := authservice.GetUser(c.Request.Context(), id)
+		if err != nil {
+			userError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, accountResponse(account))
+	}
+}
+
+func newDisableUserHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return userStatusHandler(authservice, authservice.DisableUser)
+}
+
+func newEnableUserHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return userStatusHandler(authservice, authservice.EnableUser)
+}
+
+func newDeleteUserHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := userIDParam(c)
+		if !ok {
+			return
+		}
+		err := authservice.DeleteUser(c.Request.Context(), id)
+		if err != nil {
+			userError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func newSetPasswordHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := userIDParam(c)
+		if !ok {
+			return
+		}
+		var req SetPasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		err := authservice.SetPassword(c.Request.Context(), id, req.Login, req.Password)
+		if err != nil {
+			userError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// newIssueTokensHandler starts a session of a user without their
+// credentials, to bootstrap users who have none yet.
+func newIssueTokensHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := userIDParam(c)
+		if !ok {
+			return
+		}
+		var req IssueTokensRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+				return
+			}
+		}
+		u := user.User{
+			Id:        id,
+			UserAgent: req.UserAgent,
+			IP:        c.ClientIP(),
+		}
+		if u.UserAgent == "" {
+			u.UserAgent = c.Request.UserAgent()
+		}
+		logging.SetUserID(c.Request.Context(), id.String())
+
+		pair, err := authservice.GenerateTokens(c.Request.Context(), u)
+		switch {
+		case errors.Is(err, auth.ErrTooManySessions), errors.Is(err, auth.ErrUserDisabled), errors.Is(err, auth.ErrUserLocked):
+			c.Error(err)
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			userError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, tokenResponse(pair))
+	}
+}
+
+// userStatusHandler applies set to the user and responds with the account.
+func userStatusHandler(authservice *auth.AuthService, set func(context.Context, uuid.UUID) error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := userIDParam(c)
+		if !ok {
+			return
+		}
+		err := set(c.Request.Context(), id)
+		if err != nil {
+			userError(c, err)
+			return
+		}
+		account, err := authservice.GetUser(c.Request.Context(), id)
+		if err != nil {
+			userError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, accountResponse(account))
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"medods-auth/service/auth"
+	"medods-auth/service/webauthn"
+	"medods-auth/token"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type BeginPasskeyRegistrationRequest struct {
+	AccessToken string `json:"access_token"`
+}
+
+type FinishPasskeyRegistrationRequest struct {
+	AccessToken string                        `json:"access_token"`
+	Credential  webauthn.RegistrationResponse `json:"credential"`
+}
+
+type BeginPasskeyMFARequest struct {
+	MFAToken string `json:"mfa_token"`
+}
+
+type FinishPasskeyMFARequest struct {
+	MFAToken   string                     `json:"mfa_token"`
+	Credential webauthn.AssertionResponse `json:"credential"`
+}
+
+func newBeginPasskeyRegistrationHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req BeginPasskeyRegistrationRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		opts, err := authservice.BeginPasskeyRegistration(c.Request.Context(), requestUser(c), token.EncodedToken(req.AccessToken))
+		if err != nil {
+			mfaError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"publicKey": opts})
+	}
+}
+
+func newFinishPasskeyRegistrationHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req FinishPasskeyRegistrationRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		passkey, err := authservice.FinishPasskeyRegistration(c.Request.Context(), requestUser(c), token.EncodedToken(req.AccessToken), req.Credential)
+		if err != nil {
+			mfaError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"id":         webauthn.Bytes(passkey.ID),
+			"transports": passkey.Transports,
+			"created_at": passkey.CreatedAt,
+		})
+	}
+}
+
+func newBeginPasskeyLoginHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		opts, err := authservice.BeginPasskeyLogin(c.Request.Context())
+		if err != nil {
+			mfaError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"publicKey": opts})
+	}
+}
+
+func newFinishPasskeyLoginHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req webauthn.AssertionResponse
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		pair, err := authservice.FinishPasskeyLogin(c.Request.Context(), requestUser(c), req)
+		if err != nil {
+			mfaError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, tokenResponse(pair))
+	}
+}
+
+func newBeginPasskeyMFAHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req BeginPasskeyMFARequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		opts, err := authservice.BeginPasskeyMFA(c.Request.Context(), requestUser(c), token.EncodedToken(req.MFAToken))
+		if err != nil {
+			mfaError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"publicKey": opts})
+	}
+}
+
+func newFinishPasskeyMFAHandler(authservice *auth.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req FinishPasskeyMFARequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		pair, err := authservice.FinishPasskeyMFA(c.Request.Context(), requestUser(c), token.EncodedToken(req.MFAToken), req.Credential)
+		if err != nil {
+			mfaError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, tokenResponse(pair))
+	}
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"medods-auth/app/server"
+	"os"
 
 	"github.com/joho/godotenv"
 )
@@ -10,9 +11,11 @@ import (
 func main() {
 	err := godotenv.Load()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		slog.Error("error loading .env file", "error", err)
+		os.Exit(1)
 	}
 	if err := server.Start(); err != nil {
-		log.Fatalln(err)
+		slog.Error("server stopped", "error", err)
+		os.Exit(1)
 	}
 }
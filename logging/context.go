@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+type requestKey struct{}
+
+// requestFields is shared by everything handling one request, so a handler
+// can attach the user id once it is known and later records carry it.
+type requestFields struct {
+	mu        sync.Mutex
+	requestID string
+	userID    string
+}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestKey{}, &requestFields{requestID: id})
+}
+
+func RequestID(ctx context.Context) string {
+	f, ok := ctx.Value(requestKey{}).(*requestFields)
+	if !ok {
+		return ""
+	}
+	return f.requestID
+}
+
+// SetUserID attaches the user id to the request in ctx, if any.
+func SetUserID(ctx context.Context, id string) {
+	f, ok := ctx.Value(requestKey{}).(*requestFields)
+	if !ok {
+		return
+	}
+	f.mu.Lock()
+	f.userID = id
+	f.mu.Unlock()
+}
+
+func UserID(ctx context.Context) string {
+	f, ok := ctx.Value(requestKey{}).(*requestFields)
+	if !ok {
+		return ""
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.userID
+}
+
+// contextHandler adds the request id and user id from ctx to every record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if id := UserID(ctx); id != "" {
+		r.AddAttrs(slog.String("user_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
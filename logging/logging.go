@@ -0,0 +1,121 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+type Config struct {
+	// Level applies to subsystems without an override in Subsystems.
+	Level      slog.Level
+	Subsystems map[string]slog.Level
+
+	// Writer defaults to os.Stdout.
+	Writer io.Writer
+}
+
+var (
+	mu     sync.RWMutex
+	root   slog.Handler = slog.Default().Handler()
+	levels              = map[string]*slog.LevelVar{}
+	base                = new(slog.LevelVar)
+)
+
+// Setup installs a redacting JSON handler as the slog default and applies
+// the per-subsystem levels. Loggers obtained with For before Setup keep
+// working but write through the previous handler.
+func Setup(conf Config) {
+	w := conf.Writer
+	if w == nil {
+		w = os.Stdout
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	base.Set(conf.Level)
+	for name, lvl := range levels {
+		if override, ok := conf.Subsystems[name]; ok {
+			lvl.Set(override)
+		} else {
+			lvl.Set(conf.Level)
+		}
+	}
+	for name, override := range conf.Subsystems {
+		if _, ok := levels[name]; !ok {
+			lvl := new(slog.LevelVar)
+			lvl.Set(override)
+			levels[name] = lvl
+		}
+	}
+
+	root = &contextHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{
+		// filtering is done per subsystem by levelHandler
+		Level:       slog.LevelDebug,
+		ReplaceAttr: redact,
+	})}
+	slog.SetDefault(slog.New(&levelHandler{level: base, next: root}))
+}
+
+// For returns the logger of a subsystem, e.g. "http" or "postgres".
+func For(subsystem string) *slog.Logger {
+	mu.Lock()
+	lvl, ok := levels[subsystem]
+	if !ok {
+		lvl = new(slog.LevelVar)
+		lvl.Set(base.Level())
+		levels[subsystem] = lvl
+	}
+	h := root
+	mu.Unlock()
+
+	return slog.New(&levelHandler{level: lvl, next: h}).With("subsystem", subsystem)
+}
+
+// ParseLevels parses a comma separated list of subsystem=level pairs,
+// e.g. "postgres=debug,http=warn".
+func ParseLevels(spec string) (map[string]slog.Level, error) {
+	out := map[string]slog.Level{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, level, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid log level override: %q", pair)
+		}
+		var lvl slog.Level
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, err
+		}
+		out[strings.TrimSpace(name)] = lvl
+	}
+	return out, nil
+}
+
+type levelHandler struct {
+	level slog.Leveler
+	next  slog.Handler
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= h.level.Level() && h.next.Enabled(ctx, l)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.next.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{h.level, h.next.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{h.level, h.next.WithGroup(name)}
+}
@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const Redacted = "[REDACTED]"
+
+// Attributes with these substrings in their key are never emitted.
+var sensitiveKeys = []string{
+	"token",
+	"password",
+	"secret",
+	"hash",
+	"authorization",
+	"cookie",
+	"credential",
+	"connstr",
+	"dsn",
+}
+
+// Matches JWTs and bcrypt hashes that end up in free-form values.
+var sensitiveValue = regexp.MustCompile(
+	`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*|\$2[aby]?\$\d{2}\$[./A-Za-z0-9]{53}`,
+)
+
+var connPassword = regexp.MustCompile(`password=\S+`)
+
+func redact(_ []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) && !strings.HasSuffix(key, "_type") {
+			return slog.String(a.Key, Redacted)
+		}
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, RedactString(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, RedactString(err.Error()))
+		}
+	}
+	return a
+}
+
+// RedactString masks tokens, hashes and connection string passwords in s.
+func RedactString(s string) string {
+	s = sensitiveValue.ReplaceAllString(s, Redacted)
+	return connPassword.ReplaceAllString(s, "password="+Redacted)
+}
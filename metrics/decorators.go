@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"medods-auth/service/auth"
+	"medods-auth/service/outbox"
+	"medods-auth/token"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func (m *Metrics) observeRepository(repository, method string, start time.Time, err error) {
+	outcome := "ok"
+	switch {
+	case errors.Is(err, auth.ErrRefreshTokenNotFound):
+		outcome = "not_found"
+	case errors.Is(err, auth.ErrTooManySessions):
+		outcome = "rejected"
+	case err != nil:
+		outcome = "error"
+	}
+	m.repositoryLatency.
+		WithLabelValues(repository, method, outcome).
+		Observe(time.Since(start).Seconds())
+}
+
+// hashRepository implements all the optional interfaces of a
+// auth.TokenHashRepository. The service only calls those next implements,
+// see auth.RepositoryDecorator.
+type hashRepository struct {
+	next auth.TokenHashRepository
+	m    *Metrics
+}
+
+// HashRepository instruments repo. Use auth.As to find out which optional
+// interfaces the result implements.
+func (m *Metrics) HashRepository(repo auth.TokenHashRepository) auth.TokenHashRepository {
+	return &hashRepository{next: repo, m: m}
+}
+
+func (r *hashRepository) Unwrap() auth.TokenHashRepository {
+	return r.next
+}
+
+func (r *hashRepository) Store(ctx context.Context, rec *auth.RefreshTokenRecord) (err error) {
+	defer func(start time.Time) { r.m.observeRepository("token", "Store", start, err) }(time.Now())
+	return r.next.Store(ctx, rec)
+}
+
+func (r *hashRepository) Get(ctx context.Context, jti token.JTI) (_ *auth.RefreshTokenRecord, err error) {
+	defer func(start time.Time) { r.m.observeRepository("token", "Get", start, err) }(time.Now())
+	return r.next.Get(ctx, jti)
+}
+
+func (r *hashRepository) Delete(ctx context.Context, jti token.JTI) (err error) {
+	defer func(start time.Time) { r.m.observeRepository("token", "Delete", start, err) }(time.Now())
+	return r.next.Delete(ctx, jti)
+}
+
+func (r *hashRepository) DeleteByUserId(ctx context.Context, userId uuid.UUID) (err error) {
+	defer func(start time.Time) { r.m.observeRepository("token", "DeleteByUserId", start, err) }(time.Now())
+	return r.next.DeleteByUserId(ctx, userId)
+}
+
+func (r *hashRepository) DeleteByClient(ctx context.Context, userId uuid.UUID, clientID string) (err error) {
+	defer func(start time.Time) { r.m.observeRepository("token", "DeleteByClient", start, err) }(time.Now())
+	return r.next.DeleteByClient(ctx, userId, clientID)
+}
+
+func (r *hashRepository) Rotate(ctx context.Context, rot auth.Rotation) (err error) {
+	defer func(start time.Time) { r.m.observeRepository("token", "Rotate", start, err) }(time.Now())
+	return r.next.(auth.TokenRotator).Rotate(ctx, rot)
+}
+
+func (r *hashRepository) StoreWithOutbox(ctx context.Context, rec *auth.RefreshTokenRecord, msgs []outbox.Message) (err error) {
+	defer func(start time.Time) { r.m.observeRepository("token", "StoreWithOutbox", start, err) }(time.Now())
+	return r.next.(auth.OutboxWriter).StoreWithOutbox(ctx, rec, msgs)
+}
+
+func (r *hashRepository) DeleteWithOutbox(ctx context.Context, jti token.JTI, msgs []outbox.Message) (err error) {
+	defer func(start time.Time) { r.m.observeRepository("token", "DeleteWithOutbox", start, err) }(time.Now())
+	return r.next.(auth.OutboxWriter).DeleteWithOutbox(ctx, jti, msgs)
+}
+
+func (r *hashRepository) DeleteByUserIdWithOutbox(ctx context.Context, userId uuid.UUID, msgs []outbox.Message) (err error) {
+	defer func(start time.Time) { r.m.observeRepository("token", "DeleteByUserIdWithOutbox", start, err) }(time.Now())
+	return r.next.(auth.OutboxWriter).DeleteByUserIdWithOutbox(ctx, userId, msgs)
+}
+
+func (r *hashRepository) DeleteByClientWithOutbox(ctx context.Context, userId uuid.UUID, clientID string, msgs []outbox.Message) (err error) {
+	defer func(start time.Time) { r.m.observeRepository("token", "DeleteByClientWithOutbox", start, err) }(time.Now())
+	return r.next.(auth.OutboxWriter).DeleteByClientWithOutbox(ctx, userId, clientID, msgs)
+}
+
+func (r *hashRepository) StoreSession(ctx context.Context, ns auth.NewSession) (_ []auth.RefreshTokenRecord, err error) {
+	defer func(start time.Time) { r.m.observeRepository("token", "StoreSession", start, err) }(time.Now())
+	return r.next.(auth.SessionLimiter).StoreSession(ctx, ns)
+}
+
+type blacklist struct {
+	next auth.TokenBlackList
+	m    *Metrics
+}
+
+func (m *Metrics) Blacklist(bl auth.TokenBlackList) auth.TokenBlackList {
+	return &blacklist{next: bl, m: m}
+}
+
+func (b *blacklist) Add(ctx context.Context, jti token.JTI, expiresAt time.Time) (err error) {
+	defer func(start time.Time) { b.m.observeRepository("blacklist", "Add", start, err) }(time.Now())
+	return b.next.Add(ctx, jti, expiresAt)
+}
+
+func (b *blacklist) Contains(ctx context.Context, jti token.JTI) (_ bool, err error) {
+	defer func(start time.Time) { b.m.observeRepository("blacklist", "Contains", start, err) }(time.Now())
+	return b.next.Contains(ctx, jti)
+}
+
+type hasher struct {
+	next token.Hasher
+	m    *Metrics
+}
+
+func (m *Metrics) Hasher(h token.Hasher) token.Hasher {
+	return &hasher{next: h, m: m}
+}
+
+func (h *hasher) Hash(t token.EncodedToken) (token.TokenHash, error) {
+	defer func(start time.Time) { h.m.hashLatency.Observe(time.Since(start).Seconds()) }(time.Now())
+	return h.next.Hash(t)
+}
@@ -0,0 +1,23 @@
+package metrics
+
+import (
+	"context"
+	"medods-auth/service/events"
+)
+
+// Subscribe counts suspicious activity, session revocations, login failures
+// and lockouts published on s.
+func (m *Metrics) Subscribe(s events.Subscriber) {
+	events.On(s, func(_ context.Context, e events.SuspiciousActivity) {
+		m.suspicious.WithLabelValues(e.Kind).Inc()
+	})
+	events.On(s, func(_ context.Context, e events.SessionRevoked) {
+		m.sessionsRevoked.WithLabelValues(e.Reason).Inc()
+	})
+	events.On(s, func(_ context.Context, e events.LoginFailed) {
+		m.loginFailures.WithLabelValues(e.Method).Inc()
+	})
+	events.On(s, func(_ context.Context, e events.LockedOut) {
+		m.lockouts.WithLabelValues(e.Scope).Inc()
+	})
+}
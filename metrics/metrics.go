@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "jwt_auth"
+
+type Operation string
+
+const (
+	OpIssued    Operation = "issued"
+	OpRefreshed Operation = "refreshed"
+	OpRevoked   Operation = "revoked"
+)
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	tokens             *prometheus.CounterVec
+	validationFailures *prometheus.CounterVec
+	handlerLatency     *prometheus.HistogramVec
+	hashLatency        prometheus.Histogram
+	repositoryLatency  *prometheus.HistogramVec
+	suspicious         *prometheus.CounterVec
+	sessionsRevoked    *prometheus.CounterVec
+	loginFailures      *prometheus.CounterVec
+	lockouts           *prometheus.CounterVec
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		tokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tokens_total",
+			Help:      "Token pairs issued, refreshed and revoked.",
+		}, []string{"operation"}),
+		validationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "validation_failures_total",
+			Help:      "Rejected requests by auth error code.",
+		}, []string{"route", "code"}),
+		handlerLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP handler latency.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		hashLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "hash_duration_seconds",
+			Help:      "Refresh token hashing time.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 10),
+		}),
+		repositoryLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "repository_duration_seconds",
+			Help:      "Storage call latency per repository method.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"repository", "method", "outcome"}),
+		suspicious: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "suspicious_activity_total",
+			Help:      "Suspicious activity detected by kind.",
+		}, []string{"kind"}),
+		sessionsRevoked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sessions_revoked_total",
+			Help:      "Revocations of all sessions of a user by reason.",
+		}, []string{"reason"}),
+		loginFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "login_failures_total",
+			Help:      "Wrong passwords and MFA codes by method.",
+		}, []string{"method"}),
+		lockouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "lockouts_total",
+			Help:      "Lockouts after failed logins by scope.",
+		}, []string{"scope"}),
+	}
+
+	for _, op := range []Operation{OpIssued, OpRefreshed, OpRevoked} {
+		m.tokens.WithLabelValues(string(op))
+	}
+	m.registry.MustRegister(
+		m.tokens,
+		m.validationFailures,
+		m.handlerLatency,
+		m.hashLatency,
+		m.repositoryLatency,
+		m.suspicious,
+		m.sessionsRevoked,
+		m.loginFailures,
+		m.lockouts,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// RegisterDBStats exports connection pool gauges of db labeled with name.
+func (m *Metrics) RegisterDBStats(db *sql.DB, name string) error {
+	return m.registry.Register(collectors.NewDBStatsCollector(db, name))
+}
+
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
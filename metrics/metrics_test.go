@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"context"
+	"medods-auth/persistance/memory"
+	"medods-auth/persistance/sqlite"
+	"medods-auth/service/auth"
+	"medods-auth/service/outbox"
+	"medods-auth/token"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecorators(t *testing.T) {
+	assert := assert.New(t)
+	m := New()
+	ctx := context.Background()
+
+	plain := m.HashRepository(memory.NewHashRepository(memory.Options{}))
+	_, rotates := auth.As[auth.TokenRotator](plain)
+	assert.False(rotates, "decorator must not invent a rotator")
+	_, writesOutbox := auth.As[auth.OutboxWriter](plain)
+	assert.False(writesOutbox, "decorator must not invent an outbox")
+	_, limits := auth.As[auth.SessionLimiter](plain)
+	assert.True(limits, "decorator must keep the session limiter")
+
+	db, err := sqlite.InitDatabase(&sqlite.SQLiteConfig{Path: sqlite.InMemory})
+	assert.NoError(err)
+	defer db.Close()
+	transactional := m.HashRepository(sqlite.NewHashRepository(db))
+	_, rotates = auth.As[auth.TokenRotator](transactional)
+	_, writesOutbox = auth.As[auth.OutboxWriter](transactional)
+	_, limits = auth.As[auth.SessionLimiter](transactional)
+	assert.True(rotates && writesOutbox && limits, "decorator must keep the rotator, outbox and session limiter")
+
+	_, writesOutbox = auth.As[auth.OutboxWriter](m.HashRepository(outboxOnly{memory.NewHashRepository(memory.Options{})}))
+	assert.True(writesOutbox, "decorator must keep the outbox of repositories without a rotator")
+
+	bl := m.Blacklist(memory.NewBlackListRepository(memory.Options{}))
+	assert.Nil(bl.Add(ctx, uuid.New(), time.Now().Add(time.Hour)))
+	_, err = plain.Get(ctx, uuid.New())
+	assert.Equal(auth.ErrRefreshTokenNotFound, err)
+
+	_, err = m.Hasher(token.BcryptHasher{}).Hash("token")
+	assert.Nil(err)
+
+	assert.Equal(1, testutil.CollectAndCount(m.hashLatency))
+	// blacklist Add ok, token Get not_found
+	assert.Equal(2, testutil.CollectAndCount(m.repositoryLatency))
+}
+
+// outboxOnly writes an outbox but can't rotate.
+type outboxOnly struct {
+	*memory.HashRepository
+}
+
+func (outboxOnly) StoreWithOutbox(context.Context, *auth.RefreshTokenRecord, []outbox.Message) error {
+	return nil
+}
+
+func (outboxOnly) DeleteWithOutbox(context.Context, token.JTI, []outbox.Message) error {
+	return nil
+}
+
+func (outboxOnly) DeleteByUserIdWithOutbox(context.Context, uuid.UUID, []outbox.Message) error {
+	return nil
+}
+
+func (outboxOnly) DeleteByClientWithOutbox(context.Context, uuid.UUID, string, []outbox.Message) error {
+	return nil
+}
+
+func TestMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.TestMode)
+	m := New()
+
+	router := gin.New()
+	router.Use(m.Middleware())
+	router.GET("/metrics", gin.WrapH(m.Handler()))
+	router.GET("/login", m.Count(OpIssued), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	router.POST("/refresh", m.Count(OpRefreshed), func(c *gin.Context) {
+		c.Error(auth.ErrUserAgentChanged)
+		c.Status(http.StatusUnauthorized)
+	})
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/login", nil),
+		httptest.NewRequest(http.MethodGet, "/login", nil),
+		httptest.NewRequest(http.MethodPost, "/refresh", nil),
+	} {
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(float64(2), testutil.ToFloat64(m.tokens.WithLabelValues(string(OpIssued))))
+	assert.Equal(float64(0), testutil.ToFloat64(m.tokens.WithLabelValues(string(OpRefreshed))))
+	assert.Equal(float64(1), testutil.ToFloat64(m.validationFailures.WithLabelValues("/refresh", "user_agent_changed")))
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.True(strings.Contains(rec.Body.String(), `jwt_auth_tokens_total{operation="issued"} 2`))
+	assert.True(strings.Contains(rec.Body.String(), `jwt_auth_http_request_duration_seconds_count{method="POST",route="/refresh",status="401"} 1`))
+}
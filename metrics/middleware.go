@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"medods-auth/service/auth"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Middleware records handler latency and, for requests rejected by the
+// auth service, the error code handlers attach with c.Error.
+func (m *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := c.Writer.Status()
+		m.handlerLatency.
+			WithLabelValues(route, c.Request.Method, strconv.Itoa(status)).
+			Observe(time.Since(start).Seconds())
+
+		if status >= http.StatusBadRequest && status < http.StatusInternalServerError {
+			if err := c.Errors.Last(); err != nil {
+				m.validationFailures.WithLabelValues(route, auth.ErrorCode(err.Err)).Inc()
+			}
+		}
+	}
+}
+
+// Count increments the op counter when the handler that follows succeeds.
+// It is a no-op on nil Metrics.
+func (m *Metrics) Count(op Operation) gin.HandlerFunc {
+	if m == nil {
+		return func(c *gin.Context) { c.Next() }
+	}
+	counter := m.tokens.WithLabelValues(string(op))
+	return func(c *gin.Context) {
+		c.Next()
+		if status := c.Writer.Status(); status >= 200 && status < 300 {
+			counter.Inc()
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"medods-auth/token"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+type BlacklistRepository struct {
+	db *bbolt.DB
+}
+
+func NewBlackListRepository(db *bbolt.DB) *BlacklistRepository {
+	return &BlacklistRepository{
+		db,
+	}
+}
+
+func (repo *BlacklistRepository) Add(ctx context.Context, jti token.JTI, expiresAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return repo.db.Update(func(tx *bbolt.Tx) error {
+		return addToBlacklist(tx, jti, expiresAt)
+	})
+}
+
+func (repo *BlacklistRepository) Contains(ctx context.Context, jti token.JTI) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	var found bool
+	var expiresAt time.Time
+	err := repo.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(bucketBlacklist).Get(jti[:])
+		found = v != nil
+		expiresAt = decodeExpiry(v)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return found && !expired(expiresAt, time.Now()), nil
+}
+
+func addToBlacklist(tx *bbolt.Tx, jti token.JTI, expiresAt time.Time) error {
+	b := tx.Bucket(bucketBlacklist)
+	next := encodeExpiry(expiresAt)
+	if current := b.Get(jti[:]); current != nil {
+		// keep the later of the two expiries, zero never expires
+		if decodeExpiry(current).IsZero() {
+			return nil
+		}
+		if !expiresAt.IsZero() && bytes.Compare(current, next) >= 0 {
+			return nil
+		}
+	}
+	return b.Put(jti[:], next)
+}
@@ -0,0 +1,152 @@
+package bolt
+
+import (
+	"encoding/json"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Compactor periodically removes expired tokens, blacklist entries and
+// WebAuthn challenges.
+// Expired entries are never returned by the repositories either way.
+type Compactor struct {
+	db   *bbolt.DB
+	stop chan struct{}
+	done chan struct{}
+}
+
+func StartCompactor(db *bbolt.DB, interval time.Duration) *Compactor {
+	c := &Compactor{
+		db:   db,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if interval <= 0 {
+		close(c.done)
+		return c
+	}
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				c.Compact(now)
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (c *Compactor) Close() error {
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+	<-c.done
+	return nil
+}
+
+// Compact deletes every entry expired at now and returns how many were removed.
+func (c *Compactor) Compact(now time.Time) (int, error) {
+	removed := 0
+	err := c.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		removed, err = compactTokens(tx, now)
+		if err != nil {
+			return err
+		}
+
+		blacklist := tx.Bucket(bucketBlacklist)
+		var stale [][]byte
+		err = blacklist.ForEach(func(jti, v []byte) error {
+			if expired(decodeExpiry(v), now) {
+				stale = append(stale, jti)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, jti := range stale {
+			if err := blacklist.Delete(jti); err != nil {
+				return err
+			}
+		}
+		removed += len(stale)
+
+		n, err := compactChallenges(tx, now)
+		removed += n
+		return err
+	})
+	return removed, err
+}
+
+func compactChallenges(tx *bbolt.Tx, now time.Time) (int, error) {
+	challenges := tx.Bucket(bucketChallenges)
+	var stale [][]byte
+	err := challenges.ForEach(func(k, data []byte) error {
+		var rec challengeBoltRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		if expired(rec.ExpiresAt, now) {
+			stale = append(stale, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range stale {
+		if err := challenges.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	return len(stale), nil
+}
+
+func compactTokens(tx *bbolt.Tx, now time.Time) (int, error) {
+	tokens := tx.Bucket(bucketTokens)
+	users := tx.Bucket(bucketUserTokens)
+
+	type entry struct{ jti, userID []byte }
+	var stale []entry
+	err := tokens.ForEach(func(jti, data []byte) error {
+		var rec tokenBoltRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		if expired(rec.ExpiresAt, now) {
+			stale = append(stale, entry{jti, rec.UserID[:]})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, e := range stale {
+		if err := tokens.Delete(e.jti); err != nil {
+			return 0, err
+		}
+		index := users.Bucket(e.userID)
+		if index == nil {
+			continue
+		}
+		if err := index.Delete(e.jti); err != nil {
+			return 0, err
+		}
+		if k, _ := index.Cursor().First(); k == nil {
+			if err := users.DeleteBucket(e.userID); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(stale), nil
+}
@@ -0,0 +1,65 @@
+package bolt
+
+import (
+	"context"
+	"medods-auth/service/auth"
+	"medods-auth/user"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+)
+
+func TestCompact(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, err := InitDatabase(&BoltConfig{Path: filepath.Join(t.TempDir(), "test.db")})
+	assert.Nil(err)
+	defer db.Close()
+
+	repo := NewHashRepository(db)
+	blacklist := NewBlackListRepository(db)
+	now := time.Now()
+	userID := uuid.New()
+	record := func(ttl time.Duration) *auth.RefreshTokenRecord {
+		return &auth.RefreshTokenRecord{
+			JTI:       uuid.New(),
+			User:      user.User{Id: userID},
+			Hash:      []byte("hash"),
+			CreatedAt: now,
+			ExpiresAt: now.Add(ttl),
+		}
+	}
+	stale, live := record(time.Minute), record(time.Hour)
+	assert.Nil(repo.Store(ctx, stale))
+	assert.Nil(repo.Store(ctx, live))
+	assert.Nil(blacklist.Add(ctx, uuid.New(), now.Add(time.Minute)))
+	assert.Nil(blacklist.Add(ctx, uuid.New(), time.Time{}))
+
+	c := StartCompactor(db, 0)
+	defer c.Close()
+	removed, err := c.Compact(now.Add(2 * time.Minute))
+	assert.Nil(err)
+	assert.Equal(2, removed)
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		assert.Equal(1, tx.Bucket(bucketTokens).Stats().KeyN)
+		assert.Equal(1, tx.Bucket(bucketBlacklist).Stats().KeyN)
+		assert.Nil(tx.Bucket(bucketUserTokens).Bucket(userID[:]).Get(stale.JTI[:]))
+		assert.NotNil(tx.Bucket(bucketUserTokens).Bucket(userID[:]).Get(live.JTI[:]))
+		return nil
+	})
+	assert.Nil(err)
+
+	removed, err = c.Compact(now.Add(2 * time.Hour))
+	assert.Nil(err)
+	assert.Equal(1, removed)
+	err = db.View(func(tx *bbolt.Tx) error {
+		assert.Nil(tx.Bucket(bucketUserTokens).Bucket(userID[:]))
+		return nil
+	})
+	assert.Nil(err)
+}
@@ -0,0 +1,275 @@
+package bolt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"medods-auth/service/auth"
+	"medods-auth/token"
+	"medods-auth/user"
+	"time"
+
+	"github.com/google/uuid"
+	"go.etcd.io/bbolt"
+)
+
+var ErrDuplicateJTI = errors.New("refresh token record already exists")
+
+type HashRepository struct {
+	db *bbolt.DB
+}
+
+func NewHashRepository(db *bbolt.DB) *HashRepository {
+	return &HashRepository{
+		db,
+	}
+}
+
+type tokenBoltRecord struct {
+	UserID    uuid.UUID `json:"user_id"`
+	UserAgent string    `json:"user_agent"`
+	Hash      []byte    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	StartedAt time.Time `json:"started_at"`
+	ClientID  string    `json:"client_id,omitempty"`
+}
+
+func boltRecordFromAuthRecord(in auth.RefreshTokenRecord) *tokenBoltRecord {
+	return &tokenBoltRecord{
+		UserID:    in.User.Id,
+		UserAgent: in.User.UserAgent,
+		Hash:      in.Hash,
+		CreatedAt: in.CreatedAt,
+		ExpiresAt: in.ExpiresAt,
+		StartedAt: in.StartedAt,
+		ClientID:  in.ClientID,
+	}
+}
+
+func (r *tokenBoltRecord) toAuthRecord(jti token.JTI) *auth.RefreshTokenRecord {
+	return &auth.RefreshTokenRecord{
+		JTI: jti,
+		User: user.User{
+			Id:        r.UserID,
+			UserAgent: r.UserAgent,
+		},
+		Hash:      r.Hash,
+		CreatedAt: r.CreatedAt,
+		ExpiresAt: r.ExpiresAt,
+		StartedAt: r.StartedAt,
+		ClientID:  r.ClientID,
+	}
+}
+
+func (r *HashRepository) Store(ctx context.Context, rec *auth.RefreshTokenRecord) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return storeRecord(tx, rec)
+	})
+}
+
+func (r *HashRepository) Get(ctx context.Context, jti token.JTI) (*auth.RefreshTokenRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var record tokenBoltRecord
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(bucketTokens).Get(jti[:])
+		if data == nil {
+			return auth.ErrRefreshTokenNotFound
+		}
+		return json.Unmarshal(data, &record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if expired(record.ExpiresAt, time.Now()) {
+		return nil, auth.ErrRefreshTokenNotFound
+	}
+	return record.toAuthRecord(jti), nil
+}
+
+func (r *HashRepository) Delete(ctx context.Context, jti token.JTI) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(bucketTokens).Get(jti[:])
+		if data == nil {
+			return auth.ErrRefreshTokenNotFound
+		}
+		var record tokenBoltRecord
+		err := json.Unmarshal(data, &record)
+		if err != nil {
+			return err
+		}
+		return deleteRecord(tx, record.UserID, jti)
+	})
+}
+
+func (r *HashRepository) DeleteByUserId(ctx context.Context, userId uuid.UUID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return deleteUserRecords(tx, userId)
+	})
+}
+
+func (r *HashRepository) DeleteByClient(ctx context.Context, userId uuid.UUID, clientID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		records, err := userRecords(tx, userId, time.Now())
+		if err != nil {
+			return err
+		}
+		for _, rec := range records {
+			if rec.ClientID != clientID {
+				continue
+			}
+			err = deleteRecord(tx, userId, rec.JTI)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Rotate applies the whole rotation in one bolt transaction, so a crash
+// leaves either the old session or the new one, never both or neither,
+// and concurrent rotations of the same record see each other.
+func (r *HashRepository) Rotate(ctx context.Context, rot auth.Rotation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		if rot.Revoked != uuid.Nil {
+			err := addToBlacklist(tx, rot.Revoked, rot.RevokedExpiresAt)
+			if err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(bucketTokens).Get(rot.Previous[:]) == nil {
+			return auth.ErrRefreshTokenNotFound
+		}
+		err := deleteRecord(tx, rot.UserID, rot.Previous)
+		if err != nil {
+			return err
+		}
+		return storeRecord(tx, rot.Next)
+	})
+}
+
+// StoreSession evicts and stores in one bolt transaction.
+func (r *HashRepository) StoreSession(ctx context.Context, ns auth.NewSession) ([]auth.RefreshTokenRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var evicted []auth.RefreshTokenRecord
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		sessions, err := userRecords(tx, ns.Record.User.Id, time.Now())
+		if err != nil {
+			return err
+		}
+		evicted, err = ns.Limit.Evict(sessions)
+		if err != nil {
+			return err
+		}
+		for _, rec := range evicted {
+			err = deleteRecord(tx, rec.User.Id, rec.JTI)
+			if err != nil {
+				return err
+			}
+		}
+		return storeRecord(tx, ns.Record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return evicted, nil
+}
+
+// userRecords returns the live records of a user.
+func userRecords(tx *bbolt.Tx, userID uuid.UUID, now time.Time) ([]auth.RefreshTokenRecord, error) {
+	index := tx.Bucket(bucketUserTokens).Bucket(userID[:])
+	if index == nil {
+		return nil, nil
+	}
+	tokens := tx.Bucket(bucketTokens)
+	var out []auth.RefreshTokenRecord
+	err := index.ForEach(func(k, _ []byte) error {
+		jti, err := uuid.FromBytes(k)
+		if err != nil {
+			return err
+		}
+		data := tokens.Get(k)
+		if data == nil {
+			return nil
+		}
+		var record tokenBoltRecord
+		err = json.Unmarshal(data, &record)
+		if err != nil {
+			return err
+		}
+		if !expired(record.ExpiresAt, now) {
+			out = append(out, *record.toAuthRecord(jti))
+		}
+		return nil
+	})
+	return out, err
+}
+
+func deleteRecord(tx *bbolt.Tx, userID uuid.UUID, jti token.JTI) error {
+	err := tx.Bucket(bucketTokens).Delete(jti[:])
+	if err != nil {
+		return err
+	}
+	if index := tx.Bucket(bucketUserTokens).Bucket(userID[:]); index != nil {
+		return index.Delete(jti[:])
+	}
+	return nil
+}
+
+func storeRecord(tx *bbolt.Tx, rec *auth.RefreshTokenRecord) error {
+	tokens := tx.Bucket(bucketTokens)
+	if tokens.Get(rec.JTI[:]) != nil {
+		return ErrDuplicateJTI
+	}
+	data, err := json.Marshal(boltRecordFromAuthRecord(*rec))
+	if err != nil {
+		return err
+	}
+	err = tokens.Put(rec.JTI[:], data)
+	if err != nil {
+		return err
+	}
+
+	index, err := tx.Bucket(bucketUserTokens).CreateBucketIfNotExists(rec.User.Id[:])
+	if err != nil {
+		return err
+	}
+	return index.Put(rec.JTI[:], encodeExpiry(rec.ExpiresAt))
+}
+
+func deleteUserRecords(tx *bbolt.Tx, userID uuid.UUID) error {
+	users := tx.Bucket(bucketUserTokens)
+	index := users.Bucket(userID[:])
+	if index == nil {
+		return nil
+	}
+	tokens := tx.Bucket(bucketTokens)
+	err := index.ForEach(func(jti, _ []byte) error {
+		return tokens.Delete(jti)
+	})
+	if err != nil {
+		return err
+	}
+	return users.DeleteBucket(userID[:])
+}
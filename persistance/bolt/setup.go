@@ -0,0 +1,98 @@
+package bolt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	bucketTokens     = []byte("tokens")
+	bucketBlacklist  = []byte("blacklist")
+	bucketUserTokens = []byte("user_tokens")
+	bucketUsers      = []byte("users")
+	bucketLogins     = []byte("logins")
+	// bucketUserPasskeys holds a bucket of passkey IDs per user.
+	bucketPasskeys     = []byte("passkeys")
+	bucketUserPasskeys = []byte("user_passkeys")
+	bucketChallenges   = []byte("webauthn_challenges")
+	bucketClients      = []byte("oauth_clients")
+	bucketAuthCodes    = []byte("oauth_codes")
+	bucketUserConsents = []byte("user_consents")
+	// bucketUserCodes maps user codes to the hash of their device code.
+	bucketDeviceCodes = []byte("oauth_device_codes")
+	bucketUserCodes   = []byte("oauth_user_codes")
+)
+
+type BoltConfig struct {
+	Path string
+
+	// CompactionInterval controls how often expired entries are removed,
+	// zero disables background compaction.
+	CompactionInterval time.Duration
+	OpenTimeout        *time.Duration
+}
+
+func InitDatabase(conf *BoltConfig) (*bbolt.DB, error) {
+	err := conf.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := 5 * time.Second
+	if conf.OpenTimeout != nil {
+		timeout = *conf.OpenTimeout
+	}
+	db, err := bbolt.Open(conf.Path, 0600, &bbolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt database: %w", err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{bucketTokens, bucketBlacklist, bucketUserTokens, bucketUsers, bucketLogins, bucketPasskeys, bucketUserPasskeys, bucketChallenges, bucketClients, bucketAuthCodes, bucketUserConsents, bucketDeviceCodes, bucketUserCodes} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (c *BoltConfig) validate() error {
+	if c.Path == "" {
+		return errors.New("empty bolt database path")
+	}
+	return nil
+}
+
+// Expiries are stored as big-endian unix milliseconds, zero meaning none.
+func encodeExpiry(t time.Time) []byte {
+	buf := make([]byte, 8)
+	if !t.IsZero() {
+		binary.BigEndian.PutUint64(buf, uint64(t.UnixMilli()))
+	}
+	return buf
+}
+
+func decodeExpiry(b []byte) time.Time {
+	if len(b) != 8 {
+		return time.Time{}
+	}
+	ms := binary.BigEndian.Uint64(b)
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(int64(ms))
+}
+
+func expired(expiresAt, now time.Time) bool {
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
@@ -0,0 +1,940 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"medods-auth/service/auth"
+	"medods-auth/user"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"go.etcd.io/bbolt"
+)
+
+type UserRepository struct {
+	db *bbolt.DB
+}
+
+func NewUserRepository(db *bbolt.DB) *UserRepository {
+	return &UserRepository{
+		db,
+	}
+}
+
+type userBoltRecord struct {
+	Status    user.Status `json:"status"`
+	CreatedAt time.Time   `json:"created_at"`
+
+	Login        string `json:"login,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+
+	TOTP *totpBoltRecord `json:"totp,omitempty"`
+}
+
+type totpBoltRecord struct {
+	Secret        string   `json:"secret"`
+	Active        bool     `json:"active"`
+	LastStep      int64    `json:"last_step"`
+	RecoveryCodes []string `json:"recovery_codes"`
+	Version       int64    `json:"version"`
+}
+
+func (r *UserRepository) Create(ctx context.Context, account *user.Account) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		users := tx.Bucket(bucketUsers)
+		if users.Get(account.Id[:]) != nil {
+			return auth.ErrUserExists
+		}
+		return putUser(users, account.Id, userBoltRecord{
+			Status:    account.Status,
+			CreatedAt: account.CreatedAt,
+		})
+	})
+}
+
+func (r *UserRepository) Get(ctx context.Context, id uuid.UUID) (*user.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var record userBoltRecord
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		return getUser(tx.Bucket(bucketUsers), id, &record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user.Account{
+		Id:        id,
+		Status:    record.Status,
+		CreatedAt: record.CreatedAt,
+	}, nil
+}
+
+func (r *UserRepository) SetStatus(ctx context.Context, id uuid.UUID, status user.Status) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		users := tx.Bucket(bucketUsers)
+		var record userBoltRecord
+		err := getUser(users, id, &record)
+		if err != nil {
+			return err
+		}
+		record.Status = status
+		return putUser(users, id, record)
+	})
+}
+
+func (r *UserRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		users := tx.Bucket(bucketUsers)
+		var record userBoltRecord
+		err := getUser(users, id, &record)
+		if err != nil {
+			return err
+		}
+		if record.Login != "" {
+			err = tx.Bucket(bucketLogins).Delete([]byte(record.Login))
+			if err != nil {
+				return err
+			}
+		}
+		err = deleteUserPasskeys(tx, id)
+		if err != nil {
+			return err
+		}
+		consents := tx.Bucket(bucketUserConsents)
+		if consents.Bucket(id[:]) != nil {
+			err = consents.DeleteBucket(id[:])
+			if err != nil {
+				return err
+			}
+		}
+		return users.Delete(id[:])
+	})
+}
+
+func (r *UserRepository) SetCredential(ctx context.Context, cred auth.Credential) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		users := tx.Bucket(bucketUsers)
+		logins := tx.Bucket(bucketLogins)
+		if owner := logins.Get([]byte(cred.Login)); owner != nil && !bytes.Equal(owner, cred.UserID[:]) {
+			return auth.ErrLoginTaken
+		}
+		var record userBoltRecord
+		err := getUser(users, cred.UserID, &record)
+		if err != nil {
+			return err
+		}
+		if record.Login != "" {
+			err = logins.Delete([]byte(record.Login))
+			if err != nil {
+				return err
+			}
+		}
+		record.Login = cred.Login
+		record.PasswordHash = cred.Hash
+		err = logins.Put([]byte(cred.Login), cred.UserID[:])
+		if err != nil {
+			return err
+		}
+		return putUser(users, cred.UserID, record)
+	})
+}
+
+func (r *UserRepository) GetCredential(ctx context.Context, login string) (*auth.Credential, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var cred *auth.Credential
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		owner := tx.Bucket(bucketLogins).Get([]byte(login))
+		if owner == nil {
+			return auth.ErrCredentialNotFound
+		}
+		id, err := uuid.FromBytes(owner)
+		if err != nil {
+			return err
+		}
+		var record userBoltRecord
+		err = getUser(tx.Bucket(bucketUsers), id, &record)
+		if err != nil {
+			return err
+		}
+		cred = &auth.Credential{UserID: id, Login: record.Login, Hash: record.PasswordHash}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+func (r *UserRepository) GetUserCredential(ctx context.Context, userID uuid.UUID) (*auth.Credential, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var record userBoltRecord
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		return getUser(tx.Bucket(bucketUsers), userID, &record)
+	})
+	if err == auth.ErrUserNotFound || (err == nil && record.Login == "") {
+		return nil, auth.ErrCredentialNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &auth.Credential{UserID: userID, Login: record.Login, Hash: record.PasswordHash}, nil
+}
+
+func (r *UserRepository) UpdateCredentialHash(ctx context.Context, userID uuid.UUID, old, new string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		users := tx.Bucket(bucketUsers)
+		var record userBoltRecord
+		err := getUser(users, userID, &record)
+		if err == auth.ErrUserNotFound {
+			return nil
+		}
+		if err != nil || record.PasswordHash != old {
+			return err
+		}
+		record.PasswordHash = new
+		return putUser(users, userID, record)
+	})
+}
+
+func (r *UserRepository) GetTOTP(ctx context.Context, userID uuid.UUID) (*auth.TOTP, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var record userBoltRecord
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		return getUser(tx.Bucket(bucketUsers), userID, &record)
+	})
+	if err == auth.ErrUserNotFound || (err == nil && record.TOTP == nil) {
+		return nil, auth.ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &auth.TOTP{
+		UserID:        userID,
+		Secret:        record.TOTP.Secret,
+		Active:        record.TOTP.Active,
+		LastStep:      record.TOTP.LastStep,
+		RecoveryCodes: record.TOTP.RecoveryCodes,
+		Version:       record.TOTP.Version,
+	}, nil
+}
+
+func (r *UserRepository) PutTOTP(ctx context.Context, t *auth.TOTP) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		users := tx.Bucket(bucketUsers)
+		var record userBoltRecord
+		err := getUser(users, t.UserID, &record)
+		if err != nil {
+			return err
+		}
+		var version int64
+		if record.TOTP != nil {
+			version = record.TOTP.Version
+		}
+		if version != t.Version-1 {
+			return auth.ErrTOTPConflict
+		}
+		record.TOTP = &totpBoltRecord{
+			Secret:        t.Secret,
+			Active:        t.Active,
+			LastStep:      t.LastStep,
+			RecoveryCodes: t.RecoveryCodes,
+			Version:       t.Version,
+		}
+		return putUser(users, t.UserID, record)
+	})
+}
+
+func (r *UserRepository) DeleteTOTP(ctx context.Context, userID uuid.UUID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		users := tx.Bucket(bucketUsers)
+		var record userBoltRecord
+		err := getUser(users, userID, &record)
+		if err == auth.ErrUserNotFound || (err == nil && record.TOTP == nil) {
+			return auth.ErrTOTPNotEnrolled
+		}
+		if err != nil {
+			return err
+		}
+		record.TOTP = nil
+		return putUser(users, userID, record)
+	})
+}
+
+type passkeyBoltRecord struct {
+	UserID     uuid.UUID `json:"user_id"`
+	PublicKey  []byte    `json:"public_key"`
+	SignCount  uint32    `json:"sign_count"`
+	Transports []string  `json:"transports,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (rec passkeyBoltRecord) toPasskey(id []byte) auth.Passkey {
+	return auth.Passkey{
+		ID:         bytes.Clone(id),
+		UserID:     rec.UserID,
+		PublicKey:  rec.PublicKey,
+		SignCount:  rec.SignCount,
+		Transports: rec.Transports,
+		CreatedAt:  rec.CreatedAt,
+	}
+}
+
+type challengeBoltRecord struct {
+	UserID    uuid.UUID     `json:"user_id"`
+	Ceremony  auth.Ceremony `json:"ceremony"`
+	ExpiresAt time.Time     `json:"expires_at"`
+}
+
+func (r *UserRepository) AddPasskey(ctx context.Context, p *auth.Passkey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(bucketUsers).Get(p.UserID[:]) == nil {
+			return auth.ErrUserNotFound
+		}
+		passkeys := tx.Bucket(bucketPasskeys)
+		if passkeys.Get(p.ID) != nil {
+			return auth.ErrPasskeyExists
+		}
+		err := putPasskey(passkeys, p.ID, passkeyBoltRecord{
+			UserID:     p.UserID,
+			PublicKey:  p.PublicKey,
+			SignCount:  p.SignCount,
+			Transports: p.Transports,
+			CreatedAt:  p.CreatedAt,
+		})
+		if err != nil {
+			return err
+		}
+		index, err := tx.Bucket(bucketUserPasskeys).CreateBucketIfNotExists(p.UserID[:])
+		if err != nil {
+			return err
+		}
+		return index.Put(p.ID, nil)
+	})
+}
+
+func (r *UserRepository) GetPasskey(ctx context.Context, id []byte) (*auth.Passkey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var record passkeyBoltRecord
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		return getPasskey(tx.Bucket(bucketPasskeys), id, &record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	p := record.toPasskey(id)
+	return &p, nil
+}
+
+func (r *UserRepository) ListPasskeys(ctx context.Context, userID uuid.UUID) ([]auth.Passkey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var out []auth.Passkey
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		index := tx.Bucket(bucketUserPasskeys).Bucket(userID[:])
+		if index == nil {
+			return nil
+		}
+		passkeys := tx.Bucket(bucketPasskeys)
+		return index.ForEach(func(id, _ []byte) error {
+			var record passkeyBoltRecord
+			err := getPasskey(passkeys, id, &record)
+			if err != nil {
+				return err
+			}
+			out = append(out, record.toPasskey(id))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(out, func(a, b auth.Passkey) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return out, nil
+}
+
+func (r *UserRepository) UpdateSignCount(ctx context.Context, id []byte, old, new uint32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		passkeys := tx.Bucket(bucketPasskeys)
+		var record passkeyBoltRecord
+		err := getPasskey(passkeys, id, &record)
+		if err != nil {
+			return err
+		}
+		if record.SignCount != old {
+			return auth.ErrPasskeySignCount
+		}
+		record.SignCount = new
+		return putPasskey(passkeys, id, record)
+	})
+}
+
+func (r *UserRepository) PutChallenge(ctx context.Context, c *auth.Challenge) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(challengeBoltRecord{
+		UserID:    c.UserID,
+		Ceremony:  c.Ceremony,
+		ExpiresAt: c.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketChallenges).Put(c.Value, data)
+	})
+}
+
+func (r *UserRepository) TakeChallenge(ctx context.Context, value []byte) (*auth.Challenge, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var record challengeBoltRecord
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		challenges := tx.Bucket(bucketChallenges)
+		data := challenges.Get(value)
+		if data == nil {
+			return auth.ErrChallengeNotFound
+		}
+		err := json.Unmarshal(data, &record)
+		if err != nil {
+			return err
+		}
+		return challenges.Delete(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if expired(record.ExpiresAt, time.Now()) {
+		return nil, auth.ErrChallengeNotFound
+	}
+	return &auth.Challenge{
+		Value:     bytes.Clone(value),
+		UserID:    record.UserID,
+		Ceremony:  record.Ceremony,
+		ExpiresAt: record.ExpiresAt,
+	}, nil
+}
+
+type clientBoltRecord struct {
+	Name                   string        `json:"name,omitempty"`
+	SecretHash             string        `json:"secret_hash,omitempty"`
+	Public                 bool          `json:"public,omitempty"`
+	Scopes                 []string      `json:"scopes,omitempty"`
+	RedirectURIs           []string      `json:"redirect_uris,omitempty"`
+	PostLogoutRedirectURIs []string      `json:"post_logout_redirect_uris,omitempty"`
+	AccessTTL              time.Duration `json:"access_ttl,omitempty"`
+	CreatedAt              time.Time     `json:"created_at"`
+}
+
+func (r *UserRepository) CreateClient(ctx context.Context, c *auth.Client) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(clientBoltRecord{
+		Name:                   c.Name,
+		SecretHash:             c.SecretHash,
+		Public:                 c.Public,
+		Scopes:                 c.Scopes,
+		RedirectURIs:           c.RedirectURIs,
+		PostLogoutRedirectURIs: c.PostLogoutRedirectURIs,
+		AccessTTL:              c.AccessTTL,
+		CreatedAt:              c.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		clients := tx.Bucket(bucketClients)
+		if clients.Get([]byte(c.ID)) != nil {
+			return auth.ErrClientExists
+		}
+		return clients.Put([]byte(c.ID), data)
+	})
+}
+
+func (r *UserRepository) GetClient(ctx context.Context, id string) (*auth.Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var record clientBoltRecord
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(bucketClients).Get([]byte(id))
+		if data == nil {
+			return auth.ErrClientNotFound
+		}
+		return json.Unmarshal(data, &record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &auth.Client{
+		ID:                     id,
+		Name:                   record.Name,
+		SecretHash:             record.SecretHash,
+		Public:                 record.Public,
+		Scopes:                 record.Scopes,
+		RedirectURIs:           record.RedirectURIs,
+		PostLogoutRedirectURIs: record.PostLogoutRedirectURIs,
+		AccessTTL:              record.AccessTTL,
+		CreatedAt:              record.CreatedAt,
+	}, nil
+}
+
+func (r *UserRepository) DeleteClient(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		clients := tx.Bucket(bucketClients)
+		if clients.Get([]byte(id)) == nil {
+			return auth.ErrClientNotFound
+		}
+		return clients.Delete([]byte(id))
+	})
+}
+
+type authCodeBoltRecord struct {
+	ClientID      string    `json:"client_id"`
+	UserID        uuid.UUID `json:"user_id"`
+	RedirectURI   string    `json:"redirect_uri,omitempty"`
+	Scope         string    `json:"scope,omitempty"`
+	CodeChallenge string    `json:"code_challenge"`
+	Nonce         string    `json:"nonce,omitempty"`
+	AMR           []string  `json:"amr,omitempty"`
+	AuthTime      time.Time `json:"auth_time"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// PutAuthCode also drops expired codes, which are never taken otherwise.
+func (r *UserRepository) PutAuthCode(ctx context.Context, c *auth.AuthCode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(authCodeBoltRecord{
+		ClientID:      c.ClientID,
+		UserID:        c.UserID,
+		RedirectURI:   c.RedirectURI,
+		Scope:         c.Scope,
+		CodeChallenge: c.CodeChallenge,
+		Nonce:         c.Nonce,
+		AMR:           c.AMR,
+		AuthTime:      c.AuthTime,
+		ExpiresAt:     c.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		codes := tx.Bucket(bucketAuthCodes)
+		var stale [][]byte
+		err := codes.ForEach(func(k, v []byte) error {
+			var record authCodeBoltRecord
+			if json.Unmarshal(v, &record) != nil || expired(record.ExpiresAt, now) {
+				stale = append(stale, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			err = codes.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return codes.Put([]byte(c.Hash), data)
+	})
+}
+
+func (r *UserRepository) TakeAuthCode(ctx context.Context, hash string) (*auth.AuthCode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var record authCodeBoltRecord
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		codes := tx.Bucket(bucketAuthCodes)
+		data := codes.Get([]byte(hash))
+		if data == nil {
+			return auth.ErrAuthCodeNotFound
+		}
+		err := json.Unmarshal(data, &record)
+		if err != nil {
+			return err
+		}
+		return codes.Delete([]byte(hash))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if expired(record.ExpiresAt, time.Now()) {
+		return nil, auth.ErrAuthCodeNotFound
+	}
+	return &auth.AuthCode{
+		Hash:          hash,
+		ClientID:      record.ClientID,
+		UserID:        record.UserID,
+		RedirectURI:   record.RedirectURI,
+		Scope:         record.Scope,
+		CodeChallenge: record.CodeChallenge,
+		Nonce:         record.Nonce,
+		AMR:           record.AMR,
+		AuthTime:      record.AuthTime,
+		ExpiresAt:     record.ExpiresAt,
+	}, nil
+}
+
+type consentBoltRecord struct {
+	Scopes    []string  `json:"scopes,omitempty"`
+	GrantedAt time.Time `json:"granted_at"`
+}
+
+// Consents are kept in a bucket per user, keyed by client ID.
+func (r *UserRepository) GetConsent(ctx context.Context, userID uuid.UUID, clientID string) (*auth.Consent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var record consentBoltRecord
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		consents := tx.Bucket(bucketUserConsents).Bucket(userID[:])
+		if consents == nil {
+			return auth.ErrConsentNotFound
+		}
+		data := consents.Get([]byte(clientID))
+		if data == nil {
+			return auth.ErrConsentNotFound
+		}
+		return json.Unmarshal(data, &record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &auth.Consent{
+		UserID:    userID,
+		ClientID:  clientID,
+		Scopes:    record.Scopes,
+		GrantedAt: record.GrantedAt,
+	}, nil
+}
+
+func (r *UserRepository) PutConsent(ctx context.Context, c *auth.Consent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(consentBoltRecord{
+		Scopes:    c.Scopes,
+		GrantedAt: c.GrantedAt,
+	})
+	if err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		var owner userBoltRecord
+		err := getUser(tx.Bucket(bucketUsers), c.UserID, &owner)
+		if err != nil {
+			return err
+		}
+		consents, err := tx.Bucket(bucketUserConsents).CreateBucketIfNotExists(c.UserID[:])
+		if err != nil {
+			return err
+		}
+		return consents.Put([]byte(c.ClientID), data)
+	})
+}
+
+type deviceCodeBoltRecord struct {
+	UserCode     string            `json:"user_code"`
+	ClientID     string            `json:"client_id"`
+	Scope        string            `json:"scope,omitempty"`
+	Status       auth.DeviceStatus `json:"status"`
+	UserID       uuid.UUID         `json:"user_id"`
+	AMR          []string          `json:"amr,omitempty"`
+	AuthTime     time.Time         `json:"auth_time"`
+	LastPolledAt time.Time         `json:"last_polled_at"`
+	Interval     time.Duration     `json:"interval,omitempty"`
+	ExpiresAt    time.Time         `json:"expires_at"`
+	KeepUntil    time.Time         `json:"keep_until"`
+}
+
+func (rec deviceCodeBoltRecord) toDeviceCode(hash string) *auth.DeviceCode {
+	return &auth.DeviceCode{
+		Hash:         hash,
+		UserCode:     rec.UserCode,
+		ClientID:     rec.ClientID,
+		Scope:        rec.Scope,
+		Status:       rec.Status,
+		UserID:       rec.UserID,
+		AMR:          rec.AMR,
+		AuthTime:     rec.AuthTime,
+		LastPolledAt: rec.LastPolledAt,
+		Interval:     rec.Interval,
+		ExpiresAt:    rec.ExpiresAt,
+		KeepUntil:    rec.KeepUntil,
+	}
+}
+
+// PutDeviceCode also drops codes past KeepUntil, which are never polled
+// for otherwise.
+func (r *UserRepository) PutDeviceCode(ctx context.Context, d *auth.DeviceCode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	now := time.Now()
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		codes, userCodes := tx.Bucket(bucketDeviceCodes), tx.Bucket(bucketUserCodes)
+		var stale []deviceCodeBoltRecord
+		var staleHashes [][]byte
+		err := codes.ForEach(func(k, v []byte) error {
+			var record deviceCodeBoltRecord
+			if json.Unmarshal(v, &record) != nil || expired(record.KeepUntil, now) {
+				stale = append(stale, record)
+				staleHashes = append(staleHashes, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, k := range staleHashes {
+			err = deleteDeviceCode(codes, userCodes, k, stale[i].UserCode)
+			if err != nil {
+				return err
+			}
+		}
+		if userCodes.Get([]byte(d.UserCode)) != nil {
+			return auth.ErrUserCodeTaken
+		}
+		err = putDeviceCode(codes, d.Hash, deviceCodeBoltRecord{
+			UserCode:     d.UserCode,
+			ClientID:     d.ClientID,
+			Scope:        d.Scope,
+			Status:       d.Status,
+			UserID:       d.UserID,
+			AMR:          d.AMR,
+			AuthTime:     d.AuthTime,
+			LastPolledAt: d.LastPolledAt,
+			Interval:     d.Interval,
+			ExpiresAt:    d.ExpiresAt,
+			KeepUntil:    d.KeepUntil,
+		})
+		if err != nil {
+			return err
+		}
+		return userCodes.Put([]byte(d.UserCode), []byte(d.Hash))
+	})
+}
+
+func (r *UserRepository) GetDeviceCode(ctx context.Context, userCode string) (*auth.DeviceCode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var hash string
+	var record deviceCodeBoltRecord
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		h := tx.Bucket(bucketUserCodes).Get([]byte(userCode))
+		if h == nil {
+			return auth.ErrDeviceCodeNotFound
+		}
+		hash = string(h)
+		return getDeviceCode(tx.Bucket(bucketDeviceCodes), hash, &record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if expired(record.KeepUntil, time.Now()) {
+		return nil, auth.ErrDeviceCodeNotFound
+	}
+	return record.toDeviceCode(hash), nil
+}
+
+func (r *UserRepository) DecideDeviceCode(ctx context.Context, d *auth.DeviceCode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		h := tx.Bucket(bucketUserCodes).Get([]byte(d.UserCode))
+		if h == nil {
+			return auth.ErrDeviceCodeNotFound
+		}
+		hash := string(h)
+		codes := tx.Bucket(bucketDeviceCodes)
+		var record deviceCodeBoltRecord
+		err := getDeviceCode(codes, hash, &record)
+		if err != nil {
+			return err
+		}
+		if record.Status != auth.DevicePending || expired(record.ExpiresAt, time.Now()) {
+			return auth.ErrDeviceCodeNotFound
+		}
+		record.Status = d.Status
+		record.UserID = d.UserID
+		record.AMR = d.AMR
+		record.AuthTime = d.AuthTime
+		return putDeviceCode(codes, hash, record)
+	})
+}
+
+func (r *UserRepository) PollDeviceCode(ctx context.Context, hash string, now time.Time) (*auth.DeviceCode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var polled deviceCodeBoltRecord
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		codes := tx.Bucket(bucketDeviceCodes)
+		err := getDeviceCode(codes, hash, &polled)
+		if err != nil {
+			return err
+		}
+		if expired(polled.KeepUntil, now) {
+			return auth.ErrDeviceCodeNotFound
+		}
+		if polled.Status != auth.DevicePending {
+			return deleteDeviceCode(codes, tx.Bucket(bucketUserCodes), []byte(hash), polled.UserCode)
+		}
+		record := polled
+		record.LastPolledAt = now
+		return putDeviceCode(codes, hash, record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return polled.toDeviceCode(hash), nil
+}
+
+func (r *UserRepository) SlowDownDeviceCode(ctx context.Context, hash string, interval time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		codes := tx.Bucket(bucketDeviceCodes)
+		var record deviceCodeBoltRecord
+		err := getDeviceCode(codes, hash, &record)
+		if err != nil {
+			return err
+		}
+		if record.Status != auth.DevicePending || expired(record.KeepUntil, time.Now()) {
+			return auth.ErrDeviceCodeNotFound
+		}
+		record.Interval = interval
+		return putDeviceCode(codes, hash, record)
+	})
+}
+
+func getDeviceCode(codes *bbolt.Bucket, hash string, record *deviceCodeBoltRecord) error {
+	data := codes.Get([]byte(hash))
+	if data == nil {
+		return auth.ErrDeviceCodeNotFound
+	}
+	return json.Unmarshal(data, record)
+}
+
+func putDeviceCode(codes *bbolt.Bucket, hash string, record deviceCodeBoltRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return codes.Put([]byte(hash), data)
+}
+
+func deleteDeviceCode(codes, userCodes *bbolt.Bucket, hash []byte, userCode string) error {
+	err := codes.Delete(hash)
+	if err != nil {
+		return err
+	}
+	// the user code may have been reused since
+	if bytes.Equal(userCodes.Get([]byte(userCode)), hash) {
+		return userCodes.Delete([]byte(userCode))
+	}
+	return nil
+}
+
+func getPasskey(passkeys *bbolt.Bucket, id []byte, record *passkeyBoltRecord) error {
+	data := passkeys.Get(id)
+	if data == nil {
+		return auth.ErrPasskeyNotFound
+	}
+	return json.Unmarshal(data, record)
+}
+
+func putPasskey(passkeys *bbolt.Bucket, id []byte, record passkeyBoltRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return passkeys.Put(id, data)
+}
+
+func deleteUserPasskeys(tx *bbolt.Tx, userID uuid.UUID) error {
+	users := tx.Bucket(bucketUserPasskeys)
+	index := users.Bucket(userID[:])
+	if index == nil {
+		return nil
+	}
+	passkeys := tx.Bucket(bucketPasskeys)
+	err := index.ForEach(func(id, _ []byte) error {
+		return passkeys.Delete(id)
+	})
+	if err != nil {
+		return err
+	}
+	return users.DeleteBucket(userID[:])
+}
+
+func getUser(users *bbolt.Bucket, id uuid.UUID, record *userBoltRecord) error {
+	data := users.Get(id[:])
+	if data == nil {
+		return auth.ErrUserNotFound
+	}
+	return json.Unmarshal(data, record)
+}
+
+func putUser(users *bbolt.Bucket, id uuid.UUID, record userBoltRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return users.Put(id[:], data)
+}
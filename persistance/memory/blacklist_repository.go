@@ -0,0 +1,139 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"medods-auth/token"
+	"sync"
+	"time"
+)
+
+type BlacklistRepository struct {
+	mu      sync.RWMutex
+	entries map[token.JTI]time.Time
+
+	maxEntries int
+	janitor    *janitor
+}
+
+func NewBlackListRepository(opts Options) *BlacklistRepository {
+	r := &BlacklistRepository{
+		entries:    make(map[token.JTI]time.Time),
+		maxEntries: opts.MaxEntries,
+	}
+	r.janitor = startJanitor(opts.CleanupInterval, r.sweep)
+	return r
+}
+
+func (r *BlacklistRepository) Close() error {
+	r.janitor.close()
+	return nil
+}
+
+func (r *BlacklistRepository) Add(ctx context.Context, jti token.JTI, expiresAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if old, ok := r.entries[jti]; ok && !expired(old, now) {
+		// keep the later of the two expiries
+		if !old.IsZero() && (expiresAt.IsZero() || expiresAt.After(old)) {
+			r.entries[jti] = expiresAt
+		}
+		return nil
+	}
+	if r.maxEntries > 0 && len(r.entries) >= r.maxEntries {
+		r.evictExpired(now)
+		if len(r.entries) >= r.maxEntries {
+			return ErrCapacityExceeded
+		}
+	}
+	r.entries[jti] = expiresAt
+	return nil
+}
+
+func (r *BlacklistRepository) Contains(ctx context.Context, jti token.JTI) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	expiresAt, ok := r.entries[jti]
+	r.mu.RUnlock()
+
+	return ok && !expired(expiresAt, time.Now()), nil
+}
+
+func (r *BlacklistRepository) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.entries)
+}
+
+type blacklistEntry struct {
+	JTI       token.JTI `json:"jti"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type blacklistSnapshot struct {
+	Entries []blacklistEntry `json:"entries"`
+}
+
+func (r *BlacklistRepository) Snapshot(w io.Writer) error {
+	r.mu.RLock()
+	snap := blacklistSnapshot{
+		Entries: make([]blacklistEntry, 0, len(r.entries)),
+	}
+	now := time.Now()
+	for jti, expiresAt := range r.entries {
+		if !expired(expiresAt, now) {
+			snap.Entries = append(snap.Entries, blacklistEntry{jti, expiresAt})
+		}
+	}
+	r.mu.RUnlock()
+
+	return json.NewEncoder(w).Encode(snap)
+}
+
+func (r *BlacklistRepository) Restore(rd io.Reader) error {
+	var snap blacklistSnapshot
+	err := json.NewDecoder(rd).Decode(&snap)
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[token.JTI]time.Time, len(snap.Entries))
+	now := time.Now()
+	for _, e := range snap.Entries {
+		if !expired(e.ExpiresAt, now) {
+			entries[e.JTI] = e.ExpiresAt
+		}
+	}
+	if r.maxEntries > 0 && len(entries) > r.maxEntries {
+		return ErrCapacityExceeded
+	}
+
+	r.mu.Lock()
+	r.entries = entries
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *BlacklistRepository) sweep(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.evictExpired(now)
+}
+
+func (r *BlacklistRepository) evictExpired(now time.Time) {
+	for jti, expiresAt := range r.entries {
+		if expired(expiresAt, now) {
+			delete(r.entries, jti)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"medods-auth/service/auth"
+	"medods-auth/token"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type HashRepository struct {
+	mu      sync.RWMutex
+	records map[token.JTI]auth.RefreshTokenRecord
+	byUser  map[uuid.UUID]map[token.JTI]struct{}
+
+	maxEntries int
+	janitor    *janitor
+}
+
+func NewHashRepository(opts Options) *HashRepository {
+	r := &HashRepository{
+		records:    make(map[token.JTI]auth.RefreshTokenRecord),
+		byUser:     make(map[uuid.UUID]map[token.JTI]struct{}),
+		maxEntries: opts.MaxEntries,
+	}
+	r.janitor = startJanitor(opts.CleanupInterval, r.sweep)
+	return r
+}
+
+func (r *HashRepository) Close() error {
+	r.janitor.close()
+	return nil
+}
+
+func (r *HashRepository) Store(ctx context.Context, rec *auth.RefreshTokenRecord) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if old, ok := r.records[rec.JTI]; ok {
+		if !expired(old.ExpiresAt, now) {
+			return ErrDuplicateEntry
+		}
+		r.delete(rec.JTI)
+	}
+	if r.maxEntries > 0 && len(r.records) >= r.maxEntries {
+		r.evictExpired(now)
+		if len(r.records) >= r.maxEntries {
+			return ErrCapacityExceeded
+		}
+	}
+	r.put(copyRecord(*rec))
+	return nil
+}
+
+func (r *HashRepository) Get(ctx context.Context, jti token.JTI) (*auth.RefreshTokenRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	rec, ok := r.records[jti]
+	r.mu.RUnlock()
+
+	if !ok || expired(rec.ExpiresAt, time.Now()) {
+		return nil, auth.ErrRefreshTokenNotFound
+	}
+	out := copyRecord(rec)
+	return &out, nil
+}
+
+func (r *HashRepository) Delete(ctx context.Context, jti token.JTI) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if rec, ok := r.records[jti]; !ok || expired(rec.ExpiresAt, time.Now()) {
+		return auth.ErrRefreshTokenNotFound
+	}
+	r.delete(jti)
+	return nil
+}
+
+func (r *HashRepository) DeleteByUserId(ctx context.Context, userId uuid.UUID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for jti := range r.byUser[userId] {
+		delete(r.records, jti)
+	}
+	delete(r.byUser, userId)
+	return nil
+}
+
+func (r *HashRepository) DeleteByClient(ctx context.Context, userId uuid.UUID, clientID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for jti := range r.byUser[userId] {
+		if r.records[jti].ClientID == clientID {
+			r.delete(jti)
+		}
+	}
+	return nil
+}
+
+func (r *HashRepository) StoreSession(ctx context.Context, ns auth.NewSession) ([]auth.RefreshTokenRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if old, ok := r.records[ns.Record.JTI]; ok {
+		if !expired(old.ExpiresAt, now) {
+			return nil, ErrDuplicateEntry
+		}
+		r.delete(ns.Record.JTI)
+	}
+	var sessions []auth.RefreshTokenRecord
+	for jti := range r.byUser[ns.Record.User.Id] {
+		if rec := r.records[jti]; !expired(rec.ExpiresAt, now) {
+			sessions = append(sessions, rec)
+		}
+	}
+	evicted, err := ns.Limit.Evict(sessions)
+	if err != nil {
+		return nil, err
+	}
+	if r.maxEntries > 0 && len(r.records)-len(evicted) >= r.maxEntries {
+		r.evictExpired(now)
+		if len(r.records)-len(evicted) >= r.maxEntries {
+			return nil, ErrCapacityExceeded
+		}
+	}
+	for _, rec := range evicted {
+		r.delete(rec.JTI)
+	}
+	r.put(copyRecord(*ns.Record))
+	return evicted, nil
+}
+
+func (r *HashRepository) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.records)
+}
+
+type hashSnapshot struct {
+	Records []auth.RefreshTokenRecord `json:"records"`
+}
+
+func (r *HashRepository) Snapshot(w io.Writer) error {
+	r.mu.RLock()
+	snap := hashSnapshot{
+		Records: make([]auth.RefreshTokenRecord, 0, len(r.records)),
+	}
+	now := time.Now()
+	for _, rec := range r.records {
+		if !expired(rec.ExpiresAt, now) {
+			snap.Records = append(snap.Records, copyRecord(rec))
+		}
+	}
+	r.mu.RUnlock()
+
+	return json.NewEncoder(w).Encode(snap)
+}
+
+// Restore replaces the repository contents with a snapshot, dropping
+// entries that expired in the meantime.
+func (r *HashRepository) Restore(rd io.Reader) error {
+	var snap hashSnapshot
+	err := json.NewDecoder(rd).Decode(&snap)
+	if err != nil {
+		return err
+	}
+
+	records := make(map[token.JTI]auth.RefreshTokenRecord, len(snap.Records))
+	now := time.Now()
+	for _, rec := range snap.Records {
+		if !expired(rec.ExpiresAt, now) {
+			records[rec.JTI] = rec
+		}
+	}
+	if r.maxEntries > 0 && len(records) > r.maxEntries {
+		return ErrCapacityExceeded
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = make(map[token.JTI]auth.RefreshTokenRecord, len(records))
+	r.byUser = make(map[uuid.UUID]map[token.JTI]struct{})
+	for _, rec := range records {
+		r.put(rec)
+	}
+	return nil
+}
+
+func (r *HashRepository) sweep(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.evictExpired(now)
+}
+
+func (r *HashRepository) evictExpired(now time.Time) {
+	for jti, rec := range r.records {
+		if expired(rec.ExpiresAt, now) {
+			r.delete(jti)
+		}
+	}
+}
+
+func (r *HashRepository) put(rec auth.RefreshTokenRecord) {
+	r.records[rec.JTI] = rec
+	jtis, ok := r.byUser[rec.User.Id]
+	if !ok {
+		jtis = make(map[token.JTI]struct{})
+		r.byUser[rec.User.Id] = jtis
+	}
+	jtis[rec.JTI] = struct{}{}
+}
+
+func (r *HashRepository) delete(jti token.JTI) {
+	rec, ok := r.records[jti]
+	if !ok {
+		return
+	}
+	delete(r.records, jti)
+	if jtis, ok := r.byUser[rec.User.Id]; ok {
+		delete(jtis, jti)
+		if len(jtis) == 0 {
+			delete(r.byUser, rec.User.Id)
+		}
+	}
+}
+
+func copyRecord(in auth.RefreshTokenRecord) auth.RefreshTokenRecord {
+	out := in
+	out.Hash = bytes.Clone(in.Hash)
+	if in.RevokedAt != nil {
+		revoked := *in.RevokedAt
+		out.RevokedAt = &revoked
+	}
+	return out
+}
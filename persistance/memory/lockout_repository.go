@@ -0,0 +1,96 @@
+package memory
+
+import (
+	"context"
+	"medods-auth/service/lockout"
+	"sync"
+	"time"
+)
+
+type lockoutEntry struct {
+	lockout.State
+	expires time.Time
+}
+
+// LockoutRepository keeps login failures of a single replica.
+type LockoutRepository struct {
+	mu      sync.Mutex
+	entries map[string]lockoutEntry
+
+	maxEntries int
+	janitor    *janitor
+}
+
+func NewLockoutRepository(opts Options) *LockoutRepository {
+	r := &LockoutRepository{
+		entries:    make(map[string]lockoutEntry),
+		maxEntries: opts.MaxEntries,
+	}
+	r.janitor = startJanitor(opts.CleanupInterval, r.sweep)
+	return r
+}
+
+func (r *LockoutRepository) Close() error {
+	r.janitor.close()
+	return nil
+}
+
+func (r *LockoutRepository) Get(ctx context.Context, key string) (lockout.State, error) {
+	if err := ctx.Err(); err != nil {
+		return lockout.State{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.entries[key]
+	if !ok || expired(entry.expires, time.Now()) {
+		return lockout.State{}, nil
+	}
+	return entry.State, nil
+}
+
+func (r *LockoutRepository) Fail(ctx context.Context, key string, policy lockout.Policy, now time.Time) (lockout.State, error) {
+	if err := ctx.Err(); err != nil {
+		return lockout.State{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.entries[key]
+	if !ok || expired(entry.expires, now) {
+		entry = lockoutEntry{}
+		if !ok && r.maxEntries > 0 && len(r.entries) >= r.maxEntries {
+			r.evictExpired(now)
+			if len(r.entries) >= r.maxEntries {
+				return lockout.State{}, ErrCapacityExceeded
+			}
+		}
+	}
+	state := entry.Fail(policy, now)
+	r.entries[key] = lockoutEntry{State: state, expires: state.Expires(policy)}
+	return state, nil
+}
+
+func (r *LockoutRepository) Reset(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	delete(r.entries, key)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *LockoutRepository) sweep(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.evictExpired(now)
+}
+
+func (r *LockoutRepository) evictExpired(now time.Time) {
+	for key, entry := range r.entries {
+		if expired(entry.expires, now) {
+			delete(r.entries, key)
+		}
+	}
+}
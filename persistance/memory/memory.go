@@ -0,0 +1,110 @@
+package memory
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var ErrCapacityExceeded = errors.New("in-memory store capacity exceeded")
+var ErrDuplicateEntry = errors.New("entry already exists")
+
+type Options struct {
+	// MaxEntries caps the number of live entries, zero means unlimited.
+	// Expired entries are evicted before a write is rejected.
+	MaxEntries int
+
+	// CleanupInterval enables a background sweep of expired entries.
+	// Expired entries are never returned, with or without the sweep.
+	CleanupInterval time.Duration
+}
+
+type Snapshotter interface {
+	Snapshot(io.Writer) error
+	Restore(io.Reader) error
+}
+
+func expired(expiresAt, now time.Time) bool {
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
+
+// SaveFile writes a snapshot of s to path, replacing the file atomically.
+func SaveFile(path string, s Snapshotter) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = s.Snapshot(tmp)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadFile restores s from a snapshot at path. A missing file is not an error.
+func LoadFile(path string, s Snapshotter) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	return s.Restore(f)
+}
+
+type janitor struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startJanitor(interval time.Duration, sweep func(time.Time)) *janitor {
+	if interval <= 0 {
+		return nil
+	}
+	j := &janitor{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(j.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				sweep(now)
+			case <-j.stop:
+				return
+			}
+		}
+	}()
+	return j
+}
+
+func (j *janitor) close() {
+	if j == nil {
+		return
+	}
+	select {
+	case <-j.stop:
+	default:
+		close(j.stop)
+	}
+	<-j.done
+}
@@ -0,0 +1,129 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"medods-auth/service/auth"
+	"medods-auth/user"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRecord(userID uuid.UUID, ttl time.Duration) *auth.RefreshTokenRecord {
+	now := time.Now()
+	return &auth.RefreshTokenRecord{
+		JTI:       uuid.New(),
+		User:      user.User{Id: userID, UserAgent: "test"},
+		Hash:      []byte("hash"),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+}
+
+func TestHashRepositoryExpiry(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	repo := NewHashRepository(Options{CleanupInterval: 10 * time.Millisecond})
+	defer repo.Close()
+
+	short := testRecord(uuid.New(), 20*time.Millisecond)
+	long := testRecord(uuid.New(), time.Hour)
+	assert.Nil(repo.Store(ctx, short))
+	assert.Nil(repo.Store(ctx, long))
+	assert.Equal(ErrDuplicateEntry, repo.Store(ctx, long))
+
+	got, err := repo.Get(ctx, short.JTI)
+	assert.Nil(err)
+	assert.Equal(short.User, got.User)
+
+	assert.Eventually(func() bool { return repo.Len() == 1 }, time.Second, 10*time.Millisecond)
+	_, err = repo.Get(ctx, short.JTI)
+	assert.Equal(auth.ErrRefreshTokenNotFound, err)
+	_, err = repo.Get(ctx, long.JTI)
+	assert.Nil(err)
+}
+
+func TestHashRepositoryMaxEntries(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	repo := NewHashRepository(Options{MaxEntries: 2})
+	userID := uuid.New()
+
+	assert.Nil(repo.Store(ctx, testRecord(userID, time.Hour)))
+	assert.Nil(repo.Store(ctx, testRecord(userID, -time.Second)))
+	// the expired record is evicted to make room
+	assert.Nil(repo.Store(ctx, testRecord(userID, time.Hour)))
+	assert.Equal(ErrCapacityExceeded, repo.Store(ctx, testRecord(userID, time.Hour)))
+
+	assert.Nil(repo.DeleteByUserId(ctx, userID))
+	assert.Equal(0, repo.Len())
+	assert.Nil(repo.Store(ctx, testRecord(userID, time.Hour)))
+}
+
+func TestBlacklistExpiry(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	bl := NewBlackListRepository(Options{MaxEntries: 1})
+
+	jti := uuid.New()
+	assert.Nil(bl.Add(ctx, jti, time.Now().Add(-time.Second)))
+	ok, err := bl.Contains(ctx, jti)
+	assert.Nil(err)
+	assert.False(ok)
+
+	assert.Nil(bl.Add(ctx, jti, time.Now().Add(time.Hour)))
+	ok, err = bl.Contains(ctx, jti)
+	assert.Nil(err)
+	assert.True(ok)
+
+	assert.Equal(ErrCapacityExceeded, bl.Add(ctx, uuid.New(), time.Now().Add(time.Hour)))
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	repo := NewHashRepository(Options{})
+	bl := NewBlackListRepository(Options{})
+	live := testRecord(uuid.New(), time.Hour)
+	assert.Nil(repo.Store(ctx, live))
+	assert.Nil(repo.Store(ctx, testRecord(uuid.New(), 50*time.Millisecond)))
+	jti := uuid.New()
+	assert.Nil(bl.Add(ctx, jti, time.Now().Add(time.Hour)))
+
+	assert.Nil(SaveFile(filepath.Join(dir, "tokens.json"), repo))
+	assert.Nil(SaveFile(filepath.Join(dir, "blacklist.json"), bl))
+	time.Sleep(50 * time.Millisecond)
+
+	restored := NewHashRepository(Options{})
+	restoredBl := NewBlackListRepository(Options{})
+	assert.Nil(LoadFile(filepath.Join(dir, "tokens.json"), restored))
+	assert.Nil(LoadFile(filepath.Join(dir, "blacklist.json"), restoredBl))
+	assert.Nil(LoadFile(filepath.Join(dir, "missing.json"), restored))
+
+	assert.Equal(1, restored.Len())
+	got, err := restored.Get(ctx, live.JTI)
+	assert.Nil(err)
+	assert.Equal(live.User, got.User)
+	assert.Equal(live.Hash, got.Hash)
+	assert.True(live.ExpiresAt.Equal(got.ExpiresAt))
+
+	ok, err := restoredBl.Contains(ctx, jti)
+	assert.Nil(err)
+	assert.True(ok)
+
+	// the restored user index must allow per-user deletion
+	assert.Nil(restored.DeleteByUserId(ctx, live.User.Id))
+	assert.Equal(0, restored.Len())
+
+	var buf bytes.Buffer
+	assert.Nil(NewBlackListRepository(Options{}).Snapshot(&buf))
+	assert.Equal(ErrCapacityExceeded, NewHashRepository(Options{MaxEntries: 1}).Restore(bytes.NewBufferString(
+		`{"records":[{"JTI":"`+uuid.NewString()+`"},{"JTI":"`+uuid.NewString()+`"}]}`,
+	)))
+}
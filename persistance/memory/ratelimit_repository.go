@@ -0,0 +1,74 @@
+package memory
+
+import (
+	"context"
+	"medods-auth/service/ratelimit"
+	"sync"
+	"time"
+)
+
+type bucketEntry struct {
+	ratelimit.Bucket
+	// full is when the bucket refills, after which it equals a missing one.
+	full time.Time
+}
+
+// RateLimitRepository keeps token buckets of a single replica.
+type RateLimitRepository struct {
+	mu      sync.Mutex
+	buckets map[string]bucketEntry
+
+	maxEntries int
+	janitor    *janitor
+}
+
+func NewRateLimitRepository(opts Options) *RateLimitRepository {
+	r := &RateLimitRepository{
+		buckets:    make(map[string]bucketEntry),
+		maxEntries: opts.MaxEntries,
+	}
+	r.janitor = startJanitor(opts.CleanupInterval, r.sweep)
+	return r
+}
+
+func (r *RateLimitRepository) Close() error {
+	r.janitor.close()
+	return nil
+}
+
+func (r *RateLimitRepository) Allow(ctx context.Context, key string, limit ratelimit.Limit, now time.Time) (ratelimit.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return ratelimit.Result{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.buckets[key]
+	if !ok || !now.Before(entry.full) {
+		entry.Bucket = ratelimit.FullBucket(limit, now)
+		if !ok && r.maxEntries > 0 && len(r.buckets) >= r.maxEntries {
+			r.evictFull(now)
+			if len(r.buckets) >= r.maxEntries {
+				return ratelimit.Result{}, ErrCapacityExceeded
+			}
+		}
+	}
+	bucket, res := entry.Take(limit, now)
+	r.buckets[key] = bucketEntry{Bucket: bucket, full: now.Add(res.Reset)}
+	return res, nil
+}
+
+func (r *RateLimitRepository) sweep(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.evictFull(now)
+}
+
+func (r *RateLimitRepository) evictFull(now time.Time) {
+	for key, entry := range r.buckets {
+		if !now.Before(entry.full) {
+			delete(r.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,654 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"maps"
+	"medods-auth/service/auth"
+	"medods-auth/user"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type UserRepository struct {
+	mu          sync.RWMutex
+	accounts    map[uuid.UUID]user.Account
+	credentials map[uuid.UUID]auth.Credential
+	logins      map[string]uuid.UUID
+	totps       map[uuid.UUID]auth.TOTP
+	// passkeys are keyed by credential ID.
+	passkeys   map[string]auth.Passkey
+	challenges map[string]auth.Challenge
+	clients    map[string]auth.Client
+	// authCodes are keyed by hash.
+	authCodes map[string]auth.AuthCode
+	consents  map[uuid.UUID]map[string]auth.Consent
+	// deviceCodes are keyed by hash, userCodes map to their hash.
+	deviceCodes map[string]auth.DeviceCode
+	userCodes   map[string]string
+}
+
+func NewUserRepository() *UserRepository {
+	return &UserRepository{
+		accounts:    make(map[uuid.UUID]user.Account),
+		credentials: make(map[uuid.UUID]auth.Credential),
+		logins:      make(map[string]uuid.UUID),
+		totps:       make(map[uuid.UUID]auth.TOTP),
+		passkeys:    make(map[string]auth.Passkey),
+		challenges:  make(map[string]auth.Challenge),
+		clients:     make(map[string]auth.Client),
+		authCodes:   make(map[string]auth.AuthCode),
+		consents:    make(map[uuid.UUID]map[string]auth.Consent),
+		deviceCodes: make(map[string]auth.DeviceCode),
+		userCodes:   make(map[string]string),
+	}
+}
+
+func (r *UserRepository) Create(ctx context.Context, account *user.Account) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.accounts[account.Id]; ok {
+		return auth.ErrUserExists
+	}
+	r.accounts[account.Id] = *account
+	return nil
+}
+
+func (r *UserRepository) Get(ctx context.Context, id uuid.UUID) (*user.Account, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	account, ok := r.accounts[id]
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, auth.ErrUserNotFound
+	}
+	return &account, nil
+}
+
+func (r *UserRepository) SetStatus(ctx context.Context, id uuid.UUID, status user.Status) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	account, ok := r.accounts[id]
+	if !ok {
+		return auth.ErrUserNotFound
+	}
+	account.Status = status
+	r.accounts[id] = account
+	return nil
+}
+
+func (r *UserRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.accounts[id]; !ok {
+		return auth.ErrUserNotFound
+	}
+	delete(r.accounts, id)
+	r.deleteCredential(id)
+	delete(r.totps, id)
+	maps.DeleteFunc(r.passkeys, func(_ string, p auth.Passkey) bool {
+		return p.UserID == id
+	})
+	delete(r.consents, id)
+	return nil
+}
+
+func (r *UserRepository) SetCredential(ctx context.Context, cred auth.Credential) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.accounts[cred.UserID]; !ok {
+		return auth.ErrUserNotFound
+	}
+	if owner, ok := r.logins[cred.Login]; ok && owner != cred.UserID {
+		return auth.ErrLoginTaken
+	}
+	r.deleteCredential(cred.UserID)
+	r.credentials[cred.UserID] = cred
+	r.logins[cred.Login] = cred.UserID
+	return nil
+}
+
+func (r *UserRepository) GetCredential(ctx context.Context, login string) (*auth.Credential, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, ok := r.logins[login]
+	if !ok {
+		return nil, auth.ErrCredentialNotFound
+	}
+	cred := r.credentials[id]
+	return &cred, nil
+}
+
+func (r *UserRepository) GetUserCredential(ctx context.Context, userID uuid.UUID) (*auth.Credential, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	cred, ok := r.credentials[userID]
+	if !ok {
+		return nil, auth.ErrCredentialNotFound
+	}
+	return &cred, nil
+}
+
+func (r *UserRepository) UpdateCredentialHash(ctx context.Context, userID uuid.UUID, old, new string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cred, ok := r.credentials[userID]
+	if ok && cred.Hash == old {
+		cred.Hash = new
+		r.credentials[userID] = cred
+	}
+	return nil
+}
+
+func (r *UserRepository) deleteCredential(id uuid.UUID) {
+	if cred, ok := r.credentials[id]; ok {
+		delete(r.logins, cred.Login)
+		delete(r.credentials, id)
+	}
+}
+
+func (r *UserRepository) GetTOTP(ctx context.Context, userID uuid.UUID) (*auth.TOTP, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	t, ok := r.totps[userID]
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, auth.ErrTOTPNotEnrolled
+	}
+	t.RecoveryCodes = slices.Clone(t.RecoveryCodes)
+	return &t, nil
+}
+
+func (r *UserRepository) PutTOTP(ctx context.Context, t *auth.TOTP) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.accounts[t.UserID]; !ok {
+		return auth.ErrUserNotFound
+	}
+	if r.totps[t.UserID].Version != t.Version-1 {
+		return auth.ErrTOTPConflict
+	}
+	stored := *t
+	stored.RecoveryCodes = slices.Clone(t.RecoveryCodes)
+	r.totps[t.UserID] = stored
+	return nil
+}
+
+func (r *UserRepository) DeleteTOTP(ctx context.Context, userID uuid.UUID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.totps[userID]; !ok {
+		return auth.ErrTOTPNotEnrolled
+	}
+	delete(r.totps, userID)
+	return nil
+}
+
+func (r *UserRepository) AddPasskey(ctx context.Context, p *auth.Passkey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.accounts[p.UserID]; !ok {
+		return auth.ErrUserNotFound
+	}
+	if _, ok := r.passkeys[string(p.ID)]; ok {
+		return auth.ErrPasskeyExists
+	}
+	r.passkeys[string(p.ID)] = clonePasskey(*p)
+	return nil
+}
+
+func (r *UserRepository) GetPasskey(ctx context.Context, id []byte) (*auth.Passkey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	p, ok := r.passkeys[string(id)]
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, auth.ErrPasskeyNotFound
+	}
+	p = clonePasskey(p)
+	return &p, nil
+}
+
+func (r *UserRepository) ListPasskeys(ctx context.Context, userID uuid.UUID) ([]auth.Passkey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var passkeys []auth.Passkey
+	for _, p := range r.passkeys {
+		if p.UserID == userID {
+			passkeys = append(passkeys, clonePasskey(p))
+		}
+	}
+	slices.SortFunc(passkeys, func(a, b auth.Passkey) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return passkeys, nil
+}
+
+func (r *UserRepository) UpdateSignCount(ctx context.Context, id []byte, old, new uint32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.passkeys[string(id)]
+	if !ok {
+		return auth.ErrPasskeyNotFound
+	}
+	if p.SignCount != old {
+		return auth.ErrPasskeySignCount
+	}
+	p.SignCount = new
+	r.passkeys[string(id)] = p
+	return nil
+}
+
+func (r *UserRepository) PutChallenge(ctx context.Context, c *auth.Challenge) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	maps.DeleteFunc(r.challenges, func(_ string, c auth.Challenge) bool {
+		return !now.Before(c.ExpiresAt)
+	})
+	stored := *c
+	stored.Value = slices.Clone(c.Value)
+	r.challenges[string(c.Value)] = stored
+	return nil
+}
+
+func (r *UserRepository) TakeChallenge(ctx context.Context, value []byte) (*auth.Challenge, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.challenges[string(value)]
+	if !ok {
+		return nil, auth.ErrChallengeNotFound
+	}
+	delete(r.challenges, string(value))
+	if !time.Now().Before(c.ExpiresAt) {
+		return nil, auth.ErrChallengeNotFound
+	}
+	return &c, nil
+}
+
+func (r *UserRepository) CreateClient(ctx context.Context, c *auth.Client) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.clients[c.ID]; ok {
+		return auth.ErrClientExists
+	}
+	r.clients[c.ID] = cloneClient(*c)
+	return nil
+}
+
+func (r *UserRepository) GetClient(ctx context.Context, id string) (*auth.Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	c, ok := r.clients[id]
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, auth.ErrClientNotFound
+	}
+	c = cloneClient(c)
+	return &c, nil
+}
+
+func (r *UserRepository) DeleteClient(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.clients[id]; !ok {
+		return auth.ErrClientNotFound
+	}
+	delete(r.clients, id)
+	for _, consents := range r.consents {
+		delete(consents, id)
+	}
+	return nil
+}
+
+func (r *UserRepository) PutAuthCode(ctx context.Context, c *auth.AuthCode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	maps.DeleteFunc(r.authCodes, func(_ string, c auth.AuthCode) bool {
+		return !now.Before(c.ExpiresAt)
+	})
+	stored := *c
+	stored.AMR = slices.Clone(c.AMR)
+	r.authCodes[c.Hash] = stored
+	return nil
+}
+
+func (r *UserRepository) TakeAuthCode(ctx context.Context, hash string) (*auth.AuthCode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.authCodes[hash]
+	if !ok {
+		return nil, auth.ErrAuthCodeNotFound
+	}
+	delete(r.authCodes, hash)
+	if !time.Now().Before(c.ExpiresAt) {
+		return nil, auth.ErrAuthCodeNotFound
+	}
+	return &c, nil
+}
+
+func (r *UserRepository) GetConsent(ctx context.Context, userID uuid.UUID, clientID string) (*auth.Consent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	c, ok := r.consents[userID][clientID]
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, auth.ErrConsentNotFound
+	}
+	c.Scopes = slices.Clone(c.Scopes)
+	return &c, nil
+}
+
+func (r *UserRepository) PutConsent(ctx context.Context, c *auth.Consent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.accounts[c.UserID]; !ok {
+		return auth.ErrUserNotFound
+	}
+	consents, ok := r.consents[c.UserID]
+	if !ok {
+		consents = make(map[string]auth.Consent)
+		r.consents[c.UserID] = consents
+	}
+	stored := *c
+	stored.Scopes = slices.Clone(c.Scopes)
+	consents[c.ClientID] = stored
+	return nil
+}
+
+func (r *UserRepository) PutDeviceCode(ctx context.Context, d *auth.DeviceCode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	maps.DeleteFunc(r.deviceCodes, func(_ string, d auth.DeviceCode) bool {
+		if now.Before(d.KeepUntil) {
+			return false
+		}
+		delete(r.userCodes, d.UserCode)
+		return true
+	})
+	if _, ok := r.userCodes[d.UserCode]; ok {
+		return auth.ErrUserCodeTaken
+	}
+	stored := *d
+	stored.AMR = slices.Clone(d.AMR)
+	r.deviceCodes[d.Hash] = stored
+	r.userCodes[d.UserCode] = d.Hash
+	return nil
+}
+
+func (r *UserRepository) GetDeviceCode(ctx context.Context, userCode string) (*auth.DeviceCode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	d, ok := r.deviceCodes[r.userCodes[userCode]]
+	r.mu.RUnlock()
+
+	if !ok || !time.Now().Before(d.KeepUntil) {
+		return nil, auth.ErrDeviceCodeNotFound
+	}
+	d.AMR = slices.Clone(d.AMR)
+	return &d, nil
+}
+
+func (r *UserRepository) DecideDeviceCode(ctx context.Context, d *auth.DeviceCode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hash := r.userCodes[d.UserCode]
+	stored, ok := r.deviceCodes[hash]
+	if !ok || stored.Status != auth.DevicePending || !time.Now().Before(stored.ExpiresAt) {
+		return auth.ErrDeviceCodeNotFound
+	}
+	stored.Status = d.Status
+	stored.UserID = d.UserID
+	stored.AMR = slices.Clone(d.AMR)
+	stored.AuthTime = d.AuthTime
+	r.deviceCodes[hash] = stored
+	return nil
+}
+
+func (r *UserRepository) PollDeviceCode(ctx context.Context, hash string, now time.Time) (*auth.DeviceCode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.deviceCodes[hash]
+	if !ok || !now.Before(d.KeepUntil) {
+		return nil, auth.ErrDeviceCodeNotFound
+	}
+	if d.Status == auth.DevicePending {
+		polled := d
+		polled.LastPolledAt = now
+		r.deviceCodes[hash] = polled
+	} else {
+		delete(r.deviceCodes, hash)
+		delete(r.userCodes, d.UserCode)
+	}
+	d.AMR = slices.Clone(d.AMR)
+	return &d, nil
+}
+
+func (r *UserRepository) SlowDownDeviceCode(ctx context.Context, hash string, interval time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.deviceCodes[hash]
+	if !ok || d.Status != auth.DevicePending || !time.Now().Before(d.KeepUntil) {
+		return auth.ErrDeviceCodeNotFound
+	}
+	d.Interval = interval
+	r.deviceCodes[hash] = d
+	return nil
+}
+
+func cloneClient(c auth.Client) auth.Client {
+	c.Scopes = slices.Clone(c.Scopes)
+	c.RedirectURIs = slices.Clone(c.RedirectURIs)
+	c.PostLogoutRedirectURIs = slices.Clone(c.PostLogoutRedirectURIs)
+	return c
+}
+
+func clonePasskey(p auth.Passkey) auth.Passkey {
+	p.ID = slices.Clone(p.ID)
+	p.PublicKey = slices.Clone(p.PublicKey)
+	p.Transports = slices.Clone(p.Transports)
+	return p
+}
+
+type userSnapshot struct {
+	Accounts    []user.Account    `json:"accounts"`
+	Credentials []auth.Credential `json:"credentials"`
+	TOTPs       []auth.TOTP       `json:"totps,omitempty"`
+	Passkeys    []auth.Passkey    `json:"passkeys,omitempty"`
+	Clients     []auth.Client     `json:"clients,omitempty"`
+	Consents    []auth.Consent    `json:"consents,omitempty"`
+}
+
+func (r *UserRepository) Snapshot(w io.Writer) error {
+	r.mu.RLock()
+	snap := userSnapshot{
+		Accounts: make([]user.Account, 0, len(r.accounts)),
+	}
+	for _, account := range r.accounts {
+		snap.Accounts = append(snap.Accounts, account)
+	}
+	for _, cred := range r.credentials {
+		snap.Credentials = append(snap.Credentials, cred)
+	}
+	for _, t := range r.totps {
+		snap.TOTPs = append(snap.TOTPs, t)
+	}
+	for _, p := range r.passkeys {
+		snap.Passkeys = append(snap.Passkeys, p)
+	}
+	for _, c := range r.clients {
+		snap.Clients = append(snap.Clients, c)
+	}
+	for _, consents := range r.consents {
+		for _, c := range consents {
+			snap.Consents = append(snap.Consents, c)
+		}
+	}
+	r.mu.RUnlock()
+
+	return json.NewEncoder(w).Encode(snap)
+}
+
+// Restore replaces the repository contents with a snapshot.
+func (r *UserRepository) Restore(rd io.Reader) error {
+	var snap userSnapshot
+	err := json.NewDecoder(rd).Decode(&snap)
+	if err != nil {
+		return err
+	}
+
+	accounts := make(map[uuid.UUID]user.Account, len(snap.Accounts))
+	for _, account := range snap.Accounts {
+		accounts[account.Id] = account
+	}
+	credentials := make(map[uuid.UUID]auth.Credential, len(snap.Credentials))
+	logins := make(map[string]uuid.UUID, len(snap.Credentials))
+	for _, cred := range snap.Credentials {
+		credentials[cred.UserID] = cred
+		logins[cred.Login] = cred.UserID
+	}
+	totps := make(map[uuid.UUID]auth.TOTP, len(snap.TOTPs))
+	for _, t := range snap.TOTPs {
+		totps[t.UserID] = t
+	}
+	passkeys := make(map[string]auth.Passkey, len(snap.Passkeys))
+	for _, p := range snap.Passkeys {
+		passkeys[string(p.ID)] = p
+	}
+	clients := make(map[string]auth.Client, len(snap.Clients))
+	for _, c := range snap.Clients {
+		clients[c.ID] = c
+	}
+	consents := make(map[uuid.UUID]map[string]auth.Consent)
+	for _, c := range snap.Consents {
+		if consents[c.UserID] == nil {
+			consents[c.UserID] = make(map[string]auth.Consent)
+		}
+		consents[c.UserID][c.ClientID] = c
+	}
+	r.mu.Lock()
+	r.accounts = accounts
+	r.credentials = credentials
+	r.logins = logins
+	r.totps = totps
+	r.passkeys = passkeys
+	r.clients = clients
+	r.consents = consents
+	r.mu.Unlock()
+	return nil
+}
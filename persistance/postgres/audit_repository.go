@@ -0,0 +1,158 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"medods-auth/service/audit"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+type AuditRepository struct {
+	db *sqlx.DB
+}
+
+func NewAuditRepository(db *sqlx.DB) *AuditRepository {
+	return &AuditRepository{
+		db,
+	}
+}
+
+type AuditDBRecord struct {
+	Seq       int64     `db:"seq"`
+	Time      time.Time `db:"time"`
+	Event     string    `db:"event"`
+	Outcome   string    `db:"outcome"`
+	ErrorCode string    `db:"error_code"`
+	UserID    uuid.UUID `db:"user_id"`
+	ClientID  string    `db:"client_id"`
+	JTI       string    `db:"jti"`
+	IssuedJTI string    `db:"issued_jti"`
+	IP        string    `db:"ip"`
+	UserAgent string    `db:"user_agent"`
+	PrevHash  string    `db:"prev_hash"`
+	Hash      string    `db:"hash"`
+}
+
+func (r *AuditDBRecord) toEntry() audit.Entry {
+	return audit.Entry{
+		Seq:       r.Seq,
+		Time:      r.Time.UTC(),
+		Event:     audit.Event(r.Event),
+		Outcome:   r.Outcome,
+		ErrorCode: r.ErrorCode,
+		UserID:    r.UserID,
+		ClientID:  r.ClientID,
+		JTI:       r.JTI,
+		IssuedJTI: r.IssuedJTI,
+		IP:        r.IP,
+		UserAgent: r.UserAgent,
+		PrevHash:  r.PrevHash,
+		Hash:      r.Hash,
+	}
+}
+
+func auditRecordFromEntry(e audit.Entry) *AuditDBRecord {
+	return &AuditDBRecord{
+		Seq:       e.Seq,
+		Time:      e.Time,
+		Event:     string(e.Event),
+		Outcome:   e.Outcome,
+		ErrorCode: e.ErrorCode,
+		UserID:    e.UserID,
+		ClientID:  e.ClientID,
+		JTI:       e.JTI,
+		IssuedJTI: e.IssuedJTI,
+		IP:        e.IP,
+		UserAgent: e.UserAgent,
+		PrevHash:  e.PrevHash,
+		Hash:      e.Hash,
+	}
+}
+
+const (
+	auditColumns = "seq, time, event, outcome, error_code, user_id, client_id, jti, issued_jti, ip, user_agent, prev_hash, hash"
+
+	// writers are serialized so that each entry is chained to the last one
+	queryLockAudit       = "LOCK TABLE audit_log IN EXCLUSIVE MODE"
+	querySelectLastAudit = "SELECT " + auditColumns + " FROM audit_log ORDER BY seq DESC LIMIT 1"
+	queryInsertAudit     = "INSERT INTO audit_log (" + auditColumns + ") VALUES (:seq, :time, :event, :outcome, :error_code, :user_id, :client_id, :jti, :issued_jti, :ip, :user_agent, :prev_hash, :hash)"
+	querySelectAudit     = "SELECT " + auditColumns + " FROM audit_log"
+)
+
+func (r *AuditRepository) Record(ctx context.Context, e audit.Entry) (err error) {
+	ctx, span := startQuery(ctx, "INSERT", "audit_log", queryInsertAudit)
+	defer func() { endQuery(span, err) }()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, queryLockAudit)
+	if err != nil {
+		return err
+	}
+	var last AuditDBRecord
+	err = tx.GetContext(ctx, &last, querySelectLastAudit)
+	switch {
+	case err == sql.ErrNoRows:
+		e.Seal(nil)
+	case err != nil:
+		return err
+	default:
+		prev := last.toEntry()
+		e.Seal(&prev)
+	}
+
+	_, err = tx.NamedExecContext(ctx, queryInsertAudit, auditRecordFromEntry(e))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *AuditRepository) Query(ctx context.Context, f audit.Filter) (_ []audit.Entry, err error) {
+	var where []string
+	var args []any
+	if f.UserID != nil {
+		args = append(args, *f.UserID)
+		where = append(where, "user_id = $1")
+	}
+	if !f.Since.IsZero() {
+		args = append(args, f.Since)
+		where = append(where, "time >= $"+strconv.Itoa(len(args)))
+	}
+	if !f.Until.IsZero() {
+		args = append(args, f.Until)
+		where = append(where, "time < $"+strconv.Itoa(len(args)))
+	}
+	query := querySelectAudit
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY seq"
+	if f.Limit > 0 {
+		args = append(args, f.Limit)
+		query += " LIMIT $" + strconv.Itoa(len(args))
+	}
+
+	ctx, span := startQuery(ctx, "SELECT", "audit_log", query)
+	defer func() { endQuery(span, err) }()
+
+	var records []AuditDBRecord
+	err = r.db.SelectContext(ctx, &records, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]audit.Entry, len(records))
+	for i := range records {
+		out[i] = records[i].toEntry()
+	}
+	return out, nil
+}
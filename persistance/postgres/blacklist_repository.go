@@ -2,7 +2,6 @@ package postgres
 
 import (
 	"context"
-	"database/sql"
 	"medods-auth/token"
 	"time"
 
@@ -20,27 +19,37 @@ func NewBlackListRepository(db *sqlx.DB) *BlacklistRepository {
 	}
 }
 
-func (repo *BlacklistRepository) Add(ctx context.Context, jti token.JTI) error {
-	_, err := repo.db.ExecContext(
-		ctx,
-		"INSERT INTO blacklist (jti, created_at) VALUES ($1, $2)",
-		jti, time.Now(),
-	)
+const (
+	queryInsertBlacklist = "INSERT INTO blacklist (jti, created_at, expires_at) VALUES ($1, $2, $3) ON CONFLICT (jti) DO NOTHING"
+	queryExistsBlacklist = "SELECT EXISTS (SELECT 1 FROM blacklist WHERE jti = $1 AND (expires_at IS NULL OR expires_at > $2))"
+)
+
+func (repo *BlacklistRepository) Add(ctx context.Context, jti token.JTI, expiresAt time.Time) (err error) {
+	ctx, span := startQuery(ctx, "INSERT", "blacklist", queryInsertBlacklist)
+	defer func() { endQuery(span, err) }()
+
+	_, err = repo.db.ExecContext(ctx, queryInsertBlacklist, jti, time.Now(), nullTime(expiresAt))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (repo *BlacklistRepository) Contains(ctx context.Context, jti token.JTI) (bool, error) {
-	row := repo.db.QueryRowxContext(ctx, "SELECT jti FROM blacklist WHERE jti = $1", jti)
-	var gotId token.JTI
-	err := row.Scan(&gotId)
+func (repo *BlacklistRepository) Contains(ctx context.Context, jti token.JTI) (_ bool, err error) {
+	ctx, span := startQuery(ctx, "SELECT", "blacklist", queryExistsBlacklist)
+	defer func() { endQuery(span, err) }()
+
+	var found bool
+	err = repo.db.GetContext(ctx, &found, queryExistsBlacklist, jti, time.Now())
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return false, nil
-		}
 		return false, err
 	}
-	return true, nil
+	return found, nil
+}
+
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
 }
@@ -2,7 +2,9 @@ package postgres
 
 import (
 	"context"
+	"database/sql"
 	"medods-auth/service/auth"
+	"medods-auth/service/outbox"
 	"medods-auth/token"
 	"medods-auth/user"
 	"time"
@@ -23,11 +25,14 @@ func NewHashRepository(db *sqlx.DB) *HashRepository {
 }
 
 type TokenDBRecord struct {
-	JTI       uuid.UUID `db:"jti"`
-	UserID    uuid.UUID `db:"user_id"`
-	UserAgent string    `db:"user_agent"`
-	Hash      []byte    `db:"hash"`
-	CreatedAt time.Time `db:"created_at"`
+	JTI       uuid.UUID  `db:"jti"`
+	UserID    uuid.UUID  `db:"user_id"`
+	UserAgent string     `db:"user_agent"`
+	Hash      []byte     `db:"hash"`
+	CreatedAt time.Time  `db:"created_at"`
+	ExpiresAt *time.Time `db:"expires_at"`
+	StartedAt *time.Time `db:"started_at"`
+	ClientID  string     `db:"client_id"`
 }
 
 func dbRecordFromAuthRecord(in auth.RefreshTokenRecord) *TokenDBRecord {
@@ -37,6 +42,11 @@ func dbRecordFromAuthRecord(in auth.RefreshTokenRecord) *TokenDBRecord {
 	r.UserAgent = in.User.UserAgent
 	r.Hash = in.Hash
 	r.CreatedAt = in.CreatedAt
+	if !in.ExpiresAt.IsZero() {
+		r.ExpiresAt = &in.ExpiresAt
+	}
+	r.StartedAt = nullTime(in.StartedAt)
+	r.ClientID = in.ClientID
 	return r
 }
 
@@ -49,41 +59,230 @@ func (r *TokenDBRecord) toAuthRecord() *auth.RefreshTokenRecord {
 		},
 		Hash:      r.Hash,
 		CreatedAt: r.CreatedAt,
+		ClientID:  r.ClientID,
+	}
+	if r.ExpiresAt != nil {
+		out.ExpiresAt = *r.ExpiresAt
+	}
+	if r.StartedAt != nil {
+		out.StartedAt = *r.StartedAt
 	}
 	return out
 }
 
-func (r *HashRepository) Store(ctx context.Context, rec *auth.RefreshTokenRecord) error {
-	_, err := r.db.NamedExecContext(ctx,
-		"INSERT INTO token (jti, user_id, user_agent, hash, created_at) VALUES (:jti, :user_id, :user_agent, :hash, :created_at)",
-		dbRecordFromAuthRecord(*rec),
-	)
+const (
+	queryInsertToken        = "INSERT INTO token (jti, user_id, user_agent, hash, created_at, expires_at, started_at, client_id) VALUES (:jti, :user_id, :user_agent, :hash, :created_at, :expires_at, :started_at, :client_id)"
+	querySelectToken        = "SELECT jti, user_id, user_agent, hash, created_at, expires_at, started_at, client_id FROM token WHERE jti = $1 AND (expires_at IS NULL OR expires_at > $2)"
+	queryDeleteToken        = "DELETE FROM token WHERE jti = $1"
+	queryDeleteUserTokens   = "DELETE FROM token WHERE user_id = $1"
+	queryDeleteClientTokens = "DELETE FROM token WHERE user_id = $1 AND client_id = $2"
+	querySelectUserTokens   = "SELECT jti, user_id, user_agent, hash, created_at, expires_at, started_at, client_id FROM token WHERE user_id = $1 AND (expires_at IS NULL OR expires_at > $2)"
+	// queryLockUser serializes StoreSession per user, row locks can't stop
+	// two transactions from inserting past the limit.
+	queryLockUser = "SELECT pg_advisory_xact_lock(hashtext($1))"
+)
+
+func (r *HashRepository) Store(ctx context.Context, rec *auth.RefreshTokenRecord) (err error) {
+	ctx, span := startQuery(ctx, "INSERT", "token", queryInsertToken)
+	defer func() { endQuery(span, err) }()
+
+	_, err = r.db.NamedExecContext(ctx, queryInsertToken, dbRecordFromAuthRecord(*rec))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (r *HashRepository) Get(ctx context.Context, jti token.JTI) (*auth.RefreshTokenRecord, error) {
-	row := r.db.QueryRowxContext(
-		ctx,
-		"SELECT (jti, user_id, user_agent, hash, created_at) FROM token WHERE jti = $1",
-		jti,
-	)
+func (r *HashRepository) Get(ctx context.Context, jti token.JTI) (_ *auth.RefreshTokenRecord, err error) {
+	ctx, span := startQuery(ctx, "SELECT", "token", querySelectToken)
+	defer func() { endQuery(span, err) }()
 
 	var record TokenDBRecord
-	err := row.StructScan(&record)
+	err = r.db.GetContext(ctx, &record, querySelectToken, jti, time.Now())
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrRefreshTokenNotFound
+		}
 		return nil, err
 	}
 
 	return record.toAuthRecord(), nil
 }
 
-func (r *HashRepository) DeleteByUserId(ctx context.Context, userId uuid.UUID) error {
-	_, err := r.db.ExecContext(ctx, "DELETE FROM token WHERE user_id = $1", userId)
+func (r *HashRepository) Delete(ctx context.Context, jti token.JTI) (err error) {
+	ctx, span := startQuery(ctx, "DELETE", "token", queryDeleteToken)
+	defer func() { endQuery(span, err) }()
+
+	res, err := r.db.ExecContext(ctx, queryDeleteToken, jti)
+	if err != nil {
+		return err
+	}
+	return deletedOne(res)
+}
+
+func (r *HashRepository) DeleteByUserId(ctx context.Context, userId uuid.UUID) (err error) {
+	ctx, span := startQuery(ctx, "DELETE", "token", queryDeleteUserTokens)
+	defer func() { endQuery(span, err) }()
+
+	_, err = r.db.ExecContext(ctx, queryDeleteUserTokens, userId)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *HashRepository) DeleteByClient(ctx context.Context, userId uuid.UUID, clientID string) (err error) {
+	ctx, span := startQuery(ctx, "DELETE", "token", queryDeleteClientTokens)
+	defer func() { endQuery(span, err) }()
+
+	_, err = r.db.ExecContext(ctx, queryDeleteClientTokens, userId, clientID)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// Rotate applies rot in one transaction. The blacklist table has to be in
+// the same database.
+func (r *HashRepository) Rotate(ctx context.Context, rot auth.Rotation) (err error) {
+	return r.inTx(ctx, "Rotate", func(tx *sqlx.Tx) error {
+		if rot.Revoked != uuid.Nil {
+			_, err := tx.ExecContext(ctx, queryInsertBlacklist, rot.Revoked, time.Now(), nullTime(rot.RevokedExpiresAt))
+			if err != nil {
+				return err
+			}
+		}
+		res, err := tx.ExecContext(ctx, queryDeleteToken, rot.Previous)
+		if err != nil {
+			return err
+		}
+		err = deletedOne(res)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NamedExecContext(ctx, queryInsertToken, dbRecordFromAuthRecord(*rot.Next))
+		if err != nil {
+			return err
+		}
+		return insertOutbox(ctx, tx, rot.Outbox)
+	})
+}
+
+func (r *HashRepository) StoreWithOutbox(ctx context.Context, rec *auth.RefreshTokenRecord, msgs []outbox.Message) error {
+	return r.inTx(ctx, "StoreWithOutbox", func(tx *sqlx.Tx) error {
+		_, err := tx.NamedExecContext(ctx, queryInsertToken, dbRecordFromAuthRecord(*rec))
+		if err != nil {
+			return err
+		}
+		return insertOutbox(ctx, tx, msgs)
+	})
+}
+
+func (r *HashRepository) DeleteWithOutbox(ctx context.Context, jti token.JTI, msgs []outbox.Message) error {
+	return r.inTx(ctx, "DeleteWithOutbox", func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, queryDeleteToken, jti)
+		if err != nil {
+			return err
+		}
+		err = deletedOne(res)
+		if err != nil {
+			return err
+		}
+		return insertOutbox(ctx, tx, msgs)
+	})
+}
+
+// deletedOne fails with auth.ErrRefreshTokenNotFound unless res deleted a
+// record.
+func deletedOne(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return auth.ErrRefreshTokenNotFound
+	}
+	return nil
+}
+
+func (r *HashRepository) DeleteByUserIdWithOutbox(ctx context.Context, userId uuid.UUID, msgs []outbox.Message) error {
+	return r.inTx(ctx, "DeleteByUserIdWithOutbox", func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, queryDeleteUserTokens, userId)
+		if err != nil {
+			return err
+		}
+		return insertOutbox(ctx, tx, msgs)
+	})
+}
+
+func (r *HashRepository) DeleteByClientWithOutbox(ctx context.Context, userId uuid.UUID, clientID string, msgs []outbox.Message) error {
+	return r.inTx(ctx, "DeleteByClientWithOutbox", func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, queryDeleteClientTokens, userId, clientID)
+		if err != nil {
+			return err
+		}
+		return insertOutbox(ctx, tx, msgs)
+	})
+}
+
+func (r *HashRepository) StoreSession(ctx context.Context, ns auth.NewSession) ([]auth.RefreshTokenRecord, error) {
+	var evicted []auth.RefreshTokenRecord
+	err := r.inTx(ctx, "StoreSession", func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, queryLockUser, "token:"+ns.Record.User.Id.String())
+		if err != nil {
+			return err
+		}
+		var records []TokenDBRecord
+		err = tx.SelectContext(ctx, &records, querySelectUserTokens, ns.Record.User.Id, time.Now())
+		if err != nil {
+			return err
+		}
+		sessions := make([]auth.RefreshTokenRecord, len(records))
+		for i := range records {
+			sessions[i] = *records[i].toAuthRecord()
+		}
+		evicted, err = ns.Limit.Evict(sessions)
+		if err != nil {
+			return err
+		}
+		for _, rec := range evicted {
+			_, err = tx.ExecContext(ctx, queryDeleteToken, rec.JTI)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.NamedExecContext(ctx, queryInsertToken, dbRecordFromAuthRecord(*ns.Record))
+		if err != nil {
+			return err
+		}
+		msgs := ns.Outbox
+		if ns.EvictionOutbox != nil && len(evicted) > 0 {
+			evictions, err := ns.EvictionOutbox(evicted)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, evictions...)
+		}
+		return insertOutbox(ctx, tx, msgs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return evicted, nil
+}
+
+func (r *HashRepository) inTx(ctx context.Context, name string, fn func(*sqlx.Tx) error) (err error) {
+	ctx, span := startQuery(ctx, "TRANSACTION", "token", name)
+	defer func() { endQuery(span, err) }()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,114 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"medods-auth/service/lockout"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// LockoutRepository shares login failures between replicas.
+type LockoutRepository struct {
+	db *sqlx.DB
+}
+
+func NewLockoutRepository(db *sqlx.DB) *LockoutRepository {
+	return &LockoutRepository{
+		db,
+	}
+}
+
+type lockoutDBRecord struct {
+	Failures    int          `db:"failures"`
+	UpdatedAt   time.Time    `db:"updated_at"`
+	LockedUntil time.Time    `db:"locked_until"`
+	ExpiresAt   sql.NullTime `db:"expires_at"`
+}
+
+const (
+	querySelectLockout = "SELECT failures, updated_at, locked_until, expires_at FROM lockout WHERE key = $1"
+	queryInsertLockout = "INSERT INTO lockout (key, failures, updated_at, locked_until) VALUES ($1, 0, $2, $2) ON CONFLICT (key) DO NOTHING"
+	queryLockLockout   = querySelectLockout + " FOR UPDATE"
+	queryUpdateLockout = "UPDATE lockout SET failures = $2, updated_at = $3, locked_until = $4, expires_at = $5 WHERE key = $1"
+	queryDeleteLockout = "DELETE FROM lockout WHERE key = $1"
+)
+
+func (r *LockoutRepository) Get(ctx context.Context, key string) (_ lockout.State, err error) {
+	ctx, span := startQuery(ctx, "SELECT", "lockout", querySelectLockout)
+	defer func() { endQuery(span, err) }()
+
+	var rec lockoutDBRecord
+	err = r.db.GetContext(ctx, &rec, querySelectLockout, key)
+	if err == sql.ErrNoRows {
+		return lockout.State{}, nil
+	}
+	if err != nil {
+		return lockout.State{}, err
+	}
+	return rec.state(time.Now()), nil
+}
+
+func (r *LockoutRepository) Fail(ctx context.Context, key string, policy lockout.Policy, now time.Time) (_ lockout.State, err error) {
+	ctx, span := startQuery(ctx, "UPDATE", "lockout", queryUpdateLockout)
+	defer func() { endQuery(span, err) }()
+
+	now = now.UTC()
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return lockout.State{}, err
+	}
+	defer tx.Rollback()
+
+	// a missing state has no failures, the insert only gives the select a
+	// row to lock
+	_, err = tx.ExecContext(ctx, queryInsertLockout, key, now)
+	if err != nil {
+		return lockout.State{}, err
+	}
+	var rec lockoutDBRecord
+	err = tx.GetContext(ctx, &rec, queryLockLockout, key)
+	if err != nil {
+		return lockout.State{}, err
+	}
+	state := rec.state(now).Fail(policy, now)
+
+	expires := sql.NullTime{Time: state.Expires(policy)}
+	expires.Valid = !expires.Time.IsZero()
+	_, err = tx.ExecContext(ctx, queryUpdateLockout, key, state.Failures, state.UpdatedAt, state.LockedUntil.UTC(), expires)
+	if err != nil {
+		return lockout.State{}, err
+	}
+	return state, tx.Commit()
+}
+
+func (r *LockoutRepository) Reset(ctx context.Context, key string) (err error) {
+	ctx, span := startQuery(ctx, "DELETE", "lockout", queryDeleteLockout)
+	defer func() { endQuery(span, err) }()
+
+	_, err = r.db.ExecContext(ctx, queryDeleteLockout, key)
+	return err
+}
+
+// Sweep deletes expired states, returning how many.
+func (r *LockoutRepository) Sweep(ctx context.Context, now time.Time) (n int, err error) {
+	const query = "DELETE FROM lockout WHERE expires_at <= $1"
+	ctx, span := startQuery(ctx, "DELETE", "lockout", query)
+	defer func() { endQuery(span, err) }()
+
+	res, err := r.db.ExecContext(ctx, query, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	affected, err := res.RowsAffected()
+	return int(affected), err
+}
+
+// state treats expired records as missing ones.
+func (rec lockoutDBRecord) state(now time.Time) lockout.State {
+	if rec.ExpiresAt.Valid && !now.Before(rec.ExpiresAt.Time) {
+		return lockout.State{}
+	}
+	return lockout.State{Failures: rec.Failures, UpdatedAt: rec.UpdatedAt, LockedUntil: rec.LockedUntil}
+}
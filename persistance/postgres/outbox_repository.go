@@ -0,0 +1,169 @@
+package postgres
+
+import (
+	"context"
+	"medods-auth/service/outbox"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+type OutboxRepository struct {
+	db *sqlx.DB
+}
+
+func NewOutboxRepository(db *sqlx.DB) *OutboxRepository {
+	return &OutboxRepository{
+		db,
+	}
+}
+
+type OutboxDBRecord struct {
+	ID            uuid.UUID  `db:"id"`
+	Topic         string     `db:"topic"`
+	Payload       []byte     `db:"payload"`
+	CreatedAt     time.Time  `db:"created_at"`
+	Status        string     `db:"status"`
+	Attempts      int        `db:"attempts"`
+	NextAttemptAt time.Time  `db:"next_attempt_at"`
+	LockedUntil   *time.Time `db:"locked_until"`
+	LastError     string     `db:"last_error"`
+}
+
+func outboxRecordFromMessage(m outbox.Message) *OutboxDBRecord {
+	return &OutboxDBRecord{
+		ID:            m.ID,
+		Topic:         m.Topic,
+		Payload:       m.Payload,
+		CreatedAt:     m.CreatedAt.UTC(),
+		Status:        string(m.Status),
+		Attempts:      m.Attempts,
+		NextAttemptAt: m.NextAttemptAt.UTC(),
+		LastError:     m.LastError,
+	}
+}
+
+func (r *OutboxDBRecord) toMessage() outbox.Message {
+	return outbox.Message{
+		ID:            r.ID,
+		Topic:         r.Topic,
+		Payload:       r.Payload,
+		CreatedAt:     r.CreatedAt,
+		Status:        outbox.Status(r.Status),
+		Attempts:      r.Attempts,
+		NextAttemptAt: r.NextAttemptAt,
+		LastError:     r.LastError,
+	}
+}
+
+const (
+	outboxColumns = "id, topic, payload, created_at, status, attempts, next_attempt_at, locked_until, last_error"
+
+	queryInsertOutbox = "INSERT INTO outbox (" + outboxColumns + ") VALUES (:id, :topic, :payload, :created_at, :status, :attempts, :next_attempt_at, :locked_until, :last_error)"
+	queryClaimOutbox  = `UPDATE outbox SET locked_until = $1 WHERE id IN (
+    SELECT id FROM outbox
+    WHERE status = 'pending' AND next_attempt_at <= $2 AND (locked_until IS NULL OR locked_until <= $2)
+    ORDER BY created_at LIMIT $3
+    FOR UPDATE SKIP LOCKED
+) RETURNING ` + outboxColumns
+	queryFailOutbox     = "UPDATE outbox SET status = $1, attempts = $2, next_attempt_at = $3, last_error = $4, locked_until = NULL WHERE id = $5"
+	queryDeleteOutbox   = "DELETE FROM outbox WHERE id = $1"
+	queryListOutbox     = "SELECT " + outboxColumns + " FROM outbox WHERE status = $1 ORDER BY created_at LIMIT $2"
+	queryReplayOutbox   = "UPDATE outbox SET status = 'pending', attempts = 0, next_attempt_at = $1, locked_until = NULL WHERE status = 'dead'"
+	queryReplayOutboxID = queryReplayOutbox + " AND id = ANY($2::uuid[])"
+)
+
+func insertOutbox(ctx context.Context, tx *sqlx.Tx, msgs []outbox.Message) error {
+	for _, m := range msgs {
+		_, err := tx.NamedExecContext(ctx, queryInsertOutbox, outboxRecordFromMessage(m))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *OutboxRepository) Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) (_ []outbox.Message, err error) {
+	ctx, span := startQuery(ctx, "UPDATE", "outbox", queryClaimOutbox)
+	defer func() { endQuery(span, err) }()
+
+	now = now.UTC()
+	var records []OutboxDBRecord
+	err = r.db.SelectContext(ctx, &records, queryClaimOutbox, now.Add(lease), now, limit)
+	if err != nil {
+		return nil, err
+	}
+	return toMessages(records), nil
+}
+
+func (r *OutboxRepository) Delete(ctx context.Context, id uuid.UUID) (err error) {
+	ctx, span := startQuery(ctx, "DELETE", "outbox", queryDeleteOutbox)
+	defer func() { endQuery(span, err) }()
+
+	_, err = r.db.ExecContext(ctx, queryDeleteOutbox, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *OutboxRepository) Fail(ctx context.Context, m outbox.Message) (err error) {
+	ctx, span := startQuery(ctx, "UPDATE", "outbox", queryFailOutbox)
+	defer func() { endQuery(span, err) }()
+
+	_, err = r.db.ExecContext(ctx, queryFailOutbox,
+		m.Status, m.Attempts, m.NextAttemptAt.UTC(), m.LastError, m.ID,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *OutboxRepository) List(ctx context.Context, status outbox.Status, limit int) (_ []outbox.Message, err error) {
+	ctx, span := startQuery(ctx, "SELECT", "outbox", queryListOutbox)
+	defer func() { endQuery(span, err) }()
+
+	var records []OutboxDBRecord
+	err = r.db.SelectContext(ctx, &records, queryListOutbox, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	return toMessages(records), nil
+}
+
+func (r *OutboxRepository) Replay(ctx context.Context, ids []uuid.UUID) (_ int, err error) {
+	query := queryReplayOutbox
+	args := []any{time.Now().UTC()}
+	if len(ids) > 0 {
+		query = queryReplayOutboxID
+		strs := make([]string, len(ids))
+		for i, id := range ids {
+			strs[i] = id.String()
+		}
+		args = append(args, pq.Array(strs))
+	}
+	ctx, span := startQuery(ctx, "UPDATE", "outbox", query)
+	defer func() { endQuery(span, err) }()
+
+	res, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func toMessages(records []OutboxDBRecord) []outbox.Message {
+	out := make([]outbox.Message, len(records))
+	for i := range records {
+		out[i] = records[i].toMessage()
+	}
+	slices.SortFunc(out, func(a, b outbox.Message) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return out
+}
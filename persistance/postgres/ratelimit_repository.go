@@ -0,0 +1,81 @@
+package postgres
+
+import (
+	"context"
+	"medods-auth/service/ratelimit"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// RateLimitRepository shares token buckets between replicas.
+type RateLimitRepository struct {
+	db *sqlx.DB
+}
+
+func NewRateLimitRepository(db *sqlx.DB) *RateLimitRepository {
+	return &RateLimitRepository{
+		db,
+	}
+}
+
+type RateLimitDBRecord struct {
+	Key       string    `db:"key"`
+	Tokens    float64   `db:"tokens"`
+	UpdatedAt time.Time `db:"updated_at"`
+	FullAt    time.Time `db:"full_at"`
+}
+
+const (
+	queryInsertRateLimit = "INSERT INTO rate_limit (key, tokens, updated_at, full_at) VALUES ($1, $2, $3, $3) ON CONFLICT (key) DO NOTHING"
+	querySelectRateLimit = "SELECT key, tokens, updated_at, full_at FROM rate_limit WHERE key = $1 FOR UPDATE"
+	queryUpdateRateLimit = "UPDATE rate_limit SET tokens = $2, updated_at = $3, full_at = $4 WHERE key = $1"
+)
+
+func (r *RateLimitRepository) Allow(ctx context.Context, key string, limit ratelimit.Limit, now time.Time) (res ratelimit.Result, err error) {
+	ctx, span := startQuery(ctx, "UPDATE", "rate_limit", queryUpdateRateLimit)
+	defer func() { endQuery(span, err) }()
+
+	now = now.UTC()
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	// a missing bucket is full, the insert only gives the select a row to lock
+	_, err = tx.ExecContext(ctx, queryInsertRateLimit, key, limit.Burst, now)
+	if err != nil {
+		return res, err
+	}
+	var rec RateLimitDBRecord
+	err = tx.GetContext(ctx, &rec, querySelectRateLimit, key)
+	if err != nil {
+		return res, err
+	}
+	bucket := ratelimit.Bucket{Tokens: rec.Tokens, UpdatedAt: rec.UpdatedAt}
+	if !now.Before(rec.FullAt) {
+		bucket = ratelimit.FullBucket(limit, now)
+	}
+	bucket, res = bucket.Take(limit, now)
+
+	_, err = tx.ExecContext(ctx, queryUpdateRateLimit, key, bucket.Tokens, now, now.Add(res.Reset))
+	if err != nil {
+		return res, err
+	}
+	return res, tx.Commit()
+}
+
+// Sweep deletes buckets that have refilled, returning how many.
+func (r *RateLimitRepository) Sweep(ctx context.Context, now time.Time) (n int, err error) {
+	const query = "DELETE FROM rate_limit WHERE full_at <= $1"
+	ctx, span := startQuery(ctx, "DELETE", "rate_limit", query)
+	defer func() { endQuery(span, err) }()
+
+	res, err := r.db.ExecContext(ctx, query, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	affected, err := res.RowsAffected()
+	return int(affected), err
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"medods-auth/logging"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -14,13 +15,153 @@ var schemaToken = `CREATE TABLE IF NOT EXISTS token (
     user_id UUID NOT NULL,
     user_agent TEXT,
     hash BYTEA NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP
+);
+ALTER TABLE token ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+ALTER TABLE token ADD COLUMN IF NOT EXISTS started_at TIMESTAMP;
+ALTER TABLE token ADD COLUMN IF NOT EXISTS client_id TEXT NOT NULL DEFAULT '';`
+
+var schemaUser = `CREATE TABLE IF NOT EXISTS users (
+    id UUID PRIMARY KEY,
+    status TEXT NOT NULL CHECK (status IN ('active', 'disabled', 'locked')),
+    created_at TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS credentials (
+    user_id UUID PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    login TEXT NOT NULL UNIQUE,
+    hash TEXT NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS totp (
+    user_id UUID PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    secret TEXT NOT NULL,
+    active BOOLEAN NOT NULL,
+    last_step BIGINT NOT NULL,
+    recovery_codes TEXT[] NOT NULL,
+    version BIGINT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS passkeys (
+    id BYTEA PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    public_key BYTEA NOT NULL,
+    sign_count BIGINT NOT NULL,
+    transports TEXT[] NOT NULL,
     created_at TIMESTAMP NOT NULL
-);`
+);
+CREATE INDEX IF NOT EXISTS passkeys_user_id_idx ON passkeys (user_id);
+CREATE TABLE IF NOT EXISTS webauthn_challenges (
+    value BYTEA PRIMARY KEY,
+    user_id UUID NOT NULL,
+    ceremony TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    secret_hash TEXT NOT NULL,
+    scopes TEXT[] NOT NULL,
+    access_ttl_ms BIGINT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS public BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS redirect_uris TEXT[] NOT NULL DEFAULT '{}';
+CREATE TABLE IF NOT EXISTS oauth_codes (
+    hash TEXT PRIMARY KEY,
+    client_id TEXT NOT NULL,
+    user_id UUID NOT NULL,
+    redirect_uri TEXT NOT NULL,
+    scope TEXT NOT NULL,
+    code_challenge TEXT NOT NULL,
+    amr TEXT[] NOT NULL,
+    auth_time TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS oauth_consents (
+    user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    client_id TEXT NOT NULL REFERENCES oauth_clients (id) ON DELETE CASCADE,
+    scopes TEXT[] NOT NULL,
+    granted_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_id, client_id)
+);
+CREATE TABLE IF NOT EXISTS oauth_device_codes (
+    hash TEXT PRIMARY KEY,
+    user_code TEXT NOT NULL UNIQUE,
+    client_id TEXT NOT NULL,
+    scope TEXT NOT NULL,
+    status TEXT NOT NULL,
+    user_id UUID NOT NULL,
+    amr TEXT[] NOT NULL,
+    auth_time TIMESTAMPTZ NOT NULL,
+    last_polled_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    keep_until TIMESTAMPTZ NOT NULL
+);
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS post_logout_redirect_uris TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE oauth_codes ADD COLUMN IF NOT EXISTS nonce TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_device_codes ADD COLUMN IF NOT EXISTS interval_ms BIGINT NOT NULL DEFAULT 0;`
+
+var schemaOutbox = `CREATE TABLE IF NOT EXISTS outbox (
+    id UUID PRIMARY KEY,
+    topic TEXT NOT NULL,
+    payload BYTEA NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    status TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP,
+    last_error TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS outbox_due_idx ON outbox (status, next_attempt_at);`
 
 var schemaBlacklist = `CREATE TABLE IF NOT EXISTS blacklist (
     jti UUID PRIMARY KEY,
-    created_at TIMESTAMP NOT NULL
-);`
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP
+);
+ALTER TABLE blacklist ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;`
+
+var schemaRateLimit = `CREATE TABLE IF NOT EXISTS rate_limit (
+    key TEXT PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    full_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS rate_limit_full_idx ON rate_limit (full_at);`
+
+var schemaLockout = `CREATE TABLE IF NOT EXISTS lockout (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    locked_until TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS lockout_expires_idx ON lockout (expires_at);`
+
+var schemaAudit = `CREATE TABLE IF NOT EXISTS audit_log (
+    seq BIGINT PRIMARY KEY,
+    time TIMESTAMPTZ NOT NULL,
+    event TEXT NOT NULL,
+    outcome TEXT NOT NULL,
+    error_code TEXT NOT NULL,
+    user_id UUID NOT NULL,
+    jti TEXT NOT NULL,
+    issued_jti TEXT NOT NULL,
+    ip TEXT NOT NULL,
+    user_agent TEXT NOT NULL,
+    prev_hash TEXT NOT NULL,
+    hash TEXT NOT NULL
+);
+ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS client_id TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS audit_log_user_id_idx ON audit_log (user_id, seq);
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();`
 
 type PostgresConfig struct {
 	Host     string
@@ -35,6 +176,10 @@ type PostgresConfig struct {
 
 	HashDatabase      bool
 	BlackListDatabase bool
+	AuditDatabase     bool
+	RateLimitDatabase bool
+	LockoutDatabase   bool
+	UserDatabase      bool
 
 	SkipSSL bool
 }
@@ -45,7 +190,7 @@ func InitDatabase(conf *PostgresConfig) (*sqlx.DB, error) {
 		return nil, err
 	}
 
-	if !conf.HashDatabase && !conf.BlackListDatabase {
+	if !conf.HashDatabase && !conf.BlackListDatabase && !conf.AuditDatabase && !conf.RateLimitDatabase && !conf.LockoutDatabase && !conf.UserDatabase {
 		return db, nil
 	}
 
@@ -59,6 +204,12 @@ func InitDatabase(conf *PostgresConfig) (*sqlx.DB, error) {
 			db.Close()
 			return nil, err
 		}
+		// the outbox is written together with the token table
+		_, err = tx.ExecContext(context.TODO(), schemaOutbox)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
 	if conf.BlackListDatabase {
 		_, err = tx.ExecContext(context.TODO(), schemaBlacklist)
@@ -67,6 +218,34 @@ func InitDatabase(conf *PostgresConfig) (*sqlx.DB, error) {
 			return nil, err
 		}
 	}
+	if conf.AuditDatabase {
+		_, err = tx.ExecContext(context.TODO(), schemaAudit)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if conf.RateLimitDatabase {
+		_, err = tx.ExecContext(context.TODO(), schemaRateLimit)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if conf.LockoutDatabase {
+		_, err = tx.ExecContext(context.TODO(), schemaLockout)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if conf.UserDatabase {
+		_, err = tx.ExecContext(context.TODO(), schemaUser)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
 	err = tx.Commit()
 	if err != nil {
 		return nil, err
@@ -86,7 +265,8 @@ func connect(conf *PostgresConfig) (*sqlx.DB, error) {
 		connstr += " sslmode=disable"
 	}
 
-	fmt.Println(connstr)
+	logging.For("postgres").Debug("connecting to database",
+		"host", conf.Host, "port", conf.Port, "user", conf.User, "dbname", conf.Name)
 
 	db, err := sqlx.Connect("postgres", connstr)
 	if err != nil {
@@ -122,8 +302,12 @@ func (c *PostgresConfig) validate() error {
 		c.User == "" ||
 		c.Password == "" ||
 		c.Name == "" {
+		password := ""
+		if c.Password != "" {
+			password = logging.Redacted
+		}
 		res := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s",
-			c.Host, c.Port, c.User, c.Password, c.Name)
+			c.Host, c.Port, c.User, password, c.Name)
 		return errors.New("invalid postgres connection string:\n" + res)
 	}
 	return nil
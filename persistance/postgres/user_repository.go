@@ -0,0 +1,698 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"medods-auth/service/auth"
+	"medods-auth/user"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+type UserRepository struct {
+	db *sqlx.DB
+}
+
+func NewUserRepository(db *sqlx.DB) *UserRepository {
+	return &UserRepository{
+		db,
+	}
+}
+
+type userDBRecord struct {
+	ID        uuid.UUID   `db:"id"`
+	Status    user.Status `db:"status"`
+	CreatedAt time.Time   `db:"created_at"`
+}
+
+const (
+	queryInsertUser = "INSERT INTO users (id, status, created_at) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING"
+	querySelectUser = "SELECT id, status, created_at FROM users WHERE id = $1"
+	queryUpdateUser = "UPDATE users SET status = $1 WHERE id = $2"
+	queryDeleteUser = "DELETE FROM users WHERE id = $1"
+
+	querySelectLoginOwner = "SELECT user_id FROM credentials WHERE login = $1"
+	queryUpsertCredential = `INSERT INTO credentials (user_id, login, hash, updated_at) VALUES ($1, $2, $3, $4)
+ON CONFLICT (user_id) DO UPDATE SET login = excluded.login, hash = excluded.hash, updated_at = excluded.updated_at`
+	querySelectCredential     = "SELECT user_id, login, hash FROM credentials WHERE login = $1"
+	querySelectUserCredential = "SELECT user_id, login, hash FROM credentials WHERE user_id = $1"
+	queryUpdateCredentialHash = "UPDATE credentials SET hash = $1, updated_at = $2 WHERE user_id = $3 AND hash = $4"
+
+	querySelectTOTP = "SELECT user_id, secret, active, last_step, recovery_codes, version FROM totp WHERE user_id = $1"
+	queryInsertTOTP = `INSERT INTO totp (user_id, secret, active, last_step, recovery_codes, version) VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (user_id) DO NOTHING`
+	queryUpdateTOTP = `UPDATE totp SET secret = $1, active = $2, last_step = $3, recovery_codes = $4, version = $5
+WHERE user_id = $6 AND version = $7`
+	queryDeleteTOTP = "DELETE FROM totp WHERE user_id = $1"
+
+	queryInsertPasskey = `INSERT INTO passkeys (id, user_id, public_key, sign_count, transports, created_at) VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (id) DO NOTHING`
+	querySelectPasskey   = "SELECT id, user_id, public_key, sign_count, transports, created_at FROM passkeys WHERE id = $1"
+	querySelectPasskeys  = "SELECT id, user_id, public_key, sign_count, transports, created_at FROM passkeys WHERE user_id = $1 ORDER BY created_at"
+	queryUpdateSignCount = "UPDATE passkeys SET sign_count = $1 WHERE id = $2 AND sign_count = $3"
+
+	queryDeleteExpiredChallenges = "DELETE FROM webauthn_challenges WHERE expires_at <= $1"
+	queryInsertChallenge         = "INSERT INTO webauthn_challenges (value, user_id, ceremony, expires_at) VALUES ($1, $2, $3, $4)"
+	queryTakeChallenge           = "DELETE FROM webauthn_challenges WHERE value = $1 RETURNING user_id, ceremony, expires_at"
+
+	queryInsertClient = `INSERT INTO oauth_clients (id, name, secret_hash, public, scopes, redirect_uris, post_logout_redirect_uris, access_ttl_ms, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (id) DO NOTHING`
+	querySelectClient = `SELECT id, name, secret_hash, public, scopes, redirect_uris, post_logout_redirect_uris, access_ttl_ms, created_at
+FROM oauth_clients WHERE id = $1`
+	queryDeleteClient = "DELETE FROM oauth_clients WHERE id = $1"
+
+	queryDeleteExpiredAuthCodes = "DELETE FROM oauth_codes WHERE expires_at <= $1"
+	queryInsertAuthCode         = `INSERT INTO oauth_codes (hash, client_id, user_id, redirect_uri, scope, code_challenge, nonce, amr, auth_time, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	queryTakeAuthCode = `DELETE FROM oauth_codes WHERE hash = $1
+RETURNING client_id, user_id, redirect_uri, scope, code_challenge, nonce, amr, auth_time, expires_at`
+
+	querySelectConsent = "SELECT scopes, granted_at FROM oauth_consents WHERE user_id = $1 AND client_id = $2"
+	queryUpsertConsent = `INSERT INTO oauth_consents (user_id, client_id, scopes, granted_at) VALUES ($1, $2, $3, $4)
+ON CONFLICT (user_id, client_id) DO UPDATE SET scopes = EXCLUDED.scopes, granted_at = EXCLUDED.granted_at`
+
+	queryDeleteStaleDeviceCodes = "DELETE FROM oauth_device_codes WHERE keep_until <= $1"
+	queryInsertDeviceCode       = `INSERT INTO oauth_device_codes
+(hash, user_code, client_id, scope, status, user_id, amr, auth_time, last_polled_at, interval_ms, expires_at, keep_until)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) ON CONFLICT (user_code) DO NOTHING`
+	querySelectDeviceCode = `SELECT hash, user_code, client_id, scope, status, user_id, amr, auth_time, last_polled_at, interval_ms, expires_at, keep_until
+FROM oauth_device_codes WHERE user_code = $1 AND keep_until > $2`
+	queryDecideDeviceCode = `UPDATE oauth_device_codes SET status = $1, user_id = $2, amr = $3, auth_time = $4
+WHERE user_code = $5 AND status = $6 AND expires_at > $7`
+	querySlowDownDeviceCode = `UPDATE oauth_device_codes SET interval_ms = $1
+WHERE hash = $2 AND status = $3 AND keep_until > $4`
+	// queryPollDeviceCode returns the code as it was before the poll.
+	queryPollDeviceCode = `WITH polled AS (
+    SELECT hash, user_code, client_id, scope, status, user_id, amr, auth_time, last_polled_at, interval_ms, expires_at, keep_until
+    FROM oauth_device_codes WHERE hash = $1 AND keep_until > $2 FOR UPDATE
+), updated AS (
+    UPDATE oauth_device_codes SET last_polled_at = $2 WHERE hash IN (SELECT hash FROM polled WHERE status = $3)
+), deleted AS (
+    DELETE FROM oauth_device_codes WHERE hash IN (SELECT hash FROM polled WHERE status <> $3)
+)
+SELECT * FROM polled`
+
+	pgUniqueViolation     = "23505"
+	pgForeignKeyViolation = "23503"
+)
+
+type credentialDBRecord struct {
+	UserID uuid.UUID `db:"user_id"`
+	Login  string    `db:"login"`
+	Hash   string    `db:"hash"`
+}
+
+func (r *UserRepository) Create(ctx context.Context, account *user.Account) (err error) {
+	ctx, span := startQuery(ctx, "INSERT", "users", queryInsertUser)
+	defer func() { endQuery(span, err) }()
+
+	res, err := r.db.ExecContext(ctx, queryInsertUser, account.Id, account.Status, account.CreatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrUserExists)
+}
+
+func (r *UserRepository) Get(ctx context.Context, id uuid.UUID) (_ *user.Account, err error) {
+	ctx, span := startQuery(ctx, "SELECT", "users", querySelectUser)
+	defer func() { endQuery(span, err) }()
+
+	var record userDBRecord
+	err = r.db.GetContext(ctx, &record, querySelectUser, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user.Account{
+		Id:        record.ID,
+		Status:    record.Status,
+		CreatedAt: record.CreatedAt,
+	}, nil
+}
+
+func (r *UserRepository) SetStatus(ctx context.Context, id uuid.UUID, status user.Status) (err error) {
+	ctx, span := startQuery(ctx, "UPDATE", "users", queryUpdateUser)
+	defer func() { endQuery(span, err) }()
+
+	res, err := r.db.ExecContext(ctx, queryUpdateUser, status, id)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrUserNotFound)
+}
+
+func (r *UserRepository) Delete(ctx context.Context, id uuid.UUID) (err error) {
+	ctx, span := startQuery(ctx, "DELETE", "users", queryDeleteUser)
+	defer func() { endQuery(span, err) }()
+
+	res, err := r.db.ExecContext(ctx, queryDeleteUser, id)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrUserNotFound)
+}
+
+// SetCredential relies on the unique login constraint for concurrent
+// writers, the check up front gives the usual case a clean error.
+func (r *UserRepository) SetCredential(ctx context.Context, cred auth.Credential) (err error) {
+	ctx, span := startQuery(ctx, "INSERT", "credentials", queryUpsertCredential)
+	defer func() { endQuery(span, err) }()
+
+	var owner uuid.UUID
+	err = r.db.GetContext(ctx, &owner, querySelectLoginOwner, cred.Login)
+	if err == nil && owner != cred.UserID {
+		return auth.ErrLoginTaken
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, queryUpsertCredential, cred.UserID, cred.Login, cred.Hash, time.Now().UTC())
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case pgUniqueViolation:
+			return auth.ErrLoginTaken
+		case pgForeignKeyViolation:
+			return auth.ErrUserNotFound
+		}
+	}
+	return err
+}
+
+func (r *UserRepository) GetCredential(ctx context.Context, login string) (_ *auth.Credential, err error) {
+	ctx, span := startQuery(ctx, "SELECT", "credentials", querySelectCredential)
+	defer func() { endQuery(span, err) }()
+
+	var cred credentialDBRecord
+	err = r.db.GetContext(ctx, &cred, querySelectCredential, login)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrCredentialNotFound
+		}
+		return nil, err
+	}
+	return &auth.Credential{UserID: cred.UserID, Login: cred.Login, Hash: cred.Hash}, nil
+}
+
+func (r *UserRepository) GetUserCredential(ctx context.Context, userID uuid.UUID) (_ *auth.Credential, err error) {
+	ctx, span := startQuery(ctx, "SELECT", "credentials", querySelectUserCredential)
+	defer func() { endQuery(span, err) }()
+
+	var cred credentialDBRecord
+	err = r.db.GetContext(ctx, &cred, querySelectUserCredential, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrCredentialNotFound
+		}
+		return nil, err
+	}
+	return &auth.Credential{UserID: cred.UserID, Login: cred.Login, Hash: cred.Hash}, nil
+}
+
+func (r *UserRepository) UpdateCredentialHash(ctx context.Context, userID uuid.UUID, old, new string) (err error) {
+	ctx, span := startQuery(ctx, "UPDATE", "credentials", queryUpdateCredentialHash)
+	defer func() { endQuery(span, err) }()
+
+	_, err = r.db.ExecContext(ctx, queryUpdateCredentialHash, new, time.Now().UTC(), userID, old)
+	return err
+}
+
+type totpDBRecord struct {
+	UserID        uuid.UUID      `db:"user_id"`
+	Secret        string         `db:"secret"`
+	Active        bool           `db:"active"`
+	LastStep      int64          `db:"last_step"`
+	RecoveryCodes pq.StringArray `db:"recovery_codes"`
+	Version       int64          `db:"version"`
+}
+
+func (r *UserRepository) GetTOTP(ctx context.Context, userID uuid.UUID) (_ *auth.TOTP, err error) {
+	ctx, span := startQuery(ctx, "SELECT", "totp", querySelectTOTP)
+	defer func() { endQuery(span, err) }()
+
+	var record totpDBRecord
+	err = r.db.GetContext(ctx, &record, querySelectTOTP, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrTOTPNotEnrolled
+		}
+		return nil, err
+	}
+	return &auth.TOTP{
+		UserID:        record.UserID,
+		Secret:        record.Secret,
+		Active:        record.Active,
+		LastStep:      record.LastStep,
+		RecoveryCodes: record.RecoveryCodes,
+		Version:       record.Version,
+	}, nil
+}
+
+// PutTOTP can't tell a missing user from a conflict on updates, only the
+// first version needs the user to exist.
+func (r *UserRepository) PutTOTP(ctx context.Context, t *auth.TOTP) (err error) {
+	op, query := "UPDATE", queryUpdateTOTP
+	if t.Version == 1 {
+		op, query = "INSERT", queryInsertTOTP
+	}
+	ctx, span := startQuery(ctx, op, "totp", query)
+	defer func() { endQuery(span, err) }()
+
+	codes := pq.StringArray(t.RecoveryCodes)
+	if codes == nil {
+		codes = pq.StringArray{}
+	}
+	var res sql.Result
+	if t.Version == 1 {
+		res, err = r.db.ExecContext(ctx, query, t.UserID, t.Secret, t.Active, t.LastStep, codes, t.Version)
+	} else {
+		res, err = r.db.ExecContext(ctx, query, t.Secret, t.Active, t.LastStep, codes, t.Version, t.UserID, t.Version-1)
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pgForeignKeyViolation {
+		return auth.ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrTOTPConflict)
+}
+
+func (r *UserRepository) DeleteTOTP(ctx context.Context, userID uuid.UUID) (err error) {
+	ctx, span := startQuery(ctx, "DELETE", "totp", queryDeleteTOTP)
+	defer func() { endQuery(span, err) }()
+
+	res, err := r.db.ExecContext(ctx, queryDeleteTOTP, userID)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrTOTPNotEnrolled)
+}
+
+type passkeyDBRecord struct {
+	ID         []byte         `db:"id"`
+	UserID     uuid.UUID      `db:"user_id"`
+	PublicKey  []byte         `db:"public_key"`
+	SignCount  uint32         `db:"sign_count"`
+	Transports pq.StringArray `db:"transports"`
+	CreatedAt  time.Time      `db:"created_at"`
+}
+
+func (rec passkeyDBRecord) toPasskey() auth.Passkey {
+	return auth.Passkey{
+		ID:         rec.ID,
+		UserID:     rec.UserID,
+		PublicKey:  rec.PublicKey,
+		SignCount:  rec.SignCount,
+		Transports: rec.Transports,
+		CreatedAt:  rec.CreatedAt,
+	}
+}
+
+func (r *UserRepository) AddPasskey(ctx context.Context, p *auth.Passkey) (err error) {
+	ctx, span := startQuery(ctx, "INSERT", "passkeys", queryInsertPasskey)
+	defer func() { endQuery(span, err) }()
+
+	transports := pq.StringArray(p.Transports)
+	if transports == nil {
+		transports = pq.StringArray{}
+	}
+	res, err := r.db.ExecContext(ctx, queryInsertPasskey,
+		p.ID, p.UserID, p.PublicKey, p.SignCount, transports, p.CreatedAt.UTC())
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pgForeignKeyViolation {
+		return auth.ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrPasskeyExists)
+}
+
+func (r *UserRepository) GetPasskey(ctx context.Context, id []byte) (_ *auth.Passkey, err error) {
+	ctx, span := startQuery(ctx, "SELECT", "passkeys", querySelectPasskey)
+	defer func() { endQuery(span, err) }()
+
+	var record passkeyDBRecord
+	err = r.db.GetContext(ctx, &record, querySelectPasskey, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrPasskeyNotFound
+		}
+		return nil, err
+	}
+	p := record.toPasskey()
+	return &p, nil
+}
+
+func (r *UserRepository) ListPasskeys(ctx context.Context, userID uuid.UUID) (_ []auth.Passkey, err error) {
+	ctx, span := startQuery(ctx, "SELECT", "passkeys", querySelectPasskeys)
+	defer func() { endQuery(span, err) }()
+
+	var records []passkeyDBRecord
+	err = r.db.SelectContext(ctx, &records, querySelectPasskeys, userID)
+	if err != nil {
+		return nil, err
+	}
+	var out []auth.Passkey
+	for _, record := range records {
+		out = append(out, record.toPasskey())
+	}
+	return out, nil
+}
+
+// UpdateSignCount can't tell a missing passkey from a changed count.
+func (r *UserRepository) UpdateSignCount(ctx context.Context, id []byte, old, new uint32) (err error) {
+	ctx, span := startQuery(ctx, "UPDATE", "passkeys", queryUpdateSignCount)
+	defer func() { endQuery(span, err) }()
+
+	res, err := r.db.ExecContext(ctx, queryUpdateSignCount, new, id, old)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrPasskeySignCount)
+}
+
+type challengeDBRecord struct {
+	UserID    uuid.UUID     `db:"user_id"`
+	Ceremony  auth.Ceremony `db:"ceremony"`
+	ExpiresAt time.Time     `db:"expires_at"`
+}
+
+// PutChallenge also drops expired challenges, nothing else would.
+func (r *UserRepository) PutChallenge(ctx context.Context, c *auth.Challenge) (err error) {
+	ctx, span := startQuery(ctx, "INSERT", "webauthn_challenges", queryInsertChallenge)
+	defer func() { endQuery(span, err) }()
+
+	_, err = r.db.ExecContext(ctx, queryDeleteExpiredChallenges, time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, queryInsertChallenge, c.Value, c.UserID, c.Ceremony, c.ExpiresAt)
+	return err
+}
+
+func (r *UserRepository) TakeChallenge(ctx context.Context, value []byte) (_ *auth.Challenge, err error) {
+	ctx, span := startQuery(ctx, "DELETE", "webauthn_challenges", queryTakeChallenge)
+	defer func() { endQuery(span, err) }()
+
+	var record challengeDBRecord
+	err = r.db.GetContext(ctx, &record, queryTakeChallenge, value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrChallengeNotFound
+		}
+		return nil, err
+	}
+	if !time.Now().Before(record.ExpiresAt) {
+		return nil, auth.ErrChallengeNotFound
+	}
+	return &auth.Challenge{
+		Value:     value,
+		UserID:    record.UserID,
+		Ceremony:  record.Ceremony,
+		ExpiresAt: record.ExpiresAt,
+	}, nil
+}
+
+type clientDBRecord struct {
+	ID                     string         `db:"id"`
+	Name                   string         `db:"name"`
+	SecretHash             string         `db:"secret_hash"`
+	Public                 bool           `db:"public"`
+	Scopes                 pq.StringArray `db:"scopes"`
+	RedirectURIs           pq.StringArray `db:"redirect_uris"`
+	PostLogoutRedirectURIs pq.StringArray `db:"post_logout_redirect_uris"`
+	AccessTTLMs            int64          `db:"access_ttl_ms"`
+	CreatedAt              time.Time      `db:"created_at"`
+}
+
+func (r *UserRepository) CreateClient(ctx context.Context, c *auth.Client) (err error) {
+	ctx, span := startQuery(ctx, "INSERT", "oauth_clients", queryInsertClient)
+	defer func() { endQuery(span, err) }()
+
+	res, err := r.db.ExecContext(ctx, queryInsertClient,
+		c.ID, c.Name, c.SecretHash, c.Public, stringArray(c.Scopes), stringArray(c.RedirectURIs), stringArray(c.PostLogoutRedirectURIs),
+		c.AccessTTL.Milliseconds(), c.CreatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrClientExists)
+}
+
+func (r *UserRepository) GetClient(ctx context.Context, id string) (_ *auth.Client, err error) {
+	ctx, span := startQuery(ctx, "SELECT", "oauth_clients", querySelectClient)
+	defer func() { endQuery(span, err) }()
+
+	var record clientDBRecord
+	err = r.db.GetContext(ctx, &record, querySelectClient, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrClientNotFound
+		}
+		return nil, err
+	}
+	return &auth.Client{
+		ID:                     record.ID,
+		Name:                   record.Name,
+		SecretHash:             record.SecretHash,
+		Public:                 record.Public,
+		Scopes:                 record.Scopes,
+		RedirectURIs:           record.RedirectURIs,
+		PostLogoutRedirectURIs: record.PostLogoutRedirectURIs,
+		AccessTTL:              time.Duration(record.AccessTTLMs) * time.Millisecond,
+		CreatedAt:              record.CreatedAt,
+	}, nil
+}
+
+func (r *UserRepository) DeleteClient(ctx context.Context, id string) (err error) {
+	ctx, span := startQuery(ctx, "DELETE", "oauth_clients", queryDeleteClient)
+	defer func() { endQuery(span, err) }()
+
+	res, err := r.db.ExecContext(ctx, queryDeleteClient, id)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrClientNotFound)
+}
+
+type authCodeDBRecord struct {
+	ClientID      string         `db:"client_id"`
+	UserID        uuid.UUID      `db:"user_id"`
+	RedirectURI   string         `db:"redirect_uri"`
+	Scope         string         `db:"scope"`
+	CodeChallenge string         `db:"code_challenge"`
+	Nonce         string         `db:"nonce"`
+	AMR           pq.StringArray `db:"amr"`
+	AuthTime      time.Time      `db:"auth_time"`
+	ExpiresAt     time.Time      `db:"expires_at"`
+}
+
+// PutAuthCode also drops expired codes, nothing else would.
+func (r *UserRepository) PutAuthCode(ctx context.Context, c *auth.AuthCode) (err error) {
+	ctx, span := startQuery(ctx, "INSERT", "oauth_codes", queryInsertAuthCode)
+	defer func() { endQuery(span, err) }()
+
+	_, err = r.db.ExecContext(ctx, queryDeleteExpiredAuthCodes, time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, queryInsertAuthCode,
+		c.Hash, c.ClientID, c.UserID, c.RedirectURI, c.Scope, c.CodeChallenge, c.Nonce, stringArray(c.AMR), c.AuthTime, c.ExpiresAt)
+	return err
+}
+
+func (r *UserRepository) TakeAuthCode(ctx context.Context, hash string) (_ *auth.AuthCode, err error) {
+	ctx, span := startQuery(ctx, "DELETE", "oauth_codes", queryTakeAuthCode)
+	defer func() { endQuery(span, err) }()
+
+	var record authCodeDBRecord
+	err = r.db.GetContext(ctx, &record, queryTakeAuthCode, hash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrAuthCodeNotFound
+		}
+		return nil, err
+	}
+	if !time.Now().Before(record.ExpiresAt) {
+		return nil, auth.ErrAuthCodeNotFound
+	}
+	return &auth.AuthCode{
+		Hash:          hash,
+		ClientID:      record.ClientID,
+		UserID:        record.UserID,
+		RedirectURI:   record.RedirectURI,
+		Scope:         record.Scope,
+		CodeChallenge: record.CodeChallenge,
+		Nonce:         record.Nonce,
+		AMR:           record.AMR,
+		AuthTime:      record.AuthTime,
+		ExpiresAt:     record.ExpiresAt,
+	}, nil
+}
+
+type consentDBRecord struct {
+	Scopes    pq.StringArray `db:"scopes"`
+	GrantedAt time.Time      `db:"granted_at"`
+}
+
+func (r *UserRepository) GetConsent(ctx context.Context, userID uuid.UUID, clientID string) (_ *auth.Consent, err error) {
+	ctx, span := startQuery(ctx, "SELECT", "oauth_consents", querySelectConsent)
+	defer func() { endQuery(span, err) }()
+
+	var record consentDBRecord
+	err = r.db.GetContext(ctx, &record, querySelectConsent, userID, clientID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrConsentNotFound
+		}
+		return nil, err
+	}
+	return &auth.Consent{
+		UserID:    userID,
+		ClientID:  clientID,
+		Scopes:    record.Scopes,
+		GrantedAt: record.GrantedAt,
+	}, nil
+}
+
+func (r *UserRepository) PutConsent(ctx context.Context, c *auth.Consent) (err error) {
+	ctx, span := startQuery(ctx, "INSERT", "oauth_consents", queryUpsertConsent)
+	defer func() { endQuery(span, err) }()
+
+	_, err = r.db.ExecContext(ctx, queryUpsertConsent, c.UserID, c.ClientID, stringArray(c.Scopes), c.GrantedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pgForeignKeyViolation {
+		return auth.ErrUserNotFound
+	}
+	return err
+}
+
+type deviceCodeDBRecord struct {
+	Hash         string            `db:"hash"`
+	UserCode     string            `db:"user_code"`
+	ClientID     string            `db:"client_id"`
+	Scope        string            `db:"scope"`
+	Status       auth.DeviceStatus `db:"status"`
+	UserID       uuid.UUID         `db:"user_id"`
+	AMR          pq.StringArray    `db:"amr"`
+	AuthTime     time.Time         `db:"auth_time"`
+	LastPolledAt time.Time         `db:"last_polled_at"`
+	IntervalMs   int64             `db:"interval_ms"`
+	ExpiresAt    time.Time         `db:"expires_at"`
+	KeepUntil    time.Time         `db:"keep_until"`
+}
+
+func (record *deviceCodeDBRecord) toDeviceCode() *auth.DeviceCode {
+	return &auth.DeviceCode{
+		Hash:         record.Hash,
+		UserCode:     record.UserCode,
+		ClientID:     record.ClientID,
+		Scope:        record.Scope,
+		Status:       record.Status,
+		UserID:       record.UserID,
+		AMR:          record.AMR,
+		AuthTime:     record.AuthTime,
+		LastPolledAt: record.LastPolledAt,
+		Interval:     time.Duration(record.IntervalMs) * time.Millisecond,
+		ExpiresAt:    record.ExpiresAt,
+		KeepUntil:    record.KeepUntil,
+	}
+}
+
+// PutDeviceCode also drops codes past KeepUntil, nothing else would.
+func (r *UserRepository) PutDeviceCode(ctx context.Context, d *auth.DeviceCode) (err error) {
+	ctx, span := startQuery(ctx, "INSERT", "oauth_device_codes", queryInsertDeviceCode)
+	defer func() { endQuery(span, err) }()
+
+	_, err = r.db.ExecContext(ctx, queryDeleteStaleDeviceCodes, time.Now())
+	if err != nil {
+		return err
+	}
+	res, err := r.db.ExecContext(ctx, queryInsertDeviceCode,
+		d.Hash, d.UserCode, d.ClientID, d.Scope, d.Status, d.UserID, stringArray(d.AMR),
+		d.AuthTime, d.LastPolledAt, d.Interval.Milliseconds(), d.ExpiresAt, d.KeepUntil)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrUserCodeTaken)
+}
+
+func (r *UserRepository) GetDeviceCode(ctx context.Context, userCode string) (_ *auth.DeviceCode, err error) {
+	ctx, span := startQuery(ctx, "SELECT", "oauth_device_codes", querySelectDeviceCode)
+	defer func() { endQuery(span, err) }()
+
+	var record deviceCodeDBRecord
+	err = r.db.GetContext(ctx, &record, querySelectDeviceCode, userCode, time.Now())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrDeviceCodeNotFound
+		}
+		return nil, err
+	}
+	return record.toDeviceCode(), nil
+}
+
+func (r *UserRepository) DecideDeviceCode(ctx context.Context, d *auth.DeviceCode) (err error) {
+	ctx, span := startQuery(ctx, "UPDATE", "oauth_device_codes", queryDecideDeviceCode)
+	defer func() { endQuery(span, err) }()
+
+	res, err := r.db.ExecContext(ctx, queryDecideDeviceCode,
+		d.Status, d.UserID, stringArray(d.AMR), d.AuthTime, d.UserCode, auth.DevicePending, time.Now())
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrDeviceCodeNotFound)
+}
+
+func (r *UserRepository) PollDeviceCode(ctx context.Context, hash string, now time.Time) (_ *auth.DeviceCode, err error) {
+	ctx, span := startQuery(ctx, "UPDATE", "oauth_device_codes", queryPollDeviceCode)
+	defer func() { endQuery(span, err) }()
+
+	var record deviceCodeDBRecord
+	err = r.db.GetContext(ctx, &record, queryPollDeviceCode, hash, now, auth.DevicePending)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrDeviceCodeNotFound
+		}
+		return nil, err
+	}
+	return record.toDeviceCode(), nil
+}
+
+func (r *UserRepository) SlowDownDeviceCode(ctx context.Context, hash string, interval time.Duration) (err error) {
+	ctx, span := startQuery(ctx, "UPDATE", "oauth_device_codes", querySlowDownDeviceCode)
+	defer func() { endQuery(span, err) }()
+
+	res, err := r.db.ExecContext(ctx, querySlowDownDeviceCode, interval.Milliseconds(), hash, auth.DevicePending, time.Now())
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrDeviceCodeNotFound)
+}
+
+// stringArray stores nil as an empty array, the columns are NOT NULL.
+func stringArray(s []string) pq.StringArray {
+	if s == nil {
+		return pq.StringArray{}
+	}
+	return pq.StringArray(s)
+}
+
+// checkAffected returns errNone if res changed no rows.
+func checkAffected(res sql.Result, errNone error) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNone
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package redis
+
+import (
+	"context"
+	"medods-auth/token"
+	"strconv"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+type BlacklistRepository struct {
+	client goredis.UniversalClient
+	keys   keys
+}
+
+func NewBlackListRepository(client goredis.UniversalClient, prefix string) *BlacklistRepository {
+	return &BlacklistRepository{
+		client: client,
+		keys:   newKeys(prefix),
+	}
+}
+
+// Entries hold their expiry in milliseconds and keep the later one when
+// a token is blacklisted twice.
+var addBlacklistScript = goredis.NewScript(`
+local expireAt = tonumber(ARGV[1])
+local current = redis.call('GET', KEYS[1])
+if current and (tonumber(current) == 0 or (expireAt ~= 0 and tonumber(current) >= expireAt)) then
+	return 0
+end
+if expireAt == 0 then
+	redis.call('SET', KEYS[1], 0)
+else
+	redis.call('SET', KEYS[1], ARGV[1], 'PXAT', ARGV[1])
+end
+return 1
+`)
+
+func (repo *BlacklistRepository) Add(ctx context.Context, jti token.JTI, expiresAt time.Time) error {
+	return addBlacklistScript.Run(ctx, repo.client,
+		[]string{repo.keys.blacklist(jti)},
+		expireAtMillis(expiresAt),
+	).Err()
+}
+
+func (repo *BlacklistRepository) Contains(ctx context.Context, jti token.JTI) (bool, error) {
+	val, err := repo.client.Get(ctx, repo.keys.blacklist(jti)).Result()
+	if err != nil {
+		if err == goredis.Nil {
+			return false, nil
+		}
+		return false, err
+	}
+	expireAt, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	if expireAt == 0 {
+		return true, nil
+	}
+	return !expired(time.UnixMilli(expireAt)), nil
+}
@@ -0,0 +1,362 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"medods-auth/service/auth"
+	"medods-auth/token"
+	"medods-auth/user"
+	"time"
+
+	"github.com/google/uuid"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+var ErrDuplicateJTI = errors.New("refresh token record already exists")
+
+type HashRepository struct {
+	client goredis.UniversalClient
+	keys   keys
+}
+
+func NewHashRepository(client goredis.UniversalClient, prefix string) *HashRepository {
+	return &HashRepository{
+		client: client,
+		keys:   newKeys(prefix),
+	}
+}
+
+type tokenRedisRecord struct {
+	JTI       uuid.UUID `json:"jti"`
+	UserID    uuid.UUID `json:"user_id"`
+	UserAgent string    `json:"user_agent"`
+	Hash      []byte    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	StartedAt time.Time `json:"started_at"`
+	ClientID  string    `json:"client_id,omitempty"`
+}
+
+func redisRecordFromAuthRecord(in auth.RefreshTokenRecord) *tokenRedisRecord {
+	return &tokenRedisRecord{
+		JTI:       in.JTI,
+		UserID:    in.User.Id,
+		UserAgent: in.User.UserAgent,
+		Hash:      in.Hash,
+		CreatedAt: in.CreatedAt,
+		ExpiresAt: in.ExpiresAt,
+		StartedAt: in.StartedAt,
+		ClientID:  in.ClientID,
+	}
+}
+
+func (r *tokenRedisRecord) toAuthRecord() *auth.RefreshTokenRecord {
+	return &auth.RefreshTokenRecord{
+		JTI: r.JTI,
+		User: user.User{
+			Id:        r.UserID,
+			UserAgent: r.UserAgent,
+		},
+		Hash:      r.Hash,
+		CreatedAt: r.CreatedAt,
+		ExpiresAt: r.ExpiresAt,
+		StartedAt: r.StartedAt,
+		ClientID:  r.ClientID,
+	}
+}
+
+// The token key expires with the token. The per-user index lives as long
+// as its longest-lived member, so per-user revocation never misses one.
+var storeScript = goredis.NewScript(`
+local expireAt = tonumber(ARGV[2])
+local set
+if expireAt == 0 then
+	set = redis.call('SET', KEYS[1], ARGV[1], 'NX')
+else
+	set = redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PXAT', ARGV[2])
+end
+if not set then
+	return 0
+end
+local ttl = redis.call('PTTL', KEYS[2])
+redis.call('SADD', KEYS[2], ARGV[3])
+if expireAt == 0 then
+	redis.call('PERSIST', KEYS[2])
+elseif ttl == -2 then
+	redis.call('PEXPIREAT', KEYS[2], ARGV[2])
+elseif ttl >= 0 then
+	redis.call('PEXPIREAT', KEYS[2], ARGV[2], 'GT')
+end
+return 1
+`)
+
+func (r *HashRepository) Store(ctx context.Context, rec *auth.RefreshTokenRecord) error {
+	data, err := json.Marshal(redisRecordFromAuthRecord(*rec))
+	if err != nil {
+		return err
+	}
+	stored, err := storeScript.Run(ctx, r.client,
+		[]string{r.keys.token(rec.JTI), r.keys.userTokens(rec.User.Id)},
+		data, expireAtMillis(rec.ExpiresAt), rec.JTI.String(),
+	).Int()
+	if err != nil {
+		return err
+	}
+	if stored == 0 {
+		return ErrDuplicateJTI
+	}
+	return nil
+}
+
+func (r *HashRepository) Get(ctx context.Context, jti token.JTI) (*auth.RefreshTokenRecord, error) {
+	data, err := r.client.Get(ctx, r.keys.token(jti)).Bytes()
+	if err != nil {
+		if err == goredis.Nil {
+			return nil, auth.ErrRefreshTokenNotFound
+		}
+		return nil, err
+	}
+
+	var record tokenRedisRecord
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return nil, err
+	}
+	if expired(record.ExpiresAt) {
+		return nil, auth.ErrRefreshTokenNotFound
+	}
+	return record.toAuthRecord(), nil
+}
+
+func (r *HashRepository) Delete(ctx context.Context, jti token.JTI) error {
+	rec, err := r.Get(ctx, jti)
+	if err != nil {
+		return err
+	}
+	var del *goredis.IntCmd
+	_, err = r.client.TxPipelined(ctx, func(p goredis.Pipeliner) error {
+		del = p.Del(ctx, r.keys.token(jti))
+		p.SRem(ctx, r.keys.userTokens(rec.User.Id), jti.String())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// deleted concurrently since the Get
+	if del.Val() == 0 {
+		return auth.ErrRefreshTokenNotFound
+	}
+	return nil
+}
+
+func (r *HashRepository) DeleteByUserId(ctx context.Context, userId uuid.UUID) error {
+	return r.withUserTokens(ctx, userId, func(p goredis.Pipeliner, setKey string, members []string) error {
+		r.deleteMembers(ctx, p, setKey, members)
+		return nil
+	})
+}
+
+// DeleteByClient reads the user's records in a transaction watching the
+// user's token index, so a session stored concurrently isn't missed.
+func (r *HashRepository) DeleteByClient(ctx context.Context, userId uuid.UUID, clientID string) error {
+	setKey := r.keys.userTokens(userId)
+	for range maxTxRetries {
+		err := r.client.Watch(ctx, func(tx *goredis.Tx) error {
+			records, err := r.userRecords(ctx, tx, setKey)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(p goredis.Pipeliner) error {
+				for _, rec := range records {
+					if rec.ClientID == clientID {
+						p.Del(ctx, r.keys.token(rec.JTI))
+						p.SRem(ctx, setKey, rec.JTI.String())
+					}
+				}
+				return nil
+			})
+			return err
+		}, setKey)
+		if err != goredis.TxFailedErr {
+			return err
+		}
+	}
+	return goredis.TxFailedErr
+}
+
+// Rotate blacklists the used access token, drops the rotated refresh
+// record and stores the next one in a single MULTI/EXEC round trip. The
+// transaction watches both records, so of concurrent rotations of the
+// same record only one goes through.
+func (r *HashRepository) Rotate(ctx context.Context, rot auth.Rotation) error {
+	data, err := json.Marshal(redisRecordFromAuthRecord(*rot.Next))
+	if err != nil {
+		return err
+	}
+
+	previous, next := r.keys.token(rot.Previous), r.keys.token(rot.Next.JTI)
+	for range maxTxRetries {
+		err := r.client.Watch(ctx, func(tx *goredis.Tx) error {
+			exists, err := tx.Exists(ctx, previous).Result()
+			if err != nil {
+				return err
+			}
+			if exists == 0 {
+				return auth.ErrRefreshTokenNotFound
+			}
+			exists, err = tx.Exists(ctx, next).Result()
+			if err != nil {
+				return err
+			}
+			if exists == 1 {
+				return ErrDuplicateJTI
+			}
+			_, err = tx.TxPipelined(ctx, func(p goredis.Pipeliner) error {
+				if rot.Revoked != uuid.Nil {
+					addBlacklistScript.Eval(ctx, p,
+						[]string{r.keys.blacklist(rot.Revoked)},
+						expireAtMillis(rot.RevokedExpiresAt),
+					)
+				}
+				p.Del(ctx, previous)
+				p.SRem(ctx, r.keys.userTokens(rot.UserID), rot.Previous.String())
+				storeScript.Eval(ctx, p,
+					[]string{next, r.keys.userTokens(rot.Next.User.Id)},
+					data, expireAtMillis(rot.Next.ExpiresAt), rot.Next.JTI.String(),
+				)
+				return nil
+			})
+			return err
+		}, previous, next)
+		if err != goredis.TxFailedErr {
+			return err
+		}
+	}
+	return goredis.TxFailedErr
+}
+
+// StoreSession reads the user's sessions and evicts them in a transaction
+// watching the user's token index, so concurrent logins retry.
+func (r *HashRepository) StoreSession(ctx context.Context, ns auth.NewSession) ([]auth.RefreshTokenRecord, error) {
+	data, err := json.Marshal(redisRecordFromAuthRecord(*ns.Record))
+	if err != nil {
+		return nil, err
+	}
+
+	setKey := r.keys.userTokens(ns.Record.User.Id)
+	for range maxTxRetries {
+		var evicted []auth.RefreshTokenRecord
+		var store *goredis.Cmd
+		err := r.client.Watch(ctx, func(tx *goredis.Tx) error {
+			sessions, err := r.userRecords(ctx, tx, setKey)
+			if err != nil {
+				return err
+			}
+			evicted, err = ns.Limit.Evict(sessions)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(p goredis.Pipeliner) error {
+				for _, rec := range evicted {
+					p.Del(ctx, r.keys.token(rec.JTI))
+					p.SRem(ctx, setKey, rec.JTI.String())
+				}
+				store = storeScript.Eval(ctx, p,
+					[]string{r.keys.token(ns.Record.JTI), setKey},
+					data, expireAtMillis(ns.Record.ExpiresAt), ns.Record.JTI.String(),
+				)
+				return nil
+			})
+			return err
+		}, setKey)
+		if err == goredis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if stored, _ := store.Int(); stored == 0 {
+			return nil, ErrDuplicateJTI
+		}
+		return evicted, nil
+	}
+	return nil, goredis.TxFailedErr
+}
+
+// userRecords returns the live records in the token index at setKey.
+func (r *HashRepository) userRecords(ctx context.Context, c goredis.Cmdable, setKey string) ([]auth.RefreshTokenRecord, error) {
+	members, err := c.SMembers(ctx, setKey).Result()
+	if err != nil || len(members) == 0 {
+		return nil, err
+	}
+	keys := make([]string, 0, len(members))
+	for _, m := range members {
+		jti, err := uuid.Parse(m)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, r.keys.token(jti))
+	}
+	values, err := c.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	var out []auth.RefreshTokenRecord
+	for _, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var record tokenRedisRecord
+		err = json.Unmarshal([]byte(data), &record)
+		if err != nil {
+			return nil, err
+		}
+		if !expired(record.ExpiresAt) {
+			out = append(out, *record.toAuthRecord())
+		}
+	}
+	return out, nil
+}
+
+const maxTxRetries = 8
+
+// withUserTokens runs fn in a transaction over the user's token index,
+// retrying when the index is modified concurrently.
+func (r *HashRepository) withUserTokens(
+	ctx context.Context,
+	userID uuid.UUID,
+	fn func(p goredis.Pipeliner, setKey string, members []string) error,
+) error {
+	setKey := r.keys.userTokens(userID)
+	for range maxTxRetries {
+		err := r.client.Watch(ctx, func(tx *goredis.Tx) error {
+			members, err := tx.SMembers(ctx, setKey).Result()
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(p goredis.Pipeliner) error {
+				return fn(p, setKey, members)
+			})
+			return err
+		}, setKey)
+		if err != goredis.TxFailedErr {
+			return err
+		}
+	}
+	return goredis.TxFailedErr
+}
+
+func (r *HashRepository) deleteMembers(ctx context.Context, p goredis.Pipeliner, setKey string, members []string) {
+	keys := make([]string, 0, len(members)+1)
+	for _, m := range members {
+		jti, err := uuid.Parse(m)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, r.keys.token(jti))
+	}
+	keys = append(keys, setKey)
+	p.Del(ctx, keys...)
+}
@@ -0,0 +1,129 @@
+package redis
+
+import (
+	"context"
+	"medods-auth/service/lockout"
+	"strconv"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// LockoutRepository shares login failures between replicas. States are
+// hashes expiring once they equal a missing one.
+type LockoutRepository struct {
+	client goredis.UniversalClient
+	keys   keys
+}
+
+func NewLockoutRepository(client goredis.UniversalClient, prefix string) *LockoutRepository {
+	return &LockoutRepository{
+		client: client,
+		keys:   newKeys(prefix),
+	}
+}
+
+func (r *LockoutRepository) Get(ctx context.Context, key string) (lockout.State, error) {
+	return getLockoutState(ctx, r.client, r.keys.lockout(key))
+}
+
+// failScript mirrors lockout.State.Fail with times in milliseconds, so
+// concurrent failures of a key all count.
+var failScript = goredis.NewScript(`
+local max_failures = tonumber(ARGV[1])
+local lockout = tonumber(ARGV[2])
+local delay = tonumber(ARGV[3])
+local max_delay = tonumber(ARGV[4])
+local decay = tonumber(ARGV[5])
+local now = tonumber(ARGV[6])
+local failures = 0
+local updated_at = now
+local locked_until = 0
+local state = redis.call('HMGET', KEYS[1], 'failures', 'updated_at', 'locked_until')
+if state[1] then
+	failures = tonumber(state[1])
+	updated_at = tonumber(state[2])
+	locked_until = tonumber(state[3])
+	if decay > 0 then
+		local n = math.floor((now - updated_at) / decay)
+		if n >= failures then
+			failures = 0
+		elseif n > 0 then
+			failures = failures - n
+			updated_at = updated_at + n * decay
+		end
+	end
+	if failures == 0 then
+		updated_at = now
+	end
+end
+failures = failures + 1
+local wait = 0
+if max_failures > 0 and failures >= max_failures then
+	wait = lockout
+elseif delay > 0 then
+	wait = delay
+	local n = 1
+	while n + 1 <= failures and n <= 32 and (max_delay <= 0 or wait < max_delay) do
+		wait = wait * 2
+		n = n + 1
+	end
+	if max_delay > 0 and wait > max_delay then
+		wait = max_delay
+	end
+end
+locked_until = math.max(locked_until, now + wait)
+redis.call('HSET', KEYS[1], 'failures', failures, 'updated_at', updated_at, 'locked_until', locked_until)
+if decay > 0 then
+	redis.call('PEXPIREAT', KEYS[1], math.max(locked_until, updated_at + failures * decay))
+else
+	redis.call('PERSIST', KEYS[1])
+end
+return {failures, updated_at, locked_until}
+`)
+
+func (r *LockoutRepository) Fail(ctx context.Context, key string, policy lockout.Policy, now time.Time) (lockout.State, error) {
+	reply, err := failScript.Run(ctx, r.client,
+		[]string{r.keys.lockout(key)},
+		policy.MaxFailures, policy.Lockout.Milliseconds(), policy.Delay.Milliseconds(),
+		policy.MaxDelay.Milliseconds(), policy.Decay.Milliseconds(), now.UnixMilli(),
+	).Slice()
+	if err != nil {
+		return lockout.State{}, err
+	}
+	failures, _ := reply[0].(int64)
+	updatedAt, _ := reply[1].(int64)
+	lockedUntil, _ := reply[2].(int64)
+	return lockout.State{
+		Failures:    int(failures),
+		UpdatedAt:   time.UnixMilli(updatedAt),
+		LockedUntil: time.UnixMilli(lockedUntil),
+	}, nil
+}
+
+func (r *LockoutRepository) Reset(ctx context.Context, key string) error {
+	return r.client.Del(ctx, r.keys.lockout(key)).Err()
+}
+
+func getLockoutState(ctx context.Context, c goredis.Cmdable, key string) (lockout.State, error) {
+	fields, err := c.HMGet(ctx, key, "failures", "updated_at", "locked_until").Result()
+	if err != nil {
+		return lockout.State{}, err
+	}
+	if fields[0] == nil {
+		return lockout.State{}, nil
+	}
+	var values [3]int64
+	for i, f := range fields {
+		s, _ := f.(string)
+		values[i], err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return lockout.State{}, err
+		}
+	}
+	return lockout.State{
+		Failures:    int(values[0]),
+		UpdatedAt:   time.UnixMilli(values[1]),
+		LockedUntil: time.UnixMilli(values[2]),
+	}, nil
+}
@@ -0,0 +1,64 @@
+package redis
+
+import (
+	"context"
+	"medods-auth/service/ratelimit"
+	"strconv"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// RateLimitRepository shares token buckets between replicas.
+type RateLimitRepository struct {
+	client goredis.UniversalClient
+	keys   keys
+}
+
+func NewRateLimitRepository(client goredis.UniversalClient, prefix string) *RateLimitRepository {
+	return &RateLimitRepository{
+		client: client,
+		keys:   newKeys(prefix),
+	}
+}
+
+// takeTokenScript mirrors ratelimit.Bucket.Take with times in milliseconds.
+// Buckets expire once full, as a missing bucket is a full one.
+var takeTokenScript = goredis.NewScript(`
+local burst = tonumber(ARGV[1])
+local rate = burst / tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local tokens = burst
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated_at')
+if state[1] then
+	tokens = tonumber(state[1])
+	local elapsed = now - tonumber(state[2])
+	if elapsed > 0 then
+		tokens = math.min(burst, tokens + elapsed * rate)
+	end
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated_at', now)
+redis.call('PEXPIRE', KEYS[1], math.max(1, math.ceil((burst - tokens) / rate)))
+return {allowed, tostring(tokens)}
+`)
+
+func (repo *RateLimitRepository) Allow(ctx context.Context, key string, limit ratelimit.Limit, now time.Time) (ratelimit.Result, error) {
+	reply, err := takeTokenScript.Run(ctx, repo.client,
+		[]string{repo.keys.rateLimit(key)},
+		limit.Burst, limit.Period.Milliseconds(), now.UnixMilli(),
+	).Slice()
+	if err != nil {
+		return ratelimit.Result{}, err
+	}
+	allowed, _ := reply[0].(int64)
+	tokens, err := strconv.ParseFloat(reply[1].(string), 64)
+	if err != nil {
+		return ratelimit.Result{}, err
+	}
+	return ratelimit.NewResult(limit, tokens, allowed == 1), nil
+}
@@ -0,0 +1,144 @@
+package redis
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+const defaultPrefix = "jwt:"
+
+type RedisConfig struct {
+	Addr     string
+	Password string
+	DB       int
+
+	// Prefix namespaces every key written by the repositories.
+	Prefix string
+
+	PoolSize    *int
+	DialTimeout *time.Duration
+}
+
+func Connect(conf *RedisConfig) (*goredis.Client, error) {
+	err := conf.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &goredis.Options{
+		Addr:     conf.Addr,
+		Password: conf.Password,
+		DB:       conf.DB,
+	}
+	if conf.PoolSize != nil {
+		opts.PoolSize = *conf.PoolSize
+	}
+	if conf.DialTimeout != nil {
+		opts.DialTimeout = *conf.DialTimeout
+	}
+
+	client := goredis.NewClient(opts)
+	if err := client.Ping(context.TODO()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to ping redis: %w", err)
+	}
+	return client, nil
+}
+
+func (c *RedisConfig) validate() error {
+	if c.Addr == "" {
+		return errors.New("empty redis address")
+	}
+	return nil
+}
+
+type keys struct {
+	prefix string
+}
+
+func newKeys(prefix string) keys {
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	return keys{prefix}
+}
+
+func (k keys) token(jti uuid.UUID) string {
+	return k.prefix + "token:" + jti.String()
+}
+
+func (k keys) userTokens(userID uuid.UUID) string {
+	return k.prefix + "user:" + userID.String() + ":tokens"
+}
+
+func (k keys) user(id uuid.UUID) string {
+	return k.prefix + "user:" + id.String()
+}
+
+func (k keys) login(login string) string {
+	return k.prefix + "login:" + login
+}
+
+func (k keys) lockout(key string) string {
+	return k.prefix + "lockout:" + key
+}
+
+func (k keys) passkey(id []byte) string {
+	return k.prefix + "passkey:" + base64.RawURLEncoding.EncodeToString(id)
+}
+
+func (k keys) userPasskeys(userID uuid.UUID) string {
+	return k.prefix + "user:" + userID.String() + ":passkeys"
+}
+
+func (k keys) challenge(value []byte) string {
+	return k.prefix + "webauthn_challenge:" + base64.RawURLEncoding.EncodeToString(value)
+}
+
+func (k keys) client(id string) string {
+	return k.prefix + "oauth_client:" + id
+}
+
+func (k keys) authCode(hash string) string {
+	return k.prefix + "oauth_code:" + hash
+}
+
+// deviceCode holds a device code by hash, userCode the hash of the code
+// with a user code.
+func (k keys) deviceCode(hash string) string {
+	return k.prefix + "oauth_device_code:" + hash
+}
+
+func (k keys) userCode(code string) string {
+	return k.prefix + "oauth_user_code:" + code
+}
+
+func (k keys) userConsents(userID uuid.UUID) string {
+	return k.prefix + "user:" + userID.String() + ":consents"
+}
+
+func (k keys) blacklist(jti uuid.UUID) string {
+	return k.prefix + "blacklist:" + jti.String()
+}
+
+func (k keys) rateLimit(key string) string {
+	return k.prefix + "ratelimit:" + key
+}
+
+// expireAtMillis encodes an expiry for scripts, zero meaning no expiry.
+func expireAtMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func expired(expiresAt time.Time) bool {
+	return !expiresAt.IsZero() && !time.Now().Before(expiresAt)
+}
@@ -0,0 +1,881 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"medods-auth/service/auth"
+	"medods-auth/user"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+type UserRepository struct {
+	client goredis.UniversalClient
+	keys   keys
+}
+
+func NewUserRepository(client goredis.UniversalClient, prefix string) *UserRepository {
+	return &UserRepository{
+		client: client,
+		keys:   newKeys(prefix),
+	}
+}
+
+// Accounts are hashes. The scripts only write the hash if it does or
+// doesn't exist yet, returning 0 otherwise.
+var (
+	createUserScript = goredis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'status', ARGV[1], 'created_at', ARGV[2])
+return 1
+`)
+	setUserStatusScript = goredis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'status', ARGV[1])
+return 1
+`)
+	updateHashScript = goredis.NewScript(`
+if redis.call('HGET', KEYS[1], 'password_hash') ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'password_hash', ARGV[2])
+return 1
+`)
+	// putTOTPScript returns -1 for unknown users and 0 on a version
+	// conflict.
+	putTOTPScript = goredis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+local version = tonumber(redis.call('HGET', KEYS[1], 'totp_version') or '0')
+if version ~= tonumber(ARGV[1]) - 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'totp', ARGV[2], 'totp_version', ARGV[1])
+return 1
+`)
+	// addPasskeyScript returns -1 for unknown users and 0 for taken IDs.
+	addPasskeyScript = goredis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[2], 'user_id', ARGV[1], 'public_key', ARGV[2], 'sign_count', ARGV[3], 'transports', ARGV[4], 'created_at', ARGV[5])
+redis.call('SADD', KEYS[3], ARGV[6])
+return 1
+`)
+	// putConsentScript returns -1 for unknown users.
+	putConsentScript = goredis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+return 1
+`)
+	// updateSignCountScript returns -1 for unknown passkeys and 0 if the
+	// count is no longer ARGV[1].
+	updateSignCountScript = goredis.NewScript(`
+local count = redis.call('HGET', KEYS[1], 'sign_count')
+if not count then
+	return -1
+end
+if count ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'sign_count', ARGV[2])
+return 1
+`)
+)
+
+// totpRedisRecord is stored as JSON in the totp field of the user hash,
+// the version in totp_version for putTOTPScript to compare.
+type totpRedisRecord struct {
+	Secret        string   `json:"secret"`
+	Active        bool     `json:"active"`
+	LastStep      int64    `json:"last_step"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func (r *UserRepository) Create(ctx context.Context, account *user.Account) error {
+	created, err := createUserScript.Run(ctx, r.client,
+		[]string{r.keys.user(account.Id)},
+		string(account.Status), account.CreatedAt.UTC().Format(time.RFC3339Nano),
+	).Int()
+	if err != nil {
+		return err
+	}
+	if created == 0 {
+		return auth.ErrUserExists
+	}
+	return nil
+}
+
+func (r *UserRepository) Get(ctx context.Context, id uuid.UUID) (*user.Account, error) {
+	fields, err := r.client.HGetAll(ctx, r.keys.user(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, auth.ErrUserNotFound
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, fields["created_at"])
+	if err != nil {
+		return nil, err
+	}
+	return &user.Account{
+		Id:        id,
+		Status:    user.Status(fields["status"]),
+		CreatedAt: createdAt,
+	}, nil
+}
+
+func (r *UserRepository) SetStatus(ctx context.Context, id uuid.UUID, status user.Status) error {
+	updated, err := setUserStatusScript.Run(ctx, r.client,
+		[]string{r.keys.user(id)},
+		string(status),
+	).Int()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return auth.ErrUserNotFound
+	}
+	return nil
+}
+
+// Delete drops the login index entry and passkeys along with the user.
+func (r *UserRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	userKey := r.keys.user(id)
+	passkeysKey := r.keys.userPasskeys(id)
+	for range maxTxRetries {
+		var deleted *goredis.IntCmd
+		err := r.client.Watch(ctx, func(tx *goredis.Tx) error {
+			login, err := tx.HGet(ctx, userKey, "login").Result()
+			if err != nil && err != goredis.Nil {
+				return err
+			}
+			passkeys, err := tx.SMembers(ctx, passkeysKey).Result()
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(p goredis.Pipeliner) error {
+				deleted = p.Del(ctx, userKey)
+				if login != "" {
+					p.Del(ctx, r.keys.login(login))
+				}
+				for _, id := range passkeys {
+					p.Del(ctx, r.keys.passkey([]byte(id)))
+				}
+				p.Del(ctx, passkeysKey)
+				p.Del(ctx, r.keys.userConsents(id))
+				return nil
+			})
+			return err
+		}, userKey, passkeysKey)
+		if err == goredis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if deleted.Val() == 0 {
+			return auth.ErrUserNotFound
+		}
+		return nil
+	}
+	return goredis.TxFailedErr
+}
+
+func (r *UserRepository) SetCredential(ctx context.Context, cred auth.Credential) error {
+	userKey := r.keys.user(cred.UserID)
+	loginKey := r.keys.login(cred.Login)
+	for range maxTxRetries {
+		err := r.client.Watch(ctx, func(tx *goredis.Tx) error {
+			owner, err := tx.Get(ctx, loginKey).Result()
+			if err != nil && err != goredis.Nil {
+				return err
+			}
+			if owner != "" && owner != cred.UserID.String() {
+				return auth.ErrLoginTaken
+			}
+			fields, err := tx.HMGet(ctx, userKey, "status", "login").Result()
+			if err != nil {
+				return err
+			}
+			if fields[0] == nil {
+				return auth.ErrUserNotFound
+			}
+			oldLogin, _ := fields[1].(string)
+			_, err = tx.TxPipelined(ctx, func(p goredis.Pipeliner) error {
+				if oldLogin != "" && oldLogin != cred.Login {
+					p.Del(ctx, r.keys.login(oldLogin))
+				}
+				p.Set(ctx, loginKey, cred.UserID.String(), 0)
+				p.HSet(ctx, userKey, "login", cred.Login, "password_hash", cred.Hash)
+				return nil
+			})
+			return err
+		}, userKey, loginKey)
+		if err == goredis.TxFailedErr {
+			continue
+		}
+		return err
+	}
+	return goredis.TxFailedErr
+}
+
+func (r *UserRepository) GetCredential(ctx context.Context, login string) (*auth.Credential, error) {
+	owner, err := r.client.Get(ctx, r.keys.login(login)).Result()
+	if err == goredis.Nil {
+		return nil, auth.ErrCredentialNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	id, err := uuid.Parse(owner)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := r.client.HMGet(ctx, r.keys.user(id), "login", "password_hash").Result()
+	if err != nil {
+		return nil, err
+	}
+	storedLogin, _ := fields[0].(string)
+	hash, _ := fields[1].(string)
+	// the index may briefly outlive a login change
+	if storedLogin != login || hash == "" {
+		return nil, auth.ErrCredentialNotFound
+	}
+	return &auth.Credential{UserID: id, Login: login, Hash: hash}, nil
+}
+
+func (r *UserRepository) GetUserCredential(ctx context.Context, userID uuid.UUID) (*auth.Credential, error) {
+	fields, err := r.client.HMGet(ctx, r.keys.user(userID), "login", "password_hash").Result()
+	if err != nil {
+		return nil, err
+	}
+	login, _ := fields[0].(string)
+	hash, _ := fields[1].(string)
+	if login == "" || hash == "" {
+		return nil, auth.ErrCredentialNotFound
+	}
+	return &auth.Credential{UserID: userID, Login: login, Hash: hash}, nil
+}
+
+func (r *UserRepository) UpdateCredentialHash(ctx context.Context, userID uuid.UUID, old, new string) error {
+	return updateHashScript.Run(ctx, r.client,
+		[]string{r.keys.user(userID)},
+		old, new,
+	).Err()
+}
+
+func (r *UserRepository) GetTOTP(ctx context.Context, userID uuid.UUID) (*auth.TOTP, error) {
+	fields, err := r.client.HMGet(ctx, r.keys.user(userID), "totp", "totp_version").Result()
+	if err != nil {
+		return nil, err
+	}
+	data, _ := fields[0].(string)
+	rawVersion, _ := fields[1].(string)
+	if data == "" {
+		return nil, auth.ErrTOTPNotEnrolled
+	}
+	var record totpRedisRecord
+	err = json.Unmarshal([]byte(data), &record)
+	if err != nil {
+		return nil, err
+	}
+	version, err := strconv.ParseInt(rawVersion, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &auth.TOTP{
+		UserID:        userID,
+		Secret:        record.Secret,
+		Active:        record.Active,
+		LastStep:      record.LastStep,
+		RecoveryCodes: record.RecoveryCodes,
+		Version:       version,
+	}, nil
+}
+
+func (r *UserRepository) PutTOTP(ctx context.Context, t *auth.TOTP) error {
+	data, err := json.Marshal(totpRedisRecord{
+		Secret:        t.Secret,
+		Active:        t.Active,
+		LastStep:      t.LastStep,
+		RecoveryCodes: t.RecoveryCodes,
+	})
+	if err != nil {
+		return err
+	}
+	stored, err := putTOTPScript.Run(ctx, r.client,
+		[]string{r.keys.user(t.UserID)},
+		t.Version, data,
+	).Int()
+	if err != nil {
+		return err
+	}
+	switch stored {
+	case -1:
+		return auth.ErrUserNotFound
+	case 0:
+		return auth.ErrTOTPConflict
+	}
+	return nil
+}
+
+func (r *UserRepository) DeleteTOTP(ctx context.Context, userID uuid.UUID) error {
+	deleted, err := r.client.HDel(ctx, r.keys.user(userID), "totp", "totp_version").Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return auth.ErrTOTPNotEnrolled
+	}
+	return nil
+}
+
+func (r *UserRepository) AddPasskey(ctx context.Context, p *auth.Passkey) error {
+	transports, err := json.Marshal(p.Transports)
+	if err != nil {
+		return err
+	}
+	added, err := addPasskeyScript.Run(ctx, r.client,
+		[]string{r.keys.user(p.UserID), r.keys.passkey(p.ID), r.keys.userPasskeys(p.UserID)},
+		p.UserID.String(), p.PublicKey, p.SignCount, transports,
+		p.CreatedAt.UTC().Format(time.RFC3339Nano), p.ID,
+	).Int()
+	if err != nil {
+		return err
+	}
+	switch added {
+	case -1:
+		return auth.ErrUserNotFound
+	case 0:
+		return auth.ErrPasskeyExists
+	}
+	return nil
+}
+
+func (r *UserRepository) GetPasskey(ctx context.Context, id []byte) (*auth.Passkey, error) {
+	fields, err := r.client.HGetAll(ctx, r.keys.passkey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, auth.ErrPasskeyNotFound
+	}
+	return passkeyFromFields(id, fields)
+}
+
+func (r *UserRepository) ListPasskeys(ctx context.Context, userID uuid.UUID) ([]auth.Passkey, error) {
+	ids, err := r.client.SMembers(ctx, r.keys.userPasskeys(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	cmds, err := r.client.Pipelined(ctx, func(p goredis.Pipeliner) error {
+		for _, id := range ids {
+			p.HGetAll(ctx, r.keys.passkey([]byte(id)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out []auth.Passkey
+	for i, cmd := range cmds {
+		fields := cmd.(*goredis.MapStringStringCmd).Val()
+		if len(fields) == 0 {
+			continue
+		}
+		p, err := passkeyFromFields([]byte(ids[i]), fields)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *p)
+	}
+	slices.SortFunc(out, func(a, b auth.Passkey) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return out, nil
+}
+
+func (r *UserRepository) UpdateSignCount(ctx context.Context, id []byte, old, new uint32) error {
+	updated, err := updateSignCountScript.Run(ctx, r.client,
+		[]string{r.keys.passkey(id)},
+		old, new,
+	).Int()
+	if err != nil {
+		return err
+	}
+	switch updated {
+	case -1:
+		return auth.ErrPasskeyNotFound
+	case 0:
+		return auth.ErrPasskeySignCount
+	}
+	return nil
+}
+
+type challengeRedisRecord struct {
+	UserID    uuid.UUID     `json:"user_id"`
+	Ceremony  auth.Ceremony `json:"ceremony"`
+	ExpiresAt time.Time     `json:"expires_at"`
+}
+
+// PutChallenge relies on key expiry to drop unused challenges.
+func (r *UserRepository) PutChallenge(ctx context.Context, c *auth.Challenge) error {
+	data, err := json.Marshal(challengeRedisRecord{
+		UserID:    c.UserID,
+		Ceremony:  c.Ceremony,
+		ExpiresAt: c.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	return r.client.SetArgs(ctx, r.keys.challenge(c.Value), data, goredis.SetArgs{ExpireAt: c.ExpiresAt}).Err()
+}
+
+func (r *UserRepository) TakeChallenge(ctx context.Context, value []byte) (*auth.Challenge, error) {
+	data, err := r.client.GetDel(ctx, r.keys.challenge(value)).Bytes()
+	if err == goredis.Nil {
+		return nil, auth.ErrChallengeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record challengeRedisRecord
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return nil, err
+	}
+	if expired(record.ExpiresAt) {
+		return nil, auth.ErrChallengeNotFound
+	}
+	return &auth.Challenge{
+		Value:     slices.Clone(value),
+		UserID:    record.UserID,
+		Ceremony:  record.Ceremony,
+		ExpiresAt: record.ExpiresAt,
+	}, nil
+}
+
+type clientRedisRecord struct {
+	Name                   string        `json:"name,omitempty"`
+	SecretHash             string        `json:"secret_hash,omitempty"`
+	Public                 bool          `json:"public,omitempty"`
+	Scopes                 []string      `json:"scopes,omitempty"`
+	RedirectURIs           []string      `json:"redirect_uris,omitempty"`
+	PostLogoutRedirectURIs []string      `json:"post_logout_redirect_uris,omitempty"`
+	AccessTTL              time.Duration `json:"access_ttl,omitempty"`
+	CreatedAt              time.Time     `json:"created_at"`
+}
+
+func (r *UserRepository) CreateClient(ctx context.Context, c *auth.Client) error {
+	data, err := json.Marshal(clientRedisRecord{
+		Name:                   c.Name,
+		SecretHash:             c.SecretHash,
+		Public:                 c.Public,
+		Scopes:                 c.Scopes,
+		RedirectURIs:           c.RedirectURIs,
+		PostLogoutRedirectURIs: c.PostLogoutRedirectURIs,
+		AccessTTL:              c.AccessTTL,
+		CreatedAt:              c.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	created, err := r.client.SetNX(ctx, r.keys.client(c.ID), data, 0).Result()
+	if err != nil {
+		return err
+	}
+	if !created {
+		return auth.ErrClientExists
+	}
+	return nil
+}
+
+func (r *UserRepository) GetClient(ctx context.Context, id string) (*auth.Client, error) {
+	data, err := r.client.Get(ctx, r.keys.client(id)).Bytes()
+	if err == goredis.Nil {
+		return nil, auth.ErrClientNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record clientRedisRecord
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return nil, err
+	}
+	return &auth.Client{
+		ID:                     id,
+		Name:                   record.Name,
+		SecretHash:             record.SecretHash,
+		Public:                 record.Public,
+		Scopes:                 record.Scopes,
+		RedirectURIs:           record.RedirectURIs,
+		PostLogoutRedirectURIs: record.PostLogoutRedirectURIs,
+		AccessTTL:              record.AccessTTL,
+		CreatedAt:              record.CreatedAt,
+	}, nil
+}
+
+func (r *UserRepository) DeleteClient(ctx context.Context, id string) error {
+	n, err := r.client.Del(ctx, r.keys.client(id)).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return auth.ErrClientNotFound
+	}
+	return nil
+}
+
+type authCodeRedisRecord struct {
+	ClientID      string    `json:"client_id"`
+	UserID        uuid.UUID `json:"user_id"`
+	RedirectURI   string    `json:"redirect_uri,omitempty"`
+	Scope         string    `json:"scope,omitempty"`
+	CodeChallenge string    `json:"code_challenge"`
+	Nonce         string    `json:"nonce,omitempty"`
+	AMR           []string  `json:"amr,omitempty"`
+	AuthTime      time.Time `json:"auth_time"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+func (r *UserRepository) PutAuthCode(ctx context.Context, c *auth.AuthCode) error {
+	data, err := json.Marshal(authCodeRedisRecord{
+		ClientID:      c.ClientID,
+		UserID:        c.UserID,
+		RedirectURI:   c.RedirectURI,
+		Scope:         c.Scope,
+		CodeChallenge: c.CodeChallenge,
+		Nonce:         c.Nonce,
+		AMR:           c.AMR,
+		AuthTime:      c.AuthTime,
+		ExpiresAt:     c.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	return r.client.SetArgs(ctx, r.keys.authCode(c.Hash), data, goredis.SetArgs{ExpireAt: c.ExpiresAt}).Err()
+}
+
+func (r *UserRepository) TakeAuthCode(ctx context.Context, hash string) (*auth.AuthCode, error) {
+	data, err := r.client.GetDel(ctx, r.keys.authCode(hash)).Bytes()
+	if err == goredis.Nil {
+		return nil, auth.ErrAuthCodeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record authCodeRedisRecord
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return nil, err
+	}
+	if expired(record.ExpiresAt) {
+		return nil, auth.ErrAuthCodeNotFound
+	}
+	return &auth.AuthCode{
+		Hash:          hash,
+		ClientID:      record.ClientID,
+		UserID:        record.UserID,
+		RedirectURI:   record.RedirectURI,
+		Scope:         record.Scope,
+		CodeChallenge: record.CodeChallenge,
+		Nonce:         record.Nonce,
+		AMR:           record.AMR,
+		AuthTime:      record.AuthTime,
+		ExpiresAt:     record.ExpiresAt,
+	}, nil
+}
+
+type consentRedisRecord struct {
+	Scopes    []string  `json:"scopes,omitempty"`
+	GrantedAt time.Time `json:"granted_at"`
+}
+
+// GetConsent reads a field of the consents hash of the user, deleted with
+// them.
+func (r *UserRepository) GetConsent(ctx context.Context, userID uuid.UUID, clientID string) (*auth.Consent, error) {
+	data, err := r.client.HGet(ctx, r.keys.userConsents(userID), clientID).Bytes()
+	if err == goredis.Nil {
+		return nil, auth.ErrConsentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record consentRedisRecord
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return nil, err
+	}
+	return &auth.Consent{
+		UserID:    userID,
+		ClientID:  clientID,
+		Scopes:    record.Scopes,
+		GrantedAt: record.GrantedAt,
+	}, nil
+}
+
+func (r *UserRepository) PutConsent(ctx context.Context, c *auth.Consent) error {
+	data, err := json.Marshal(consentRedisRecord{
+		Scopes:    c.Scopes,
+		GrantedAt: c.GrantedAt,
+	})
+	if err != nil {
+		return err
+	}
+	put, err := putConsentScript.Run(ctx, r.client,
+		[]string{r.keys.user(c.UserID), r.keys.userConsents(c.UserID)},
+		c.ClientID, data,
+	).Int()
+	if err != nil {
+		return err
+	}
+	if put == -1 {
+		return auth.ErrUserNotFound
+	}
+	return nil
+}
+
+type deviceCodeRedisRecord struct {
+	UserCode     string            `json:"user_code"`
+	ClientID     string            `json:"client_id"`
+	Scope        string            `json:"scope,omitempty"`
+	Status       auth.DeviceStatus `json:"status"`
+	UserID       uuid.UUID         `json:"user_id"`
+	AMR          []string          `json:"amr,omitempty"`
+	AuthTime     time.Time         `json:"auth_time"`
+	LastPolledAt time.Time         `json:"last_polled_at"`
+	Interval     time.Duration     `json:"interval,omitempty"`
+	ExpiresAt    time.Time         `json:"expires_at"`
+	KeepUntil    time.Time         `json:"keep_until"`
+}
+
+func deviceCodeRedisRecordFrom(d *auth.DeviceCode) deviceCodeRedisRecord {
+	return deviceCodeRedisRecord{
+		UserCode:     d.UserCode,
+		ClientID:     d.ClientID,
+		Scope:        d.Scope,
+		Status:       d.Status,
+		UserID:       d.UserID,
+		AMR:          d.AMR,
+		AuthTime:     d.AuthTime,
+		LastPolledAt: d.LastPolledAt,
+		Interval:     d.Interval,
+		ExpiresAt:    d.ExpiresAt,
+		KeepUntil:    d.KeepUntil,
+	}
+}
+
+func (rec deviceCodeRedisRecord) toDeviceCode(hash string) *auth.DeviceCode {
+	return &auth.DeviceCode{
+		Hash:         hash,
+		UserCode:     rec.UserCode,
+		ClientID:     rec.ClientID,
+		Scope:        rec.Scope,
+		Status:       rec.Status,
+		UserID:       rec.UserID,
+		AMR:          rec.AMR,
+		AuthTime:     rec.AuthTime,
+		LastPolledAt: rec.LastPolledAt,
+		Interval:     rec.Interval,
+		ExpiresAt:    rec.ExpiresAt,
+		KeepUntil:    rec.KeepUntil,
+	}
+}
+
+// PutDeviceCode claims the user code first, both keys expire at
+// KeepUntil.
+func (r *UserRepository) PutDeviceCode(ctx context.Context, d *auth.DeviceCode) error {
+	data, err := json.Marshal(deviceCodeRedisRecordFrom(d))
+	if err != nil {
+		return err
+	}
+	err = r.client.SetArgs(ctx, r.keys.userCode(d.UserCode), d.Hash, goredis.SetArgs{Mode: "NX", ExpireAt: d.KeepUntil}).Err()
+	if err == goredis.Nil {
+		return auth.ErrUserCodeTaken
+	}
+	if err != nil {
+		return err
+	}
+	return r.client.SetArgs(ctx, r.keys.deviceCode(d.Hash), data, goredis.SetArgs{ExpireAt: d.KeepUntil}).Err()
+}
+
+func (r *UserRepository) GetDeviceCode(ctx context.Context, userCode string) (*auth.DeviceCode, error) {
+	hash, err := r.client.Get(ctx, r.keys.userCode(userCode)).Result()
+	if err == goredis.Nil {
+		return nil, auth.ErrDeviceCodeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	record, err := getDeviceCode(ctx, r.client, r.keys.deviceCode(hash))
+	if err != nil {
+		return nil, err
+	}
+	return record.toDeviceCode(hash), nil
+}
+
+func (r *UserRepository) DecideDeviceCode(ctx context.Context, d *auth.DeviceCode) error {
+	hash, err := r.client.Get(ctx, r.keys.userCode(d.UserCode)).Result()
+	if err == goredis.Nil {
+		return auth.ErrDeviceCodeNotFound
+	}
+	if err != nil {
+		return err
+	}
+	key := r.keys.deviceCode(hash)
+	for range maxTxRetries {
+		err := r.client.Watch(ctx, func(tx *goredis.Tx) error {
+			record, err := getDeviceCode(ctx, tx, key)
+			if err != nil {
+				return err
+			}
+			if record.Status != auth.DevicePending || expired(record.ExpiresAt) {
+				return auth.ErrDeviceCodeNotFound
+			}
+			record.Status = d.Status
+			record.UserID = d.UserID
+			record.AMR = d.AMR
+			record.AuthTime = d.AuthTime
+			data, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(p goredis.Pipeliner) error {
+				p.SetArgs(ctx, key, data, goredis.SetArgs{KeepTTL: true})
+				return nil
+			})
+			return err
+		}, key)
+		if err == goredis.TxFailedErr {
+			continue
+		}
+		return err
+	}
+	return goredis.TxFailedErr
+}
+
+func (r *UserRepository) PollDeviceCode(ctx context.Context, hash string, now time.Time) (*auth.DeviceCode, error) {
+	key := r.keys.deviceCode(hash)
+	for range maxTxRetries {
+		var polled deviceCodeRedisRecord
+		err := r.client.Watch(ctx, func(tx *goredis.Tx) error {
+			record, err := getDeviceCode(ctx, tx, key)
+			if err != nil {
+				return err
+			}
+			polled = record
+			if record.Status != auth.DevicePending {
+				_, err = tx.TxPipelined(ctx, func(p goredis.Pipeliner) error {
+					p.Del(ctx, key, r.keys.userCode(record.UserCode))
+					return nil
+				})
+				return err
+			}
+			record.LastPolledAt = now
+			data, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(p goredis.Pipeliner) error {
+				p.SetArgs(ctx, key, data, goredis.SetArgs{KeepTTL: true})
+				return nil
+			})
+			return err
+		}, key)
+		if err == goredis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return polled.toDeviceCode(hash), nil
+	}
+	return nil, goredis.TxFailedErr
+}
+
+func (r *UserRepository) SlowDownDeviceCode(ctx context.Context, hash string, interval time.Duration) error {
+	key := r.keys.deviceCode(hash)
+	for range maxTxRetries {
+		err := r.client.Watch(ctx, func(tx *goredis.Tx) error {
+			record, err := getDeviceCode(ctx, tx, key)
+			if err != nil {
+				return err
+			}
+			if record.Status != auth.DevicePending {
+				return auth.ErrDeviceCodeNotFound
+			}
+			record.Interval = interval
+			data, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(p goredis.Pipeliner) error {
+				p.SetArgs(ctx, key, data, goredis.SetArgs{KeepTTL: true})
+				return nil
+			})
+			return err
+		}, key)
+		if err == goredis.TxFailedErr {
+			continue
+		}
+		return err
+	}
+	return goredis.TxFailedErr
+}
+
+func getDeviceCode(ctx context.Context, c goredis.Cmdable, key string) (deviceCodeRedisRecord, error) {
+	var record deviceCodeRedisRecord
+	data, err := c.Get(ctx, key).Bytes()
+	if err == goredis.Nil {
+		return record, auth.ErrDeviceCodeNotFound
+	}
+	if err != nil {
+		return record, err
+	}
+	err = json.Unmarshal(data, &record)
+	return record, err
+}
+
+func passkeyFromFields(id []byte, fields map[string]string) (*auth.Passkey, error) {
+	userID, err := uuid.Parse(fields["user_id"])
+	if err != nil {
+		return nil, err
+	}
+	signCount, err := strconv.ParseUint(fields["sign_count"], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	var transports []string
+	err = json.Unmarshal([]byte(fields["transports"]), &transports)
+	if err != nil {
+		return nil, err
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, fields["created_at"])
+	if err != nil {
+		return nil, err
+	}
+	return &auth.Passkey{
+		ID:         slices.Clone(id),
+		UserID:     userID,
+		PublicKey:  []byte(fields["public_key"]),
+		SignCount:  uint32(signCount),
+		Transports: transports,
+		CreatedAt:  createdAt,
+	}, nil
+}
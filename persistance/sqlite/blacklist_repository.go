@@ -0,0 +1,50 @@
+package sqlite
+
+import (
+	"context"
+	"medods-auth/token"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type BlacklistRepository struct {
+	db *sqlx.DB
+}
+
+func NewBlackListRepository(db *sqlx.DB) *BlacklistRepository {
+	return &BlacklistRepository{
+		db,
+	}
+}
+
+func (repo *BlacklistRepository) Add(ctx context.Context, jti token.JTI, expiresAt time.Time) error {
+	_, err := repo.db.ExecContext(
+		ctx,
+		"INSERT INTO blacklist (jti, created_at, expires_at) VALUES (?, ?, ?) ON CONFLICT (jti) DO NOTHING",
+		jti, time.Now().UTC(), nullTime(expiresAt),
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (repo *BlacklistRepository) Contains(ctx context.Context, jti token.JTI) (bool, error) {
+	var found int
+	err := repo.db.GetContext(ctx, &found, "SELECT EXISTS (SELECT 1 FROM blacklist WHERE jti = ? AND (expires_at IS NULL OR expires_at > ?))",
+		jti, time.Now().UTC(),
+	)
+	if err != nil {
+		return false, err
+	}
+	return found == 1, nil
+}
+
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
@@ -0,0 +1,266 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"medods-auth/service/auth"
+	"medods-auth/service/outbox"
+	"medods-auth/token"
+	"medods-auth/user"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+type HashRepository struct {
+	db *sqlx.DB
+}
+
+func NewHashRepository(db *sqlx.DB) *HashRepository {
+	return &HashRepository{
+		db,
+	}
+}
+
+type TokenDBRecord struct {
+	JTI       uuid.UUID  `db:"jti"`
+	UserID    uuid.UUID  `db:"user_id"`
+	UserAgent string     `db:"user_agent"`
+	Hash      []byte     `db:"hash"`
+	CreatedAt time.Time  `db:"created_at"`
+	ExpiresAt *time.Time `db:"expires_at"`
+	StartedAt *time.Time `db:"started_at"`
+	ClientID  string     `db:"client_id"`
+}
+
+func dbRecordFromAuthRecord(in auth.RefreshTokenRecord) *TokenDBRecord {
+	r := &TokenDBRecord{}
+	r.JTI = in.JTI
+	r.UserID = in.User.Id
+	r.UserAgent = in.User.UserAgent
+	r.Hash = in.Hash
+	r.CreatedAt = in.CreatedAt.UTC()
+	r.ExpiresAt = nullTime(in.ExpiresAt)
+	r.StartedAt = nullTime(in.StartedAt)
+	r.ClientID = in.ClientID
+	return r
+}
+
+func (r *TokenDBRecord) toAuthRecord() *auth.RefreshTokenRecord {
+	out := &auth.RefreshTokenRecord{
+		JTI: r.JTI,
+		User: user.User{
+			Id:        r.UserID,
+			UserAgent: r.UserAgent,
+		},
+		Hash:      r.Hash,
+		CreatedAt: r.CreatedAt,
+		ClientID:  r.ClientID,
+	}
+	if r.ExpiresAt != nil {
+		out.ExpiresAt = *r.ExpiresAt
+	}
+	if r.StartedAt != nil {
+		out.StartedAt = *r.StartedAt
+	}
+	return out
+}
+
+const queryInsertToken = "INSERT INTO token (jti, user_id, user_agent, hash, created_at, expires_at, started_at, client_id) VALUES (:jti, :user_id, :user_agent, :hash, :created_at, :expires_at, :started_at, :client_id)"
+
+func (r *HashRepository) Store(ctx context.Context, rec *auth.RefreshTokenRecord) error {
+	_, err := r.db.NamedExecContext(ctx, queryInsertToken, dbRecordFromAuthRecord(*rec))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *HashRepository) Get(ctx context.Context, jti token.JTI) (*auth.RefreshTokenRecord, error) {
+	var record TokenDBRecord
+	err := r.db.GetContext(
+		ctx,
+		&record,
+		"SELECT jti, user_id, user_agent, hash, created_at, expires_at, started_at, client_id FROM token WHERE jti = ? AND (expires_at IS NULL OR expires_at > ?)",
+		jti, time.Now().UTC(),
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrRefreshTokenNotFound
+		}
+		return nil, err
+	}
+
+	return record.toAuthRecord(), nil
+}
+
+func (r *HashRepository) Delete(ctx context.Context, jti token.JTI) error {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM token WHERE jti = ?", jti)
+	if err != nil {
+		return err
+	}
+	return deletedOne(res)
+}
+
+func (r *HashRepository) DeleteByUserId(ctx context.Context, userId uuid.UUID) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM token WHERE user_id = ?", userId)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *HashRepository) DeleteByClient(ctx context.Context, userId uuid.UUID, clientID string) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM token WHERE user_id = ? AND client_id = ?", userId, clientID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Rotate applies rot in one transaction. The blacklist table has to be in
+// the same database.
+func (r *HashRepository) Rotate(ctx context.Context, rot auth.Rotation) error {
+	return r.inTx(ctx, func(tx *sqlx.Tx) error {
+		if rot.Revoked != uuid.Nil {
+			_, err := tx.ExecContext(ctx,
+				"INSERT INTO blacklist (jti, created_at, expires_at) VALUES (?, ?, ?) ON CONFLICT (jti) DO NOTHING",
+				rot.Revoked, time.Now().UTC(), nullTime(rot.RevokedExpiresAt),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		res, err := tx.ExecContext(ctx, "DELETE FROM token WHERE jti = ?", rot.Previous)
+		if err != nil {
+			return err
+		}
+		err = deletedOne(res)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NamedExecContext(ctx, queryInsertToken, dbRecordFromAuthRecord(*rot.Next))
+		if err != nil {
+			return err
+		}
+		return insertOutbox(ctx, tx, rot.Outbox)
+	})
+}
+
+func (r *HashRepository) StoreWithOutbox(ctx context.Context, rec *auth.RefreshTokenRecord, msgs []outbox.Message) error {
+	return r.inTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.NamedExecContext(ctx, queryInsertToken, dbRecordFromAuthRecord(*rec))
+		if err != nil {
+			return err
+		}
+		return insertOutbox(ctx, tx, msgs)
+	})
+}
+
+func (r *HashRepository) DeleteWithOutbox(ctx context.Context, jti token.JTI, msgs []outbox.Message) error {
+	return r.inTx(ctx, func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, "DELETE FROM token WHERE jti = ?", jti)
+		if err != nil {
+			return err
+		}
+		err = deletedOne(res)
+		if err != nil {
+			return err
+		}
+		return insertOutbox(ctx, tx, msgs)
+	})
+}
+
+// deletedOne fails with auth.ErrRefreshTokenNotFound unless res deleted a
+// record.
+func deletedOne(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return auth.ErrRefreshTokenNotFound
+	}
+	return nil
+}
+
+func (r *HashRepository) DeleteByUserIdWithOutbox(ctx context.Context, userId uuid.UUID, msgs []outbox.Message) error {
+	return r.inTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM token WHERE user_id = ?", userId)
+		if err != nil {
+			return err
+		}
+		return insertOutbox(ctx, tx, msgs)
+	})
+}
+
+func (r *HashRepository) DeleteByClientWithOutbox(ctx context.Context, userId uuid.UUID, clientID string, msgs []outbox.Message) error {
+	return r.inTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM token WHERE user_id = ? AND client_id = ?", userId, clientID)
+		if err != nil {
+			return err
+		}
+		return insertOutbox(ctx, tx, msgs)
+	})
+}
+
+// StoreSession relies on transactions taking the write lock up front
+// (_txlock=immediate), so concurrent logins see each other's sessions.
+func (r *HashRepository) StoreSession(ctx context.Context, ns auth.NewSession) ([]auth.RefreshTokenRecord, error) {
+	var evicted []auth.RefreshTokenRecord
+	err := r.inTx(ctx, func(tx *sqlx.Tx) error {
+		var records []TokenDBRecord
+		err := tx.SelectContext(ctx, &records,
+			"SELECT jti, user_id, user_agent, hash, created_at, expires_at, started_at, client_id FROM token WHERE user_id = ? AND (expires_at IS NULL OR expires_at > ?)",
+			ns.Record.User.Id, time.Now().UTC(),
+		)
+		if err != nil {
+			return err
+		}
+		sessions := make([]auth.RefreshTokenRecord, len(records))
+		for i := range records {
+			sessions[i] = *records[i].toAuthRecord()
+		}
+		evicted, err = ns.Limit.Evict(sessions)
+		if err != nil {
+			return err
+		}
+		for _, rec := range evicted {
+			_, err = tx.ExecContext(ctx, "DELETE FROM token WHERE jti = ?", rec.JTI)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.NamedExecContext(ctx, queryInsertToken, dbRecordFromAuthRecord(*ns.Record))
+		if err != nil {
+			return err
+		}
+		msgs := ns.Outbox
+		if ns.EvictionOutbox != nil && len(evicted) > 0 {
+			evictions, err := ns.EvictionOutbox(evicted)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, evictions...)
+		}
+		return insertOutbox(ctx, tx, msgs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return evicted, nil
+}
+
+func (r *HashRepository) inTx(ctx context.Context, fn func(*sqlx.Tx) error) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,150 @@
+package sqlite
+
+import (
+	"context"
+	"medods-auth/service/outbox"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+type OutboxRepository struct {
+	db *sqlx.DB
+}
+
+func NewOutboxRepository(db *sqlx.DB) *OutboxRepository {
+	return &OutboxRepository{
+		db,
+	}
+}
+
+type OutboxDBRecord struct {
+	ID            uuid.UUID  `db:"id"`
+	Topic         string     `db:"topic"`
+	Payload       []byte     `db:"payload"`
+	CreatedAt     time.Time  `db:"created_at"`
+	Status        string     `db:"status"`
+	Attempts      int        `db:"attempts"`
+	NextAttemptAt time.Time  `db:"next_attempt_at"`
+	LockedUntil   *time.Time `db:"locked_until"`
+	LastError     string     `db:"last_error"`
+}
+
+func outboxRecordFromMessage(m outbox.Message) *OutboxDBRecord {
+	return &OutboxDBRecord{
+		ID:            m.ID,
+		Topic:         m.Topic,
+		Payload:       m.Payload,
+		CreatedAt:     m.CreatedAt.UTC(),
+		Status:        string(m.Status),
+		Attempts:      m.Attempts,
+		NextAttemptAt: m.NextAttemptAt.UTC(),
+		LastError:     m.LastError,
+	}
+}
+
+func (r *OutboxDBRecord) toMessage() outbox.Message {
+	return outbox.Message{
+		ID:            r.ID,
+		Topic:         r.Topic,
+		Payload:       r.Payload,
+		CreatedAt:     r.CreatedAt,
+		Status:        outbox.Status(r.Status),
+		Attempts:      r.Attempts,
+		NextAttemptAt: r.NextAttemptAt,
+		LastError:     r.LastError,
+	}
+}
+
+const (
+	outboxColumns = "id, topic, payload, created_at, status, attempts, next_attempt_at, locked_until, last_error"
+
+	queryInsertOutbox = "INSERT INTO outbox (" + outboxColumns + ") VALUES (:id, :topic, :payload, :created_at, :status, :attempts, :next_attempt_at, :locked_until, :last_error)"
+	queryClaimOutbox  = `UPDATE outbox SET locked_until = ? WHERE id IN (
+    SELECT id FROM outbox
+    WHERE status = 'pending' AND next_attempt_at <= ? AND (locked_until IS NULL OR locked_until <= ?)
+    ORDER BY created_at LIMIT ?
+) RETURNING ` + outboxColumns
+	queryFailOutbox = "UPDATE outbox SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ?, locked_until = NULL WHERE id = ?"
+)
+
+func insertOutbox(ctx context.Context, tx *sqlx.Tx, msgs []outbox.Message) error {
+	for _, m := range msgs {
+		_, err := tx.NamedExecContext(ctx, queryInsertOutbox, outboxRecordFromMessage(m))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *OutboxRepository) Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]outbox.Message, error) {
+	now = now.UTC()
+	var records []OutboxDBRecord
+	err := r.db.SelectContext(ctx, &records, queryClaimOutbox, now.Add(lease), now, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	return toMessages(records), nil
+}
+
+func (r *OutboxRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM outbox WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *OutboxRepository) Fail(ctx context.Context, m outbox.Message) error {
+	_, err := r.db.ExecContext(ctx, queryFailOutbox,
+		m.Status, m.Attempts, m.NextAttemptAt.UTC(), m.LastError, m.ID,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *OutboxRepository) List(ctx context.Context, status outbox.Status, limit int) ([]outbox.Message, error) {
+	var records []OutboxDBRecord
+	err := r.db.SelectContext(ctx, &records,
+		"SELECT "+outboxColumns+" FROM outbox WHERE status = ? ORDER BY created_at LIMIT ?",
+		status, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return toMessages(records), nil
+}
+
+func (r *OutboxRepository) Replay(ctx context.Context, ids []uuid.UUID) (int, error) {
+	query := "UPDATE outbox SET status = 'pending', attempts = 0, next_attempt_at = ?, locked_until = NULL WHERE status = 'dead'"
+	args := []any{time.Now().UTC()}
+	if len(ids) > 0 {
+		var err error
+		query, args, err = sqlx.In(query+" AND id IN (?)", args[0], ids)
+		if err != nil {
+			return 0, err
+		}
+	}
+	res, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func toMessages(records []OutboxDBRecord) []outbox.Message {
+	out := make([]outbox.Message, len(records))
+	for i := range records {
+		out[i] = records[i].toMessage()
+	}
+	slices.SortFunc(out, func(a, b outbox.Message) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return out
+}
@@ -0,0 +1,244 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const InMemory = ":memory:"
+
+// migrations are applied in order, each one exactly once. Append only.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS token (
+    jti TEXT PRIMARY KEY CHECK (length(jti) = 36),
+    user_id TEXT NOT NULL CHECK (length(user_id) = 36),
+    user_agent TEXT,
+    hash BLOB NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS token_user_id_idx ON token (user_id);`,
+
+	`CREATE TABLE IF NOT EXISTS blacklist (
+    jti TEXT PRIMARY KEY CHECK (length(jti) = 36),
+    created_at TIMESTAMP NOT NULL
+);`,
+
+	`ALTER TABLE token ADD COLUMN expires_at TIMESTAMP;
+ALTER TABLE blacklist ADD COLUMN expires_at TIMESTAMP;`,
+
+	`CREATE TABLE IF NOT EXISTS outbox (
+    id TEXT PRIMARY KEY CHECK (length(id) = 36),
+    topic TEXT NOT NULL,
+    payload BLOB NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    status TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP,
+    last_error TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS outbox_due_idx ON outbox (status, next_attempt_at);`,
+
+	`ALTER TABLE token ADD COLUMN started_at TIMESTAMP;`,
+
+	`CREATE TABLE IF NOT EXISTS users (
+    id TEXT PRIMARY KEY CHECK (length(id) = 36),
+    status TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);`,
+
+	`CREATE TABLE IF NOT EXISTS credentials (
+    user_id TEXT PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    login TEXT NOT NULL UNIQUE,
+    hash TEXT NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);`,
+
+	`CREATE TABLE IF NOT EXISTS totp (
+    user_id TEXT PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    secret TEXT NOT NULL,
+    active BOOLEAN NOT NULL,
+    last_step INTEGER NOT NULL,
+    recovery_codes TEXT NOT NULL,
+    version INTEGER NOT NULL
+);`,
+
+	`CREATE TABLE IF NOT EXISTS passkeys (
+    id BLOB PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    public_key BLOB NOT NULL,
+    sign_count INTEGER NOT NULL,
+    transports TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS passkeys_user_id_idx ON passkeys (user_id);
+CREATE TABLE IF NOT EXISTS webauthn_challenges (
+    value BLOB PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    ceremony TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);`,
+
+	`CREATE TABLE IF NOT EXISTS oauth_clients (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    secret_hash TEXT NOT NULL,
+    scopes TEXT NOT NULL,
+    access_ttl_ms INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);`,
+
+	`ALTER TABLE oauth_clients ADD COLUMN public BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE oauth_clients ADD COLUMN redirect_uris TEXT NOT NULL DEFAULT '[]';
+CREATE TABLE IF NOT EXISTS oauth_codes (
+    hash TEXT PRIMARY KEY,
+    client_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    redirect_uri TEXT NOT NULL,
+    scope TEXT NOT NULL,
+    code_challenge TEXT NOT NULL,
+    amr TEXT NOT NULL,
+    auth_time TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS oauth_consents (
+    user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    client_id TEXT NOT NULL REFERENCES oauth_clients (id) ON DELETE CASCADE,
+    scopes TEXT NOT NULL,
+    granted_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, client_id)
+);`,
+
+	`CREATE TABLE IF NOT EXISTS oauth_device_codes (
+    hash TEXT PRIMARY KEY,
+    user_code TEXT NOT NULL UNIQUE,
+    client_id TEXT NOT NULL,
+    scope TEXT NOT NULL,
+    status TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    amr TEXT NOT NULL,
+    auth_time TIMESTAMP NOT NULL,
+    last_polled_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    keep_until TIMESTAMP NOT NULL
+);`,
+
+	`ALTER TABLE oauth_clients ADD COLUMN post_logout_redirect_uris TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE oauth_codes ADD COLUMN nonce TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE token ADD COLUMN client_id TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE oauth_device_codes ADD COLUMN interval_ms INTEGER NOT NULL DEFAULT 0;`,
+}
+
+var schemaMigrations = `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    applied_at TIMESTAMP NOT NULL
+);`
+
+type SQLiteConfig struct {
+	// Path to the database file, or InMemory.
+	Path string
+
+	BusyTimeout  *time.Duration
+	MaxOpenConns *int
+}
+
+func InitDatabase(conf *SQLiteConfig) (*sqlx.DB, error) {
+	db, err := connect(conf)
+	if err != nil {
+		return nil, err
+	}
+	err = migrate(context.TODO(), db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func connect(conf *SQLiteConfig) (*sqlx.DB, error) {
+	err := conf.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	busyTimeout := 5 * time.Second
+	if conf.BusyTimeout != nil {
+		busyTimeout = *conf.BusyTimeout
+	}
+
+	params := url.Values{}
+	params.Set("_busy_timeout", fmt.Sprint(busyTimeout.Milliseconds()))
+	params.Set("_foreign_keys", "on")
+	params.Set("_txlock", "immediate")
+	if conf.Path != InMemory {
+		params.Set("_journal_mode", "WAL")
+		params.Set("_synchronous", "NORMAL")
+	}
+	dsn := "file:" + conf.Path + "?" + params.Encode()
+
+	db, err := sqlx.Connect("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+
+	switch {
+	case conf.Path == InMemory:
+		// every connection to :memory: gets its own empty database
+		db.SetMaxOpenConns(1)
+	case conf.MaxOpenConns != nil:
+		db.SetMaxOpenConns(*conf.MaxOpenConns)
+	default:
+		db.SetMaxOpenConns(4)
+	}
+	db.SetConnMaxLifetime(0)
+
+	return db, nil
+}
+
+func migrate(ctx context.Context, db *sqlx.DB) error {
+	_, err := db.ExecContext(ctx, schemaMigrations)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current int
+	err = tx.GetContext(ctx, &current, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+	for i := current; i < len(migrations); i++ {
+		_, err = tx.ExecContext(ctx, migrations[i])
+		if err != nil {
+			return fmt.Errorf("sqlite migration %d: %w", i+1, err)
+		}
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)",
+			i+1, time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (c *SQLiteConfig) validate() error {
+	if c.Path == "" {
+		return errors.New("empty sqlite database path")
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package sqlite
+
+import (
+	"context"
+	"medods-auth/service/auth"
+	"medods-auth/user"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitDatabase(t *testing.T) {
+	assert := assert.New(t)
+	conf := &SQLiteConfig{Path: filepath.Join(t.TempDir(), "test.db")}
+
+	db, err := InitDatabase(conf)
+	assert.Nil(err)
+
+	var mode string
+	err = db.Get(&mode, "PRAGMA journal_mode")
+	assert.Nil(err)
+	assert.Equal("wal", mode)
+
+	rec := &auth.RefreshTokenRecord{
+		JTI:       uuid.New(),
+		User:      user.User{Id: uuid.New(), UserAgent: "test"},
+		Hash:      []byte("hash"),
+		CreatedAt: time.Now(),
+	}
+	err = NewHashRepository(db).Store(context.Background(), rec)
+	assert.Nil(err)
+	assert.Nil(db.Close())
+
+	// migrations must not be reapplied on an existing database
+	db, err = InitDatabase(conf)
+	assert.Nil(err)
+	defer db.Close()
+
+	var version int
+	err = db.Get(&version, "SELECT MAX(version) FROM schema_migrations")
+	assert.Nil(err)
+	assert.Equal(len(migrations), version)
+
+	got, err := NewHashRepository(db).Get(context.Background(), rec.JTI)
+	assert.Nil(err)
+	assert.Equal(rec.JTI, got.JTI)
+	assert.Equal(rec.User, got.User)
+	assert.True(rec.CreatedAt.Equal(got.CreatedAt))
+
+	_, err = NewHashRepository(db).Get(context.Background(), uuid.New())
+	assert.Equal(auth.ErrRefreshTokenNotFound, err)
+}
@@ -0,0 +1,728 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"medods-auth/service/auth"
+	"medods-auth/user"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+type UserRepository struct {
+	db *sqlx.DB
+}
+
+func NewUserRepository(db *sqlx.DB) *UserRepository {
+	return &UserRepository{
+		db,
+	}
+}
+
+type userDBRecord struct {
+	ID        uuid.UUID   `db:"id"`
+	Status    user.Status `db:"status"`
+	CreatedAt time.Time   `db:"created_at"`
+}
+
+type credentialDBRecord struct {
+	UserID uuid.UUID `db:"user_id"`
+	Login  string    `db:"login"`
+	Hash   string    `db:"hash"`
+}
+
+func (r *UserRepository) Create(ctx context.Context, account *user.Account) error {
+	res, err := r.db.ExecContext(ctx,
+		"INSERT INTO users (id, status, created_at) VALUES (?, ?, ?) ON CONFLICT (id) DO NOTHING",
+		account.Id, account.Status, account.CreatedAt.UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrUserExists)
+}
+
+func (r *UserRepository) Get(ctx context.Context, id uuid.UUID) (*user.Account, error) {
+	var record userDBRecord
+	err := r.db.GetContext(ctx, &record, "SELECT id, status, created_at FROM users WHERE id = ?", id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user.Account{
+		Id:        record.ID,
+		Status:    record.Status,
+		CreatedAt: record.CreatedAt,
+	}, nil
+}
+
+func (r *UserRepository) SetStatus(ctx context.Context, id uuid.UUID, status user.Status) error {
+	res, err := r.db.ExecContext(ctx, "UPDATE users SET status = ? WHERE id = ?", status, id)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrUserNotFound)
+}
+
+func (r *UserRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM users WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrUserNotFound)
+}
+
+func (r *UserRepository) SetCredential(ctx context.Context, cred auth.Credential) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var owner uuid.UUID
+	err = tx.GetContext(ctx, &owner, "SELECT user_id FROM credentials WHERE login = ?", cred.Login)
+	if err == nil && owner != cred.UserID {
+		return auth.ErrLoginTaken
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	var exists int
+	err = tx.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", cred.UserID)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return auth.ErrUserNotFound
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO credentials (user_id, login, hash, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET login = excluded.login, hash = excluded.hash, updated_at = excluded.updated_at`,
+		cred.UserID, cred.Login, cred.Hash, time.Now().UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *UserRepository) GetCredential(ctx context.Context, login string) (*auth.Credential, error) {
+	var cred credentialDBRecord
+	err := r.db.GetContext(ctx, &cred, "SELECT user_id, login, hash FROM credentials WHERE login = ?", login)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrCredentialNotFound
+		}
+		return nil, err
+	}
+	return &auth.Credential{UserID: cred.UserID, Login: cred.Login, Hash: cred.Hash}, nil
+}
+
+func (r *UserRepository) GetUserCredential(ctx context.Context, userID uuid.UUID) (*auth.Credential, error) {
+	var cred credentialDBRecord
+	err := r.db.GetContext(ctx, &cred, "SELECT user_id, login, hash FROM credentials WHERE user_id = ?", userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrCredentialNotFound
+		}
+		return nil, err
+	}
+	return &auth.Credential{UserID: cred.UserID, Login: cred.Login, Hash: cred.Hash}, nil
+}
+
+func (r *UserRepository) UpdateCredentialHash(ctx context.Context, userID uuid.UUID, old, new string) error {
+	_, err := r.db.ExecContext(ctx,
+		"UPDATE credentials SET hash = ?, updated_at = ? WHERE user_id = ? AND hash = ?",
+		new, time.Now().UTC(), userID, old,
+	)
+	return err
+}
+
+type totpDBRecord struct {
+	UserID        uuid.UUID `db:"user_id"`
+	Secret        string    `db:"secret"`
+	Active        bool      `db:"active"`
+	LastStep      int64     `db:"last_step"`
+	RecoveryCodes string    `db:"recovery_codes"`
+	Version       int64     `db:"version"`
+}
+
+func (r *UserRepository) GetTOTP(ctx context.Context, userID uuid.UUID) (*auth.TOTP, error) {
+	var record totpDBRecord
+	err := r.db.GetContext(ctx, &record,
+		"SELECT user_id, secret, active, last_step, recovery_codes, version FROM totp WHERE user_id = ?", userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrTOTPNotEnrolled
+		}
+		return nil, err
+	}
+	t := &auth.TOTP{
+		UserID:   record.UserID,
+		Secret:   record.Secret,
+		Active:   record.Active,
+		LastStep: record.LastStep,
+		Version:  record.Version,
+	}
+	err = json.Unmarshal([]byte(record.RecoveryCodes), &t.RecoveryCodes)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (r *UserRepository) PutTOTP(ctx context.Context, t *auth.TOTP) error {
+	codes, err := json.Marshal(t.RecoveryCodes)
+	if err != nil {
+		return err
+	}
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", t.UserID)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return auth.ErrUserNotFound
+	}
+	var res sql.Result
+	if t.Version == 1 {
+		res, err = tx.ExecContext(ctx,
+			`INSERT INTO totp (user_id, secret, active, last_step, recovery_codes, version) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (user_id) DO NOTHING`,
+			t.UserID, t.Secret, t.Active, t.LastStep, string(codes), t.Version,
+		)
+	} else {
+		res, err = tx.ExecContext(ctx,
+			`UPDATE totp SET secret = ?, active = ?, last_step = ?, recovery_codes = ?, version = ?
+			WHERE user_id = ? AND version = ?`,
+			t.Secret, t.Active, t.LastStep, string(codes), t.Version, t.UserID, t.Version-1,
+		)
+	}
+	if err != nil {
+		return err
+	}
+	err = checkAffected(res, auth.ErrTOTPConflict)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *UserRepository) DeleteTOTP(ctx context.Context, userID uuid.UUID) error {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM totp WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrTOTPNotEnrolled)
+}
+
+type passkeyDBRecord struct {
+	ID         []byte    `db:"id"`
+	UserID     uuid.UUID `db:"user_id"`
+	PublicKey  []byte    `db:"public_key"`
+	SignCount  uint32    `db:"sign_count"`
+	Transports string    `db:"transports"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+func (rec passkeyDBRecord) toPasskey() (auth.Passkey, error) {
+	p := auth.Passkey{
+		ID:        rec.ID,
+		UserID:    rec.UserID,
+		PublicKey: rec.PublicKey,
+		SignCount: rec.SignCount,
+		CreatedAt: rec.CreatedAt,
+	}
+	err := json.Unmarshal([]byte(rec.Transports), &p.Transports)
+	return p, err
+}
+
+func (r *UserRepository) AddPasskey(ctx context.Context, p *auth.Passkey) error {
+	transports, err := json.Marshal(p.Transports)
+	if err != nil {
+		return err
+	}
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", p.UserID)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return auth.ErrUserNotFound
+	}
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO passkeys (id, user_id, public_key, sign_count, transports, created_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`,
+		p.ID, p.UserID, p.PublicKey, p.SignCount, string(transports), p.CreatedAt.UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	err = checkAffected(res, auth.ErrPasskeyExists)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *UserRepository) GetPasskey(ctx context.Context, id []byte) (*auth.Passkey, error) {
+	var record passkeyDBRecord
+	err := r.db.GetContext(ctx, &record,
+		"SELECT id, user_id, public_key, sign_count, transports, created_at FROM passkeys WHERE id = ?", id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrPasskeyNotFound
+		}
+		return nil, err
+	}
+	p, err := record.toPasskey()
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (r *UserRepository) ListPasskeys(ctx context.Context, userID uuid.UUID) ([]auth.Passkey, error) {
+	var records []passkeyDBRecord
+	err := r.db.SelectContext(ctx, &records,
+		`SELECT id, user_id, public_key, sign_count, transports, created_at FROM passkeys
+		WHERE user_id = ? ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	var out []auth.Passkey
+	for _, record := range records {
+		p, err := record.toPasskey()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+func (r *UserRepository) UpdateSignCount(ctx context.Context, id []byte, old, new uint32) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var count uint32
+	err = tx.GetContext(ctx, &count, "SELECT sign_count FROM passkeys WHERE id = ?", id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return auth.ErrPasskeyNotFound
+		}
+		return err
+	}
+	if count != old {
+		return auth.ErrPasskeySignCount
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE passkeys SET sign_count = ? WHERE id = ?", new, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type challengeDBRecord struct {
+	UserID    uuid.UUID     `db:"user_id"`
+	Ceremony  auth.Ceremony `db:"ceremony"`
+	ExpiresAt time.Time     `db:"expires_at"`
+}
+
+// PutChallenge also drops expired challenges, nothing else would.
+func (r *UserRepository) PutChallenge(ctx context.Context, c *auth.Challenge) error {
+	now := time.Now().UTC()
+	_, err := r.db.ExecContext(ctx, "DELETE FROM webauthn_challenges WHERE expires_at <= ?", now)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx,
+		"INSERT INTO webauthn_challenges (value, user_id, ceremony, expires_at) VALUES (?, ?, ?, ?)",
+		c.Value, c.UserID, c.Ceremony, c.ExpiresAt.UTC(),
+	)
+	return err
+}
+
+func (r *UserRepository) TakeChallenge(ctx context.Context, value []byte) (*auth.Challenge, error) {
+	var record challengeDBRecord
+	err := r.db.GetContext(ctx, &record,
+		"DELETE FROM webauthn_challenges WHERE value = ? RETURNING user_id, ceremony, expires_at", value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrChallengeNotFound
+		}
+		return nil, err
+	}
+	if !time.Now().Before(record.ExpiresAt) {
+		return nil, auth.ErrChallengeNotFound
+	}
+	return &auth.Challenge{
+		Value:     value,
+		UserID:    record.UserID,
+		Ceremony:  record.Ceremony,
+		ExpiresAt: record.ExpiresAt,
+	}, nil
+}
+
+type clientDBRecord struct {
+	ID                     string    `db:"id"`
+	Name                   string    `db:"name"`
+	SecretHash             string    `db:"secret_hash"`
+	Public                 bool      `db:"public"`
+	Scopes                 string    `db:"scopes"`
+	RedirectURIs           string    `db:"redirect_uris"`
+	PostLogoutRedirectURIs string    `db:"post_logout_redirect_uris"`
+	AccessTTLMs            int64     `db:"access_ttl_ms"`
+	CreatedAt              time.Time `db:"created_at"`
+}
+
+func (r *UserRepository) CreateClient(ctx context.Context, c *auth.Client) error {
+	scopes, err := json.Marshal(c.Scopes)
+	if err != nil {
+		return err
+	}
+	redirectURIs, err := json.Marshal(c.RedirectURIs)
+	if err != nil {
+		return err
+	}
+	postLogoutRedirectURIs, err := json.Marshal(c.PostLogoutRedirectURIs)
+	if err != nil {
+		return err
+	}
+	res, err := r.db.ExecContext(ctx,
+		`INSERT INTO oauth_clients (id, name, secret_hash, public, scopes, redirect_uris, post_logout_redirect_uris, access_ttl_ms, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`,
+		c.ID, c.Name, c.SecretHash, c.Public, string(scopes), string(redirectURIs), string(postLogoutRedirectURIs), c.AccessTTL.Milliseconds(), c.CreatedAt.UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrClientExists)
+}
+
+func (r *UserRepository) GetClient(ctx context.Context, id string) (*auth.Client, error) {
+	var record clientDBRecord
+	err := r.db.GetContext(ctx, &record,
+		`SELECT id, name, secret_hash, public, scopes, redirect_uris, post_logout_redirect_uris, access_ttl_ms, created_at
+		FROM oauth_clients WHERE id = ?`, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrClientNotFound
+		}
+		return nil, err
+	}
+	c := &auth.Client{
+		ID:         record.ID,
+		Name:       record.Name,
+		SecretHash: record.SecretHash,
+		Public:     record.Public,
+		AccessTTL:  time.Duration(record.AccessTTLMs) * time.Millisecond,
+		CreatedAt:  record.CreatedAt,
+	}
+	err = json.Unmarshal([]byte(record.Scopes), &c.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(record.RedirectURIs), &c.RedirectURIs)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(record.PostLogoutRedirectURIs), &c.PostLogoutRedirectURIs)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (r *UserRepository) DeleteClient(ctx context.Context, id string) error {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM oauth_clients WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrClientNotFound)
+}
+
+type authCodeDBRecord struct {
+	ClientID      string    `db:"client_id"`
+	UserID        uuid.UUID `db:"user_id"`
+	RedirectURI   string    `db:"redirect_uri"`
+	Scope         string    `db:"scope"`
+	CodeChallenge string    `db:"code_challenge"`
+	Nonce         string    `db:"nonce"`
+	AMR           string    `db:"amr"`
+	AuthTime      time.Time `db:"auth_time"`
+	ExpiresAt     time.Time `db:"expires_at"`
+}
+
+// PutAuthCode also drops expired codes, nothing else would.
+func (r *UserRepository) PutAuthCode(ctx context.Context, c *auth.AuthCode) error {
+	amr, err := json.Marshal(c.AMR)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, "DELETE FROM oauth_codes WHERE expires_at <= ?", time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx,
+		`INSERT INTO oauth_codes (hash, client_id, user_id, redirect_uri, scope, code_challenge, nonce, amr, auth_time, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		c.Hash, c.ClientID, c.UserID, c.RedirectURI, c.Scope, c.CodeChallenge, c.Nonce, string(amr), c.AuthTime.UTC(), c.ExpiresAt.UTC(),
+	)
+	return err
+}
+
+func (r *UserRepository) TakeAuthCode(ctx context.Context, hash string) (*auth.AuthCode, error) {
+	var record authCodeDBRecord
+	err := r.db.GetContext(ctx, &record,
+		`DELETE FROM oauth_codes WHERE hash = ?
+		RETURNING client_id, user_id, redirect_uri, scope, code_challenge, nonce, amr, auth_time, expires_at`, hash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrAuthCodeNotFound
+		}
+		return nil, err
+	}
+	if !time.Now().Before(record.ExpiresAt) {
+		return nil, auth.ErrAuthCodeNotFound
+	}
+	c := &auth.AuthCode{
+		Hash:          hash,
+		ClientID:      record.ClientID,
+		UserID:        record.UserID,
+		RedirectURI:   record.RedirectURI,
+		Scope:         record.Scope,
+		CodeChallenge: record.CodeChallenge,
+		Nonce:         record.Nonce,
+		AuthTime:      record.AuthTime,
+		ExpiresAt:     record.ExpiresAt,
+	}
+	err = json.Unmarshal([]byte(record.AMR), &c.AMR)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type consentDBRecord struct {
+	Scopes    string    `db:"scopes"`
+	GrantedAt time.Time `db:"granted_at"`
+}
+
+func (r *UserRepository) GetConsent(ctx context.Context, userID uuid.UUID, clientID string) (*auth.Consent, error) {
+	var record consentDBRecord
+	err := r.db.GetContext(ctx, &record,
+		"SELECT scopes, granted_at FROM oauth_consents WHERE user_id = ? AND client_id = ?", userID, clientID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrConsentNotFound
+		}
+		return nil, err
+	}
+	c := &auth.Consent{
+		UserID:    userID,
+		ClientID:  clientID,
+		GrantedAt: record.GrantedAt,
+	}
+	err = json.Unmarshal([]byte(record.Scopes), &c.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (r *UserRepository) PutConsent(ctx context.Context, c *auth.Consent) error {
+	scopes, err := json.Marshal(c.Scopes)
+	if err != nil {
+		return err
+	}
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", c.UserID)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return auth.ErrUserNotFound
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO oauth_consents (user_id, client_id, scopes, granted_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, client_id) DO UPDATE SET scopes = excluded.scopes, granted_at = excluded.granted_at`,
+		c.UserID, c.ClientID, string(scopes), c.GrantedAt.UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type deviceCodeDBRecord struct {
+	Hash         string            `db:"hash"`
+	UserCode     string            `db:"user_code"`
+	ClientID     string            `db:"client_id"`
+	Scope        string            `db:"scope"`
+	Status       auth.DeviceStatus `db:"status"`
+	UserID       uuid.UUID         `db:"user_id"`
+	AMR          string            `db:"amr"`
+	AuthTime     time.Time         `db:"auth_time"`
+	LastPolledAt time.Time         `db:"last_polled_at"`
+	IntervalMs   int64             `db:"interval_ms"`
+	ExpiresAt    time.Time         `db:"expires_at"`
+	KeepUntil    time.Time         `db:"keep_until"`
+}
+
+func (record *deviceCodeDBRecord) toDeviceCode() (*auth.DeviceCode, error) {
+	d := &auth.DeviceCode{
+		Hash:         record.Hash,
+		UserCode:     record.UserCode,
+		ClientID:     record.ClientID,
+		Scope:        record.Scope,
+		Status:       record.Status,
+		UserID:       record.UserID,
+		AuthTime:     record.AuthTime,
+		LastPolledAt: record.LastPolledAt,
+		Interval:     time.Duration(record.IntervalMs) * time.Millisecond,
+		ExpiresAt:    record.ExpiresAt,
+		KeepUntil:    record.KeepUntil,
+	}
+	err := json.Unmarshal([]byte(record.AMR), &d.AMR)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+const deviceCodeColumns = "hash, user_code, client_id, scope, status, user_id, amr, auth_time, last_polled_at, interval_ms, expires_at, keep_until"
+
+// PutDeviceCode also drops codes past KeepUntil, nothing else would.
+func (r *UserRepository) PutDeviceCode(ctx context.Context, d *auth.DeviceCode) error {
+	amr, err := json.Marshal(d.AMR)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, "DELETE FROM oauth_device_codes WHERE keep_until <= ?", time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	res, err := r.db.ExecContext(ctx,
+		`INSERT INTO oauth_device_codes (`+deviceCodeColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_code) DO NOTHING`,
+		d.Hash, d.UserCode, d.ClientID, d.Scope, d.Status, d.UserID, string(amr),
+		d.AuthTime.UTC(), d.LastPolledAt.UTC(), d.Interval.Milliseconds(), d.ExpiresAt.UTC(), d.KeepUntil.UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrUserCodeTaken)
+}
+
+func (r *UserRepository) GetDeviceCode(ctx context.Context, userCode string) (*auth.DeviceCode, error) {
+	var record deviceCodeDBRecord
+	err := r.db.GetContext(ctx, &record,
+		"SELECT "+deviceCodeColumns+" FROM oauth_device_codes WHERE user_code = ? AND keep_until > ?",
+		userCode, time.Now().UTC())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrDeviceCodeNotFound
+		}
+		return nil, err
+	}
+	return record.toDeviceCode()
+}
+
+func (r *UserRepository) DecideDeviceCode(ctx context.Context, d *auth.DeviceCode) error {
+	amr, err := json.Marshal(d.AMR)
+	if err != nil {
+		return err
+	}
+	res, err := r.db.ExecContext(ctx,
+		`UPDATE oauth_device_codes SET status = ?, user_id = ?, amr = ?, auth_time = ?
+		WHERE user_code = ? AND status = ? AND expires_at > ?`,
+		d.Status, d.UserID, string(amr), d.AuthTime.UTC(),
+		d.UserCode, auth.DevicePending, time.Now().UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrDeviceCodeNotFound)
+}
+
+func (r *UserRepository) PollDeviceCode(ctx context.Context, hash string, now time.Time) (*auth.DeviceCode, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var record deviceCodeDBRecord
+	err = tx.GetContext(ctx, &record,
+		"SELECT "+deviceCodeColumns+" FROM oauth_device_codes WHERE hash = ? AND keep_until > ?",
+		hash, now.UTC())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, auth.ErrDeviceCodeNotFound
+		}
+		return nil, err
+	}
+	if record.Status == auth.DevicePending {
+		_, err = tx.ExecContext(ctx, "UPDATE oauth_device_codes SET last_polled_at = ? WHERE hash = ?", now.UTC(), hash)
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM oauth_device_codes WHERE hash = ?", hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return record.toDeviceCode()
+}
+
+func (r *UserRepository) SlowDownDeviceCode(ctx context.Context, hash string, interval time.Duration) error {
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE oauth_device_codes SET interval_ms = ? WHERE hash = ? AND status = ? AND keep_until > ?",
+		interval.Milliseconds(), hash, auth.DevicePending, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return checkAffected(res, auth.ErrDeviceCodeNotFound)
+}
+
+// checkAffected returns errNone if res changed no rows.
+func checkAffected(res sql.Result, errNone error) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNone
+	}
+	return nil
+}
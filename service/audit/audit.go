@@ -0,0 +1,173 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Event string
+
+const (
+	EventTokensIssued      Event = "tokens_issued"
+	EventTokensRefreshed   Event = "tokens_refreshed"
+	EventLogout            Event = "logout"
+	EventSessionsRevoked   Event = "sessions_revoked"
+	EventUserAgentMismatch Event = "user_agent_mismatch"
+	EventReuseDetected     Event = "refresh_token_reuse"
+	// EventSessionEvicted has the evicted refresh token as JTI and the
+	// one of the session replacing it as IssuedJTI.
+	EventSessionEvicted Event = "session_evicted"
+
+	EventUserCreated  Event = "user_created"
+	EventUserDisabled Event = "user_disabled"
+	EventUserEnabled  Event = "user_enabled"
+	EventUserDeleted  Event = "user_deleted"
+	EventPasswordSet  Event = "password_set"
+	EventLogin        Event = "login"
+	// EventLogin is followed by EventMFAVerified for users with a second
+	// factor, the tokens are only issued by the latter.
+	EventMFAVerified   Event = "mfa_verified"
+	EventTOTPEnrolled  Event = "totp_enrolled"
+	EventTOTPActivated Event = "totp_activated"
+	EventTOTPReset     Event = "totp_reset"
+	EventPasskeyAdded  Event = "passkey_added"
+	// EventPasskeyLogin is a login with a passkey alone.
+	EventPasskeyLogin Event = "passkey_login"
+	// EventLockoutCleared is an admin clearing the failed logins of a
+	// user, or of the IP of the entry when it has no user.
+	EventLockoutCleared Event = "lockout_cleared"
+
+	EventClientCreated Event = "client_created"
+	EventClientDeleted Event = "client_deleted"
+	// EventClientTokenIssued is an access token issued to a client on its
+	// own behalf.
+	EventClientTokenIssued Event = "client_token_issued"
+	// EventCodeIssued is an authorization code issued to a client for a
+	// user.
+	EventCodeIssued Event = "authorization_code_issued"
+	// EventDeviceApproved and EventDeviceDenied record the decision of a
+	// user on a device authorization.
+	EventDeviceApproved Event = "device_approved"
+	EventDeviceDenied   Event = "device_denied"
+	// EventTokenRevoked is a client revoking a token issued to it. For a
+	// refresh token the sessions of the user are revoked with it.
+	EventTokenRevoked Event = "token_revoked"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+var ErrChainBroken = errors.New("audit chain broken")
+
+// Entry is one record of the audit log. Seq, PrevHash and Hash are
+// assigned by the sink when the entry is appended.
+type Entry struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Event     Event     `json:"event"`
+	Outcome   string    `json:"outcome"`
+	ErrorCode string    `json:"error_code,omitempty"`
+
+	UserID uuid.UUID `json:"user_id"`
+	// ClientID is the OAuth client acting, on its own behalf when the
+	// entry has no user.
+	ClientID  string `json:"client_id,omitempty"`
+	JTI       string `json:"jti,omitempty"`
+	IssuedJTI string `json:"issued_jti,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// Seal links e to prev, which is nil for the first entry of the log.
+// Time is normalized to UTC microseconds so it survives a round trip
+// through any of the sinks unchanged.
+func (e *Entry) Seal(prev *Entry) {
+	e.Seq = 1
+	e.PrevHash = ""
+	if prev != nil {
+		e.Seq = prev.Seq + 1
+		e.PrevHash = prev.Hash
+	}
+	e.Time = e.Time.UTC().Truncate(time.Microsecond)
+	e.Hash = e.ComputeHash()
+}
+
+// ComputeHash returns the hash of all fields of e except Hash itself.
+func (e Entry) ComputeHash() string {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		// Entry only holds plain values
+		panic(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify checks that entries, ordered by Seq, form an unbroken chain.
+// The link to the entry preceding entries[0] is not checked unless
+// entries[0] is the first entry of the log.
+func Verify(entries []Entry) error {
+	for i, e := range entries {
+		if e.Hash != e.ComputeHash() {
+			return fmt.Errorf("%w: entry %d was modified", ErrChainBroken, e.Seq)
+		}
+		if i == 0 {
+			if e.Seq == 1 && e.PrevHash != "" {
+				return fmt.Errorf("%w: entry 1 has a predecessor", ErrChainBroken)
+			}
+			continue
+		}
+		prev := entries[i-1]
+		if e.Seq != prev.Seq+1 {
+			return fmt.Errorf("%w: entries %d to %d are missing", ErrChainBroken, prev.Seq+1, e.Seq-1)
+		}
+		if e.PrevHash != prev.Hash {
+			return fmt.Errorf("%w: entry %d does not follow entry %d", ErrChainBroken, e.Seq, prev.Seq)
+		}
+	}
+	return nil
+}
+
+type Filter struct {
+	UserID *uuid.UUID
+	Since  time.Time
+	Until  time.Time
+
+	// Limit caps the number of entries returned, 0 means no limit.
+	Limit int
+}
+
+func (f Filter) Match(e Entry) bool {
+	if f.UserID != nil && e.UserID != *f.UserID {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+type Sink interface {
+	Record(context.Context, Entry) error
+}
+
+// Reader returns the entries matching the filter ordered by Seq.
+type Reader interface {
+	Query(context.Context, Filter) ([]Entry, error)
+}
@@ -0,0 +1,84 @@
+package audit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSinkChain(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	ctx := context.Background()
+
+	alice, bob := uuid.New(), uuid.New()
+	sink, err := NewFileSink(path)
+	assert.NoError(err)
+	assert.NoError(sink.Record(ctx, Entry{Time: time.Now(), Event: EventTokensIssued, UserID: alice}))
+	assert.NoError(sink.Record(ctx, Entry{Time: time.Now(), Event: EventTokensIssued, UserID: bob}))
+	assert.NoError(sink.Close())
+
+	// the chain continues after reopening
+	sink, err = NewFileSink(path)
+	assert.NoError(err)
+	defer sink.Close()
+	assert.NoError(sink.Record(ctx, Entry{Time: time.Now(), Event: EventLogout, UserID: alice}))
+
+	all, err := sink.Query(ctx, Filter{})
+	assert.NoError(err)
+	if assert.Len(all, 3) {
+		assert.Equal(int64(3), all[2].Seq)
+		assert.Equal(all[1].Hash, all[2].PrevHash)
+	}
+	assert.NoError(Verify(all))
+
+	own, err := sink.Query(ctx, Filter{UserID: &alice})
+	assert.NoError(err)
+	if assert.Len(own, 2) {
+		assert.Equal(EventTokensIssued, own[0].Event)
+		assert.Equal(EventLogout, own[1].Event)
+	}
+
+	limited, err := sink.Query(ctx, Filter{Limit: 1})
+	assert.NoError(err)
+	assert.Len(limited, 1)
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	ctx := context.Background()
+
+	sink, err := NewFileSink(path)
+	assert.NoError(err)
+	for _, outcome := range []string{OutcomeSuccess, OutcomeFailure, OutcomeSuccess} {
+		assert.NoError(sink.Record(ctx, Entry{Time: time.Now(), Event: EventTokensRefreshed, Outcome: outcome}))
+	}
+	assert.NoError(sink.Close())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(err)
+	lines := strings.SplitAfter(string(data), "\n")
+
+	edited := strings.Replace(lines[1], OutcomeFailure, OutcomeSuccess, 1)
+	assert.NoError(os.WriteFile(path, []byte(lines[0]+edited+lines[2]), 0o600))
+	assertBroken(t, path)
+
+	assert.NoError(os.WriteFile(path, []byte(lines[0]+lines[2]), 0o600))
+	assertBroken(t, path)
+}
+
+func assertBroken(t *testing.T, path string) {
+	sink, err := NewFileSink(path)
+	assert.NoError(t, err)
+	defer sink.Close()
+	entries, err := sink.Query(context.Background(), Filter{})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, Verify(entries), ErrChainBroken)
+}
@@ -0,0 +1,109 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// FileSink appends entries to a JSON lines file.
+type FileSink struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	last *Entry
+}
+
+// NewFileSink opens or creates the log at path and continues its chain.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileSink{path: path, file: f}
+
+	err = s.scan(func(e Entry) bool {
+		s.last = &e
+		return true
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) Record(ctx context.Context, e Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.Seal(s.last)
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	err = s.file.Sync()
+	if err != nil {
+		return err
+	}
+	s.last = &e
+	return nil
+}
+
+func (s *FileSink) Query(ctx context.Context, f Filter) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []Entry
+	err := s.scan(func(e Entry) bool {
+		if f.Match(e) {
+			out = append(out, e)
+		}
+		return ctx.Err() == nil && (f.Limit == 0 || len(out) < f.Limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, ctx.Err()
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+func (s *FileSink) scan(fn func(Entry) bool) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		var e Entry
+		if jsonErr := json.Unmarshal(data, &e); jsonErr != nil {
+			return fmt.Errorf("%s:%d: %w", s.path, line, jsonErr)
+		}
+		if !fn(e) || err == io.EOF {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"medods-auth/logging"
+	"medods-auth/service/audit"
+	"medods-auth/user"
+	"time"
+)
+
+type AuditSink interface {
+	Record(context.Context, audit.Entry) error
+}
+
+func newEntry(event audit.Event, u user.User) *audit.Entry {
+	return &audit.Entry{
+		Time:      time.Now(),
+		Event:     event,
+		UserID:    u.Id,
+		IP:        u.IP,
+		UserAgent: u.UserAgent,
+	}
+}
+
+// record appends e with the outcome of err. A failure to write the audit
+// log is logged but does not fail the operation being audited.
+func (s *AuthService) record(ctx context.Context, e *audit.Entry, err error) {
+	if s.audit == nil || e == nil {
+		return
+	}
+	e.Outcome = audit.OutcomeSuccess
+	if err != nil {
+		e.Outcome = audit.OutcomeFailure
+		e.ErrorCode = ErrorCode(err)
+		if errors.Is(err, ErrUserAgentChanged) {
+			e.Event = audit.EventUserAgentMismatch
+		}
+	}
+	if auditErr := s.audit.Record(context.WithoutCancel(ctx), *e); auditErr != nil {
+		logging.For("audit").ErrorContext(ctx, "failed to record audit entry",
+			"event", e.Event, "error", auditErr)
+	}
+}
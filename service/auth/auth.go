@@ -3,10 +3,18 @@ package auth
 import (
 	"context"
 	"errors"
+	"medods-auth/service/audit"
+	"medods-auth/service/events"
+	"medods-auth/service/outbox"
+	"medods-auth/service/password"
+	"medods-auth/service/webauthn"
 	"medods-auth/token"
 	"medods-auth/user"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 )
 
@@ -24,32 +32,265 @@ var (
 
 	ErrAccessTokenExpected  AuthError = errors.New("access token expected")
 	ErrRefreshTokenExpected AuthError = errors.New("refresh token expected")
+	ErrIDTokenExpected      AuthError = errors.New("id token expected")
 
 	ErrBlackListedToken AuthError = errors.New("blacklisted token provided")
+
+	ErrRefreshTokenNotFound AuthError = errors.New("refresh token record not found")
+	ErrRefreshTokenReused   AuthError = errors.New("refresh token reused")
+
+	ErrTooManySessions AuthError = errors.New("too many sessions")
+	ErrSessionExpired  AuthError = errors.New("session expired")
+
+	ErrUserNotFound AuthError = errors.New("user not found")
+	ErrUserExists   AuthError = errors.New("user already exists")
+	ErrUserDisabled AuthError = errors.New("user disabled")
+	ErrUserLocked   AuthError = errors.New("user locked")
+
+	ErrInvalidCredentials AuthError = errors.New("invalid login or password")
+	ErrCredentialNotFound AuthError = errors.New("credential not found")
+	ErrLoginTaken         AuthError = errors.New("login already taken")
+
+	ErrMFATokenExpected  AuthError = errors.New("mfa token expected")
+	ErrInvalidMFACode    AuthError = errors.New("invalid mfa code")
+	ErrTOTPNotEnrolled   AuthError = errors.New("totp not enrolled")
+	ErrTOTPAlreadyActive AuthError = errors.New("totp already active")
+	ErrTOTPConflict      AuthError = errors.New("totp changed concurrently")
+
+	ErrPasskeyNotFound   AuthError = errors.New("passkey not found")
+	ErrPasskeyExists     AuthError = errors.New("passkey already registered")
+	ErrInvalidPasskey    AuthError = errors.New("invalid passkey response")
+	ErrPasskeySignCount  AuthError = errors.New("passkey sign count regressed")
+	ErrChallengeNotFound AuthError = errors.New("challenge not found or expired")
+
+	// ErrLockedOut is wrapped in a *LockedOutError saying how long to wait.
+	ErrLockedOut AuthError = errors.New("too many failed attempts")
+
+	ErrClientNotFound       AuthError = errors.New("client not found")
+	ErrClientExists         AuthError = errors.New("client already exists")
+	ErrInvalidClient        AuthError = errors.New("invalid client credentials")
+	ErrInvalidScope         AuthError = errors.New("invalid scope")
+	ErrInsufficientScope    AuthError = errors.New("insufficient scope")
+	ErrClientTokenExpected  AuthError = errors.New("client token expected")
+	ErrUserTokenExpected    AuthError = errors.New("user token expected")
+	ErrUnauthorizedClient   AuthError = errors.New("client not allowed to use this grant")
+	ErrInvalidRedirectURI   AuthError = errors.New("invalid redirect uri")
+	ErrInvalidCodeChallenge AuthError = errors.New("s256 code challenge required")
+	ErrAuthCodeNotFound     AuthError = errors.New("authorization code not found or expired")
+	ErrInvalidGrant         AuthError = errors.New("invalid grant")
+	ErrConsentNotFound      AuthError = errors.New("consent not found")
+	ErrConsentRequired      AuthError = errors.New("consent required")
+	ErrLoginRequired        AuthError = errors.New("login required")
+	ErrDeviceCodeNotFound   AuthError = errors.New("device code not found")
+	ErrUserCodeTaken        AuthError = errors.New("user code already in use")
+	ErrAuthorizationPending AuthError = errors.New("authorization pending")
+	ErrSlowDown             AuthError = errors.New("polling too frequently")
+	ErrDeviceCodeExpired    AuthError = errors.New("device code expired")
+	ErrAccessDenied         AuthError = errors.New("access denied by user")
 )
 
+const (
+	CodeInternal     = "internal"
+	CodeInvalidToken = "invalid_token"
+)
+
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrUserAgentChanged, "user_agent_changed"},
+	{ErrUserIDMissmatch, "user_id_mismatch"},
+	{ErrAccessTokenExpired, "access_token_expired"},
+	{ErrTokenExpired, "token_expired"},
+	{jwt.ErrTokenExpired, "token_expired"},
+	{ErrRefreshTokenExpired, "refresh_token_expired"},
+	{ErrNilRefreshToken, "missing_refresh_token"},
+	{ErrAccessTokenExpected, "access_token_expected"},
+	{ErrRefreshTokenExpected, "refresh_token_expected"},
+	{ErrIDTokenExpected, "id_token_expected"},
+	{ErrBlackListedToken, "blacklisted_token"},
+	{ErrRefreshTokenNotFound, "refresh_token_not_found"},
+	{ErrRefreshTokenReused, "refresh_token_reused"},
+	{ErrTooManySessions, "too_many_sessions"},
+	{ErrSessionExpired, "session_expired"},
+	{ErrUserNotFound, "user_not_found"},
+	{ErrUserExists, "user_exists"},
+	{ErrUserDisabled, "user_disabled"},
+	{ErrUserLocked, "user_locked"},
+	{ErrInvalidCredentials, "invalid_credentials"},
+	{ErrCredentialNotFound, "credential_not_found"},
+	{ErrLoginTaken, "login_taken"},
+	{ErrMFATokenExpected, "mfa_token_expected"},
+	{ErrInvalidMFACode, "invalid_mfa_code"},
+	{ErrTOTPNotEnrolled, "totp_not_enrolled"},
+	{ErrTOTPAlreadyActive, "totp_already_active"},
+	{ErrTOTPConflict, "totp_conflict"},
+	{ErrPasskeyNotFound, "passkey_not_found"},
+	{ErrPasskeyExists, "passkey_exists"},
+	{ErrInvalidPasskey, "invalid_passkey"},
+	{ErrPasskeySignCount, "passkey_sign_count"},
+	{ErrChallengeNotFound, "challenge_not_found"},
+	{ErrLockedOut, "locked_out"},
+	{ErrClientNotFound, "client_not_found"},
+	{ErrClientExists, "client_exists"},
+	{ErrInvalidClient, "invalid_client"},
+	{ErrInvalidScope, "invalid_scope"},
+	{ErrInsufficientScope, "insufficient_scope"},
+	{ErrClientTokenExpected, "client_token_expected"},
+	{ErrUserTokenExpected, "user_token_expected"},
+	{ErrUnauthorizedClient, "unauthorized_client"},
+	{ErrInvalidRedirectURI, "invalid_redirect_uri"},
+	{ErrInvalidCodeChallenge, "invalid_code_challenge"},
+	{ErrAuthCodeNotFound, "auth_code_not_found"},
+	{ErrInvalidGrant, "invalid_grant"},
+	{ErrConsentNotFound, "consent_not_found"},
+	{ErrConsentRequired, "consent_required"},
+	{ErrLoginRequired, "login_required"},
+	{ErrDeviceCodeNotFound, "device_code_not_found"},
+	{ErrUserCodeTaken, "user_code_taken"},
+	{ErrAuthorizationPending, "authorization_pending"},
+	{ErrSlowDown, "slow_down"},
+	{ErrDeviceCodeExpired, "expired_token"},
+	{ErrAccessDenied, "access_denied"},
+	{jwt.ErrTokenMalformed, CodeInvalidToken},
+	{jwt.ErrTokenSignatureInvalid, CodeInvalidToken},
+	{jwt.ErrTokenUnverifiable, CodeInvalidToken},
+	{jwt.ErrTokenNotValidYet, CodeInvalidToken},
+	{jwt.ErrTokenInvalidClaims, CodeInvalidToken},
+}
+
+// ErrorCode maps an error returned by AuthService to a stable code
+// suitable for metric labels and logs. Unknown errors map to CodeInternal.
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return CodeInternal
+}
+
 type TokenPair struct {
 	Access  *token.EncodedToken
 	Refresh *token.EncodedToken
+
+	// The expiry times are only set on issued pairs. SessionExpiresAt is
+	// zero when sessions have no absolute lifetime.
+	AccessExpiresAt  time.Time
+	RefreshExpiresAt time.Time
+	SessionExpiresAt time.Time
 }
 
 type RefreshTokenRecord struct {
-	JTI       token.JTI
-	User      user.User
-	Hash      token.TokenHash
+	JTI  token.JTI
+	User user.User
+	Hash token.TokenHash
+	// CreatedAt is when the record was issued. Records are replaced on
+	// every refresh, so it is also when the session was last used.
 	CreatedAt time.Time
+	ExpiresAt time.Time
+	// StartedAt is when GenerateTokens started the session, carried over
+	// by Refresh. It is zero for records stored before it was tracked.
+	StartedAt time.Time
+	// ClientID is the OAuth client the session was granted to, empty for
+	// sessions of the service itself.
+	ClientID string
 
 	RevokedAt *time.Time
 }
 
+// SessionStart returns StartedAt, or CreatedAt for older records.
+func (r RefreshTokenRecord) SessionStart() time.Time {
+	if r.StartedAt.IsZero() {
+		return r.CreatedAt
+	}
+	return r.StartedAt
+}
+
 type TokenHashRepository interface {
 	Store(context.Context, *RefreshTokenRecord) error
 	Get(context.Context, token.JTI) (*RefreshTokenRecord, error)
+	// Delete drops the record of jti, failing with ErrRefreshTokenNotFound
+	// when there is none, so that of concurrent deletes only one succeeds.
+	Delete(ctx context.Context, jti token.JTI) error
 	DeleteByUserId(context.Context, uuid.UUID) error
+	// DeleteByClient drops the records of a user granted to clientID.
+	DeleteByClient(ctx context.Context, userID uuid.UUID, clientID string) error
+}
+
+// Rotation replaces the refresh record Previous of a user with Next and
+// blacklists the access token used to request it. The other sessions of
+// the user are left alone. When Previous is gone, such as after a
+// concurrent rotation of the same record, nothing is changed and the
+// rotation fails with ErrRefreshTokenNotFound, so that a refresh token
+// can't be exchanged twice.
+type Rotation struct {
+	UserID   uuid.UUID
+	Previous token.JTI
+
+	// Revoked is uuid.Nil when the access token is unknown, as with the
+	// OAuth refresh_token grant.
+	Revoked          token.JTI
+	RevokedExpiresAt time.Time
+
+	Next *RefreshTokenRecord
+
+	// Outbox is only set for repositories implementing OutboxWriter.
+	Outbox []outbox.Message
+}
+
+// TokenRotator may be implemented by a TokenHashRepository sharing storage
+// with the blacklist, to apply a Rotation atomically. Rotate fails with
+// ErrRefreshTokenNotFound without changing anything when the record
+// Previous doesn't exist.
+type TokenRotator interface {
+	Rotate(context.Context, Rotation) error
+}
+
+// OutboxWriter may be implemented by a TokenHashRepository keeping an outbox
+// in the same database. The messages are committed together with the change
+// to the refresh records, and by Rotate together with the rotation.
+// DeleteWithOutbox fails with ErrRefreshTokenNotFound, writing nothing,
+// when there is no record to delete.
+type OutboxWriter interface {
+	StoreWithOutbox(context.Context, *RefreshTokenRecord, []outbox.Message) error
+	DeleteWithOutbox(context.Context, token.JTI, []outbox.Message) error
+	DeleteByUserIdWithOutbox(context.Context, uuid.UUID, []outbox.Message) error
+	DeleteByClientWithOutbox(context.Context, uuid.UUID, string, []outbox.Message) error
+}
+
+// RepositoryDecorator may be implemented by a TokenHashRepository wrapping
+// another one, such as to instrument it. The decorator implements all the
+// optional interfaces by forwarding to Unwrap, and they are only used when
+// the repository it wraps implements them.
+type RepositoryDecorator interface {
+	Unwrap() TokenHashRepository
+}
+
+// As returns repo as T, one of the optional interfaces of a
+// TokenHashRepository, if repo and the repositories it decorates implement
+// it.
+func As[T any](repo TokenHashRepository) (T, bool) {
+	t, ok := repo.(T)
+	for next := repo; ok; {
+		d, decorates := next.(RepositoryDecorator)
+		if !decorates {
+			return t, true
+		}
+		next = d.Unwrap()
+		_, ok = next.(T)
+	}
+	var zero T
+	return zero, false
 }
 
 type TokenBlackList interface {
-	Add(context.Context, token.JTI) error
+	// Add blacklists jti until expiresAt, after which the token is
+	// rejected on its own and the entry may be dropped.
+	Add(ctx context.Context, jti token.JTI, expiresAt time.Time) error
 	Contains(context.Context, token.JTI) (bool, error)
 }
 
@@ -58,10 +299,28 @@ type AuthService struct {
 	generator        token.Generator
 	hasher           token.Hasher
 	blacklist        TokenBlackList
+	users            UserRepository
+	credentials      CredentialRepository
+	passwords        *password.Hasher
+	totp             TOTPRepository
+	totpOptions      TOTPOptions
+	passkeys         PasskeyRepository
+	webauthn         webauthn.Config
+	lockout          LockoutOptions
+	clients          ClientRepository
+	oauth            OAuthOptions
+	audit            AuditSink
+	events           events.Publisher
+	rotator          TokenRotator
+	outbox           OutboxWriter
+	sessions         SessionLimiter
+	sessionLimit     SessionLimit
 
-	accessTTL  time.Duration
-	refreshTTL time.Duration
-	secret     []byte
+	accessTTL          time.Duration
+	refreshTTL         time.Duration
+	sessionLifetime    time.Duration
+	sessionIdleTimeout time.Duration
+	secret             []byte
 }
 
 type AuthServiceOptions struct {
@@ -70,10 +329,45 @@ type AuthServiceOptions struct {
 	Hasher           token.Hasher
 	Blacklist        TokenBlackList
 
+	// Users is optional. Without it tokens are issued for any user ID.
+	Users UserRepository
+	// Passwords is optional and enables Login. Users must implement
+	// CredentialRepository when it is set.
+	Passwords *password.Hasher
+	// TOTP is optional and adds a second factor to Login for users who
+	// enrolled one. Users must implement TOTPRepository when it is set.
+	TOTP *TOTPOptions
+	// WebAuthn is optional and enables passkeys, as a first factor and as
+	// a second factor to Login. Users must implement PasskeyRepository
+	// when it is set.
+	WebAuthn *webauthn.Config
+	// OAuth is optional and enables OAuth clients. Users must implement
+	// ClientRepository when it is set.
+	OAuth *OAuthOptions
+	// Lockout is optional and slows down, then locks out, guessing of
+	// passwords and MFA codes.
+	Lockout *LockoutOptions
+	// Audit is optional.
+	Audit AuditSink
+	// Events is optional.
+	Events events.Publisher
+	// UseOutbox also writes events to the outbox of RefreshTokenRepo,
+	// which must implement OutboxWriter.
+	UseOutbox bool
+	// SessionLimit is optional. RefreshTokenRepo must implement
+	// SessionLimiter when it is set.
+	SessionLimit *SessionLimit
+
 	Secret []byte
 
 	AccessTTL  *time.Duration
 	RefreshTTL *time.Duration
+	// SessionLifetime is optional. Sessions end that long after
+	// GenerateTokens however often they are refreshed.
+	SessionLifetime *time.Duration
+	// SessionIdleTimeout is optional. Sessions not refreshed for that long
+	// end, refresh tokens expire no later.
+	SessionIdleTimeout *time.Duration
 }
 
 func NewAuthService(opts AuthServiceOptions) (*AuthService, error) {
@@ -98,104 +392,517 @@ func NewAuthService(opts AuthServiceOptions) (*AuthService, error) {
 	if opts.RefreshTTL == nil {
 		return nil, errors.New("nil refresh token ttl")
 	}
+	var outboxWriter OutboxWriter
+	if opts.UseOutbox {
+		w, ok := As[OutboxWriter](opts.RefreshTokenRepo)
+		if !ok {
+			return nil, errors.New("token repository has no outbox")
+		}
+		outboxWriter = w
+	}
+	var credentials CredentialRepository
+	if opts.Passwords != nil {
+		c, ok := opts.Users.(CredentialRepository)
+		if !ok {
+			return nil, errors.New("user repository can't store credentials")
+		}
+		credentials = c
+	}
+	var totpRepo TOTPRepository
+	var totpOptions TOTPOptions
+	if opts.TOTP != nil {
+		t, ok := opts.Users.(TOTPRepository)
+		if !ok {
+			return nil, errors.New("user repository can't store totp")
+		}
+		totpRepo = t
+		totpOptions = opts.TOTP.withDefaults()
+	}
+	var passkeys PasskeyRepository
+	var webauthnConfig webauthn.Config
+	if opts.WebAuthn != nil {
+		p, ok := opts.Users.(PasskeyRepository)
+		if !ok {
+			return nil, errors.New("user repository can't store passkeys")
+		}
+		passkeys = p
+		webauthnConfig = *opts.WebAuthn
+		if webauthnConfig.Timeout <= 0 {
+			webauthnConfig.Timeout = 5 * time.Minute
+		}
+	}
+	var clients ClientRepository
+	var oauthOptions OAuthOptions
+	if opts.OAuth != nil {
+		c, ok := opts.Users.(ClientRepository)
+		if !ok {
+			return nil, errors.New("user repository can't store clients")
+		}
+		clients = c
+		oauthOptions = *opts.OAuth
+		if oauthOptions.CodeTTL <= 0 {
+			oauthOptions.CodeTTL = time.Minute
+		}
+		if oauthOptions.DeviceCodeTTL <= 0 {
+			oauthOptions.DeviceCodeTTL = 10 * time.Minute
+		}
+		if oauthOptions.DeviceInterval <= 0 {
+			oauthOptions.DeviceInterval = 5 * time.Second
+		}
+		if oauthOptions.Issuer != "" && oauthOptions.SigningKey == nil {
+			return nil, errors.New("nil id token signing key")
+		}
+		if oauthOptions.Issuer != "" && len(oauthOptions.Scopes) > 0 {
+			scopes := slices.Clone(oauthOptions.Scopes)
+			for _, scope := range OpenIDScopes {
+				if !slices.Contains(scopes, scope) {
+					scopes = append(scopes, scope)
+				}
+			}
+			oauthOptions.Scopes = scopes
+		}
+	}
+	var lockoutOptions LockoutOptions
+	if opts.Lockout != nil {
+		if opts.Lockout.Store == nil {
+			return nil, errors.New("nil lockout store")
+		}
+		lockoutOptions = opts.Lockout.withDefaults()
+	}
+	var sessionLimit SessionLimit
+	var sessions SessionLimiter
+	if opts.SessionLimit != nil && opts.SessionLimit.Max > 0 {
+		l, ok := As[SessionLimiter](opts.RefreshTokenRepo)
+		if !ok {
+			return nil, errors.New("token repository can't limit sessions")
+		}
+		switch opts.SessionLimit.Policy {
+		case RejectNewSession, EvictOldest, EvictLeastRecentlyUsed:
+		default:
+			return nil, errors.New("unknown session policy")
+		}
+		sessionLimit = *opts.SessionLimit
+		sessions = l
+	}
+	rotator, _ := As[TokenRotator](opts.RefreshTokenRepo)
 	return &AuthService{
 		refreshTokenRepo: opts.RefreshTokenRepo,
 		generator:        opts.Generator,
 		hasher:           opts.Hasher,
 		blacklist:        opts.Blacklist,
+		users:            opts.Users,
+		credentials:      credentials,
+		passwords:        opts.Passwords,
+		totp:             totpRepo,
+		totpOptions:      totpOptions,
+		passkeys:         passkeys,
+		webauthn:         webauthnConfig,
+		lockout:          lockoutOptions,
+		clients:          clients,
+		oauth:            oauthOptions,
+		audit:            opts.Audit,
+		events:           opts.Events,
+		rotator:          rotator,
+		outbox:           outboxWriter,
+		sessions:         sessions,
+		sessionLimit:     sessionLimit,
 
 		accessTTL:  *opts.AccessTTL,
 		refreshTTL: *opts.RefreshTTL,
 		secret:     opts.Secret,
+
+		sessionLifetime:    durationOrZero(opts.SessionLifetime),
+		sessionIdleTimeout: durationOrZero(opts.SessionIdleTimeout),
 	}, nil
 }
 
-func (s *AuthService) GenerateTokens(u user.User) (TokenPair, error) {
-	access := s.generator.Generate(token.Options{
-		User: u,
-		TTL:  s.accessTTL,
-	})
-	accessEnc, err := s.encodeToken(access)
+func durationOrZero(d *time.Duration) time.Duration {
+	if d == nil || *d < 0 {
+		return 0
+	}
+	return *d
+}
+
+func (s *AuthService) GenerateTokens(ctx context.Context, u user.User) (TokenPair, error) {
+	return s.generateTokens(ctx, u, grant{})
+}
+
+// grant is what a session was granted, carried over by Refresh.
+type grant struct {
+	// amr lists the methods the session was authenticated with.
+	amr []string
+	// clientID and scope are set for sessions of OAuth clients.
+	clientID string
+	scope    string
+}
+
+func grantOf(t *token.Token) (grant, error) {
+	claims, err := t.GetClaims()
+	if err != nil {
+		return grant{}, err
+	}
+	return grant{amr: claims.AMR, clientID: claims.ClientID, scope: claims.Scope}, nil
+}
+
+// generateTokens starts a session with g.
+func (s *AuthService) generateTokens(ctx context.Context, u user.User, g grant) (_ TokenPair, err error) {
+	ctx, span := startSpan(ctx, "AuthService.GenerateTokens", &u)
+	defer func() { endSpan(span, err) }()
+	entry := newEntry(audit.EventTokensIssued, u)
+	entry.ClientID = g.clientID
+	defer func() { s.record(ctx, entry, err) }()
+
+	err = s.checkUser(ctx, u.Id)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	pair, record, err := s.issueTokens(ctx, u, time.Time{}, g)
 	if err != nil {
 		return TokenPair{}, err
 	}
+	entry.IssuedJTI = record.JTI.String()
 
-	refresh := s.generator.Generate(token.Options{
-		User: u,
-		TTL:  s.refreshTTL,
-	})
-	refreshEnc, err := s.encodeToken(refresh)
+	issued := events.TokensIssued{
+		UserID:    u.Id,
+		JTI:       record.JTI,
+		IP:        u.IP,
+		UserAgent: u.UserAgent,
+		At:        record.CreatedAt,
+	}
+	err = s.storeSession(ctx, record, issued)
 	if err != nil {
 		return TokenPair{}, err
 	}
+	s.publish(ctx, issued)
+	return pair, nil
+}
 
-	jti, err := refresh.JTI()
+func (s *AuthService) Refresh(ctx context.Context, u user.User, pair TokenPair) (_ TokenPair, err error) {
+	ctx, span := startSpan(ctx, "AuthService.Refresh", &u)
+	defer func() { endSpan(span, err) }()
+	entry := newEntry(audit.EventTokensRefreshed, u)
+	var refreshJTI token.JTI
+	defer func() {
+		s.record(ctx, entry, err)
+		s.flagSuspicious(ctx, u, refreshJTI, err)
+	}()
+
+	if pair.Refresh == nil {
+		return TokenPair{}, ErrNilRefreshToken
+	}
+	refresh, err := s.decodeToken(*pair.Refresh)
 	if err != nil {
 		return TokenPair{}, err
 	}
-	hash, err := s.hasher.Hash(refreshEnc)
+	refreshJTI, err = refresh.JTI()
 	if err != nil {
 		return TokenPair{}, err
 	}
-	tokenRecord := RefreshTokenRecord{
-		JTI:       jti,
-		User:      u,
-		Hash:      hash,
-		CreatedAt: time.Now(),
+	entry.JTI = refreshJTI.String()
+	err = s.validateRefresh(ctx, &u, refresh)
+	if err != nil {
+		return TokenPair{}, err
 	}
 
-	err = s.refreshTokenRepo.Store(context.TODO(), &tokenRecord)
+	access, err := s.decodeToken(*pair.Access)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	err = s.Validate(ctx, &u, access)
 	if err != nil {
 		return TokenPair{}, err
 	}
 
-	return TokenPair{
-		Access:  &accessEnc,
-		Refresh: &refreshEnc,
-	}, nil
+	newPair, err := s.rotateSession(ctx, u, refresh, access, nil, entry)
+	if errors.Is(err, ErrRefreshTokenReused) {
+		// already recorded by rotateSession
+		entry = nil
+	}
+	return newPair, err
 }
 
-func (s *AuthService) Refresh(u user.User, pair TokenPair) (TokenPair, error) {
-	refresh, err := s.decodeToken(*pair.Refresh)
+// rotateSession issues a new pair for the session of refresh, a valid
+// refresh token of u, and revokes the old one with access, which may be nil
+// if it is unknown. scopes narrows the scope of the session when not nil.
+// entry is the audit entry of the refresh. When a reuse is detected it is
+// recorded as such before the sessions of u are revoked.
+func (s *AuthService) rotateSession(ctx context.Context, u user.User, refresh, access *token.Token, scopes []string, entry *audit.Entry) (TokenPair, error) {
+	refreshJTI, err := refresh.JTI()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	err = s.checkUser(ctx, u.Id)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	current, err := s.refreshTokenRepo.Get(ctx, refreshJTI)
+	// a valid refresh token without a record was rotated away or revoked
+	reused := errors.Is(err, ErrRefreshTokenNotFound)
+	if err != nil && !reused {
+		return TokenPair{}, err
+	}
+	if err == nil && s.sessionExpired(current, time.Now()) {
+		return TokenPair{}, ErrSessionExpired
+	}
+	if reused {
+		return TokenPair{}, s.reuseDetected(ctx, u, refreshJTI, entry)
+	}
+
+	g, err := grantOf(refresh)
 	if err != nil {
-		return TokenPair{}, nil
+		return TokenPair{}, err
+	}
+	if scopes != nil {
+		g.scope = strings.Join(scopes, " ")
 	}
-	err = s.Validate(&u, refresh)
+	newPair, record, err := s.issueTokens(ctx, u, current.SessionStart(), g)
 	if err != nil {
 		return TokenPair{}, err
 	}
+	entry.IssuedJTI = record.JTI.String()
 
-	err = s.RevokeTokens(u, *pair.Access)
+	refreshed := events.TokensRefreshed{
+		UserID:      u.Id,
+		PreviousJTI: refreshJTI,
+		JTI:         record.JTI,
+		IP:          u.IP,
+		UserAgent:   u.UserAgent,
+		At:          record.CreatedAt,
+	}
+	if s.rotator != nil {
+		err = s.rotate(ctx, u, refreshJTI, access, record, refreshed)
+	} else {
+		err = s.replace(ctx, refreshJTI, access, record, refreshed)
+	}
+	if errors.Is(err, ErrRefreshTokenNotFound) {
+		// a concurrent refresh with the same token rotated it first
+		return TokenPair{}, s.reuseDetected(ctx, u, refreshJTI, entry)
+	}
 	if err != nil {
 		return TokenPair{}, err
 	}
+	s.publish(ctx, refreshed)
+	return newPair, nil
+}
 
-	return s.GenerateTokens(u)
+// reuseDetected records the refresh of entry as a reuse of refreshJTI,
+// ahead of the revocation in the log, and revokes the sessions of u.
+func (s *AuthService) reuseDetected(ctx context.Context, u user.User, refreshJTI token.JTI, entry *audit.Entry) error {
+	entry.Event = audit.EventReuseDetected
+	s.record(ctx, entry, ErrRefreshTokenReused)
+	return s.revokeSessions(ctx, u, refreshJTI)
 }
 
-func (s *AuthService) RevokeTokens(u user.User, access token.EncodedToken) error {
+func (s *AuthService) rotate(ctx context.Context, u user.User, previous token.JTI, access *token.Token, next *RefreshTokenRecord, e events.Event) error {
+	rot := Rotation{
+		UserID:   u.Id,
+		Previous: previous,
+		Next:     next,
+	}
+	if access != nil {
+		var err error
+		rot.Revoked, err = access.JTI()
+		if err != nil {
+			return err
+		}
+		rot.RevokedExpiresAt, err = access.Expires()
+		if err != nil {
+			return err
+		}
+	}
+	msgs, err := s.outboxMessages(e)
+	if err != nil {
+		return err
+	}
+	rot.Outbox = msgs
+	return s.rotator.Rotate(ctx, rot)
+}
+
+// replace is the non-atomic fallback of rotate for repositories that
+// don't implement TokenRotator. Deleting previous comes first: only one of
+// concurrent refreshes with the same token gets to, the others fail with
+// ErrRefreshTokenNotFound.
+func (s *AuthService) replace(ctx context.Context, previous token.JTI, access *token.Token, next *RefreshTokenRecord, e events.Event) error {
+	err := s.refreshTokenRepo.Delete(ctx, previous)
+	if err != nil {
+		return err
+	}
+	if access != nil {
+		err := s.revokeAccessToken(ctx, access)
+		if err != nil {
+			return err
+		}
+	}
+	return s.store(ctx, next, e)
+}
+
+// revokeSessions drops all refresh records of a user whose refresh token
+// was reused, since either the user or an attacker holds a stolen copy.
+func (s *AuthService) revokeSessions(ctx context.Context, u user.User, jti token.JTI) error {
+	entry := newEntry(audit.EventSessionsRevoked, u)
+	entry.JTI = jti.String()
+	revoked := events.SessionRevoked{
+		UserID: u.Id,
+		JTI:    jti,
+		Reason: events.ReasonRefreshTokenReused,
+		At:     time.Now(),
+	}
+	err := s.deleteSessions(ctx, u.Id, revoked)
+	s.record(ctx, entry, err)
+	if err != nil {
+		return errors.Join(ErrRefreshTokenReused, err)
+	}
+	s.publish(ctx, revoked)
+	return ErrRefreshTokenReused
+}
+
+func (s *AuthService) RevokeTokens(ctx context.Context, u user.User, access token.EncodedToken) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.RevokeTokens", &u)
+	defer func() { endSpan(span, err) }()
+	entry := newEntry(audit.EventLogout, u)
+	var jti token.JTI
+	defer func() {
+		s.record(ctx, entry, err)
+		s.flagSuspicious(ctx, u, jti, err)
+	}()
+
 	decoded, err := s.decodeToken(access)
 	if err != nil {
 		return err
 	}
-	err = s.Validate(&u, decoded)
+	jti, err = decoded.JTI()
+	if err != nil {
+		return err
+	}
+	entry.JTI = jti.String()
+	err = s.Validate(ctx, &u, decoded)
 	if err != nil {
 		return err
 	}
 	// revoke access
-	err = s.revokeAccessToken(decoded)
+	err = s.revokeAccessToken(ctx, decoded)
 	if err != nil {
 		return err
 	}
 
-	err = s.refreshTokenRepo.DeleteByUserId(context.TODO(), u.Id)
+	revoked := events.SessionRevoked{
+		UserID: u.Id,
+		JTI:    jti,
+		Reason: events.ReasonLogout,
+		At:     time.Now(),
+	}
+	err = s.deleteSessions(ctx, u.Id, revoked)
 	if err != nil {
 		return err
 	}
+	s.publish(ctx, revoked)
 	return nil
 }
 
-func (s *AuthService) Validate(u *user.User, t *token.Token) error {
+// RevokeSession ends the session of pair alone, unlike RevokeTokens: the
+// access token is blacklisted and the refresh record deleted, the other
+// sessions of u keep working.
+func (s *AuthService) RevokeSession(ctx context.Context, u user.User, pair TokenPair) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.RevokeSession", &u)
+	defer func() { endSpan(span, err) }()
+	entry := newEntry(audit.EventLogout, u)
+	var jti token.JTI
+	defer func() {
+		s.record(ctx, entry, err)
+		s.flagSuspicious(ctx, u, jti, err)
+	}()
+
+	if pair.Refresh == nil {
+		return ErrNilRefreshToken
+	}
+	access, err := s.decodeToken(*pair.Access)
+	if err != nil {
+		return err
+	}
+	jti, err = access.JTI()
+	if err != nil {
+		return err
+	}
+	entry.JTI = jti.String()
+	err = s.Validate(ctx, &u, access)
+	if err != nil {
+		return err
+	}
+	refresh, err := s.decodeToken(*pair.Refresh)
+	if err != nil {
+		return err
+	}
+	refreshJTI, err := refresh.JTI()
+	if err != nil {
+		return err
+	}
+	err = s.validateRefresh(ctx, &u, refresh)
+	if err != nil {
+		return err
+	}
+
+	err = s.revokeAccessToken(ctx, access)
+	if err != nil {
+		return err
+	}
+	revoked := events.SessionRevoked{
+		UserID: u.Id,
+		JTI:    refreshJTI,
+		Reason: events.ReasonLogout,
+		At:     time.Now(),
+	}
+	err = s.deleteSession(ctx, refreshJTI, revoked)
+	if errors.Is(err, ErrRefreshTokenNotFound) {
+		// already rotated or revoked
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.publish(ctx, revoked)
+	return nil
+}
+
+func (s *AuthService) Validate(ctx context.Context, u *user.User, t *token.Token) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.Validate", u)
+	defer func() { endSpan(span, err) }()
+
+	// tokens issued before their type was set are still accepted
+	if typ, err := t.Type(); err != nil {
+		return err
+	} else if typ != token.TokenTypeAccess && typ != "" {
+		return ErrAccessTokenExpected
+	}
+	if u != nil && isClientToken(t) {
+		return ErrUserTokenExpected
+	}
+	err = s.validate(ctx, u, t)
+	if err != nil || isClientToken(t) {
+		return err
+	}
+	// access tokens of users disabled, locked or deleted since they were
+	// issued are refused at once rather than when they expire
+	id, err := t.UserID()
+	if err != nil {
+		return err
+	}
+	return s.checkUser(ctx, id)
+}
+
+// validateRefresh checks t as Validate does, but only accepts refresh
+// tokens.
+func (s *AuthService) validateRefresh(ctx context.Context, u *user.User, t *token.Token) error {
+	if typ, err := t.Type(); err != nil {
+		return err
+	} else if typ != token.TokenTypeRefresh {
+		return ErrRefreshTokenExpected
+	}
+	return s.validate(ctx, u, t)
+}
+
+// validate checks t regardless of its type.
+func (s *AuthService) validate(ctx context.Context, u *user.User, t *token.Token) error {
 	if exp, err := t.Expires(); err != nil {
 		return err
 	} else if time.Now().After(exp) {
@@ -222,7 +929,7 @@ func (s *AuthService) Validate(u *user.User, t *token.Token) error {
 	if err != nil {
 		return err
 	}
-	blacklisted, err := s.blacklist.Contains(context.TODO(), jti)
+	blacklisted, err := s.blacklist.Contains(ctx, jti)
 	if err != nil {
 		return err
 	}
@@ -233,15 +940,35 @@ func (s *AuthService) Validate(u *user.User, t *token.Token) error {
 	return nil
 }
 
-func (s *AuthService) ExtractUserID(enc *token.EncodedToken) (uuid.UUID, error) {
+// Subject returns the user a token of the service was issued to, checking
+// its signature and expiry but, unlike ExtractUserID, neither its type nor
+// the blacklist. It is cheap enough to pick a rate limit bucket with.
+func (s *AuthService) Subject(enc token.EncodedToken) (uuid.UUID, error) {
+	decoded, err := s.decodeToken(enc)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if isClientToken(decoded) {
+		return uuid.Nil, ErrUserTokenExpected
+	}
+	return decoded.UserID()
+}
+
+func (s *AuthService) ExtractUserID(ctx context.Context, enc *token.EncodedToken) (_ uuid.UUID, err error) {
+	ctx, span := startSpan(ctx, "AuthService.ExtractUserID", nil)
+	defer func() { endSpan(span, err) }()
+
 	token, err := s.generator.Decode(enc.String(), s.secret)
 	if err != nil {
 		return uuid.Nil, err
 	}
-	err = s.Validate(nil, token)
+	err = s.Validate(ctx, nil, token)
 	if err != nil {
 		return uuid.Nil, err
 	}
+	if isClientToken(token) {
+		return uuid.Nil, ErrUserTokenExpected
+	}
 	id, err := token.UserID()
 	if err != nil {
 		return uuid.Nil, err
@@ -249,6 +976,105 @@ func (s *AuthService) ExtractUserID(enc *token.EncodedToken) (uuid.UUID, error)
 	return id, nil
 }
 
+// sessionExpired reports whether the session of rec is past its lifetime
+// or idle timeout. Tokens already expire by then, this catches tokens
+// issued before the limits were lowered.
+func (s *AuthService) sessionExpired(rec *RefreshTokenRecord, now time.Time) bool {
+	if s.sessionLifetime > 0 && !now.Before(rec.SessionStart().Add(s.sessionLifetime)) {
+		return true
+	}
+	return s.sessionIdleTimeout > 0 && !now.Before(rec.CreatedAt.Add(s.sessionIdleTimeout))
+}
+
+// sessionTTLs caps the token TTLs to the session limits.
+func (s *AuthService) sessionTTLs(startedAt, now time.Time) (accessTTL, refreshTTL time.Duration, sessionEnd time.Time) {
+	accessTTL, refreshTTL = s.accessTTL, s.refreshTTL
+	if s.sessionIdleTimeout > 0 {
+		refreshTTL = min(refreshTTL, s.sessionIdleTimeout)
+	}
+	if s.sessionLifetime > 0 {
+		sessionEnd = startedAt.Add(s.sessionLifetime)
+		left := sessionEnd.Sub(now)
+		accessTTL = min(accessTTL, left)
+		refreshTTL = min(refreshTTL, left)
+	}
+	return accessTTL, refreshTTL, sessionEnd
+}
+
+// issueTokens signs a new pair and prepares the refresh record without
+// storing it. A zero startedAt starts a new session.
+func (s *AuthService) issueTokens(ctx context.Context, u user.User, startedAt time.Time, g grant) (TokenPair, *RefreshTokenRecord, error) {
+	now := time.Now()
+	if startedAt.IsZero() {
+		startedAt = now
+	}
+	accessTTL, refreshTTL, sessionEnd := s.sessionTTLs(startedAt, now)
+
+	access := s.generator.Generate(token.Options{
+		User:         u,
+		TTL:          accessTTL,
+		Type:         token.TokenTypeAccess,
+		SessionStart: startedAt,
+		AMR:          g.amr,
+		ClientID:     g.clientID,
+		Scope:        g.scope,
+	})
+	accessEnc, err := s.encodeToken(access)
+	if err != nil {
+		return TokenPair{}, nil, err
+	}
+	accessExp, err := access.Expires()
+	if err != nil {
+		return TokenPair{}, nil, err
+	}
+
+	refresh := s.generator.Generate(token.Options{
+		User:         u,
+		TTL:          refreshTTL,
+		Type:         token.TokenTypeRefresh,
+		SessionStart: startedAt,
+		AMR:          g.amr,
+		ClientID:     g.clientID,
+		Scope:        g.scope,
+	})
+	refreshEnc, err := s.encodeToken(refresh)
+	if err != nil {
+		return TokenPair{}, nil, err
+	}
+
+	jti, err := refresh.JTI()
+	if err != nil {
+		return TokenPair{}, nil, err
+	}
+	exp, err := refresh.Expires()
+	if err != nil {
+		return TokenPair{}, nil, err
+	}
+	_, span := tracer.Start(ctx, "Hasher.Hash")
+	hash, err := s.hasher.Hash(refreshEnc)
+	endSpan(span, err)
+	if err != nil {
+		return TokenPair{}, nil, err
+	}
+	record := &RefreshTokenRecord{
+		JTI:       jti,
+		User:      u,
+		Hash:      hash,
+		CreatedAt: now,
+		ExpiresAt: exp,
+		StartedAt: startedAt,
+		ClientID:  g.clientID,
+	}
+
+	return TokenPair{
+		Access:           &accessEnc,
+		Refresh:          &refreshEnc,
+		AccessExpiresAt:  accessExp,
+		RefreshExpiresAt: exp,
+		SessionExpiresAt: sessionEnd,
+	}, record, nil
+}
+
 func (s *AuthService) encodeToken(t *token.Token) (token.EncodedToken, error) {
 	enc, err := s.generator.Encode(t, s.secret)
 	if err != nil {
@@ -265,10 +1091,14 @@ func (s *AuthService) decodeToken(enc token.EncodedToken) (*token.Token, error)
 	return token, err
 }
 
-func (s *AuthService) revokeAccessToken(t *token.Token) error {
+func (s *AuthService) revokeAccessToken(ctx context.Context, t *token.Token) error {
 	jti, err := t.JTI()
 	if err != nil {
 		return err
 	}
-	return s.blacklist.Add(context.TODO(), jti)
+	exp, err := t.Expires()
+	if err != nil {
+		return err
+	}
+	return s.blacklist.Add(ctx, jti, exp)
 }
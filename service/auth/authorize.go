@@ -0,0 +1,368 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"medods-auth/service/audit"
+	"medods-auth/token"
+	"medods-auth/user"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuthCode is an authorization code, exchanged once for the tokens of the
+// user who approved the request.
+type AuthCode struct {
+	// Hash is the SHA-256 of the code, which is not stored.
+	Hash     string
+	ClientID string
+	UserID   uuid.UUID
+	// RedirectURI is as requested, empty if the request had none.
+	RedirectURI string
+	Scope       string
+	// CodeChallenge is the S256 PKCE challenge of RFC 7636.
+	CodeChallenge string
+	// Nonce is copied into the ID token, empty if the request had none.
+	Nonce string
+	// AMR and AuthTime are those of the session of the user.
+	AMR       []string
+	AuthTime  time.Time
+	ExpiresAt time.Time
+}
+
+// Consent lists the scopes a user granted a client.
+type Consent struct {
+	UserID    uuid.UUID
+	ClientID  string
+	Scopes    []string
+	GrantedAt time.Time
+}
+
+// AuthorizeRequest holds the parameters of an authorization request. The
+// response type and state are left to the caller.
+type AuthorizeRequest struct {
+	ClientID    string
+	RedirectURI string
+	// Scope is space separated, all scopes of the client when empty.
+	Scope               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	// Nonce is optional, returned in the ID token.
+	Nonce string
+}
+
+// GrantedTokens are tokens issued to a client on behalf of a user.
+type GrantedTokens struct {
+	TokenPair
+	Scope string
+	// IDToken is only set with OpenID Connect, for the openid scope.
+	IDToken token.EncodedToken
+}
+
+const codeChallengeS256 = "S256"
+
+// CheckAuthorizeRequest returns the client of req and the URI to redirect
+// to. It fails with ErrInvalidClient or ErrInvalidRedirectURI when there is
+// nowhere safe to redirect to, and with ErrInvalidScope or
+// ErrInvalidCodeChallenge, which should be sent to the redirect URI.
+func (s *AuthService) CheckAuthorizeRequest(ctx context.Context, req AuthorizeRequest) (_ *Client, redirectURI string, err error) {
+	ctx, span := startSpan(ctx, "AuthService.CheckAuthorizeRequest", nil)
+	defer func() { endSpan(span, err) }()
+	if s.clients == nil {
+		return nil, "", errNoClients
+	}
+
+	client, err := s.clients.GetClient(ctx, req.ClientID)
+	if errors.Is(err, ErrClientNotFound) {
+		return nil, "", ErrInvalidClient
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	redirectURI, err = client.redirectURI(req.RedirectURI)
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = grantScopes(client, req.Scope)
+	if err != nil {
+		return client, redirectURI, err
+	}
+	if req.CodeChallengeMethod != codeChallengeS256 || !validCodeVerifier(req.CodeChallenge) {
+		return client, redirectURI, ErrInvalidCodeChallenge
+	}
+	return client, redirectURI, nil
+}
+
+// Authorize issues a code for req to the user of access, a token of a
+// session of the service itself. Unless consent is set the user must have
+// consented to the client and scopes before, or ErrConsentRequired is
+// returned; with it the scopes are added to their consent.
+func (s *AuthService) Authorize(ctx context.Context, u user.User, access token.EncodedToken, req AuthorizeRequest, consent bool) (code string, err error) {
+	ctx, span := startSpan(ctx, "AuthService.Authorize", &u)
+	defer func() { endSpan(span, err) }()
+	if s.clients == nil {
+		return "", errNoClients
+	}
+	entry := newEntry(audit.EventCodeIssued, u)
+	entry.ClientID = req.ClientID
+	defer func() { s.record(ctx, entry, err) }()
+
+	client, _, err := s.CheckAuthorizeRequest(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	session, err := s.loginSession(ctx, &u, access)
+	if err != nil {
+		return "", err
+	}
+	entry.UserID = u.Id
+	err = s.checkUser(ctx, u.Id)
+	if err != nil {
+		return "", err
+	}
+
+	scopes, _ := grantScopes(client, req.Scope)
+	err = s.checkConsent(ctx, u.Id, client, scopes, consent)
+	if err != nil {
+		return "", err
+	}
+
+	authTime, err := session.SessionStart()
+	if err != nil {
+		return "", err
+	}
+	amr, err := session.AMR()
+	if err != nil {
+		return "", err
+	}
+	code = randomString(32)
+	err = s.clients.PutAuthCode(ctx, &AuthCode{
+		Hash:          hashSecret(code),
+		ClientID:      client.ID,
+		UserID:        u.Id,
+		RedirectURI:   req.RedirectURI,
+		Scope:         strings.Join(scopes, " "),
+		CodeChallenge: req.CodeChallenge,
+		Nonce:         req.Nonce,
+		AMR:           amr,
+		AuthTime:      authTime,
+		ExpiresAt:     time.Now().Add(s.oauth.CodeTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// ExchangeCode authenticates a client and exchanges code, checking
+// redirectURI and the PKCE verifier, for tokens of the user who approved
+// it. u carries the request's User-Agent and IP. Any problem with the code
+// is ErrInvalidGrant.
+func (s *AuthService) ExchangeCode(ctx context.Context, id, secret, code, redirectURI, verifier string, u user.User) (_ GrantedTokens, err error) {
+	ctx, span := startSpan(ctx, "AuthService.ExchangeCode", nil)
+	defer func() { endSpan(span, err) }()
+	if s.clients == nil {
+		return GrantedTokens{}, errNoClients
+	}
+
+	client, err := s.authenticateClient(ctx, id, secret)
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	stored, err := s.clients.TakeAuthCode(ctx, hashSecret(code))
+	if errors.Is(err, ErrAuthCodeNotFound) {
+		return GrantedTokens{}, ErrInvalidGrant
+	}
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	if stored.ClientID != client.ID || stored.RedirectURI != redirectURI || !verifyCodeChallenge(stored.CodeChallenge, verifier) {
+		return GrantedTokens{}, ErrInvalidGrant
+	}
+
+	u.Id = stored.UserID
+	pair, err := s.generateTokens(ctx, u, grant{amr: stored.AMR, clientID: client.ID, scope: stored.Scope})
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	return s.grantedTokens(pair, stored.Scope, stored.Nonce)
+}
+
+// RefreshGrant authenticates a client and rotates the session of refresh,
+// which must have been issued to it, as Refresh does. scope may narrow the
+// scope of the session. u carries the request's User-Agent and IP.
+func (s *AuthService) RefreshGrant(ctx context.Context, id, secret string, refresh token.EncodedToken, scope string, u user.User) (_ GrantedTokens, err error) {
+	ctx, span := startSpan(ctx, "AuthService.RefreshGrant", nil)
+	defer func() { endSpan(span, err) }()
+	if s.clients == nil {
+		return GrantedTokens{}, errNoClients
+	}
+
+	client, err := s.authenticateClient(ctx, id, secret)
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	decoded, err := s.decodeToken(refresh)
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	claims, err := decoded.GetClaims()
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	// an access token has no refresh record, rotating it would pass
+	// for a reuse and revoke every session of the user
+	if claims.ClientID != client.ID || claims.SubjectType != "" || claims.TokenType != token.TokenTypeRefresh {
+		return GrantedTokens{}, ErrInvalidGrant
+	}
+	u.Id, err = decoded.UserID()
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	var scopes []string
+	if requested := strings.Fields(scope); len(requested) > 0 {
+		granted := strings.Fields(claims.Scope)
+		for _, scope := range requested {
+			if !slices.Contains(granted, scope) {
+				return GrantedTokens{}, ErrInvalidScope
+			}
+		}
+		slices.Sort(requested)
+		scopes = slices.Compact(requested)
+	}
+
+	entry := newEntry(audit.EventTokensRefreshed, u)
+	entry.ClientID = client.ID
+	var refreshJTI token.JTI
+	defer func() {
+		s.record(ctx, entry, err)
+		s.flagSuspicious(ctx, u, refreshJTI, err)
+	}()
+	refreshJTI, err = decoded.JTI()
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	entry.JTI = refreshJTI.String()
+	err = s.validateRefresh(ctx, &u, decoded)
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	pair, err := s.rotateSession(ctx, u, decoded, nil, scopes, entry)
+	if errors.Is(err, ErrRefreshTokenReused) {
+		// already recorded by rotateSession
+		entry = nil
+	}
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	if scopes == nil {
+		scope = claims.Scope
+	} else {
+		scope = strings.Join(scopes, " ")
+	}
+	return s.grantedTokens(pair, scope, "")
+}
+
+// loginSession validates access, which must belong to a session of the
+// service itself rather than to one of a client, and sets the user of u.
+func (s *AuthService) loginSession(ctx context.Context, u *user.User, access token.EncodedToken) (*token.Token, error) {
+	if access == "" {
+		return nil, ErrLoginRequired
+	}
+	decoded, err := s.decodeToken(access)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := decoded.GetClaims()
+	if err != nil {
+		return nil, err
+	}
+	if claims.ClientID != "" {
+		return nil, ErrLoginRequired
+	}
+	u.Id, err = decoded.UserID()
+	if err != nil {
+		return nil, err
+	}
+	err = s.Validate(ctx, u, decoded)
+	if err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
+
+// checkConsent fails with ErrConsentRequired unless the user consented to
+// scopes of client, or consent is set and their consent is stored.
+// Consents given to an earlier client with the same ID don't count.
+func (s *AuthService) checkConsent(ctx context.Context, userID uuid.UUID, client *Client, scopes []string, consent bool) error {
+	current, err := s.clients.GetConsent(ctx, userID, client.ID)
+	if errors.Is(err, ErrConsentNotFound) || err == nil && current.GrantedAt.Before(client.CreatedAt) {
+		current = &Consent{UserID: userID, ClientID: client.ID}
+	} else if err != nil {
+		return err
+	}
+	missing := slices.DeleteFunc(slices.Clone(scopes), func(scope string) bool {
+		return slices.Contains(current.Scopes, scope)
+	})
+	if len(missing) == 0 && !current.GrantedAt.IsZero() {
+		return nil
+	}
+	if !consent {
+		return ErrConsentRequired
+	}
+	granted := append(slices.Clone(current.Scopes), missing...)
+	slices.Sort(granted)
+	return s.clients.PutConsent(ctx, &Consent{
+		UserID:    userID,
+		ClientID:  client.ID,
+		Scopes:    granted,
+		GrantedAt: time.Now().UTC().Truncate(time.Millisecond),
+	})
+}
+
+// redirectURI returns requested if it is registered, or the only
+// registered URI if requested is empty.
+func (c *Client) redirectURI(requested string) (string, error) {
+	if requested == "" {
+		if len(c.RedirectURIs) != 1 {
+			return "", ErrInvalidRedirectURI
+		}
+		return c.RedirectURIs[0], nil
+	}
+	if !slices.Contains(c.RedirectURIs, requested) {
+		return "", ErrInvalidRedirectURI
+	}
+	return requested, nil
+}
+
+// validCodeVerifier reports whether v has the syntax of RFC 7636 section
+// 4.1, which S256 challenges share.
+func validCodeVerifier(v string) bool {
+	if len(v) < 43 || len(v) > 128 {
+		return false
+	}
+	for _, c := range []byte(v) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func verifyCodeChallenge(challenge, verifier string) bool {
+	if !validCodeVerifier(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
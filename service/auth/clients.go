@@ -0,0 +1,364 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"medods-auth/service/audit"
+	"medods-auth/token"
+	"medods-auth/user"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Client is an OAuth client, calling the service on its own behalf or on
+// behalf of users who authorized it.
+type Client struct {
+	ID   string
+	Name string
+	// SecretHash is the SHA-256 of the secret. Secrets are random, so
+	// they need no slow hash. It is empty for public clients.
+	SecretHash string
+	// Public clients, such as SPAs and mobile apps, can't keep a secret.
+	// They only use the authorization code grant, which PKCE protects.
+	Public bool
+	// Scopes are those the client may request.
+	Scopes []string
+	// RedirectURIs are those the authorization endpoint may redirect to,
+	// compared as exact strings.
+	RedirectURIs []string
+	// PostLogoutRedirectURIs are those users may be sent back to after
+	// signing out through the end session endpoint of OpenID Connect.
+	PostLogoutRedirectURIs []string
+	// AccessTTL overrides the TTL of the access tokens of the client when
+	// positive.
+	AccessTTL time.Duration
+	CreatedAt time.Time
+}
+
+// ClientRepository may be implemented by a UserRepository to store OAuth
+// clients, with the authorization codes issued to them and the consents
+// users gave them.
+type ClientRepository interface {
+	// CreateClient fails with ErrClientExists if the ID is taken.
+	CreateClient(context.Context, *Client) error
+	// GetClient fails with ErrClientNotFound.
+	GetClient(ctx context.Context, id string) (*Client, error)
+	// DeleteClient fails with ErrClientNotFound.
+	DeleteClient(ctx context.Context, id string) error
+
+	// PutAuthCode stores a code until it expires.
+	PutAuthCode(context.Context, *AuthCode) error
+	// TakeAuthCode deletes and returns a code, failing with
+	// ErrAuthCodeNotFound if it is missing or expired.
+	TakeAuthCode(ctx context.Context, hash string) (*AuthCode, error)
+
+	// GetConsent fails with ErrConsentNotFound. Consents are deleted with
+	// their user.
+	GetConsent(ctx context.Context, userID uuid.UUID, clientID string) (*Consent, error)
+	// PutConsent replaces the consent of the user to the client.
+	PutConsent(context.Context, *Consent) error
+
+	// PutDeviceCode stores a code until KeepUntil, failing with
+	// ErrUserCodeTaken if a stored one has the same user code.
+	PutDeviceCode(context.Context, *DeviceCode) error
+	// GetDeviceCode returns the code with userCode, expired or not,
+	// failing with ErrDeviceCodeNotFound.
+	GetDeviceCode(ctx context.Context, userCode string) (*DeviceCode, error)
+	// DecideDeviceCode sets the status, user, AMR and auth time of the
+	// code with the user code of d. It fails with ErrDeviceCodeNotFound if
+	// the code is missing, expired or no longer pending.
+	DecideDeviceCode(ctx context.Context, d *DeviceCode) error
+	// PollDeviceCode sets LastPolledAt of a code to now and returns it as
+	// it was. A code that is no longer pending is deleted instead, so it is
+	// redeemed once. It fails with ErrDeviceCodeNotFound.
+	PollDeviceCode(ctx context.Context, hash string, now time.Time) (*DeviceCode, error)
+	// SlowDownDeviceCode sets the Interval of a pending code, failing with
+	// ErrDeviceCodeNotFound if it is missing or no longer pending.
+	SlowDownDeviceCode(ctx context.Context, hash string, interval time.Duration) error
+}
+
+type OAuthOptions struct {
+	// Scopes are those clients can be registered with, any when empty.
+	Scopes []string
+	// CodeTTL is how long authorization codes can be exchanged, 1 minute
+	// by default.
+	CodeTTL time.Duration
+	// DeviceCodeTTL is how long users have to approve a device, 10 minutes
+	// by default. Devices poll at most every DeviceInterval, 5 seconds by
+	// default, plus 5 seconds every time they polled too early.
+	DeviceCodeTTL  time.Duration
+	DeviceInterval time.Duration
+	// Issuer enables OpenID Connect when set, to the URL of the server.
+	// Clients granted the openid scope get ID tokens it issued, and the
+	// scopes of OpenIDScopes may always be registered.
+	Issuer string
+	// SigningKey signs the ID tokens, so that clients can verify them
+	// with its public half. It is required with Issuer.
+	SigningKey *token.SigningKey
+}
+
+// ClientRegistration describes a client to register. ID is optional, a
+// random one is assigned without it.
+type ClientRegistration struct {
+	ID           string
+	Name         string
+	Public       bool
+	Scopes       []string
+	RedirectURIs []string
+	// PostLogoutRedirectURIs are only used with OpenID Connect.
+	PostLogoutRedirectURIs []string
+	AccessTTL              time.Duration
+}
+
+// ClientToken is an access token issued to a client. There is no refresh
+// token, the client asks for a new one with its credentials.
+type ClientToken struct {
+	Access    *token.EncodedToken
+	ExpiresAt time.Time
+	Scope     string
+}
+
+var errNoClients = errors.New("oauth is not enabled")
+
+// RegisterClient stores a new client and returns it with its secret, which
+// is not stored and can't be retrieved later. Public clients get no secret.
+func (s *AuthService) RegisterClient(ctx context.Context, reg ClientRegistration) (_ *Client, secret string, err error) {
+	ctx, span := startSpan(ctx, "AuthService.RegisterClient", nil)
+	defer func() { endSpan(span, err) }()
+	if s.clients == nil {
+		return nil, "", errNoClients
+	}
+	if reg.ID == "" {
+		reg.ID = randomString(16)
+	}
+	entry := newEntry(audit.EventClientCreated, user.User{})
+	entry.ClientID = reg.ID
+	defer func() { s.record(ctx, entry, err) }()
+
+	for _, scope := range reg.Scopes {
+		if !validScope(scope) || len(s.oauth.Scopes) > 0 && !slices.Contains(s.oauth.Scopes, scope) {
+			return nil, "", ErrInvalidScope
+		}
+	}
+	for _, uri := range slices.Concat(reg.RedirectURIs, reg.PostLogoutRedirectURIs) {
+		if !validRedirectURI(uri) {
+			return nil, "", ErrInvalidRedirectURI
+		}
+	}
+	client := &Client{
+		ID:                     reg.ID,
+		Name:                   reg.Name,
+		Public:                 reg.Public,
+		Scopes:                 slices.Clone(reg.Scopes),
+		RedirectURIs:           slices.Clone(reg.RedirectURIs),
+		PostLogoutRedirectURIs: slices.Clone(reg.PostLogoutRedirectURIs),
+		AccessTTL:              max(reg.AccessTTL, 0),
+		CreatedAt:              time.Now().UTC().Truncate(time.Millisecond),
+	}
+	if !reg.Public {
+		secret = randomString(32)
+		client.SecretHash = hashSecret(secret)
+	}
+	err = s.clients.CreateClient(ctx, client)
+	if err != nil {
+		return nil, "", err
+	}
+	return client, secret, nil
+}
+
+func (s *AuthService) GetClient(ctx context.Context, id string) (_ *Client, err error) {
+	ctx, span := startSpan(ctx, "AuthService.GetClient", nil)
+	defer func() { endSpan(span, err) }()
+	if s.clients == nil {
+		return nil, errNoClients
+	}
+
+	return s.clients.GetClient(ctx, id)
+}
+
+// DeleteClient removes a client. Tokens already issued to it stay valid
+// until they expire.
+func (s *AuthService) DeleteClient(ctx context.Context, id string) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.DeleteClient", nil)
+	defer func() { endSpan(span, err) }()
+	if s.clients == nil {
+		return errNoClients
+	}
+	entry := newEntry(audit.EventClientDeleted, user.User{})
+	entry.ClientID = id
+	defer func() { s.record(ctx, entry, err) }()
+
+	return s.clients.DeleteClient(ctx, id)
+}
+
+// ClientCredentials authenticates a client and issues it an access token
+// for scope, space separated, or for all of its scopes when empty. u
+// carries the request's User-Agent and IP.
+func (s *AuthService) ClientCredentials(ctx context.Context, id, secret, scope string, u user.User) (_ ClientToken, err error) {
+	ctx, span := startSpan(ctx, "AuthService.ClientCredentials", nil)
+	defer func() { endSpan(span, err) }()
+	if s.clients == nil {
+		return ClientToken{}, errNoClients
+	}
+	entry := newEntry(audit.EventClientTokenIssued, u)
+	entry.ClientID = id
+	defer func() { s.record(ctx, entry, err) }()
+
+	client, err := s.authenticateClient(ctx, id, secret)
+	if err != nil {
+		return ClientToken{}, err
+	}
+	if client.Public {
+		return ClientToken{}, ErrUnauthorizedClient
+	}
+	scopes, err := grantScopes(client, scope)
+	if err != nil {
+		return ClientToken{}, err
+	}
+	ttl := s.accessTTL
+	if client.AccessTTL > 0 {
+		ttl = client.AccessTTL
+	}
+	scope = strings.Join(scopes, " ")
+	access := s.generator.Generate(token.Options{
+		TTL:      ttl,
+		Type:     token.TokenTypeAccess,
+		ClientID: client.ID,
+		Scope:    scope,
+	})
+	enc, err := s.encodeToken(access)
+	if err != nil {
+		return ClientToken{}, err
+	}
+	jti, err := access.JTI()
+	if err != nil {
+		return ClientToken{}, err
+	}
+	exp, err := access.Expires()
+	if err != nil {
+		return ClientToken{}, err
+	}
+	entry.IssuedJTI = jti.String()
+	return ClientToken{Access: &enc, ExpiresAt: exp, Scope: scope}, nil
+}
+
+// ValidateClientToken checks an access token issued to a client on its
+// own behalf and returns the client ID. It fails with
+// ErrInsufficientScope unless the token was granted all of scopes.
+func (s *AuthService) ValidateClientToken(ctx context.Context, access token.EncodedToken, scopes ...string) (_ string, err error) {
+	ctx, span := startSpan(ctx, "AuthService.ValidateClientToken", nil)
+	defer func() { endSpan(span, err) }()
+
+	decoded, err := s.decodeToken(access)
+	if err != nil {
+		return "", err
+	}
+	err = s.validate(ctx, nil, decoded)
+	if err != nil {
+		return "", err
+	}
+	claims, err := decoded.GetClaims()
+	if err != nil {
+		return "", err
+	}
+	if claims.SubjectType != token.SubjectClient || claims.TokenType != token.TokenTypeAccess {
+		return "", ErrClientTokenExpected
+	}
+	granted := strings.Fields(claims.Scope)
+	for _, scope := range scopes {
+		if !slices.Contains(granted, scope) {
+			return "", ErrInsufficientScope
+		}
+	}
+	return claims.ClientID, nil
+}
+
+// isClientToken reports whether t was issued to a client on its own
+// behalf.
+func isClientToken(t *token.Token) bool {
+	sub, err := t.SubjectType()
+	return err == nil && sub == token.SubjectClient
+}
+
+// authenticateClient fails with ErrInvalidClient whether the client is
+// unknown or the secret wrong. Public clients authenticate with their ID
+// alone.
+func (s *AuthService) authenticateClient(ctx context.Context, id, secret string) (*Client, error) {
+	client, err := s.clients.GetClient(ctx, id)
+	if errors.Is(err, ErrClientNotFound) {
+		return nil, ErrInvalidClient
+	}
+	if err != nil {
+		return nil, err
+	}
+	if client.Public {
+		if secret != "" {
+			return nil, ErrInvalidClient
+		}
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(client.SecretHash)) != 1 {
+		return nil, ErrInvalidClient
+	}
+	return client, nil
+}
+
+// grantScopes returns the scopes of scope, or all scopes of client when
+// it is empty, failing with ErrInvalidScope if client may not have one.
+func grantScopes(client *Client, scope string) ([]string, error) {
+	requested := strings.Fields(scope)
+	if len(requested) == 0 {
+		return client.Scopes, nil
+	}
+	for _, scope := range requested {
+		if !slices.Contains(client.Scopes, scope) {
+			return nil, ErrInvalidScope
+		}
+	}
+	slices.Sort(requested)
+	return slices.Compact(requested), nil
+}
+
+// validScope reports whether scope is a scope-token of RFC 6749.
+func validScope(scope string) bool {
+	if scope == "" {
+		return false
+	}
+	for _, c := range []byte(scope) {
+		if c < 0x21 || c == '"' || c == '\\' || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// validRedirectURI reports whether uri is absolute without a fragment, as
+// RFC 6749 section 3.1.2 requires. Custom schemes of native apps are
+// allowed.
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	return err == nil && u.Scheme != "" && !strings.Contains(uri, "#")
+}
+
+// hashSecret hashes random secrets, such as those of clients and
+// authorization codes.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomString returns n random bytes, base64url encoded.
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"medods-auth/logging"
+	"medods-auth/service/audit"
+	"medods-auth/token"
+	"medods-auth/user"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Credential is the login and Argon2id password hash of a user.
+type Credential struct {
+	UserID uuid.UUID
+	Login  string
+	Hash   string
+}
+
+// CredentialRepository may be implemented by a UserRepository to store
+// one credential per user. Deleting a user deletes their credential.
+type CredentialRepository interface {
+	// SetCredential creates or replaces the credential of c.UserID, and
+	// fails with ErrLoginTaken if another user has c.Login.
+	SetCredential(context.Context, Credential) error
+	// GetCredential fails with ErrCredentialNotFound.
+	GetCredential(ctx context.Context, login string) (*Credential, error)
+	// GetUserCredential returns the credential of a user, failing with
+	// ErrCredentialNotFound.
+	GetUserCredential(ctx context.Context, userID uuid.UUID) (*Credential, error)
+	// UpdateCredentialHash replaces the hash of a user only if it is still
+	// old, so that a rehash can't undo a concurrent password change.
+	UpdateCredentialHash(ctx context.Context, userID uuid.UUID, old, new string) error
+}
+
+// NormalizeLogin makes logins, usually emails, case-insensitive.
+func NormalizeLogin(login string) string {
+	return strings.ToLower(strings.TrimSpace(login))
+}
+
+// SetPassword sets the login and password of an existing user.
+func (s *AuthService) SetPassword(ctx context.Context, id uuid.UUID, login, pw string) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.SetPassword", &user.User{Id: id})
+	defer func() { endSpan(span, err) }()
+	if s.credentials == nil {
+		return errNoCredentials
+	}
+	entry := newEntry(audit.EventPasswordSet, user.User{Id: id})
+	defer func() { s.record(ctx, entry, err) }()
+
+	login = NormalizeLogin(login)
+	if login == "" || pw == "" {
+		return ErrInvalidCredentials
+	}
+	_, err = s.users.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	hash, err := s.passwords.Hash(pw)
+	if err != nil {
+		return err
+	}
+	return s.credentials.SetCredential(ctx, Credential{UserID: id, Login: login, Hash: hash})
+}
+
+// LoginResult holds the tokens of a login, or for users with a second
+// factor the MFA token VerifyMFA completes the login with.
+type LoginResult struct {
+	Tokens TokenPair
+
+	MFAToken     *token.EncodedToken
+	MFAExpiresAt time.Time
+	// MFAMethods are the amr values of the second factors the user has,
+	// "otp" for TOTP and "hwk" for passkeys.
+	MFAMethods []string
+}
+
+// Login checks the password of login and issues tokens for its user. u
+// carries the request's User-Agent and IP, its ID is ignored. Unknown
+// logins take as long as wrong passwords and fail the same way, lockout
+// included. While locked out Login fails with a *LockedOutError without
+// checking the password.
+func (s *AuthService) Login(ctx context.Context, login, pw string, u user.User) (_ LoginResult, err error) {
+	ctx, span := startSpan(ctx, "AuthService.Login", nil)
+	defer func() { endSpan(span, err) }()
+	if s.credentials == nil {
+		return LoginResult{}, errNoCredentials
+	}
+	entry := newEntry(audit.EventLogin, u)
+	defer func() { s.record(ctx, entry, err) }()
+
+	login = NormalizeLogin(login)
+	cred, err := s.credentials.GetCredential(ctx, login)
+	if err != nil && !errors.Is(err, ErrCredentialNotFound) {
+		return LoginResult{}, err
+	}
+	account := "login:" + login
+	if cred != nil {
+		u.Id = cred.UserID
+		entry.UserID = cred.UserID
+		account = userLockoutKey(cred.UserID)
+	}
+	keys := s.lockoutKeys(account, u)
+	if err := s.checkLockout(ctx, keys); err != nil {
+		return LoginResult{}, err
+	}
+
+	if cred == nil {
+		s.passwords.VerifyDummy(pw)
+		s.failLockout(ctx, keys, u, amrPassword)
+		return LoginResult{}, ErrInvalidCredentials
+	}
+	ok, rehash, err := s.passwords.Verify(pw, cred.Hash)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	if !ok {
+		s.failLockout(ctx, keys, u, amrPassword)
+		return LoginResult{}, ErrInvalidCredentials
+	}
+	if rehash {
+		s.rehashPassword(ctx, cred, pw)
+	}
+	if s.totp != nil || s.passkeys != nil {
+		// failures are only reset by completing the login, a stolen
+		// password mustn't reset those of the second factor
+		mfa, err := s.startMFA(ctx, u)
+		if err != nil || mfa.MFAToken != nil {
+			return mfa, err
+		}
+	}
+	pair, err := s.generateTokens(ctx, u, grant{amr: []string{amrPassword}})
+	if err != nil {
+		return LoginResult{}, err
+	}
+	s.resetLockout(ctx, u.Id)
+	return LoginResult{Tokens: pair}, nil
+}
+
+// rehashPassword upgrades cred to the current params. Failing to is
+// logged, the old hash still verifies.
+func (s *AuthService) rehashPassword(ctx context.Context, cred *Credential, pw string) {
+	hash, err := s.passwords.Hash(pw)
+	if err == nil {
+		err = s.credentials.UpdateCredentialHash(ctx, cred.UserID, cred.Hash, hash)
+	}
+	if err != nil {
+		logging.For("auth").ErrorContext(ctx, "failed to rehash password",
+			"user_id", cred.UserID, "error", err)
+	}
+}
@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"medods-auth/service/audit"
+	"medods-auth/token"
+	"medods-auth/user"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type DeviceStatus string
+
+const (
+	DevicePending  DeviceStatus = "pending"
+	DeviceApproved DeviceStatus = "approved"
+	DeviceDenied   DeviceStatus = "denied"
+)
+
+// DeviceCode is a device authorization of RFC 8628, polled for by the
+// device with the device code and decided by a user who enters the user
+// code on another screen.
+type DeviceCode struct {
+	// Hash is the SHA-256 of the device code, which is not stored.
+	Hash string
+	// UserCode is normalized, see NormalizeUserCode.
+	UserCode string
+	ClientID string
+	Scope    string
+	Status   DeviceStatus
+	// UserID, AMR and AuthTime are those of the user who decided.
+	UserID       uuid.UUID
+	AMR          []string
+	AuthTime     time.Time
+	LastPolledAt time.Time
+	// Interval is how often the device may poll, raised every time it
+	// polls too early. Codes stored without one use DeviceInterval.
+	Interval  time.Duration
+	ExpiresAt time.Time
+	// KeepUntil is after ExpiresAt, so devices still polling are told the
+	// code expired rather than that it is unknown.
+	KeepUntil time.Time
+}
+
+// DeviceAuthorization is the response to a device of RFC 8628 section
+// 3.2.
+type DeviceAuthorization struct {
+	DeviceCode string
+	// UserCode is formatted for display, as in "BCDF-GHJK".
+	UserCode  string
+	ExpiresAt time.Time
+	Interval  time.Duration
+}
+
+// userCodeAlphabet has no vowels, so codes don't spell words, and no
+// characters that look alike, as RFC 8628 section 6.1 suggests.
+const (
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+// slowDownStep is how much the interval of a device grows every time it
+// is told to slow down, as RFC 8628 section 3.5 has it.
+const slowDownStep = 5 * time.Second
+
+// AuthorizeDevice authenticates a client and starts the authorization of a
+// device for scope, space separated, or for all scopes of the client when
+// empty.
+func (s *AuthService) AuthorizeDevice(ctx context.Context, id, secret, scope string) (_ DeviceAuthorization, err error) {
+	ctx, span := startSpan(ctx, "AuthService.AuthorizeDevice", nil)
+	defer func() { endSpan(span, err) }()
+	if s.clients == nil {
+		return DeviceAuthorization{}, errNoClients
+	}
+
+	client, err := s.authenticateClient(ctx, id, secret)
+	if err != nil {
+		return DeviceAuthorization{}, err
+	}
+	scopes, err := grantScopes(client, scope)
+	if err != nil {
+		return DeviceAuthorization{}, err
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	deviceCode := randomString(32)
+	d := &DeviceCode{
+		Hash:      hashSecret(deviceCode),
+		ClientID:  client.ID,
+		Scope:     strings.Join(scopes, " "),
+		Status:    DevicePending,
+		Interval:  s.oauth.DeviceInterval,
+		ExpiresAt: now.Add(s.oauth.DeviceCodeTTL),
+		KeepUntil: now.Add(2 * s.oauth.DeviceCodeTTL),
+	}
+	// user codes are short, a few pending ones may collide
+	for range 3 {
+		d.UserCode = randomUserCode()
+		err = s.clients.PutDeviceCode(ctx, d)
+		if !errors.Is(err, ErrUserCodeTaken) {
+			break
+		}
+	}
+	if err != nil {
+		return DeviceAuthorization{}, err
+	}
+	return DeviceAuthorization{
+		DeviceCode: deviceCode,
+		UserCode:   FormatUserCode(d.UserCode),
+		ExpiresAt:  d.ExpiresAt,
+		Interval:   s.oauth.DeviceInterval,
+	}, nil
+}
+
+// DeviceRequest returns the pending code with userCode, as the user typed
+// it, and its client, for the user to decide on. It fails with
+// ErrDeviceCodeNotFound if the code is unknown, expired or decided.
+func (s *AuthService) DeviceRequest(ctx context.Context, userCode string) (_ *DeviceCode, _ *Client, err error) {
+	ctx, span := startSpan(ctx, "AuthService.DeviceRequest", nil)
+	defer func() { endSpan(span, err) }()
+	if s.clients == nil {
+		return nil, nil, errNoClients
+	}
+
+	d, err := s.clients.GetDeviceCode(ctx, NormalizeUserCode(userCode))
+	if err != nil {
+		return nil, nil, err
+	}
+	if d.Status != DevicePending || !time.Now().Before(d.ExpiresAt) {
+		return nil, nil, ErrDeviceCodeNotFound
+	}
+	client, err := s.clients.GetClient(ctx, d.ClientID)
+	if errors.Is(err, ErrClientNotFound) {
+		return nil, nil, ErrDeviceCodeNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, client, nil
+}
+
+// DecideDevice approves or denies the device with userCode on behalf of
+// the user of access, a token of a session of the service itself.
+func (s *AuthService) DecideDevice(ctx context.Context, u user.User, access token.EncodedToken, userCode string, approve bool) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.DecideDevice", &u)
+	defer func() { endSpan(span, err) }()
+	if s.clients == nil {
+		return errNoClients
+	}
+	entry := newEntry(audit.EventDeviceDenied, u)
+	if approve {
+		entry.Event = audit.EventDeviceApproved
+	}
+	defer func() { s.record(ctx, entry, err) }()
+
+	session, err := s.loginSession(ctx, &u, access)
+	if err != nil {
+		return err
+	}
+	entry.UserID = u.Id
+	err = s.checkUser(ctx, u.Id)
+	if err != nil {
+		return err
+	}
+	d, _, err := s.DeviceRequest(ctx, userCode)
+	if err != nil {
+		return err
+	}
+	entry.ClientID = d.ClientID
+
+	d.Status = DeviceDenied
+	if approve {
+		d.Status = DeviceApproved
+	}
+	d.UserID = u.Id
+	d.AuthTime, err = session.SessionStart()
+	if err != nil {
+		return err
+	}
+	d.AMR, err = session.AMR()
+	if err != nil {
+		return err
+	}
+	return s.clients.DecideDeviceCode(ctx, d)
+}
+
+// PollDevice authenticates a client polling for the tokens of a device.
+// It fails with ErrAuthorizationPending until the user decided,
+// ErrSlowDown when polled more often than its interval, which then grows
+// by 5 seconds, ErrAccessDenied if the user denied it and ErrDeviceCodeExpired once it
+// expired. The tokens are issued as GenerateTokens does. u carries the
+// request's User-Agent and IP.
+func (s *AuthService) PollDevice(ctx context.Context, id, secret, deviceCode string, u user.User) (_ GrantedTokens, err error) {
+	ctx, span := startSpan(ctx, "AuthService.PollDevice", nil)
+	defer func() { endSpan(span, err) }()
+	if s.clients == nil {
+		return GrantedTokens{}, errNoClients
+	}
+
+	client, err := s.authenticateClient(ctx, id, secret)
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	now := time.Now()
+	hash := hashSecret(deviceCode)
+	d, err := s.clients.PollDeviceCode(ctx, hash, now)
+	if errors.Is(err, ErrDeviceCodeNotFound) {
+		return GrantedTokens{}, ErrInvalidGrant
+	}
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	if d.ClientID != client.ID {
+		return GrantedTokens{}, ErrInvalidGrant
+	}
+	if !now.Before(d.ExpiresAt) {
+		return GrantedTokens{}, ErrDeviceCodeExpired
+	}
+	switch d.Status {
+	case DevicePending:
+		interval := d.Interval
+		if interval <= 0 {
+			interval = s.oauth.DeviceInterval
+		}
+		if now.Sub(d.LastPolledAt) < interval {
+			// a code decided meanwhile has no interval left to raise
+			err = s.clients.SlowDownDeviceCode(ctx, hash, interval+slowDownStep)
+			if err != nil && !errors.Is(err, ErrDeviceCodeNotFound) {
+				return GrantedTokens{}, err
+			}
+			return GrantedTokens{}, ErrSlowDown
+		}
+		return GrantedTokens{}, ErrAuthorizationPending
+	case DeviceDenied:
+		return GrantedTokens{}, ErrAccessDenied
+	}
+
+	u.Id = d.UserID
+	pair, err := s.generateTokens(ctx, u, grant{amr: d.AMR, clientID: client.ID, scope: d.Scope})
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	return s.grantedTokens(pair, d.Scope, "")
+}
+
+// NormalizeUserCode drops the dash and anything else users may type
+// around a user code, and upper-cases it.
+func NormalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' {
+			r -= 'a' - 'A'
+		}
+		if 'A' <= r && r <= 'Z' {
+			return r
+		}
+		return -1
+	}, code)
+}
+
+// FormatUserCode splits a normalized user code in two halves.
+func FormatUserCode(code string) string {
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+func randomUserCode() string {
+	b := make([]byte, userCodeLength)
+	n := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := range b {
+		c, err := rand.Int(rand.Reader, n)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = userCodeAlphabet[c.Int64()]
+	}
+	return string(b)
+}
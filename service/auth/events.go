@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"medods-auth/service/events"
+	"medods-auth/service/outbox"
+	"medods-auth/token"
+	"medods-auth/user"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// outboxMessages returns nil when the outbox is not used.
+func (s *AuthService) outboxMessages(evs ...events.Event) ([]outbox.Message, error) {
+	if s.outbox == nil {
+		return nil, nil
+	}
+	msgs := make([]outbox.Message, 0, len(evs))
+	for _, e := range evs {
+		m, err := outbox.NewMessage(e)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// store stores rec and, with the outbox in use, e in the same transaction.
+func (s *AuthService) store(ctx context.Context, rec *RefreshTokenRecord, e events.Event) error {
+	if s.outbox == nil {
+		return s.refreshTokenRepo.Store(ctx, rec)
+	}
+	msgs, err := s.outboxMessages(e)
+	if err != nil {
+		return err
+	}
+	return s.outbox.StoreWithOutbox(ctx, rec, msgs)
+}
+
+// deleteSession deletes the refresh record jti, writing e to the outbox in
+// the same transaction when there is one. It fails with
+// ErrRefreshTokenNotFound without the record.
+func (s *AuthService) deleteSession(ctx context.Context, jti token.JTI, e events.Event) error {
+	if s.outbox == nil {
+		return s.refreshTokenRepo.Delete(ctx, jti)
+	}
+	msgs, err := s.outboxMessages(e)
+	if err != nil {
+		return err
+	}
+	return s.outbox.DeleteWithOutbox(ctx, jti, msgs)
+}
+
+func (s *AuthService) deleteSessions(ctx context.Context, userID uuid.UUID, e events.Event) error {
+	if s.outbox == nil {
+		return s.refreshTokenRepo.DeleteByUserId(ctx, userID)
+	}
+	msgs, err := s.outboxMessages(e)
+	if err != nil {
+		return err
+	}
+	return s.outbox.DeleteByUserIdWithOutbox(ctx, userID, msgs)
+}
+
+func (s *AuthService) deleteClientSessions(ctx context.Context, userID uuid.UUID, clientID string, e events.Event) error {
+	if s.outbox == nil {
+		return s.refreshTokenRepo.DeleteByClient(ctx, userID, clientID)
+	}
+	msgs, err := s.outboxMessages(e)
+	if err != nil {
+		return err
+	}
+	return s.outbox.DeleteByClientWithOutbox(ctx, userID, clientID, msgs)
+}
+
+func (s *AuthService) publish(ctx context.Context, e events.Event) {
+	if s.events != nil {
+		s.events.Publish(ctx, e)
+	}
+}
+
+// flagSuspicious publishes SuspiciousActivity for errors hinting that a
+// token is used by someone other than its owner.
+func (s *AuthService) flagSuspicious(ctx context.Context, u user.User, jti token.JTI, err error) {
+	var kind string
+	switch {
+	case errors.Is(err, ErrUserAgentChanged):
+		kind = events.ActivityUserAgentMismatch
+	case errors.Is(err, ErrRefreshTokenReused):
+		kind = events.ActivityRefreshTokenReuse
+	default:
+		return
+	}
+	s.publish(ctx, events.SuspiciousActivity{
+		UserID:    u.Id,
+		JTI:       jti,
+		Kind:      kind,
+		IP:        u.IP,
+		UserAgent: u.UserAgent,
+		At:        time.Now(),
+	})
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"medods-auth/token"
+	"time"
+)
+
+// Introspection describes a token as in RFC 7662 section 2.2. Only Active
+// is set for tokens that are not.
+type Introspection struct {
+	Active bool
+	// Subject is the ID of the user, or of the client for tokens issued to
+	// a client on its own behalf.
+	Subject   string
+	ClientID  string
+	Scope     string
+	Refresh   bool
+	JTI       token.JTI
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// Introspect authenticates a confidential client and describes t, an
+// access or refresh token. Tokens that are malformed, expired, revoked,
+// rotated away or whose user is no longer active are reported inactive
+// without an error.
+func (s *AuthService) Introspect(ctx context.Context, id, secret string, t token.EncodedToken) (_ Introspection, err error) {
+	ctx, span := startSpan(ctx, "AuthService.Introspect", nil)
+	defer func() { endSpan(span, err) }()
+	if s.clients == nil {
+		return Introspection{}, errNoClients
+	}
+
+	client, err := s.authenticateClient(ctx, id, secret)
+	if err != nil {
+		return Introspection{}, err
+	}
+	if client.Public {
+		return Introspection{}, ErrUnauthorizedClient
+	}
+	decoded, err := s.decodeToken(t)
+	if err != nil {
+		return Introspection{}, nil
+	}
+	result, err := s.introspect(ctx, decoded)
+	if err != nil && ErrorCode(err) != CodeInternal {
+		return Introspection{}, nil
+	}
+	return result, err
+}
+
+func (s *AuthService) introspect(ctx context.Context, t *token.Token) (Introspection, error) {
+	typ, err := t.Type()
+	if err != nil {
+		return Introspection{}, err
+	}
+	validate := s.Validate
+	if typ == token.TokenTypeRefresh {
+		validate = s.validateRefresh
+	}
+	err = validate(ctx, nil, t)
+	if err != nil {
+		return Introspection{}, err
+	}
+	claims, err := t.GetClaims()
+	if err != nil {
+		return Introspection{}, err
+	}
+	jti, err := t.JTI()
+	if err != nil {
+		return Introspection{}, err
+	}
+	result := Introspection{
+		Active:    true,
+		Subject:   claims.Subject,
+		ClientID:  claims.ClientID,
+		Scope:     claims.Scope,
+		JTI:       jti,
+		IssuedAt:  claims.IssuedAt.Time,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}
+	if isClientToken(t) {
+		return result, nil
+	}
+
+	userID, err := t.UserID()
+	if err != nil {
+		return Introspection{}, err
+	}
+	err = s.checkUser(ctx, userID)
+	if err != nil {
+		return Introspection{}, err
+	}
+	record, err := s.refreshRecord(ctx, t)
+	if err != nil {
+		return Introspection{}, err
+	}
+	if record == nil {
+		return result, nil
+	}
+	if s.sessionExpired(record, time.Now()) {
+		return Introspection{}, ErrSessionExpired
+	}
+	result.Refresh = true
+	return result, nil
+}
+
+// refreshRecord returns the record of t if it is a refresh token, nil if
+// it is an access token, and ErrRefreshTokenNotFound for refresh tokens
+// rotated away or revoked.
+func (s *AuthService) refreshRecord(ctx context.Context, t *token.Token) (*RefreshTokenRecord, error) {
+	typ, err := t.Type()
+	if err != nil {
+		return nil, err
+	}
+	if typ == token.TokenTypeAccess || isClientToken(t) {
+		return nil, nil
+	}
+	jti, err := t.JTI()
+	if err != nil {
+		return nil, err
+	}
+	record, err := s.refreshTokenRepo.Get(ctx, jti)
+	// tokens issued before their type was set are told apart by the record
+	if errors.Is(err, ErrRefreshTokenNotFound) && typ == "" {
+		return nil, nil
+	}
+	return record, err
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"medods-auth/logging"
+	"medods-auth/service/audit"
+	"medods-auth/service/events"
+	"medods-auth/service/lockout"
+	"medods-auth/user"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var errNoLockout = errors.New("lockout is not enabled")
+
+// LockedOutError is returned with ErrLockedOut while an account or IP has
+// to wait after failed attempts.
+type LockedOutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedOutError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrLockedOut, e.RetryAfter)
+}
+
+func (e *LockedOutError) Is(target error) bool {
+	return target == ErrLockedOut
+}
+
+type LockoutOptions struct {
+	Store lockout.Store
+	// Account counts failures per user, or per login for unknown ones.
+	// Defaults to a delay of 1s doubling up to 30s, and a 15 minute
+	// lockout after 10 failures, one forgotten every 5 minutes.
+	Account *lockout.Policy
+	// IP counts failures per client IP. Defaults to a 15 minute lockout
+	// after 50 failures, one forgotten every minute.
+	IP *lockout.Policy
+}
+
+func (o LockoutOptions) withDefaults() LockoutOptions {
+	if o.Account == nil {
+		o.Account = &lockout.Policy{
+			MaxFailures: 10,
+			Lockout:     15 * time.Minute,
+			Delay:       time.Second,
+			MaxDelay:    30 * time.Second,
+			Decay:       5 * time.Minute,
+		}
+	}
+	if o.IP == nil {
+		o.IP = &lockout.Policy{
+			MaxFailures: 50,
+			Lockout:     15 * time.Minute,
+			Decay:       time.Minute,
+		}
+	}
+	return o
+}
+
+// lockoutKey is a key failures of an attempt count against.
+type lockoutKey struct {
+	key    string
+	scope  string
+	policy lockout.Policy
+}
+
+// lockoutKeys returns the keys of an attempt on account, "user:<id>" or
+// "login:<login>", from u.IP. It returns nil when lockout is disabled.
+func (s *AuthService) lockoutKeys(account string, u user.User) []lockoutKey {
+	if s.lockout.Store == nil {
+		return nil
+	}
+	keys := []lockoutKey{{account, events.LockoutScopeAccount, *s.lockout.Account}}
+	if u.IP != "" {
+		keys = append(keys, lockoutKey{"ip:" + u.IP, events.LockoutScopeIP, *s.lockout.IP})
+	}
+	return keys
+}
+
+func userLockoutKey(id uuid.UUID) string {
+	return "user:" + id.String()
+}
+
+// checkLockout fails with a *LockedOutError if any of keys has to wait.
+// Attempts are let through when the store fails, an outage shouldn't lock
+// out every user.
+func (s *AuthService) checkLockout(ctx context.Context, keys []lockoutKey) error {
+	now := time.Now()
+	var wait time.Duration
+	for _, k := range keys {
+		state, err := s.lockout.Store.Get(ctx, k.key)
+		if err != nil {
+			logging.For("lockout").ErrorContext(ctx, "failed to get lockout state",
+				"scope", k.scope, "error", err)
+			continue
+		}
+		wait = max(wait, state.RetryAfter(now))
+	}
+	if wait > 0 {
+		return &LockedOutError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// failLockout counts a failed attempt of u with method against keys, and
+// publishes LoginFailed and, for keys it locks out, LockedOut.
+func (s *AuthService) failLockout(ctx context.Context, keys []lockoutKey, u user.User, method string) {
+	if keys == nil {
+		return
+	}
+	now := time.Now()
+	ctx = context.WithoutCancel(ctx)
+	for _, k := range keys {
+		state, err := s.lockout.Store.Fail(ctx, k.key, k.policy, now)
+		if err != nil {
+			logging.For("lockout").ErrorContext(ctx, "failed to record failed attempt",
+				"scope", k.scope, "error", err)
+			continue
+		}
+		if k.policy.LockedOut(state) {
+			locked := events.LockedOut{
+				UserID:    u.Id,
+				Scope:     k.scope,
+				IP:        u.IP,
+				UserAgent: u.UserAgent,
+				Until:     state.LockedUntil,
+				At:        now,
+			}
+			if k.scope == events.LockoutScopeIP {
+				locked.UserID = uuid.Nil
+			}
+			s.publish(ctx, locked)
+		}
+	}
+	s.publish(ctx, events.LoginFailed{
+		UserID:    u.Id,
+		Method:    method,
+		IP:        u.IP,
+		UserAgent: u.UserAgent,
+		At:        now,
+	})
+}
+
+// resetLockout clears the failures of a user once they logged in. Those
+// of their IP are left to decay, they may not all be theirs.
+func (s *AuthService) resetLockout(ctx context.Context, id uuid.UUID) {
+	if s.lockout.Store == nil {
+		return
+	}
+	err := s.lockout.Store.Reset(context.WithoutCancel(ctx), userLockoutKey(id))
+	if err != nil {
+		logging.For("lockout").ErrorContext(ctx, "failed to reset lockout state",
+			"user_id", id, "error", err)
+	}
+}
+
+// UnlockUser clears the failed attempts of a user, lifting their lockout.
+// It does not change the status set by DisableUser.
+func (s *AuthService) UnlockUser(ctx context.Context, id uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.UnlockUser", &user.User{Id: id})
+	defer func() { endSpan(span, err) }()
+	if s.lockout.Store == nil {
+		return errNoLockout
+	}
+	entry := newEntry(audit.EventLockoutCleared, user.User{Id: id})
+	defer func() { s.record(ctx, entry, err) }()
+
+	if s.users != nil {
+		_, err = s.users.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+	}
+	return s.lockout.Store.Reset(ctx, userLockoutKey(id))
+}
+
+// UnlockIP clears the failed attempts from ip.
+func (s *AuthService) UnlockIP(ctx context.Context, ip string) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.UnlockIP", nil)
+	defer func() { endSpan(span, err) }()
+	if s.lockout.Store == nil {
+		return errNoLockout
+	}
+	entry := newEntry(audit.EventLockoutCleared, user.User{IP: ip})
+	defer func() { s.record(ctx, entry, err) }()
+
+	return s.lockout.Store.Reset(ctx, "ip:"+ip)
+}
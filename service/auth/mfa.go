@@ -0,0 +1,399 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"medods-auth/service/audit"
+	"medods-auth/service/totp"
+	"medods-auth/token"
+	"medods-auth/user"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Authentication methods of RFC 8176 recorded in the amr claim.
+const (
+	amrPassword = "pwd"
+	amrOTP      = "otp"
+	amrMFA      = "mfa"
+	amrHardware = "hwk"
+)
+
+// TOTP is the second factor of a user. It is enrolled inactive and
+// activated once the user proves their authenticator has the secret.
+type TOTP struct {
+	UserID uuid.UUID
+	Secret string
+	Active bool
+	// LastStep is the time step of the last accepted code, codes of it or
+	// earlier steps are rejected as replays.
+	LastStep int64
+	// RecoveryCodes are the unused recovery codes, hashed with
+	// totp.HashRecoveryCode.
+	RecoveryCodes []string
+	// Version is 1 for a new enrollment and incremented by every update.
+	Version int64
+}
+
+// TOTPRepository may be implemented by a UserRepository to store one TOTP
+// per user. Deleting a user deletes their TOTP.
+type TOTPRepository interface {
+	// GetTOTP fails with ErrTOTPNotEnrolled.
+	GetTOTP(ctx context.Context, userID uuid.UUID) (*TOTP, error)
+	// PutTOTP stores t if the stored version is t.Version-1, where version
+	// 0 means none is stored, and fails with ErrTOTPConflict otherwise.
+	PutTOTP(context.Context, *TOTP) error
+	// DeleteTOTP fails with ErrTOTPNotEnrolled.
+	DeleteTOTP(ctx context.Context, userID uuid.UUID) error
+}
+
+type TOTPOptions struct {
+	// Issuer names the service in authenticator apps.
+	Issuer string
+	// Skew is how many steps before and after the current one are
+	// accepted, for clock drift. Defaults to 1.
+	Skew *int
+	// MFATokenTTL is how long the second factor may be entered after the
+	// first. Defaults to 5 minutes.
+	MFATokenTTL *time.Duration
+	// RecoveryCodes is how many recovery codes activation returns.
+	// Defaults to 10.
+	RecoveryCodes *int
+}
+
+func (o TOTPOptions) withDefaults() TOTPOptions {
+	if o.Issuer == "" {
+		o.Issuer = "medods-auth"
+	}
+	if o.Skew == nil {
+		skew := 1
+		o.Skew = &skew
+	}
+	if o.MFATokenTTL == nil {
+		ttl := 5 * time.Minute
+		o.MFATokenTTL = &ttl
+	}
+	if o.RecoveryCodes == nil {
+		n := 10
+		o.RecoveryCodes = &n
+	}
+	return o
+}
+
+type TOTPEnrollment struct {
+	Secret string
+	// URI is the otpauth URI of Secret, usually shown as a QR code.
+	URI string
+}
+
+var errNoTOTP = errors.New("totp is not enabled")
+
+// EnrollTOTP starts enrolling a TOTP for the user of access, replacing an
+// enrollment not activated yet. It is inactive until ActivateTOTP.
+func (s *AuthService) EnrollTOTP(ctx context.Context, u user.User, access token.EncodedToken) (_ *TOTPEnrollment, err error) {
+	ctx, span := startSpan(ctx, "AuthService.EnrollTOTP", &u)
+	defer func() { endSpan(span, err) }()
+	if s.totp == nil {
+		return nil, errNoTOTP
+	}
+	entry := newEntry(audit.EventTOTPEnrolled, u)
+	defer func() { s.record(ctx, entry, err) }()
+
+	u.Id, err = s.authenticate(ctx, u, access)
+	if err != nil {
+		return nil, err
+	}
+	entry.UserID = u.Id
+
+	current, err := s.totp.GetTOTP(ctx, u.Id)
+	if err != nil && !errors.Is(err, ErrTOTPNotEnrolled) {
+		return nil, err
+	}
+	next := &TOTP{
+		UserID:  u.Id,
+		Secret:  totp.NewSecret(),
+		Version: 1,
+	}
+	if current != nil {
+		if current.Active {
+			return nil, ErrTOTPAlreadyActive
+		}
+		next.Version = current.Version + 1
+	}
+	err = s.totp.PutTOTP(ctx, next)
+	if err != nil {
+		return nil, err
+	}
+	return &TOTPEnrollment{
+		Secret: next.Secret,
+		URI:    totp.URI(s.totpOptions.Issuer, u.Id.String(), next.Secret),
+	}, nil
+}
+
+// ActivateTOTP activates the enrolled TOTP of the user of access if code
+// is valid for it, and returns the recovery codes. They are only stored
+// hashed, this is the only time they are shown.
+func (s *AuthService) ActivateTOTP(ctx context.Context, u user.User, access token.EncodedToken, code string) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "AuthService.ActivateTOTP", &u)
+	defer func() { endSpan(span, err) }()
+	if s.totp == nil {
+		return nil, errNoTOTP
+	}
+	entry := newEntry(audit.EventTOTPActivated, u)
+	defer func() { s.record(ctx, entry, err) }()
+
+	u.Id, err = s.authenticate(ctx, u, access)
+	if err != nil {
+		return nil, err
+	}
+	entry.UserID = u.Id
+
+	current, err := s.totp.GetTOTP(ctx, u.Id)
+	if err != nil {
+		return nil, err
+	}
+	if current.Active {
+		return nil, ErrTOTPAlreadyActive
+	}
+	step, ok, err := totp.Validate(current.Secret, code, time.Now(), *s.totpOptions.Skew)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes := totp.NewRecoveryCodes(*s.totpOptions.RecoveryCodes)
+	next := *current
+	next.Active = true
+	next.LastStep = step
+	next.RecoveryCodes = make([]string, len(codes))
+	for i, c := range codes {
+		next.RecoveryCodes[i] = totp.HashRecoveryCode(c)
+	}
+	next.Version++
+	err = s.totp.PutTOTP(ctx, &next)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// ResetTOTP removes the TOTP of a user who lost their authenticator and
+// recovery codes.
+func (s *AuthService) ResetTOTP(ctx context.Context, id uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.ResetTOTP", &user.User{Id: id})
+	defer func() { endSpan(span, err) }()
+	if s.totp == nil {
+		return errNoTOTP
+	}
+	entry := newEntry(audit.EventTOTPReset, user.User{Id: id})
+	defer func() { s.record(ctx, entry, err) }()
+
+	return s.totp.DeleteTOTP(ctx, id)
+}
+
+// startMFA returns an MFA token if u has a second factor, and an empty
+// result otherwise.
+func (s *AuthService) startMFA(ctx context.Context, u user.User) (LoginResult, error) {
+	var methods []string
+	if s.totp != nil {
+		current, err := s.totp.GetTOTP(ctx, u.Id)
+		if err != nil && !errors.Is(err, ErrTOTPNotEnrolled) {
+			return LoginResult{}, err
+		}
+		if err == nil && current.Active {
+			methods = append(methods, amrOTP)
+		}
+	}
+	if s.passkeys != nil {
+		keys, err := s.passkeys.ListPasskeys(ctx, u.Id)
+		if err != nil {
+			return LoginResult{}, err
+		}
+		if len(keys) > 0 {
+			methods = append(methods, amrHardware)
+		}
+	}
+	if len(methods) == 0 {
+		return LoginResult{}, nil
+	}
+	// fail now rather than after the second factor
+	err := s.checkUser(ctx, u.Id)
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	pending := s.generator.Generate(token.Options{
+		User: u,
+		TTL:  s.mfaTokenTTL(),
+		Type: token.TokenTypeMFAPending,
+		AMR:  []string{amrPassword},
+	})
+	enc, err := s.encodeToken(pending)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	exp, err := pending.Expires()
+	if err != nil {
+		return LoginResult{}, err
+	}
+	return LoginResult{MFAToken: &enc, MFAExpiresAt: exp, MFAMethods: methods}, nil
+}
+
+// mfaTokenTTL defaults to 5 minutes when TOTP is off but passkeys aren't.
+func (s *AuthService) mfaTokenTTL() time.Duration {
+	if s.totpOptions.MFATokenTTL != nil {
+		return *s.totpOptions.MFATokenTTL
+	}
+	return 5 * time.Minute
+}
+
+// checkMFAToken validates an MFA token for u and sets u.Id to its user.
+func (s *AuthService) checkMFAToken(ctx context.Context, u *user.User, mfaToken token.EncodedToken) (*token.Token, error) {
+	pending, err := s.decodeToken(mfaToken)
+	if err != nil {
+		return nil, err
+	}
+	if typ, err := pending.Type(); err != nil {
+		return nil, err
+	} else if typ != token.TokenTypeMFAPending {
+		return nil, ErrMFATokenExpected
+	}
+	u.Id, err = pending.UserID()
+	if err != nil {
+		return nil, err
+	}
+	err = s.validate(ctx, u, pending)
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// pendingJTI returns the JTI of a checked MFA token for the audit log.
+func pendingJTI(pending *token.Token) string {
+	jti, err := pending.JTI()
+	if err != nil {
+		return ""
+	}
+	return jti.String()
+}
+
+// completeMFA uses up pending and issues tokens with its methods and
+// method.
+func (s *AuthService) completeMFA(ctx context.Context, u user.User, pending *token.Token, method string) (TokenPair, error) {
+	err := s.revokeAccessToken(ctx, pending)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	amr, err := pending.AMR()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	pair, err := s.generateTokens(ctx, u, grant{amr: append(slices.Clone(amr), method, amrMFA)})
+	if err != nil {
+		return TokenPair{}, err
+	}
+	s.resetLockout(ctx, u.Id)
+	return pair, nil
+}
+
+// VerifyMFA completes a login with the MFA token returned by Login and a
+// TOTP or recovery code, and issues tokens. The MFA token can be used
+// until a code is accepted. Wrong codes count towards the lockout of the
+// user like wrong passwords.
+func (s *AuthService) VerifyMFA(ctx context.Context, u user.User, mfaToken token.EncodedToken, code string) (_ TokenPair, err error) {
+	ctx, span := startSpan(ctx, "AuthService.VerifyMFA", &u)
+	defer func() { endSpan(span, err) }()
+	if s.totp == nil {
+		return TokenPair{}, errNoTOTP
+	}
+	entry := newEntry(audit.EventMFAVerified, u)
+	defer func() { s.record(ctx, entry, err) }()
+
+	pending, err := s.checkMFAToken(ctx, &u, mfaToken)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	entry.UserID = u.Id
+	entry.JTI = pendingJTI(pending)
+
+	current, err := s.totp.GetTOTP(ctx, u.Id)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if !current.Active {
+		return TokenPair{}, ErrTOTPNotEnrolled
+	}
+	keys := s.lockoutKeys(userLockoutKey(u.Id), u)
+	if err := s.checkLockout(ctx, keys); err != nil {
+		return TokenPair{}, err
+	}
+	next, err := s.useCode(current, code)
+	if err != nil {
+		if errors.Is(err, ErrInvalidMFACode) {
+			s.failLockout(ctx, keys, u, amrOTP)
+		}
+		return TokenPair{}, err
+	}
+	err = s.totp.PutTOTP(ctx, next)
+	if errors.Is(err, ErrTOTPConflict) {
+		// a concurrent request used the same code
+		return TokenPair{}, ErrInvalidMFACode
+	}
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return s.completeMFA(ctx, u, pending, amrOTP)
+}
+
+// useCode returns current updated to reject code from now on, or
+// ErrInvalidMFACode if it is neither a TOTP code of a step after the last
+// one used nor an unused recovery code.
+func (s *AuthService) useCode(current *TOTP, code string) (*TOTP, error) {
+	next := *current
+	next.Version++
+
+	step, ok, err := totp.Validate(current.Secret, code, time.Now(), *s.totpOptions.Skew)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if step <= current.LastStep {
+			return nil, ErrInvalidMFACode
+		}
+		next.LastStep = step
+		return &next, nil
+	}
+
+	i := slices.Index(current.RecoveryCodes, totp.HashRecoveryCode(code))
+	if i < 0 {
+		return nil, ErrInvalidMFACode
+	}
+	next.RecoveryCodes = slices.Delete(slices.Clone(current.RecoveryCodes), i, i+1)
+	return &next, nil
+}
+
+// authenticate validates access for u and returns its user.
+func (s *AuthService) authenticate(ctx context.Context, u user.User, access token.EncodedToken) (uuid.UUID, error) {
+	decoded, err := s.decodeToken(access)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if isClientToken(decoded) {
+		return uuid.Nil, ErrUserTokenExpected
+	}
+	id, err := decoded.UserID()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	u.Id = id
+	err = s.Validate(ctx, &u, decoded)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return id, nil
+}
@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"medods-auth/service/audit"
+	"medods-auth/service/events"
+	"medods-auth/token"
+	"medods-auth/user"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Scopes of OpenID Connect. openid asks for ID tokens, profile and email
+// for claims of the user from UserInfo.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// OpenIDScopes may be granted to clients whenever OpenID Connect is
+// enabled.
+var OpenIDScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail}
+
+// Values of the acr claim of ID tokens. Sessions started with a second
+// factor are ACRMultiFactor.
+const (
+	ACRSingleFactor = "1"
+	ACRMultiFactor  = "2"
+)
+
+// UserInfo holds the claims about a user released to a client, as in
+// OpenID Connect Core section 5.3. Login is only set with the profile
+// scope, Email with the email scope and a login that is an email.
+type UserInfo struct {
+	Subject uuid.UUID
+	Login   string
+	Email   string
+}
+
+var errNoOpenID = errors.New("openid connect is not enabled")
+
+// grantedTokens adds an ID token to pair when scope has openid. nonce is
+// that of the authorization request, if any.
+func (s *AuthService) grantedTokens(pair TokenPair, scope, nonce string) (GrantedTokens, error) {
+	granted := GrantedTokens{TokenPair: pair, Scope: scope}
+	if s.oauth.Issuer == "" || !slices.Contains(strings.Fields(scope), ScopeOpenID) {
+		return granted, nil
+	}
+	access, err := s.decodeToken(*pair.Access)
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	claims, err := access.GetClaims()
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	userID, err := access.UserID()
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	authTime, err := access.SessionStart()
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	// expiring with the access token it comes with
+	idToken, err := s.oauth.SigningKey.Sign(s.generator.Generate(token.Options{
+		User:            user.User{Id: userID},
+		TTL:             time.Until(pair.AccessExpiresAt),
+		Type:            token.TokenTypeID,
+		SessionStart:    authTime,
+		AMR:             claims.AMR,
+		Issuer:          s.oauth.Issuer,
+		Audience:        claims.ClientID,
+		Nonce:           nonce,
+		ACR:             acr(claims.AMR),
+		AccessTokenHash: accessTokenHash(*pair.Access),
+	}))
+	if err != nil {
+		return GrantedTokens{}, err
+	}
+	granted.IDToken = token.EncodedToken(idToken)
+	return granted, nil
+}
+
+func acr(amr []string) string {
+	if slices.Contains(amr, amrMFA) {
+		return ACRMultiFactor
+	}
+	return ACRSingleFactor
+}
+
+// accessTokenHash returns the at_hash of OpenID Connect Core section
+// 3.1.3.6, the left half of the SHA-256 of access since ID tokens are
+// ES256.
+func accessTokenHash(access token.EncodedToken) string {
+	sum := sha256.Sum256([]byte(access))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
+
+// UserInfo returns the claims about the user of access, an access token
+// issued to a client granted the openid scope, as the UserInfo endpoint
+// of OpenID Connect does.
+func (s *AuthService) UserInfo(ctx context.Context, access token.EncodedToken) (_ *UserInfo, err error) {
+	ctx, span := startSpan(ctx, "AuthService.UserInfo", nil)
+	defer func() { endSpan(span, err) }()
+	if s.clients == nil || s.oauth.Issuer == "" {
+		return nil, errNoOpenID
+	}
+
+	decoded, err := s.decodeToken(access)
+	if err != nil {
+		return nil, err
+	}
+	err = s.Validate(ctx, nil, decoded)
+	if err != nil {
+		return nil, err
+	}
+	if isClientToken(decoded) {
+		return nil, ErrUserTokenExpected
+	}
+	claims, err := decoded.GetClaims()
+	if err != nil {
+		return nil, err
+	}
+	// tokens with the openid scope all have their type
+	if claims.TokenType != token.TokenTypeAccess {
+		return nil, ErrAccessTokenExpected
+	}
+	scopes := strings.Fields(claims.Scope)
+	if claims.ClientID == "" || !slices.Contains(scopes, ScopeOpenID) {
+		return nil, ErrInsufficientScope
+	}
+	userID, err := decoded.UserID()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &UserInfo{Subject: userID}
+	profile, email := slices.Contains(scopes, ScopeProfile), slices.Contains(scopes, ScopeEmail)
+	if s.credentials == nil || !profile && !email {
+		return info, nil
+	}
+	cred, err := s.credentials.GetUserCredential(ctx, userID)
+	if errors.Is(err, ErrCredentialNotFound) {
+		return info, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if profile {
+		info.Login = cred.Login
+	}
+	if email && isEmail(cred.Login) {
+		info.Email = cred.Login
+	}
+	return info, nil
+}
+
+func isEmail(login string) bool {
+	addr, err := mail.ParseAddress(login)
+	return err == nil && addr.Address == login
+}
+
+// EndSession signs out the user of idTokenHint, an ID token issued by the
+// service that may have expired, as in OpenID Connect RP-Initiated Logout.
+// The sessions of the user granted to the client the hint was issued to are
+// revoked, the others are left alone. A new ID token comes with every
+// refresh, so a hint issued longer than the refresh token TTL ago belongs
+// to no live session and is rejected with ErrTokenExpired, lest a leaked
+// one sign the user out at will. postLogoutRedirectURI, if
+// set, must be registered for the client the hint was issued to, or
+// ErrInvalidRedirectURI is returned and nothing is revoked. u carries the
+// request's User-Agent and IP.
+func (s *AuthService) EndSession(ctx context.Context, u user.User, idTokenHint token.EncodedToken, postLogoutRedirectURI string) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.EndSession", nil)
+	defer func() { endSpan(span, err) }()
+	if s.clients == nil || s.oauth.Issuer == "" {
+		return errNoOpenID
+	}
+	entry := newEntry(audit.EventLogout, u)
+	defer func() { s.record(ctx, entry, err) }()
+
+	if idTokenHint == "" {
+		return ErrIDTokenExpected
+	}
+	decoded, err := s.oauth.SigningKey.Verify(idTokenHint.String())
+	if err != nil && !errors.Is(err, jwt.ErrTokenExpired) {
+		return err
+	}
+	claims, err := decoded.GetClaims()
+	if err != nil {
+		return err
+	}
+	if claims.TokenType != token.TokenTypeID || len(claims.Audience) != 1 {
+		return ErrIDTokenExpected
+	}
+	if claims.IssuedAt == nil || time.Since(claims.IssuedAt.Time) > s.refreshTTL {
+		return ErrTokenExpired
+	}
+	u.Id, err = decoded.UserID()
+	if err != nil {
+		return err
+	}
+	entry.UserID = u.Id
+	entry.ClientID = claims.Audience[0]
+	entry.JTI = claims.ID
+
+	if postLogoutRedirectURI != "" {
+		client, err := s.clients.GetClient(ctx, entry.ClientID)
+		if errors.Is(err, ErrClientNotFound) {
+			return ErrInvalidRedirectURI
+		}
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(client.PostLogoutRedirectURIs, postLogoutRedirectURI) {
+			return ErrInvalidRedirectURI
+		}
+	}
+	revoked := events.SessionRevoked{
+		UserID: u.Id,
+		Reason: events.ReasonLogout,
+		At:     time.Now(),
+	}
+	err = s.deleteClientSessions(ctx, u.Id, entry.ClientID, revoked)
+	if err != nil {
+		return err
+	}
+	s.publish(ctx, revoked)
+	return nil
+}
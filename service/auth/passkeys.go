@@ -0,0 +1,317 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"medods-auth/logging"
+	"medods-auth/service/audit"
+	"medods-auth/service/webauthn"
+	"medods-auth/token"
+	"medods-auth/user"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Passkey is a WebAuthn credential registered by a user.
+type Passkey struct {
+	ID     []byte
+	UserID uuid.UUID
+	// PublicKey is COSE encoded.
+	PublicKey  []byte
+	SignCount  uint32
+	Transports []string
+	CreatedAt  time.Time
+}
+
+type Ceremony string
+
+const (
+	CeremonyRegistration Ceremony = "registration"
+	// CeremonyLogin authenticates with a passkey alone, UserID is nil.
+	CeremonyLogin Ceremony = "login"
+	// CeremonyMFA authenticates with a passkey after a password.
+	CeremonyMFA Ceremony = "mfa"
+)
+
+// Challenge is the pending state of a WebAuthn ceremony.
+type Challenge struct {
+	// Value is the random challenge the authenticator signs, it also
+	// identifies the ceremony.
+	Value     []byte
+	UserID    uuid.UUID
+	Ceremony  Ceremony
+	ExpiresAt time.Time
+}
+
+// PasskeyRepository may be implemented by a UserRepository to store
+// passkeys and the challenges of their ceremonies. Deleting a user
+// deletes their passkeys.
+type PasskeyRepository interface {
+	// AddPasskey fails with ErrPasskeyExists if the ID is taken and with
+	// ErrUserNotFound.
+	AddPasskey(context.Context, *Passkey) error
+	// GetPasskey fails with ErrPasskeyNotFound.
+	GetPasskey(ctx context.Context, id []byte) (*Passkey, error)
+	ListPasskeys(ctx context.Context, userID uuid.UUID) ([]Passkey, error)
+	// UpdateSignCount sets the counter of a passkey only if it is still
+	// old, and fails with ErrPasskeySignCount otherwise.
+	UpdateSignCount(ctx context.Context, id []byte, old, new uint32) error
+
+	// PutChallenge stores c until c.ExpiresAt.
+	PutChallenge(ctx context.Context, c *Challenge) error
+	// TakeChallenge deletes and returns a challenge, so that each is used
+	// once. It fails with ErrChallengeNotFound if it is unknown or expired.
+	TakeChallenge(ctx context.Context, value []byte) (*Challenge, error)
+}
+
+var errNoPasskeys = errors.New("passkeys are not enabled")
+
+// BeginPasskeyRegistration returns the options to create a passkey for the
+// user of access with.
+func (s *AuthService) BeginPasskeyRegistration(ctx context.Context, u user.User, access token.EncodedToken) (_ *webauthn.CreationOptions, err error) {
+	ctx, span := startSpan(ctx, "AuthService.BeginPasskeyRegistration", &u)
+	defer func() { endSpan(span, err) }()
+	if s.passkeys == nil {
+		return nil, errNoPasskeys
+	}
+
+	u.Id, err = s.authenticate(ctx, u, access)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := s.passkeys.ListPasskeys(ctx, u.Id)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := s.newChallenge(ctx, u.Id, CeremonyRegistration)
+	if err != nil {
+		return nil, err
+	}
+	opts := s.webauthn.CreationOptions(challenge, webauthn.UserEntity{
+		ID:          u.Id[:],
+		Name:        u.Id.String(),
+		DisplayName: u.Id.String(),
+	}, descriptors(existing))
+	return &opts, nil
+}
+
+// FinishPasskeyRegistration verifies the response to the options of
+// BeginPasskeyRegistration and stores the passkey.
+func (s *AuthService) FinishPasskeyRegistration(ctx context.Context, u user.User, access token.EncodedToken, resp webauthn.RegistrationResponse) (_ *Passkey, err error) {
+	ctx, span := startSpan(ctx, "AuthService.FinishPasskeyRegistration", &u)
+	defer func() { endSpan(span, err) }()
+	if s.passkeys == nil {
+		return nil, errNoPasskeys
+	}
+	entry := newEntry(audit.EventPasskeyAdded, u)
+	defer func() { s.record(ctx, entry, err) }()
+
+	u.Id, err = s.authenticate(ctx, u, access)
+	if err != nil {
+		return nil, err
+	}
+	entry.UserID = u.Id
+
+	challenge, err := s.takeChallenge(ctx, resp.Response.ClientDataJSON, CeremonyRegistration)
+	if err != nil {
+		return nil, err
+	}
+	if challenge.UserID != u.Id {
+		return nil, ErrChallengeNotFound
+	}
+	reg, err := s.webauthn.VerifyRegistration(challenge.Value, resp, false)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPasskey, err)
+	}
+	passkey := &Passkey{
+		ID:         reg.CredentialID,
+		UserID:     u.Id,
+		PublicKey:  reg.PublicKey,
+		SignCount:  reg.SignCount,
+		Transports: reg.Transports,
+		CreatedAt:  time.Now().UTC().Truncate(time.Microsecond),
+	}
+	err = s.passkeys.AddPasskey(ctx, passkey)
+	if err != nil {
+		return nil, err
+	}
+	return passkey, nil
+}
+
+// BeginPasskeyLogin returns the options to log in with any discoverable
+// passkey.
+func (s *AuthService) BeginPasskeyLogin(ctx context.Context) (_ *webauthn.RequestOptions, err error) {
+	ctx, span := startSpan(ctx, "AuthService.BeginPasskeyLogin", nil)
+	defer func() { endSpan(span, err) }()
+	if s.passkeys == nil {
+		return nil, errNoPasskeys
+	}
+
+	challenge, err := s.newChallenge(ctx, uuid.Nil, CeremonyLogin)
+	if err != nil {
+		return nil, err
+	}
+	opts := s.webauthn.RequestOptions(challenge, nil, webauthn.VerificationRequired)
+	return &opts, nil
+}
+
+// FinishPasskeyLogin verifies the response to the options of
+// BeginPasskeyLogin and issues tokens for the owner of the passkey. The
+// passkey must verify the user, so it stands in for both factors.
+func (s *AuthService) FinishPasskeyLogin(ctx context.Context, u user.User, resp webauthn.AssertionResponse) (_ TokenPair, err error) {
+	ctx, span := startSpan(ctx, "AuthService.FinishPasskeyLogin", nil)
+	defer func() { endSpan(span, err) }()
+	if s.passkeys == nil {
+		return TokenPair{}, errNoPasskeys
+	}
+	entry := newEntry(audit.EventPasskeyLogin, u)
+	defer func() { s.record(ctx, entry, err) }()
+
+	challenge, err := s.takeChallenge(ctx, resp.Response.ClientDataJSON, CeremonyLogin)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	passkey, err := s.verifyPasskey(ctx, challenge, resp, true)
+	if err != nil {
+		if passkey != nil {
+			entry.UserID = passkey.UserID
+		}
+		return TokenPair{}, err
+	}
+	u.Id = passkey.UserID
+	entry.UserID = passkey.UserID
+	return s.generateTokens(ctx, u, grant{amr: []string{amrHardware}})
+}
+
+// BeginPasskeyMFA returns the options to complete a login with one of the
+// passkeys of the user of the MFA token returned by Login.
+func (s *AuthService) BeginPasskeyMFA(ctx context.Context, u user.User, mfaToken token.EncodedToken) (_ *webauthn.RequestOptions, err error) {
+	ctx, span := startSpan(ctx, "AuthService.BeginPasskeyMFA", &u)
+	defer func() { endSpan(span, err) }()
+	if s.passkeys == nil {
+		return nil, errNoPasskeys
+	}
+
+	_, err = s.checkMFAToken(ctx, &u, mfaToken)
+	if err != nil {
+		return nil, err
+	}
+	passkeys, err := s.passkeys.ListPasskeys(ctx, u.Id)
+	if err != nil {
+		return nil, err
+	}
+	if len(passkeys) == 0 {
+		return nil, ErrPasskeyNotFound
+	}
+	challenge, err := s.newChallenge(ctx, u.Id, CeremonyMFA)
+	if err != nil {
+		return nil, err
+	}
+	opts := s.webauthn.RequestOptions(challenge, descriptors(passkeys), webauthn.VerificationPreferred)
+	return &opts, nil
+}
+
+// FinishPasskeyMFA verifies the response to the options of
+// BeginPasskeyMFA and issues tokens like VerifyMFA.
+func (s *AuthService) FinishPasskeyMFA(ctx context.Context, u user.User, mfaToken token.EncodedToken, resp webauthn.AssertionResponse) (_ TokenPair, err error) {
+	ctx, span := startSpan(ctx, "AuthService.FinishPasskeyMFA", &u)
+	defer func() { endSpan(span, err) }()
+	if s.passkeys == nil {
+		return TokenPair{}, errNoPasskeys
+	}
+	entry := newEntry(audit.EventMFAVerified, u)
+	defer func() { s.record(ctx, entry, err) }()
+
+	pending, err := s.checkMFAToken(ctx, &u, mfaToken)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	entry.UserID = u.Id
+	entry.JTI = pendingJTI(pending)
+
+	challenge, err := s.takeChallenge(ctx, resp.Response.ClientDataJSON, CeremonyMFA)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if challenge.UserID != u.Id {
+		return TokenPair{}, ErrChallengeNotFound
+	}
+	_, err = s.verifyPasskey(ctx, challenge, resp, false)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return s.completeMFA(ctx, u, pending, amrHardware)
+}
+
+func (s *AuthService) newChallenge(ctx context.Context, userID uuid.UUID, ceremony Ceremony) ([]byte, error) {
+	c := &Challenge{
+		Value:     webauthn.NewChallenge(),
+		UserID:    userID,
+		Ceremony:  ceremony,
+		ExpiresAt: time.Now().Add(s.webauthn.Timeout),
+	}
+	err := s.passkeys.PutChallenge(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return c.Value, nil
+}
+
+// takeChallenge uses up the challenge clientDataJSON answers.
+func (s *AuthService) takeChallenge(ctx context.Context, clientDataJSON []byte, ceremony Ceremony) (*Challenge, error) {
+	value, err := webauthn.ResponseChallenge(clientDataJSON)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPasskey, err)
+	}
+	c, err := s.passkeys.TakeChallenge(ctx, value)
+	if err != nil {
+		return nil, err
+	}
+	if c.Ceremony != ceremony || !time.Now().Before(c.ExpiresAt) {
+		return nil, ErrChallengeNotFound
+	}
+	return c, nil
+}
+
+// verifyPasskey checks an assertion for challenge and advances the sign
+// count of the passkey used. A passkey is returned along with errors
+// once it is known.
+func (s *AuthService) verifyPasskey(ctx context.Context, challenge *Challenge, resp webauthn.AssertionResponse, requireUV bool) (*Passkey, error) {
+	passkey, err := s.passkeys.GetPasskey(ctx, resp.RawID)
+	if err != nil {
+		return nil, err
+	}
+	if challenge.UserID != uuid.Nil && passkey.UserID != challenge.UserID {
+		return passkey, ErrPasskeyNotFound
+	}
+	if len(resp.Response.UserHandle) > 0 && !bytes.Equal(resp.Response.UserHandle, passkey.UserID[:]) {
+		return passkey, fmt.Errorf("%w: user handle mismatch", ErrInvalidPasskey)
+	}
+	assertion, err := s.webauthn.VerifyAssertion(challenge.Value, passkey.PublicKey, resp, requireUV)
+	if err != nil {
+		return passkey, fmt.Errorf("%w: %w", ErrInvalidPasskey, err)
+	}
+	if webauthn.CheckSignCount(passkey.SignCount, assertion.SignCount) != nil {
+		logging.For("auth").WarnContext(ctx, "passkey sign count regressed, it may be cloned",
+			"user_id", passkey.UserID, "stored", passkey.SignCount, "received", assertion.SignCount)
+		return passkey, ErrPasskeySignCount
+	}
+	if assertion.SignCount != passkey.SignCount {
+		err = s.passkeys.UpdateSignCount(ctx, passkey.ID, passkey.SignCount, assertion.SignCount)
+		if err != nil {
+			return passkey, err
+		}
+	}
+	return passkey, nil
+}
+
+func descriptors(passkeys []Passkey) []webauthn.CredentialDescriptor {
+	ds := make([]webauthn.CredentialDescriptor, len(passkeys))
+	for i, p := range passkeys {
+		ds[i] = webauthn.CredentialDescriptor{Type: "public-key", ID: p.ID, Transports: p.Transports}
+	}
+	return ds
+}
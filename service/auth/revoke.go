@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"medods-auth/service/audit"
+	"medods-auth/service/events"
+	"medods-auth/token"
+	"medods-auth/user"
+	"time"
+)
+
+// RevokeToken authenticates a client and revokes t, a token issued to it,
+// as in RFC 7009. Access tokens are blacklisted. Refresh tokens are
+// blacklisted too and their record dropped, ending that session alone;
+// access tokens already issued in it stay valid until they expire.
+// Tokens that are invalid already, and ID tokens, are ignored. u carries
+// the request's User-Agent and IP.
+func (s *AuthService) RevokeToken(ctx context.Context, id, secret string, t token.EncodedToken, u user.User) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.RevokeToken", nil)
+	defer func() { endSpan(span, err) }()
+	if s.clients == nil {
+		return errNoClients
+	}
+
+	client, err := s.authenticateClient(ctx, id, secret)
+	if err != nil {
+		return err
+	}
+	decoded, err := s.decodeToken(t)
+	if err != nil {
+		return nil
+	}
+	claims, err := decoded.GetClaims()
+	if err != nil {
+		return err
+	}
+	if claims.TokenType == token.TokenTypeID {
+		// expire on their own, and are no use as bearer tokens
+		return nil
+	}
+	if claims.ClientID != client.ID {
+		return ErrUnauthorizedClient
+	}
+	err = s.validate(ctx, nil, decoded)
+	if err != nil {
+		if ErrorCode(err) != CodeInternal {
+			// expired or revoked already
+			return nil
+		}
+		return err
+	}
+
+	jti, err := decoded.JTI()
+	if err != nil {
+		return err
+	}
+	if !isClientToken(decoded) {
+		u.Id, err = decoded.UserID()
+		if err != nil {
+			return err
+		}
+	}
+	entry := newEntry(audit.EventTokenRevoked, u)
+	entry.ClientID = client.ID
+	entry.JTI = jti.String()
+	defer func() { s.record(ctx, entry, err) }()
+
+	err = s.revokeAccessToken(ctx, decoded)
+	if err != nil {
+		return err
+	}
+	record, err := s.refreshRecord(ctx, decoded)
+	// already revoked or rotated, there's no session left to end
+	if errors.Is(err, ErrRefreshTokenNotFound) || record == nil && err == nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	revoked := events.SessionRevoked{
+		UserID: u.Id,
+		JTI:    jti,
+		Reason: events.ReasonClientRevoked,
+		At:     time.Now(),
+	}
+	err = s.deleteSession(ctx, jti, revoked)
+	if errors.Is(err, ErrRefreshTokenNotFound) {
+		// lost the race with a concurrent revocation
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.publish(ctx, revoked)
+	return nil
+}
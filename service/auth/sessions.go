@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"context"
+	"medods-auth/logging"
+	"medods-auth/service/audit"
+	"medods-auth/service/events"
+	"medods-auth/service/outbox"
+	"slices"
+	"time"
+)
+
+type SessionPolicy string
+
+const (
+	// RejectNewSession fails GenerateTokens with ErrTooManySessions.
+	RejectNewSession SessionPolicy = "reject"
+	// EvictOldest drops the sessions started first.
+	EvictOldest SessionPolicy = "evict_oldest"
+	// EvictLeastRecentlyUsed drops the sessions refreshed least recently.
+	EvictLeastRecentlyUsed SessionPolicy = "evict_lru"
+)
+
+// SessionLimit caps the live refresh records of a user, zero Max meaning
+// no cap.
+type SessionLimit struct {
+	Max    int
+	Policy SessionPolicy
+}
+
+// Evict returns the sessions to drop so that one more fits under l, or
+// ErrTooManySessions if l rejects it. sessions must be live records of
+// one user. Repositories implementing SessionLimiter share it.
+func (l SessionLimit) Evict(sessions []RefreshTokenRecord) ([]RefreshTokenRecord, error) {
+	excess := len(sessions) + 1 - l.Max
+	if l.Max <= 0 || excess <= 0 {
+		return nil, nil
+	}
+	if l.Policy != EvictOldest && l.Policy != EvictLeastRecentlyUsed {
+		return nil, ErrTooManySessions
+	}
+
+	sorted := slices.Clone(sessions)
+	slices.SortFunc(sorted, func(a, b RefreshTokenRecord) int {
+		if l.Policy == EvictOldest {
+			if c := a.SessionStart().Compare(b.SessionStart()); c != 0 {
+				return c
+			}
+		}
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return sorted[:excess], nil
+}
+
+// NewSession is a refresh record stored by GenerateTokens under Limit.
+type NewSession struct {
+	Record *RefreshTokenRecord
+	Limit  SessionLimit
+
+	// Outbox and EvictionOutbox are only set for repositories implementing
+	// OutboxWriter. EvictionOutbox returns the messages for the evicted
+	// records, to be committed along with Outbox.
+	Outbox         []outbox.Message
+	EvictionOutbox func(evicted []RefreshTokenRecord) ([]outbox.Message, error)
+}
+
+// SessionLimiter may be implemented by a TokenHashRepository to evict
+// sessions over a limit and store a new one atomically, so that
+// concurrent logins can't exceed it.
+type SessionLimiter interface {
+	StoreSession(context.Context, NewSession) (evicted []RefreshTokenRecord, err error)
+}
+
+// storeSession is store under the session limit. Evicted sessions are
+// audited and published once the new one is stored, and their refresh
+// tokens blacklisted so that using one isn't mistaken for reuse of a
+// rotated token. Their access tokens stay valid until they expire.
+func (s *AuthService) storeSession(ctx context.Context, rec *RefreshTokenRecord, issued events.Event) error {
+	if s.sessionLimit.Max <= 0 {
+		return s.store(ctx, rec, issued)
+	}
+
+	ns := NewSession{Record: rec, Limit: s.sessionLimit}
+	if s.outbox != nil {
+		msgs, err := s.outboxMessages(issued)
+		if err != nil {
+			return err
+		}
+		ns.Outbox = msgs
+		ns.EvictionOutbox = func(evicted []RefreshTokenRecord) ([]outbox.Message, error) {
+			return s.outboxMessages(evictionEvents(evicted)...)
+		}
+	}
+	evicted, err := s.sessions.StoreSession(ctx, ns)
+	if err != nil {
+		return err
+	}
+
+	for i, e := range evictionEvents(evicted) {
+		err = s.blacklist.Add(ctx, evicted[i].JTI, evicted[i].ExpiresAt)
+		if err != nil {
+			logging.For("auth").ErrorContext(ctx, "failed to blacklist evicted session",
+				"jti", evicted[i].JTI, "error", err)
+		}
+		entry := newEntry(audit.EventSessionEvicted, rec.User)
+		entry.JTI = evicted[i].JTI.String()
+		entry.IssuedJTI = rec.JTI.String()
+		s.record(ctx, entry, nil)
+		s.publish(ctx, e)
+	}
+	return nil
+}
+
+func evictionEvents(evicted []RefreshTokenRecord) []events.Event {
+	out := make([]events.Event, len(evicted))
+	now := time.Now()
+	for i, rec := range evicted {
+		out[i] = events.SessionRevoked{
+			UserID: rec.User.Id,
+			JTI:    rec.JTI,
+			Reason: events.ReasonSessionLimit,
+			At:     now,
+		}
+	}
+	return out
+}
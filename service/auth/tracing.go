@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"medods-auth/user"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("medods-auth/service/auth")
+
+const (
+	attrOperation  = attribute.Key("auth.operation")
+	attrUserIDHash = attribute.Key("auth.user_id_hash")
+	attrErrorCode  = attribute.Key("auth.error_code")
+)
+
+func startSpan(ctx context.Context, name string, u *user.User) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, name)
+	span.SetAttributes(attrOperation.String(name))
+	if u != nil {
+		span.SetAttributes(attrUserIDHash.String(HashUserID(u)))
+	}
+	return ctx, span
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetAttributes(attrErrorCode.String(ErrorCode(err)))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, ErrorCode(err))
+	}
+	span.End()
+}
+
+// HashUserID returns a stable pseudonym of the user id for telemetry.
+func HashUserID(u *user.User) string {
+	sum := sha256.Sum256(u.Id[:])
+	return hex.EncodeToString(sum[:8])
+}
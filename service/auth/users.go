@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"medods-auth/service/audit"
+	"medods-auth/service/events"
+	"medods-auth/user"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	errNoUsers       = errors.New("no user repository")
+	errNoCredentials = errors.New("no credential repository")
+)
+
+type UserRepository interface {
+	// Create fails with ErrUserExists if the ID is taken.
+	Create(context.Context, *user.Account) error
+	Get(context.Context, uuid.UUID) (*user.Account, error)
+	SetStatus(context.Context, uuid.UUID, user.Status) error
+	Delete(context.Context, uuid.UUID) error
+}
+
+// checkUser refuses users missing from the directory or not active.
+func (s *AuthService) checkUser(ctx context.Context, id uuid.UUID) error {
+	if s.users == nil {
+		return nil
+	}
+	account, err := s.users.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	switch account.Status {
+	case user.StatusActive:
+		return nil
+	case user.StatusLocked:
+		return ErrUserLocked
+	default:
+		return ErrUserDisabled
+	}
+}
+
+// CreateUser registers an active user, with a random ID if id is nil.
+func (s *AuthService) CreateUser(ctx context.Context, id uuid.UUID) (_ *user.Account, err error) {
+	if id == uuid.Nil {
+		id = uuid.New()
+	}
+	ctx, span := startSpan(ctx, "AuthService.CreateUser", &user.User{Id: id})
+	defer func() { endSpan(span, err) }()
+	if s.users == nil {
+		return nil, errNoUsers
+	}
+	entry := newEntry(audit.EventUserCreated, user.User{Id: id})
+	defer func() { s.record(ctx, entry, err) }()
+
+	account := &user.Account{
+		Id:        id,
+		Status:    user.StatusActive,
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+	err = s.users.Create(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (s *AuthService) GetUser(ctx context.Context, id uuid.UUID) (_ *user.Account, err error) {
+	ctx, span := startSpan(ctx, "AuthService.GetUser", &user.User{Id: id})
+	defer func() { endSpan(span, err) }()
+	if s.users == nil {
+		return nil, errNoUsers
+	}
+
+	return s.users.Get(ctx, id)
+}
+
+// DisableUser refuses the user new tokens and revokes their sessions.
+// Access tokens already issued are refused from then on, as Validate checks
+// the user.
+func (s *AuthService) DisableUser(ctx context.Context, id uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.DisableUser", &user.User{Id: id})
+	defer func() { endSpan(span, err) }()
+	if s.users == nil {
+		return errNoUsers
+	}
+	entry := newEntry(audit.EventUserDisabled, user.User{Id: id})
+	defer func() { s.record(ctx, entry, err) }()
+
+	err = s.users.SetStatus(ctx, id, user.StatusDisabled)
+	if err != nil {
+		return err
+	}
+	return s.revokeUserSessions(ctx, id, events.ReasonUserDisabled)
+}
+
+func (s *AuthService) EnableUser(ctx context.Context, id uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.EnableUser", &user.User{Id: id})
+	defer func() { endSpan(span, err) }()
+	if s.users == nil {
+		return errNoUsers
+	}
+	entry := newEntry(audit.EventUserEnabled, user.User{Id: id})
+	defer func() { s.record(ctx, entry, err) }()
+
+	return s.users.SetStatus(ctx, id, user.StatusActive)
+}
+
+// DeleteUser removes the user and revokes their sessions.
+func (s *AuthService) DeleteUser(ctx context.Context, id uuid.UUID) (err error) {
+	ctx, span := startSpan(ctx, "AuthService.DeleteUser", &user.User{Id: id})
+	defer func() { endSpan(span, err) }()
+	if s.users == nil {
+		return errNoUsers
+	}
+	entry := newEntry(audit.EventUserDeleted, user.User{Id: id})
+	defer func() { s.record(ctx, entry, err) }()
+
+	err = s.users.Delete(ctx, id)
+	if err != nil {
+		return err
+	}
+	return s.revokeUserSessions(ctx, id, events.ReasonUserDeleted)
+}
+
+func (s *AuthService) revokeUserSessions(ctx context.Context, id uuid.UUID, reason string) error {
+	revoked := events.SessionRevoked{
+		UserID: id,
+		Reason: reason,
+		At:     time.Now(),
+	}
+	err := s.deleteSessions(ctx, id, revoked)
+	if err != nil {
+		return err
+	}
+	s.publish(ctx, revoked)
+	return nil
+}
@@ -0,0 +1,161 @@
+package events
+
+import (
+	"context"
+	"medods-auth/logging"
+	"sync"
+	"sync/atomic"
+)
+
+type subscribers struct {
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+func (s *subscribers) Subscribe(h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers = append(s.handlers, h)
+}
+
+// dispatch calls every handler, a panicking handler does not affect the others.
+func (s *subscribers) dispatch(ctx context.Context, e Event) {
+	s.mu.RLock()
+	handlers := s.handlers
+	s.mu.RUnlock()
+
+	for _, h := range handlers {
+		call(ctx, h, e)
+	}
+}
+
+func call(ctx context.Context, h Handler, e Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			logging.For("events").ErrorContext(ctx, "event handler panicked",
+				"event", e.EventName(), "panic", r)
+		}
+	}()
+	h(ctx, e)
+}
+
+// SyncDispatcher calls subscribers in the publishing goroutine.
+type SyncDispatcher struct {
+	subscribers
+}
+
+func NewSyncDispatcher() *SyncDispatcher {
+	return &SyncDispatcher{}
+}
+
+func (d *SyncDispatcher) Publish(ctx context.Context, e Event) {
+	d.dispatch(ctx, e)
+}
+
+type OverflowPolicy int
+
+const (
+	// Drop discards events published while the queue is full.
+	Drop OverflowPolicy = iota
+	// Block waits for space in the queue or for the publishing context to end.
+	Block
+)
+
+type AsyncOptions struct {
+	QueueSize int
+	Workers   int
+	Overflow  OverflowPolicy
+}
+
+type envelope struct {
+	ctx   context.Context
+	event Event
+}
+
+// AsyncDispatcher calls subscribers from a pool of workers fed by a
+// bounded queue.
+type AsyncDispatcher struct {
+	subscribers
+
+	overflow OverflowPolicy
+	queue    chan envelope
+	wg       sync.WaitGroup
+	dropped  atomic.Int64
+
+	closeMu sync.RWMutex
+	closed  bool
+}
+
+func NewAsyncDispatcher(opts AsyncOptions) *AsyncDispatcher {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1024
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	d := &AsyncDispatcher{
+		overflow: opts.Overflow,
+		queue:    make(chan envelope, opts.QueueSize),
+	}
+	d.wg.Add(opts.Workers)
+	for range opts.Workers {
+		go d.work()
+	}
+	return d
+}
+
+func (d *AsyncDispatcher) work() {
+	defer d.wg.Done()
+	for env := range d.queue {
+		d.dispatch(env.ctx, env.event)
+	}
+}
+
+// Publish enqueues e. Handlers get ctx without its cancellation, since
+// they usually run after the request has finished.
+func (d *AsyncDispatcher) Publish(ctx context.Context, e Event) {
+	d.closeMu.RLock()
+	defer d.closeMu.RUnlock()
+	if d.closed {
+		d.drop(ctx, e)
+		return
+	}
+
+	env := envelope{context.WithoutCancel(ctx), e}
+	if d.overflow == Block {
+		select {
+		case d.queue <- env:
+		case <-ctx.Done():
+			d.drop(ctx, e)
+		}
+		return
+	}
+	select {
+	case d.queue <- env:
+	default:
+		d.drop(ctx, e)
+	}
+}
+
+func (d *AsyncDispatcher) drop(ctx context.Context, e Event) {
+	d.dropped.Add(1)
+	logging.For("events").WarnContext(ctx, "event dropped", "event", e.EventName())
+}
+
+// Dropped returns the number of events discarded so far.
+func (d *AsyncDispatcher) Dropped() int64 {
+	return d.dropped.Load()
+}
+
+// Close stops accepting events and waits for the queued ones to be handled.
+func (d *AsyncDispatcher) Close() error {
+	d.closeMu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.closeMu.Unlock()
+
+	d.wg.Wait()
+	return nil
+}
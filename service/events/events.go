@@ -0,0 +1,118 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Event interface {
+	EventName() string
+}
+
+type TokensIssued struct {
+	UserID    uuid.UUID
+	JTI       uuid.UUID
+	IP        string
+	UserAgent string
+	At        time.Time
+}
+
+type TokensRefreshed struct {
+	UserID      uuid.UUID
+	PreviousJTI uuid.UUID
+	JTI         uuid.UUID
+	IP          string
+	UserAgent   string
+	At          time.Time
+}
+
+const (
+	ReasonLogout             = "logout"
+	ReasonRefreshTokenReused = "refresh_token_reused"
+	// ReasonSessionLimit revokes only the session of JTI, evicted to make
+	// room for a new one.
+	ReasonSessionLimit = "session_limit"
+	ReasonUserDisabled = "user_disabled"
+	ReasonUserDeleted  = "user_deleted"
+	// ReasonClientRevoked is a client revoking a refresh token of the user.
+	ReasonClientRevoked = "client_revoked"
+)
+
+// SessionRevoked is published when all refresh records of a user are dropped,
+// or a single one for ReasonSessionLimit. JTI is nil when an admin revoked
+// them, for ReasonUserDisabled and ReasonUserDeleted.
+type SessionRevoked struct {
+	UserID uuid.UUID
+	JTI    uuid.UUID
+	Reason string
+	At     time.Time
+}
+
+const (
+	ActivityUserAgentMismatch = "user_agent_mismatch"
+	ActivityRefreshTokenReuse = "refresh_token_reuse"
+)
+
+type SuspiciousActivity struct {
+	UserID    uuid.UUID
+	JTI       uuid.UUID
+	Kind      string
+	IP        string
+	UserAgent string
+	At        time.Time
+}
+
+// LoginFailed is published for every wrong password or MFA code. UserID
+// is nil for unknown logins. Method is the amr value of the factor, "pwd"
+// or "otp".
+type LoginFailed struct {
+	UserID    uuid.UUID
+	Method    string
+	IP        string
+	UserAgent string
+	At        time.Time
+}
+
+const (
+	LockoutScopeAccount = "account"
+	LockoutScopeIP      = "ip"
+)
+
+// LockedOut is published when failures lock out an account or an IP until
+// Until. UserID is nil for unknown logins and for LockoutScopeIP.
+type LockedOut struct {
+	UserID    uuid.UUID
+	Scope     string
+	IP        string
+	UserAgent string
+	Until     time.Time
+	At        time.Time
+}
+
+func (TokensIssued) EventName() string       { return "tokens_issued" }
+func (TokensRefreshed) EventName() string    { return "tokens_refreshed" }
+func (SessionRevoked) EventName() string     { return "session_revoked" }
+func (SuspiciousActivity) EventName() string { return "suspicious_activity" }
+func (LoginFailed) EventName() string        { return "login_failed" }
+func (LockedOut) EventName() string          { return "locked_out" }
+
+type Publisher interface {
+	Publish(context.Context, Event)
+}
+
+type Handler func(context.Context, Event)
+
+type Subscriber interface {
+	Subscribe(Handler)
+}
+
+// On subscribes fn to events of type T only.
+func On[T Event](s Subscriber, fn func(context.Context, T)) {
+	s.Subscribe(func(ctx context.Context, e Event) {
+		if typed, ok := e.(T); ok {
+			fn(ctx, typed)
+		}
+	})
+}
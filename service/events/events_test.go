@@ -0,0 +1,104 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncDispatcher(t *testing.T) {
+	assert := assert.New(t)
+	d := NewSyncDispatcher()
+
+	var all []string
+	var issued []TokensIssued
+	d.Subscribe(func(_ context.Context, e Event) { all = append(all, e.EventName()) })
+	d.Subscribe(func(context.Context, Event) { panic("broken subscriber") })
+	On(d, func(_ context.Context, e TokensIssued) { issued = append(issued, e) })
+
+	userID := uuid.New()
+	d.Publish(context.Background(), TokensIssued{UserID: userID})
+	d.Publish(context.Background(), SessionRevoked{UserID: userID, Reason: ReasonLogout})
+
+	assert.Equal([]string{"tokens_issued", "session_revoked"}, all)
+	if assert.Len(issued, 1) {
+		assert.Equal(userID, issued[0].UserID)
+	}
+}
+
+func TestAsyncDispatcherDrop(t *testing.T) {
+	assert := assert.New(t)
+	d := NewAsyncDispatcher(AsyncOptions{QueueSize: 1, Overflow: Drop})
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	var mu sync.Mutex
+	handled := 0
+	d.Subscribe(func(context.Context, Event) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		mu.Lock()
+		handled++
+		mu.Unlock()
+	})
+
+	ctx := context.Background()
+	d.Publish(ctx, TokensIssued{})
+	<-started
+	d.Publish(ctx, TokensIssued{}) // queued
+	d.Publish(ctx, TokensIssued{}) // dropped
+	assert.Equal(int64(1), d.Dropped())
+
+	close(release)
+	assert.NoError(d.Close())
+	assert.Equal(2, handled)
+
+	d.Publish(ctx, TokensIssued{})
+	assert.Equal(int64(2), d.Dropped(), "events after Close are dropped")
+}
+
+func TestAsyncDispatcherBlock(t *testing.T) {
+	assert := assert.New(t)
+	d := NewAsyncDispatcher(AsyncOptions{QueueSize: 1, Overflow: Block})
+
+	release := make(chan struct{})
+	d.Subscribe(func(context.Context, Event) { <-release })
+
+	d.Publish(context.Background(), TokensIssued{}) // being handled
+	d.Publish(context.Background(), TokensIssued{}) // queued
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	d.Publish(ctx, TokensIssued{})
+	assert.GreaterOrEqual(time.Since(start), 20*time.Millisecond, "publish should block while the queue is full")
+	assert.Equal(int64(1), d.Dropped())
+
+	close(release)
+	assert.NoError(d.Close())
+}
+
+func TestAsyncDispatcherContext(t *testing.T) {
+	assert := assert.New(t)
+	d := NewAsyncDispatcher(AsyncOptions{})
+
+	type key struct{}
+	got := make(chan context.Context, 1)
+	d.Subscribe(func(ctx context.Context, _ Event) { got <- ctx })
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "value"))
+	d.Publish(ctx, TokensIssued{})
+	cancel()
+	assert.NoError(d.Close())
+
+	handlerCtx := <-got
+	assert.Equal("value", handlerCtx.Value(key{}))
+	assert.NoError(handlerCtx.Err(), "handlers outlive the publishing request")
+}
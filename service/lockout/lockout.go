@@ -0,0 +1,115 @@
+// Package lockout counts failed logins per key, an account or an IP, and
+// makes keys wait longer after each failure until they are locked out.
+package lockout
+
+import (
+	"context"
+	"time"
+)
+
+// Policy shapes how the failures of a key add up.
+type Policy struct {
+	// MaxFailures locks a key out for Lockout once reached.
+	MaxFailures int
+	Lockout     time.Duration
+	// Delay is the wait after a first failure, doubled for each further
+	// one up to MaxDelay.
+	Delay    time.Duration
+	MaxDelay time.Duration
+	// Decay is how long it takes to forget a failure.
+	Decay time.Duration
+}
+
+// State is the stored state of a key. A missing key has no failures.
+type State struct {
+	Failures int
+	// UpdatedAt is when the oldest of Failures started to decay.
+	UpdatedAt   time.Time
+	LockedUntil time.Time
+}
+
+// Store keeps the state of keys until it expires.
+type Store interface {
+	Get(ctx context.Context, key string) (State, error)
+	// Fail records a failure of key with State.Fail and returns the new
+	// state.
+	Fail(ctx context.Context, key string, policy Policy, now time.Time) (State, error)
+	Reset(ctx context.Context, key string) error
+}
+
+// decay forgets one failure for each Decay elapsed since UpdatedAt.
+func (s State) decay(p Policy, now time.Time) State {
+	if p.Decay <= 0 {
+		return s
+	}
+	n := int(now.Sub(s.UpdatedAt) / p.Decay)
+	switch {
+	case n <= 0:
+	case n >= s.Failures:
+		s.Failures = 0
+	default:
+		s.Failures -= n
+		s.UpdatedAt = s.UpdatedAt.Add(time.Duration(n) * p.Decay)
+	}
+	return s
+}
+
+// Fail decays s up to now and adds a failure. Backends that keep states
+// in Go share it.
+func (s State) Fail(p Policy, now time.Time) State {
+	next := s.decay(p, now)
+	if next.Failures == 0 {
+		next.UpdatedAt = now
+	}
+	next.Failures++
+	if until := now.Add(p.wait(next.Failures)); until.After(next.LockedUntil) {
+		next.LockedUntil = until
+	}
+	return next
+}
+
+// RetryAfter is how long the key must wait at now, zero if it needn't.
+func (s State) RetryAfter(now time.Time) time.Duration {
+	if !now.Before(s.LockedUntil) {
+		return 0
+	}
+	return s.LockedUntil.Sub(now)
+}
+
+// Expires returns when s equals a missing state, zero if failures are
+// never forgotten.
+func (s State) Expires(p Policy) time.Time {
+	if p.Decay <= 0 {
+		return time.Time{}
+	}
+	expires := s.UpdatedAt.Add(time.Duration(s.Failures) * p.Decay)
+	if s.LockedUntil.After(expires) {
+		expires = s.LockedUntil
+	}
+	return expires
+}
+
+// LockedOut reports whether the failure that led to s locked its key out,
+// rather than making it wait.
+func (p Policy) LockedOut(s State) bool {
+	return p.MaxFailures > 0 && s.Failures == p.MaxFailures
+}
+
+// wait returns how long a key with failures waits.
+func (p Policy) wait(failures int) time.Duration {
+	if p.MaxFailures > 0 && failures >= p.MaxFailures {
+		return p.Lockout
+	}
+	if p.Delay <= 0 || failures < 1 {
+		return 0
+	}
+	d := p.Delay
+	// 32 doublings of any sane delay outlast every sane lockout
+	for n := 1; n < failures && n <= 32 && (p.MaxDelay <= 0 || d < p.MaxDelay); n++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
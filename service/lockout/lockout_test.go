@@ -0,0 +1,59 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFail(t *testing.T) {
+	assert := assert.New(t)
+	p := Policy{MaxFailures: 4, Lockout: time.Hour, Delay: time.Second, MaxDelay: 3 * time.Second, Decay: time.Minute}
+	now := time.Now()
+
+	var s State
+	assert.Zero(s.RetryAfter(now))
+
+	s = s.Fail(p, now)
+	assert.Equal(1, s.Failures)
+	assert.Equal(time.Second, s.RetryAfter(now))
+	assert.False(p.LockedOut(s))
+
+	s = s.Fail(p, now)
+	assert.Equal(2*time.Second, s.RetryAfter(now))
+	s = s.Fail(p, now)
+	assert.Equal(3*time.Second, s.RetryAfter(now), "delays are capped")
+	assert.False(p.LockedOut(s))
+
+	s = s.Fail(p, now)
+	assert.True(p.LockedOut(s))
+	assert.Equal(time.Hour, s.RetryAfter(now))
+	assert.Zero(s.RetryAfter(now.Add(time.Hour)))
+	assert.Equal(now.Add(time.Hour), s.Expires(p))
+
+	// failures are forgotten one per Decay
+	decayed := s.Fail(p, now.Add(90*time.Second))
+	assert.Equal(4, decayed.Failures)
+	assert.Equal(now.Add(time.Minute), decayed.UpdatedAt, "the rest of a Decay is kept")
+
+	later := now.Add(time.Hour)
+	s = s.Fail(p, later)
+	assert.Equal(1, s.Failures)
+	assert.False(p.LockedOut(s))
+	assert.Equal(time.Second, s.RetryAfter(later))
+	assert.Equal(later.Add(time.Minute), s.Expires(p))
+}
+
+func TestWait(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Zero(Policy{MaxFailures: 5}.wait(3))
+	assert.Equal(time.Minute, Policy{MaxFailures: 5, Lockout: time.Minute}.wait(5))
+	// a longer lockout isn't shortened by a later delay
+	s := State{Failures: 5, LockedUntil: time.Now().Add(time.Hour)}
+	s = s.Fail(Policy{Delay: time.Second, Decay: time.Hour}, time.Now())
+	assert.Greater(s.RetryAfter(time.Now()), 59*time.Minute)
+	// without a cap delays keep doubling without overflowing
+	assert.Positive(Policy{Delay: time.Second}.wait(1000))
+}
@@ -0,0 +1,69 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"medods-auth/service/events"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Status string
+
+const (
+	StatusPending Status = "pending"
+	// StatusDead messages have run out of attempts and wait to be replayed.
+	StatusDead Status = "dead"
+)
+
+type Message struct {
+	ID        uuid.UUID       `json:"id"`
+	Topic     string          `json:"topic"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+
+	Status        Status    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+// NewMessage returns a pending message carrying e, due immediately.
+func NewMessage(e events.Event) (Message, error) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return Message{}, err
+	}
+	now := time.Now().UTC()
+	return Message{
+		ID:            uuid.New(),
+		Topic:         e.EventName(),
+		Payload:       payload,
+		CreatedAt:     now,
+		Status:        StatusPending,
+		NextAttemptAt: now,
+	}, nil
+}
+
+// Store is the relay's view of the outbox. Messages are written to it by
+// the token repositories in the same transaction as the change they describe.
+type Store interface {
+	// Claim leases up to limit pending messages due at now until now+lease,
+	// so that relays running concurrently don't pick the same messages.
+	Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Message, error)
+	// Delete removes a delivered message.
+	Delete(ctx context.Context, id uuid.UUID) error
+	// Fail stores Status, Attempts, NextAttemptAt and LastError of m and
+	// ends its lease.
+	Fail(ctx context.Context, m Message) error
+
+	List(ctx context.Context, status Status, limit int) ([]Message, error)
+	// Replay makes dead messages pending again, all of them if ids is empty.
+	Replay(ctx context.Context, ids []uuid.UUID) (int, error)
+}
+
+type Sink interface {
+	Name() string
+	Deliver(context.Context, Message) error
+}
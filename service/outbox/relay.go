@@ -0,0 +1,155 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"medods-auth/logging"
+	"sync"
+	"time"
+)
+
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	// MaxAttempts after which a message is dead-lettered.
+	MaxAttempts int
+}
+
+// Delay returns the wait before the next attempt after attempt failed ones,
+// doubling from Initial up to Max.
+func (b Backoff) Delay(attempts int) time.Duration {
+	d := b.Initial
+	for i := 1; i < attempts && d < b.Max; i++ {
+		d *= 2
+	}
+	return min(d, b.Max)
+}
+
+type RelayOptions struct {
+	Interval  time.Duration
+	BatchSize int
+	// Lease must be longer than delivering a batch to all sinks takes.
+	Lease   time.Duration
+	Backoff Backoff
+}
+
+// Relay delivers messages from the outbox to every sink, at least once.
+// A message is retried on all sinks when any of them fails.
+type Relay struct {
+	store Store
+	sinks []Sink
+	opts  RelayOptions
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+func NewRelay(store Store, sinks []Sink, opts RelayOptions) *Relay {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.Lease <= 0 {
+		opts.Lease = time.Minute
+	}
+	if opts.Backoff.Initial <= 0 {
+		opts.Backoff.Initial = time.Second
+	}
+	if opts.Backoff.Max < opts.Backoff.Initial {
+		opts.Backoff.Max = max(time.Hour, opts.Backoff.Initial)
+	}
+	if opts.Backoff.MaxAttempts <= 0 {
+		opts.Backoff.MaxAttempts = 10
+	}
+	return &Relay{
+		store: store,
+		sinks: sinks,
+		opts:  opts,
+		stop:  make(chan struct{}),
+	}
+}
+
+// Start polls the outbox every Interval until Close.
+func (r *Relay) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-r.stop
+			cancel()
+		}()
+
+		ticker := time.NewTicker(r.opts.Interval)
+		defer ticker.Stop()
+		for {
+			// a full batch means more messages are likely waiting
+			for {
+				n, err := r.RunOnce(ctx)
+				if err != nil && ctx.Err() == nil {
+					logging.For("outbox").Error("relay failed", "error", err)
+				}
+				if err != nil || n < r.opts.BatchSize {
+					break
+				}
+			}
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (r *Relay) Close() error {
+	r.once.Do(func() { close(r.stop) })
+	r.wg.Wait()
+	return nil
+}
+
+// RunOnce handles one batch of due messages and returns its size.
+func (r *Relay) RunOnce(ctx context.Context) (int, error) {
+	now := time.Now().UTC()
+	batch, err := r.store.Claim(ctx, now, r.opts.Lease, r.opts.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var errs []error
+	for _, m := range batch {
+		errs = append(errs, r.handle(ctx, m))
+	}
+	return len(batch), errors.Join(errs...)
+}
+
+func (r *Relay) handle(ctx context.Context, m Message) error {
+	var failures []error
+	for _, sink := range r.sinks {
+		if err := sink.Deliver(ctx, m); err != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", sink.Name(), err))
+		}
+	}
+	if len(failures) == 0 {
+		return r.store.Delete(ctx, m.ID)
+	}
+
+	deliveryErr := errors.Join(failures...)
+	m.Attempts++
+	m.LastError = deliveryErr.Error()
+	logger := logging.For("outbox")
+	if m.Attempts >= r.opts.Backoff.MaxAttempts {
+		m.Status = StatusDead
+		logger.Error("outbox message dead-lettered",
+			"id", m.ID, "topic", m.Topic, "attempts", m.Attempts, "error", deliveryErr)
+	} else {
+		m.NextAttemptAt = time.Now().UTC().Add(r.opts.Backoff.Delay(m.Attempts))
+		logger.Warn("outbox delivery failed",
+			"id", m.ID, "topic", m.Topic, "attempts", m.Attempts, "retry_at", m.NextAttemptAt, "error", deliveryErr)
+	}
+	return r.store.Fail(ctx, m)
+}
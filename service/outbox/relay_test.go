@@ -0,0 +1,170 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"medods-auth/service/events"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStore keeps messages in a map, ignoring leases.
+type fakeStore struct {
+	mu   sync.Mutex
+	msgs map[uuid.UUID]Message
+}
+
+func newFakeStore(msgs ...Message) *fakeStore {
+	s := &fakeStore{msgs: map[uuid.UUID]Message{}}
+	for _, m := range msgs {
+		s.msgs[m.ID] = m
+	}
+	return s
+}
+
+func (s *fakeStore) Claim(_ context.Context, now time.Time, _ time.Duration, limit int) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Message
+	for _, m := range s.msgs {
+		if m.Status == StatusPending && !m.NextAttemptAt.After(now) && len(out) < limit {
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+func (s *fakeStore) Delete(_ context.Context, id uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.msgs, id)
+	return nil
+}
+
+func (s *fakeStore) Fail(_ context.Context, m Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.msgs[m.ID] = m
+	return nil
+}
+
+func (s *fakeStore) List(context.Context, Status, int) ([]Message, error) { return nil, nil }
+
+func (s *fakeStore) Replay(context.Context, []uuid.UUID) (int, error) { return 0, nil }
+
+func (s *fakeStore) get(id uuid.UUID) (Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.msgs[id]
+	return m, ok
+}
+
+func newTestMessage(t *testing.T) Message {
+	m, err := NewMessage(events.TokensIssued{UserID: uuid.New()})
+	assert.NoError(t, err)
+	return m
+}
+
+func TestRelayDelivers(t *testing.T) {
+	assert := assert.New(t)
+	secret := []byte("webhook secret")
+	var mu sync.Mutex
+	var received []delivery
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal("sha256="+Sign(secret, body), r.Header.Get(HeaderSignature))
+		var d delivery
+		assert.NoError(json.Unmarshal(body, &d))
+		assert.Equal(d.ID, r.Header.Get(HeaderMessageID))
+		mu.Lock()
+		received = append(received, d)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	file, err := NewFileSink(path)
+	assert.NoError(err)
+	defer file.Close()
+
+	msg := newTestMessage(t)
+	store := newFakeStore(msg)
+	relay := NewRelay(store, []Sink{NewWebhookSink(srv.URL, secret, nil), file}, RelayOptions{})
+
+	n, err := relay.RunOnce(context.Background())
+	assert.NoError(err)
+	assert.Equal(1, n)
+	_, pending := store.get(msg.ID)
+	assert.False(pending, "delivered messages are deleted")
+
+	if assert.Len(received, 1) {
+		assert.Equal(msg.ID.String(), received[0].ID)
+		assert.Equal("tokens_issued", received[0].Topic)
+		assert.JSONEq(string(msg.Payload), string(received[0].Payload))
+	}
+	data, err := os.ReadFile(path)
+	assert.NoError(err)
+	assert.Contains(string(data), msg.ID.String())
+}
+
+func TestRelayBackoffAndDeadLetter(t *testing.T) {
+	assert := assert.New(t)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	msg := newTestMessage(t)
+	store := newFakeStore(msg)
+	relay := NewRelay(store, []Sink{NewWebhookSink(srv.URL, nil, nil)}, RelayOptions{
+		Backoff: Backoff{Initial: time.Millisecond, Max: 4 * time.Millisecond, MaxAttempts: 3},
+	})
+	ctx := context.Background()
+
+	before := time.Now()
+	_, err := relay.RunOnce(ctx)
+	assert.NoError(err, "delivery failures are not relay errors")
+	failed, _ := store.get(msg.ID)
+	assert.Equal(StatusPending, failed.Status)
+	assert.Equal(1, failed.Attempts)
+	assert.True(failed.NextAttemptAt.After(before))
+	assert.True(strings.Contains(failed.LastError, "503"), failed.LastError)
+
+	for i := 0; i < 10 && calls.Load() < 3; i++ {
+		time.Sleep(5 * time.Millisecond)
+		_, err = relay.RunOnce(ctx)
+		assert.NoError(err)
+	}
+	dead, _ := store.get(msg.ID)
+	assert.Equal(StatusDead, dead.Status)
+	assert.Equal(3, dead.Attempts)
+
+	n, err := relay.RunOnce(ctx)
+	assert.NoError(err)
+	assert.Equal(0, n, "dead messages are not retried")
+	assert.EqualValues(3, calls.Load())
+}
+
+func TestBackoffDelay(t *testing.T) {
+	assert := assert.New(t)
+	b := Backoff{Initial: time.Second, Max: 10 * time.Second}
+	assert.Equal(time.Second, b.Delay(1))
+	assert.Equal(2*time.Second, b.Delay(2))
+	assert.Equal(8*time.Second, b.Delay(4))
+	assert.Equal(10*time.Second, b.Delay(5))
+	assert.Equal(10*time.Second, b.Delay(50))
+}
@@ -0,0 +1,132 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderMessageID = "X-Outbox-Message-ID"
+	HeaderTopic     = "X-Outbox-Topic"
+	// HeaderSignature carries "sha256=<hex HMAC of the body>" when the
+	// webhook has a secret.
+	HeaderSignature = "X-Signature-256"
+)
+
+// delivery is the body of a webhook call and a line of the file sink.
+type delivery struct {
+	ID        string          `json:"id"`
+	Topic     string          `json:"topic"`
+	CreatedAt time.Time       `json:"created_at"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+func encodeDelivery(m Message) ([]byte, error) {
+	return json.Marshal(delivery{
+		ID:        m.ID.String(),
+		Topic:     m.Topic,
+		CreatedAt: m.CreatedAt,
+		Payload:   m.Payload,
+	})
+}
+
+// WebhookSink POSTs messages as JSON. Any 2xx response is a delivery.
+// Receivers may see a message more than once and should deduplicate
+// by HeaderMessageID.
+type WebhookSink struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func NewWebhookSink(url string, secret []byte, client *http.Client) *WebhookSink {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &WebhookSink{url: url, secret: secret, client: client}
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhook " + s.url
+}
+
+func (s *WebhookSink) Deliver(ctx context.Context, m Message) error {
+	body, err := encodeDelivery(m)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderMessageID, m.ID.String())
+	req.Header.Set(HeaderTopic, m.Topic)
+	if len(s.secret) > 0 {
+		req.Header.Set(HeaderSignature, "sha256="+Sign(s.secret, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 of body, as sent in HeaderSignature.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// FileSink appends messages to a JSON lines file.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: f}, nil
+}
+
+func (s *FileSink) Name() string {
+	return "file " + s.file.Name()
+}
+
+func (s *FileSink) Deliver(_ context.Context, m Message) error {
+	line, err := encodeDelivery(m)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,134 @@
+// Package password hashes passwords with Argon2id in the PHC string format,
+// $argon2id$v=19$m=<KiB>,t=<iterations>,p=<threads>$<salt>$<key>.
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var ErrInvalidHash = errors.New("invalid argon2id hash")
+
+// Params is the Argon2id work factor. Hashes made with other params still
+// verify, and are reported for rehashing.
+type Params struct {
+	// Memory is in KiB.
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultParams follow the second recommended option of RFC 9106.
+var DefaultParams = Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func (p Params) validate() error {
+	if p.Memory < 8*uint32(p.Parallelism) || p.Iterations == 0 || p.Parallelism == 0 {
+		return errors.New("invalid argon2id params")
+	}
+	if p.SaltLength < 8 || p.KeyLength < 16 {
+		return errors.New("argon2id salt or key too short")
+	}
+	return nil
+}
+
+type Hasher struct {
+	params Params
+	// dummy is verified against for unknown users, so that they take as
+	// long as known ones.
+	dummy string
+}
+
+func NewHasher(params Params) (*Hasher, error) {
+	err := params.validate()
+	if err != nil {
+		return nil, err
+	}
+	h := &Hasher{params: params}
+	h.dummy, err = h.Hash(rand.Text())
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *Hasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	p := h.params
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return encode(p, salt, key), nil
+}
+
+// Verify reports whether password matches encoded, and whether encoded
+// should be replaced by a hash with the current params.
+func (h *Hasher) Verify(password, encoded string) (ok, rehash bool, err error) {
+	p, salt, key, err := decode(encoded)
+	if err != nil {
+		return false, false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return false, false, nil
+	}
+	return true, p != h.params, nil
+}
+
+// VerifyDummy does the work of Verify for a user without a hash.
+func (h *Hasher) VerifyDummy(password string) {
+	h.Verify(password, h.dummy)
+}
+
+var b64 = base64.RawStdEncoding
+
+func encode(p Params, salt, key []byte) string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		b64.EncodeToString(salt), b64.EncodeToString(key))
+}
+
+func decode(encoded string) (p Params, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return Params{}, nil, nil, ErrInvalidHash
+	}
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return Params{}, nil, nil, ErrInvalidHash
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism)
+	if err != nil {
+		return Params{}, nil, nil, ErrInvalidHash
+	}
+	salt, err = b64.DecodeString(parts[4])
+	if err != nil {
+		return Params{}, nil, nil, ErrInvalidHash
+	}
+	key, err = b64.DecodeString(parts[5])
+	if err != nil {
+		return Params{}, nil, nil, ErrInvalidHash
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+	if p.validate() != nil {
+		return Params{}, nil, nil, ErrInvalidHash
+	}
+	return p, salt, key, nil
+}
@@ -0,0 +1,96 @@
+package password
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testParams keep the tests fast.
+var testParams = Params{
+	Memory:      1024,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func TestHashVerify(t *testing.T) {
+	assert := assert.New(t)
+	h, err := NewHasher(testParams)
+	assert.NoError(err)
+
+	encoded, err := h.Hash("correct horse")
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$"), encoded)
+
+	ok, rehash, err := h.Verify("correct horse", encoded)
+	assert.NoError(err)
+	assert.True(ok)
+	assert.False(rehash)
+
+	ok, _, err = h.Verify("wrong horse", encoded)
+	assert.NoError(err)
+	assert.False(ok)
+
+	other, err := h.Hash("correct horse")
+	assert.NoError(err)
+	assert.NotEqual(encoded, other, "salts are random")
+}
+
+func TestRehash(t *testing.T) {
+	assert := assert.New(t)
+	old, err := NewHasher(testParams)
+	assert.NoError(err)
+	encoded, err := old.Hash("password")
+	assert.NoError(err)
+
+	upgraded := testParams
+	upgraded.Iterations = 2
+	h, err := NewHasher(upgraded)
+	assert.NoError(err)
+
+	ok, rehash, err := h.Verify("password", encoded)
+	assert.NoError(err)
+	assert.True(ok)
+	assert.True(rehash)
+
+	ok, rehash, _ = h.Verify("wrong", encoded)
+	assert.False(ok)
+	assert.False(rehash, "only verified passwords are rehashed")
+}
+
+func TestInvalidHash(t *testing.T) {
+	h, err := NewHasher(testParams)
+	assert.NoError(t, err)
+	for _, encoded := range []string{
+		"",
+		"$2a$10$abcdefghijklmnopqrstuu",
+		"$argon2i$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0$a2V5a2V5a2V5a2V5a2V5a2V5",
+		"$argon2id$v=18$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0$a2V5a2V5a2V5a2V5a2V5a2V5",
+		"$argon2id$v=19$m=1024,t=0,p=1$c2FsdHNhbHRzYWx0$a2V5a2V5a2V5a2V5a2V5a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$!!$a2V5a2V5a2V5a2V5a2V5a2V5",
+	} {
+		_, _, err := h.Verify("password", encoded)
+		assert.ErrorIs(t, err, ErrInvalidHash, encoded)
+	}
+}
+
+func TestVerifyDummy(t *testing.T) {
+	h, err := NewHasher(DefaultParams)
+	assert.NoError(t, err)
+	encoded, err := h.Hash("password")
+	assert.NoError(t, err)
+
+	start := time.Now()
+	h.Verify("password", encoded)
+	known := time.Since(start)
+	start = time.Now()
+	h.VerifyDummy("password")
+	unknown := time.Since(start)
+
+	// same work, allowing for scheduling noise
+	assert.Greater(t, unknown, known/4)
+}
@@ -0,0 +1,125 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit is a token bucket holding Burst tokens, refilled at Burst per Period.
+type Limit struct {
+	Burst  int
+	Period time.Duration
+}
+
+func (l Limit) String() string {
+	return strconv.Itoa(l.Burst) + "/" + l.Period.String()
+}
+
+// rate returns the refill rate in tokens per second.
+func (l Limit) rate() float64 {
+	return float64(l.Burst) / l.Period.Seconds()
+}
+
+type Result struct {
+	Allowed bool
+	Limit   int
+	// Remaining whole tokens after this request.
+	Remaining int
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is the time until the next request is allowed, zero
+	// when this one was.
+	RetryAfter time.Duration
+}
+
+// Limiter takes one token for key from a bucket shaped by limit.
+type Limiter interface {
+	Allow(ctx context.Context, key string, limit Limit, now time.Time) (Result, error)
+}
+
+// Bucket is the stored state of a token bucket. A missing bucket is full.
+type Bucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+func FullBucket(limit Limit, now time.Time) Bucket {
+	return Bucket{Tokens: float64(limit.Burst), UpdatedAt: now}
+}
+
+// Take refills b up to now and takes a token if one is available.
+// Backends that keep buckets in Go share it; the Redis script mirrors it.
+func (b Bucket) Take(limit Limit, now time.Time) (Bucket, Result) {
+	tokens := b.Tokens
+	if elapsed := now.Sub(b.UpdatedAt).Seconds(); elapsed > 0 {
+		tokens = math.Min(float64(limit.Burst), tokens+elapsed*limit.rate())
+	}
+
+	allowed := tokens >= 1
+	if allowed {
+		tokens--
+	}
+	return Bucket{Tokens: tokens, UpdatedAt: now}, NewResult(limit, tokens, allowed)
+}
+
+// NewResult describes a request that left tokens in the bucket.
+func NewResult(limit Limit, tokens float64, allowed bool) Result {
+	rate := limit.rate()
+	res := Result{
+		Allowed:   allowed,
+		Limit:     limit.Burst,
+		Remaining: int(tokens),
+		Reset:     seconds((float64(limit.Burst) - tokens) / rate),
+	}
+	if !allowed {
+		res.RetryAfter = seconds((1 - tokens) / rate)
+	}
+	return res
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s * float64(time.Second)))
+}
+
+// ParseLimit parses "<burst>/<period>", e.g. "10/1m".
+func ParseLimit(s string) (Limit, error) {
+	burst, period, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate limit %q, <burst>/<period> expected", s)
+	}
+	n, err := strconv.Atoi(burst)
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit burst %q", burst)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit period %q", period)
+	}
+	return Limit{Burst: n, Period: d}, nil
+}
+
+// ParseLimits parses comma separated "<name>=<limit>" pairs,
+// e.g. "login.user=5/1m,refresh.ip=100/1m".
+func ParseLimits(spec string) (map[string]Limit, error) {
+	out := map[string]Limit{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, limit, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit override: %q", pair)
+		}
+		l, err := ParseLimit(limit)
+		if err != nil {
+			return nil, err
+		}
+		out[strings.TrimSpace(name)] = l
+	}
+	return out, nil
+}
@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketTake(t *testing.T) {
+	assert := assert.New(t)
+	limit := Limit{Burst: 2, Period: 2 * time.Second}
+	now := time.Now()
+
+	b, res := FullBucket(limit, now).Take(limit, now)
+	assert.True(res.Allowed)
+	assert.Equal(2, res.Limit)
+	assert.Equal(1, res.Remaining)
+	assert.Equal(time.Second, res.Reset)
+
+	b, res = b.Take(limit, now)
+	assert.True(res.Allowed)
+	assert.Equal(0, res.Remaining)
+	assert.Equal(2*time.Second, res.Reset)
+
+	b, res = b.Take(limit, now.Add(500*time.Millisecond))
+	assert.False(res.Allowed)
+	assert.Equal(0, res.Remaining)
+	assert.Equal(500*time.Millisecond, res.RetryAfter)
+
+	_, res = b.Take(limit, now.Add(time.Second))
+	assert.True(res.Allowed, "a token refills after Period/Burst")
+
+	_, res = b.Take(limit, now.Add(time.Hour))
+	assert.True(res.Allowed)
+	assert.Equal(1, res.Remaining, "refill is capped at Burst")
+}
+
+func TestParseLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := ParseLimit("10/1m")
+	assert.NoError(err)
+	assert.Equal(Limit{Burst: 10, Period: time.Minute}, l)
+	assert.Equal("10/1m0s", l.String())
+
+	for _, invalid := range []string{"10", "x/1m", "0/1m", "10/x", "10/0s"} {
+		_, err = ParseLimit(invalid)
+		assert.Error(err, invalid)
+	}
+
+	limits, err := ParseLimits(" login.user=5/1m, refresh.ip=100/1h ,")
+	assert.NoError(err)
+	assert.Equal(map[string]Limit{
+		"login.user": {Burst: 5, Period: time.Minute},
+		"refresh.ip": {Burst: 100, Period: time.Hour},
+	}, limits)
+
+	_, err = ParseLimits("login.user")
+	assert.Error(err)
+}
@@ -0,0 +1,88 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rfcKey is the SHA1 seed of the RFC 6238 test vectors.
+var rfcKey = []byte("12345678901234567890")
+
+func TestRFC6238Vectors(t *testing.T) {
+	for _, tc := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	} {
+		step := Step(time.Unix(tc.unix, 0))
+		assert.Equal(t, tc.code, code(rfcKey, step, 8), "time %d", tc.unix)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(rfcKey)
+	now := time.Unix(59, 0)
+
+	current, err := Code(secret, Step(now))
+	assert.NoError(err)
+	assert.Equal("287082", current)
+
+	step, ok, err := Validate(secret, current, now, 1)
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(Step(now), step)
+
+	// a code from the previous step is accepted within the skew only
+	previous, err := Code(secret, Step(now)-1)
+	assert.NoError(err)
+	step, ok, _ = Validate(secret, previous, now, 1)
+	assert.True(ok)
+	assert.Equal(Step(now)-1, step)
+	_, ok, _ = Validate(secret, previous, now, 0)
+	assert.False(ok)
+
+	_, ok, _ = Validate(secret, "000000", now, 1)
+	assert.False(ok)
+
+	_, _, err = Validate("not base32!", current, now, 1)
+	assert.Error(err)
+}
+
+func TestNewSecret(t *testing.T) {
+	secret := NewSecret()
+	assert.Len(t, secret, 32)
+	assert.NotEqual(t, secret, NewSecret())
+	_, err := Code(secret, 1)
+	assert.NoError(t, err)
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("medods", "alice@example.com", "JBSWY3DPEHPK3PXP")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/medods:alice@example.com?"), uri)
+	assert.Contains(t, uri, "secret=JBSWY3DPEHPK3PXP")
+	assert.Contains(t, uri, "issuer=medods")
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes := NewRecoveryCodes(10)
+	assert.Len(t, codes, 10)
+	seen := map[string]bool{}
+	for _, c := range codes {
+		assert.Regexp(t, `^[a-z2-9]{5}-[a-z2-9]{5}$`, c)
+		assert.False(t, seen[c])
+		seen[c] = true
+	}
+	assert.Equal(t, HashRecoveryCode(codes[0]), HashRecoveryCode(" "+strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))))
+	assert.NotEqual(t, HashRecoveryCode(codes[0]), HashRecoveryCode(codes[1]))
+}
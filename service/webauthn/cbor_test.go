@@ -0,0 +1,32 @@
+package webauthn
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	assert := assert.New(t)
+
+	// {1: 2, "a": [-1, h'0102', true]} followed by 0xff
+	v, rest, err := decodeCBOR([]byte{0xa2, 0x01, 0x02, 0x61, 'a', 0x83, 0x20, 0x42, 0x01, 0x02, 0xf5, 0xff})
+	assert.NoError(err)
+	assert.Equal([]byte{0xff}, rest)
+	assert.Equal(map[any]any{int64(1): int64(2), "a": []any{int64(-1), []byte{1, 2}, true}}, v)
+
+	v, _, err = decodeCBOR([]byte{0x19, 0x01, 0x00})
+	assert.NoError(err)
+	assert.Equal(int64(256), v)
+
+	for _, data := range [][]byte{
+		{},
+		{0x42, 0x01},                   // short byte string
+		{0x9f, 0xff},                   // indefinite array
+		{0xa2, 0x01, 0x02, 0x01, 0x03}, // duplicate key
+		{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, // huge array
+	} {
+		_, _, err = decodeCBOR(data)
+		assert.ErrorIs(err, errCBOR, "% x", data)
+	}
+}
@@ -0,0 +1,411 @@
+// Package webauthn implements the relying party side of the WebAuthn
+// registration and authentication ceremonies for passkeys. Attestation is
+// not verified: registration asks for "none", which browsers honour, so
+// the authenticator model isn't known, only that it holds the key.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidResponse        = errors.New("invalid webauthn response")
+	ErrChallengeMismatch      = errors.New("webauthn challenge mismatch")
+	ErrOriginMismatch         = errors.New("webauthn origin not allowed")
+	ErrRPIDMismatch           = errors.New("webauthn rp id mismatch")
+	ErrUserNotPresent         = errors.New("webauthn user not present")
+	ErrUserNotVerified        = errors.New("webauthn user not verified")
+	ErrUnsupportedAttestation = errors.New("unsupported attestation format")
+	ErrInvalidSignature       = errors.New("invalid webauthn signature")
+	// ErrSignCountRegression means the authenticator's counter went back,
+	// a sign that the credential was cloned.
+	ErrSignCountRegression = errors.New("webauthn sign count regressed")
+)
+
+// User verification requirements.
+const (
+	VerificationRequired  = "required"
+	VerificationPreferred = "preferred"
+)
+
+const (
+	challengeSize   = 32
+	credentialType  = "public-key"
+	ceremonyCreate  = "webauthn.create"
+	ceremonyGet     = "webauthn.get"
+	attestationNone = "none"
+
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+	flagExtensions   = 0x80
+)
+
+type Config struct {
+	// RPID is the domain credentials are scoped to, e.g. example.com.
+	RPID   string
+	RPName string
+	// Origins the ceremonies may run on, e.g. https://example.com.
+	Origins []string
+	Timeout time.Duration
+}
+
+// Bytes are encoded as unpadded base64url, as in the JSON serialization
+// of WebAuthn level 3.
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          Bytes  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         Bytes    `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions are passed as publicKey to navigator.credentials.create.
+type CreationOptions struct {
+	RP                     RelyingParty           `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	Challenge              Bytes                  `json:"challenge"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials,omitempty"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are passed as publicKey to navigator.credentials.get.
+type RequestOptions struct {
+	Challenge        Bytes                  `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials,omitempty"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// RegistrationResponse is the credential navigator.credentials.create
+// returns, serialized with toJSON.
+type RegistrationResponse struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes    `json:"clientDataJSON"`
+		AttestationObject Bytes    `json:"attestationObject"`
+		Transports        []string `json:"transports,omitempty"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the credential navigator.credentials.get returns,
+// serialized with toJSON.
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes `json:"clientDataJSON"`
+		AuthenticatorData Bytes `json:"authenticatorData"`
+		Signature         Bytes `json:"signature"`
+		// UserHandle is the user ID given on registration, set by
+		// authenticators holding discoverable credentials.
+		UserHandle Bytes `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+// Registration is a verified new credential.
+type Registration struct {
+	CredentialID []byte
+	// PublicKey is the COSE encoded key to pass to VerifyAssertion.
+	PublicKey    []byte
+	SignCount    uint32
+	Transports   []string
+	UserVerified bool
+}
+
+// Assertion is a verified use of a credential.
+type Assertion struct {
+	SignCount    uint32
+	UserVerified bool
+}
+
+// NewChallenge returns a random challenge for one ceremony.
+func NewChallenge() []byte {
+	c := make([]byte, challengeSize)
+	rand.Read(c)
+	return c
+}
+
+// CreationOptions asks for a discoverable credential, so that it can be
+// used without entering a login first.
+func (c Config) CreationOptions(challenge []byte, user UserEntity, exclude []CredentialDescriptor) CreationOptions {
+	params := make([]CredentialParameter, len(SupportedAlgorithms))
+	for i, alg := range SupportedAlgorithms {
+		params[i] = CredentialParameter{Type: credentialType, Alg: alg}
+	}
+	return CreationOptions{
+		RP:                 RelyingParty{ID: c.RPID, Name: c.RPName},
+		User:               user,
+		Challenge:          challenge,
+		PubKeyCredParams:   params,
+		Timeout:            c.Timeout.Milliseconds(),
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: VerificationPreferred,
+		},
+		Attestation: attestationNone,
+	}
+}
+
+// RequestOptions lets the user pick any of their discoverable credentials
+// when allow is empty.
+func (c Config) RequestOptions(challenge []byte, allow []CredentialDescriptor, userVerification string) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		Timeout:          c.Timeout.Milliseconds(),
+		RPID:             c.RPID,
+		AllowCredentials: allow,
+		UserVerification: userVerification,
+	}
+}
+
+// VerifyRegistration checks the response to CreationOptions with
+// challenge and returns the new credential.
+func (c Config) VerifyRegistration(challenge []byte, resp RegistrationResponse, requireUV bool) (*Registration, error) {
+	if resp.Type != credentialType {
+		return nil, fmt.Errorf("%w: type %q", ErrInvalidResponse, resp.Type)
+	}
+	err := c.verifyClientData(resp.Response.ClientDataJSON, ceremonyCreate, challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	item, rest, err := decodeCBOR(resp.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidResponse, err)
+	}
+	obj, ok := item.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return nil, fmt.Errorf("%w: attestation object", ErrInvalidResponse)
+	}
+	format, _ := obj["fmt"].(string)
+	stmt, _ := obj["attStmt"].(map[any]any)
+	rawAuthData, _ := obj["authData"].([]byte)
+	if format != attestationNone || len(stmt) != 0 {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedAttestation, format)
+	}
+
+	authData, err := c.verifyAuthData(rawAuthData, requireUV)
+	if err != nil {
+		return nil, err
+	}
+	if authData.credentialID == nil {
+		return nil, fmt.Errorf("%w: no attested credential", ErrInvalidResponse)
+	}
+	if !bytes.Equal(authData.credentialID, resp.RawID) {
+		return nil, fmt.Errorf("%w: credential id mismatch", ErrInvalidResponse)
+	}
+	_, err = parsePublicKey(authData.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Registration{
+		CredentialID: authData.credentialID,
+		PublicKey:    authData.publicKey,
+		SignCount:    authData.signCount,
+		Transports:   resp.Response.Transports,
+		UserVerified: authData.flags&flagUserVerified != 0,
+	}, nil
+}
+
+// VerifyAssertion checks the response to RequestOptions with challenge
+// against the stored publicKey of the credential. The caller looks the
+// credential up by resp.RawID and checks the sign count with
+// CheckSignCount.
+func (c Config) VerifyAssertion(challenge, publicKey []byte, resp AssertionResponse, requireUV bool) (*Assertion, error) {
+	if resp.Type != credentialType {
+		return nil, fmt.Errorf("%w: type %q", ErrInvalidResponse, resp.Type)
+	}
+	err := c.verifyClientData(resp.Response.ClientDataJSON, ceremonyGet, challenge)
+	if err != nil {
+		return nil, err
+	}
+	authData, err := c.verifyAuthData(resp.Response.AuthenticatorData, requireUV)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(resp.Response.ClientDataJSON)
+	signed := append(slices.Clone([]byte(resp.Response.AuthenticatorData)), clientDataHash[:]...)
+	if !key.verify(signed, resp.Response.Signature) {
+		return nil, ErrInvalidSignature
+	}
+	return &Assertion{
+		SignCount:    authData.signCount,
+		UserVerified: authData.flags&flagUserVerified != 0,
+	}, nil
+}
+
+// CheckSignCount fails if received doesn't advance stored. Authenticators
+// without a counter always report 0, which is accepted.
+func CheckSignCount(stored, received uint32) error {
+	if (stored != 0 || received != 0) && received <= stored {
+		return ErrSignCountRegression
+	}
+	return nil
+}
+
+// ResponseChallenge returns the challenge in clientDataJSON, to look up
+// the ceremony it answers. It is verified by VerifyRegistration and
+// VerifyAssertion.
+func ResponseChallenge(clientDataJSON []byte) ([]byte, error) {
+	var data clientData
+	err := json.Unmarshal(clientDataJSON, &data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: client data: %w", ErrInvalidResponse, err)
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(data.Challenge, "="))
+	if err != nil {
+		return nil, fmt.Errorf("%w: challenge: %w", ErrInvalidResponse, err)
+	}
+	return challenge, nil
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+func (c Config) verifyClientData(raw []byte, ceremony string, challenge []byte) error {
+	var data clientData
+	err := json.Unmarshal(raw, &data)
+	if err != nil {
+		return fmt.Errorf("%w: client data: %w", ErrInvalidResponse, err)
+	}
+	if data.Type != ceremony {
+		return fmt.Errorf("%w: ceremony %q", ErrInvalidResponse, data.Type)
+	}
+	got, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(data.Challenge, "="))
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return ErrChallengeMismatch
+	}
+	if data.CrossOrigin || !slices.Contains(c.Origins, data.Origin) {
+		return ErrOriginMismatch
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	flags     byte
+	signCount uint32
+
+	// set only with flagAttested
+	credentialID []byte
+	publicKey    []byte
+}
+
+func (c Config) verifyAuthData(raw []byte, requireUV bool) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrInvalidResponse)
+	}
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	if !bytes.Equal(raw[:32], rpIDHash[:]) {
+		return nil, ErrRPIDMismatch
+	}
+	data := &authenticatorData{
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	if data.flags&flagUserPresent == 0 {
+		return nil, ErrUserNotPresent
+	}
+	if requireUV && data.flags&flagUserVerified == 0 {
+		return nil, ErrUserNotVerified
+	}
+
+	rest := raw[37:]
+	if data.flags&flagAttested != 0 {
+		// AAGUID, then the length of the credential ID
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("%w: attested credential data too short", ErrInvalidResponse)
+		}
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLen {
+			return nil, fmt.Errorf("%w: credential id too short", ErrInvalidResponse)
+		}
+		data.credentialID = slices.Clone(rest[:idLen])
+		rest = rest[idLen:]
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: public key: %w", ErrInvalidResponse, err)
+		}
+		data.publicKey = slices.Clone(rest[:len(rest)-len(after)])
+		rest = after
+	}
+	if data.flags&flagExtensions != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: extensions: %w", ErrInvalidResponse, err)
+		}
+		rest = after
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: trailing authenticator data", ErrInvalidResponse)
+	}
+	return data, nil
+}
@@ -0,0 +1,106 @@
+package webauthn_test
+
+import (
+	"medods-auth/service/webauthn"
+	"medods-auth/service/webauthn/webauthntest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var config = webauthn.Config{
+	RPID:    "example.com",
+	RPName:  "Example",
+	Origins: []string{"https://example.com"},
+	Timeout: time.Minute,
+}
+
+var testUser = webauthn.UserEntity{ID: []byte("user-handle"), Name: "alice", DisplayName: "alice"}
+
+func register(t *testing.T, a *webauthntest.Authenticator) *webauthn.Registration {
+	t.Helper()
+	challenge := webauthn.NewChallenge()
+	resp, err := a.Register(config.CreationOptions(challenge, testUser, nil))
+	require.NoError(t, err)
+	reg, err := config.VerifyRegistration(challenge, resp, true)
+	require.NoError(t, err)
+	return reg
+}
+
+func TestRegistration(t *testing.T) {
+	assert := assert.New(t)
+	a := webauthntest.New("https://example.com")
+
+	reg := register(t, a)
+	assert.Len(reg.CredentialID, 16)
+	assert.NotEmpty(reg.PublicKey)
+	assert.True(reg.UserVerified)
+	assert.Equal([]string{"internal"}, reg.Transports)
+
+	challenge := webauthn.NewChallenge()
+	resp, err := a.Register(config.CreationOptions(challenge, testUser, nil))
+	require.NoError(t, err)
+	_, err = config.VerifyRegistration(webauthn.NewChallenge(), resp, true)
+	assert.ErrorIs(err, webauthn.ErrChallengeMismatch)
+
+	other := config
+	other.Origins = []string{"https://evil.example"}
+	_, err = other.VerifyRegistration(challenge, resp, true)
+	assert.ErrorIs(err, webauthn.ErrOriginMismatch)
+
+	other = config
+	other.RPID = "evil.example"
+	_, err = other.VerifyRegistration(challenge, resp, true)
+	assert.ErrorIs(err, webauthn.ErrRPIDMismatch)
+
+	a.UserVerified = false
+	resp, err = a.Register(config.CreationOptions(challenge, testUser, nil))
+	require.NoError(t, err)
+	_, err = config.VerifyRegistration(challenge, resp, true)
+	assert.ErrorIs(err, webauthn.ErrUserNotVerified)
+	_, err = config.VerifyRegistration(challenge, resp, false)
+	assert.NoError(err)
+}
+
+func TestAssertion(t *testing.T) {
+	assert := assert.New(t)
+	a := webauthntest.New("https://example.com")
+	reg := register(t, a)
+
+	challenge := webauthn.NewChallenge()
+	resp, err := a.Assert(config.RequestOptions(challenge, nil, webauthn.VerificationRequired))
+	require.NoError(t, err)
+	assert.Equal(reg.CredentialID, []byte(resp.RawID))
+	assert.Equal(testUser.ID, resp.Response.UserHandle)
+
+	assertion, err := config.VerifyAssertion(challenge, reg.PublicKey, resp, true)
+	require.NoError(t, err)
+	assert.Equal(uint32(1), assertion.SignCount)
+	assert.NoError(webauthn.CheckSignCount(reg.SignCount, assertion.SignCount))
+
+	_, err = config.VerifyAssertion(webauthn.NewChallenge(), reg.PublicKey, resp, true)
+	assert.ErrorIs(err, webauthn.ErrChallengeMismatch)
+
+	// the signature covers the authenticator data
+	tampered := resp
+	tampered.Response.AuthenticatorData = append([]byte(nil), resp.Response.AuthenticatorData...)
+	tampered.Response.AuthenticatorData[36]++
+	_, err = config.VerifyAssertion(challenge, reg.PublicKey, tampered, true)
+	assert.ErrorIs(err, webauthn.ErrInvalidSignature)
+
+	// a key of another credential doesn't verify
+	otherReg := register(t, webauthntest.New("https://example.com"))
+	_, err = config.VerifyAssertion(challenge, otherReg.PublicKey, resp, true)
+	assert.ErrorIs(err, webauthn.ErrInvalidSignature)
+}
+
+func TestCheckSignCount(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(webauthn.CheckSignCount(0, 0))
+	assert.NoError(webauthn.CheckSignCount(4, 5))
+	assert.ErrorIs(webauthn.CheckSignCount(5, 5), webauthn.ErrSignCountRegression)
+	assert.ErrorIs(webauthn.CheckSignCount(5, 3), webauthn.ErrSignCountRegression)
+	assert.ErrorIs(webauthn.CheckSignCount(5, 0), webauthn.ErrSignCountRegression)
+}
@@ -0,0 +1,164 @@
+// Package webauthntest provides a software authenticator to run WebAuthn
+// ceremonies in tests.
+package webauthntest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"medods-auth/service/webauthn"
+	"slices"
+	"sync"
+)
+
+var ErrNoCredential = errors.New("no matching credential")
+
+// Authenticator holds discoverable ES256 credentials, as platform
+// authenticators do, and answers ceremonies for Origin.
+type Authenticator struct {
+	Origin string
+	// UserVerified sets the user verified flag of responses.
+	UserVerified bool
+
+	mu    sync.Mutex
+	creds []*credential
+}
+
+type credential struct {
+	id         []byte
+	rpID       string
+	userHandle []byte
+	key        *ecdsa.PrivateKey
+	signCount  uint32
+}
+
+func New(origin string) *Authenticator {
+	return &Authenticator{Origin: origin, UserVerified: true}
+}
+
+// Register creates a credential for opts.
+func (a *Authenticator) Register(opts webauthn.CreationOptions) (webauthn.RegistrationResponse, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return webauthn.RegistrationResponse{}, err
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	cred := &credential{
+		id:         id,
+		rpID:       opts.RP.ID,
+		userHandle: slices.Clone(opts.User.ID),
+		key:        key,
+	}
+	a.mu.Lock()
+	a.creds = append(a.creds, cred)
+	a.mu.Unlock()
+
+	x, y := make([]byte, 32), make([]byte, 32)
+	key.PublicKey.X.FillBytes(x)
+	key.PublicKey.Y.FillBytes(y)
+	coseKey := encode(cborMap{
+		{int64(1), int64(2)},
+		{int64(3), int64(webauthn.AlgES256)},
+		{int64(-1), int64(1)},
+		{int64(-2), x},
+		{int64(-3), y},
+	})
+
+	attested := make([]byte, 16, 18+len(id)+len(coseKey))
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(id)))
+	attested = append(attested, id...)
+	attested = append(attested, coseKey...)
+	authData := a.authData(cred, 0x40, attested)
+
+	var resp webauthn.RegistrationResponse
+	resp.ID = base64.RawURLEncoding.EncodeToString(id)
+	resp.RawID = id
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON = a.clientData("webauthn.create", opts.Challenge)
+	resp.Response.AttestationObject = encode(cborMap{
+		{"fmt", "none"},
+		{"attStmt", cborMap{}},
+		{"authData", authData},
+	})
+	resp.Response.Transports = []string{"internal"}
+	return resp, nil
+}
+
+// Assert signs opts with the first credential for its RP, limited to
+// opts.AllowCredentials when it is set.
+func (a *Authenticator) Assert(opts webauthn.RequestOptions) (webauthn.AssertionResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var cred *credential
+	for _, c := range a.creds {
+		if c.rpID != opts.RPID {
+			continue
+		}
+		allowed := len(opts.AllowCredentials) == 0 || slices.ContainsFunc(opts.AllowCredentials, func(d webauthn.CredentialDescriptor) bool {
+			return bytes.Equal(d.ID, c.id)
+		})
+		if allowed {
+			cred = c
+			break
+		}
+	}
+	if cred == nil {
+		return webauthn.AssertionResponse{}, ErrNoCredential
+	}
+	cred.signCount++
+
+	var resp webauthn.AssertionResponse
+	resp.ID = base64.RawURLEncoding.EncodeToString(cred.id)
+	resp.RawID = cred.id
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON = a.clientData("webauthn.get", opts.Challenge)
+	resp.Response.AuthenticatorData = a.authData(cred, 0, nil)
+	resp.Response.UserHandle = cred.userHandle
+
+	hash := sha256.Sum256(resp.Response.ClientDataJSON)
+	digest := sha256.Sum256(append(slices.Clone([]byte(resp.Response.AuthenticatorData)), hash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, cred.key, digest[:])
+	if err != nil {
+		return webauthn.AssertionResponse{}, err
+	}
+	resp.Response.Signature = sig
+	return resp, nil
+}
+
+// SetSignCount sets the counter of all credentials, for example to make
+// them look cloned.
+func (a *Authenticator) SetSignCount(n uint32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.creds {
+		c.signCount = n
+	}
+}
+
+func (a *Authenticator) authData(cred *credential, flags byte, attested []byte) []byte {
+	flags |= 0x01
+	if a.UserVerified {
+		flags |= 0x04
+	}
+	rpIDHash := sha256.Sum256([]byte(cred.rpID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, cred.signCount)
+	return append(data, attested...)
+}
+
+func (a *Authenticator) clientData(ceremony string, challenge []byte) []byte {
+	data, _ := json.Marshal(map[string]any{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    a.Origin,
+	})
+	return data
+}
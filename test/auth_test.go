@@ -1,15 +1,32 @@
 package auth_test
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"medods-auth/persistance/memory"
+	"medods-auth/persistance/redis"
+	"medods-auth/persistance/sqlite"
+	"medods-auth/service/audit"
 	"medods-auth/service/auth"
-	"medods-auth/test/testutil"
+	"medods-auth/service/events"
+	"medods-auth/service/lockout"
+	"medods-auth/service/password"
+	"medods-auth/service/totp"
+	"medods-auth/service/webauthn"
+	"medods-auth/service/webauthn/webauthntest"
 	"medods-auth/token"
 	"medods-auth/user"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var TestUser = user.User{
@@ -22,43 +39,1626 @@ var TestUserAgentChanged = user.User{
 	UserAgent: "User-Agent Changed",
 }
 
-func TestAuthService(t *testing.T) {
-	assert := assert.New(t)
-
-	testRepo := testutil.NewTestInmemoryRepo()
-	defer testRepo.Close()
-	defer testRepo.DumpContents()
+// The services of newTestService sign tokens with testSecret, access
+// tokens last testAccessTTL and refresh tokens testRefreshTTL.
+var testSecret = []byte("test_secret")
 
-	accessTTL := time.Second * 1
-	refreshTTL := time.Second * 2
+const (
+	testAccessTTL  = time.Minute
+	testRefreshTTL = time.Hour
+)
 
-	service, err := auth.NewAuthService(auth.AuthServiceOptions{
-		RefreshTokenRepo: testRepo,
-		Blacklist:        testRepo,
+// testServiceOptions returns options for a service on in-memory token
+// repositories and without users, changed by configure, if not nil, to
+// what a test needs.
+func testServiceOptions(configure func(*auth.AuthServiceOptions)) auth.AuthServiceOptions {
+	accessTTL := testAccessTTL
+	refreshTTL := testRefreshTTL
+	opts := auth.AuthServiceOptions{
+		RefreshTokenRepo: memory.NewHashRepository(memory.Options{}),
+		Blacklist:        memory.NewBlackListRepository(memory.Options{}),
 
 		Generator: &token.SHA512Generator{},
 		Hasher:    &token.BcryptHasher{},
 
-		Secret:     []byte("test_secret"),
+		Secret:     testSecret,
 		AccessTTL:  &accessTTL,
 		RefreshTTL: &refreshTTL,
+	}
+	if configure != nil {
+		configure(&opts)
+	}
+	return opts
+}
+
+// newTestService returns a service with the options of testServiceOptions.
+func newTestService(t *testing.T, configure func(*auth.AuthServiceOptions)) *auth.AuthService {
+	t.Helper()
+	service, err := auth.NewAuthService(testServiceOptions(configure))
+	require.NoError(t, err)
+	return service
+}
+
+func TestAuthService(t *testing.T) {
+	testAuthService(t,
+		memory.NewHashRepository(memory.Options{}),
+		memory.NewBlackListRepository(memory.Options{}),
+	)
+}
+
+func TestAuthServiceRotator(t *testing.T) {
+	client := openRedis(t)
+	testAuthService(t,
+		redis.NewHashRepository(client, ""),
+		redis.NewBlackListRepository(client, ""),
+	)
+}
+
+func testAuthService(t *testing.T, hashRepo auth.TokenHashRepository, blacklist auth.TokenBlackList) {
+	assert := assert.New(t)
+
+	// exp has second precision, so short TTLs may expire mid-test
+	accessTTL := time.Second * 5
+	refreshTTL := time.Second * 10
+
+	service := newTestService(t, func(o *auth.AuthServiceOptions) {
+		o.RefreshTokenRepo = hashRepo
+		o.Blacklist = blacklist
+		o.AccessTTL = &accessTTL
+		o.RefreshTTL = &refreshTTL
 	})
-	assert.Nil(err)
-	assert.NotNil(service)
 
-	tokenPair, err := service.GenerateTokens(TestUser)
+	tokenPair, err := service.GenerateTokens(context.Background(), TestUser)
 	assert.Nil(err)
 	assert.NotNil(tokenPair.Access)
 	assert.NotNil(tokenPair.Refresh)
 	assert.NotEqual(tokenPair.Access, tokenPair.Refresh)
 
-	_, err = service.Refresh(TestUserAgentChanged, tokenPair)
+	_, err = service.Refresh(context.Background(), TestUserAgentChanged, tokenPair)
 	assert.Equal(err, auth.ErrUserAgentChanged)
 
-	updTokenPair, err := service.Refresh(TestUser, tokenPair)
+	updTokenPair, err := service.Refresh(context.Background(), TestUser, tokenPair)
 	assert.Nil(err)
 	assert.NotEqual(updTokenPair, tokenPair)
 
-	_, err = service.Refresh(TestUser, tokenPair)
+	_, err = service.Refresh(context.Background(), TestUser, tokenPair)
 	assert.Equal(auth.ErrBlackListedToken, err, "old token should be revoken")
 }
+
+func TestMultipleSessions(t *testing.T) {
+	t.Run("Replace", func(t *testing.T) {
+		testMultipleSessions(t,
+			memory.NewHashRepository(memory.Options{}),
+			memory.NewBlackListRepository(memory.Options{}),
+		)
+	})
+	t.Run("Rotate", func(t *testing.T) {
+		client := openRedis(t)
+		testMultipleSessions(t,
+			redis.NewHashRepository(client, ""),
+			redis.NewBlackListRepository(client, ""),
+		)
+	})
+}
+
+// testMultipleSessions refreshes two sessions of a user in turn, rotating
+// one must not be mistaken for reuse of the other.
+func testMultipleSessions(t *testing.T, hashRepo auth.TokenHashRepository, blacklist auth.TokenBlackList) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	service := newTestService(t, func(o *auth.AuthServiceOptions) {
+		o.RefreshTokenRepo = hashRepo
+		o.Blacklist = blacklist
+	})
+
+	u := user.User{Id: uuid.New(), UserAgent: TestUser.UserAgent}
+	first, err := service.GenerateTokens(ctx, u)
+	assert.NoError(err)
+	second, err := service.GenerateTokens(ctx, u)
+	assert.NoError(err)
+
+	first, err = service.Refresh(ctx, u, first)
+	assert.NoError(err)
+	second, err = service.Refresh(ctx, u, second)
+	assert.NoError(err, "refreshing one session must keep the others")
+	_, err = service.Refresh(ctx, u, first)
+	assert.NoError(err)
+	_, err = service.Refresh(ctx, u, second)
+	assert.NoError(err)
+}
+
+func TestRevokeSession(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	service := newTestService(t, nil)
+
+	u := user.User{Id: uuid.New(), UserAgent: TestUser.UserAgent}
+	ended, err := service.GenerateTokens(ctx, u)
+	assert.NoError(err)
+	kept, err := service.GenerateTokens(ctx, u)
+	assert.NoError(err)
+
+	assert.Equal(auth.ErrNilRefreshToken, service.RevokeSession(ctx, u, auth.TokenPair{Access: ended.Access}))
+	assert.NoError(service.RevokeSession(ctx, u, ended))
+	_, err = service.ExtractUserID(ctx, ended.Access)
+	assert.Equal(auth.ErrBlackListedToken, err)
+	_, err = service.Refresh(ctx, u, ended)
+	assert.Equal(auth.ErrBlackListedToken, err)
+
+	_, err = service.Refresh(ctx, u, kept)
+	assert.NoError(err, "the other sessions of the user live on")
+}
+
+func TestConcurrentRefresh(t *testing.T) {
+	t.Run("Replace", func(t *testing.T) {
+		testConcurrentRefresh(t,
+			memory.NewHashRepository(memory.Options{}),
+			memory.NewBlackListRepository(memory.Options{}),
+		)
+	})
+	t.Run("Rotate", func(t *testing.T) {
+		client := openRedis(t)
+		testConcurrentRefresh(t,
+			redis.NewHashRepository(client, ""),
+			redis.NewBlackListRepository(client, ""),
+		)
+	})
+}
+
+// testConcurrentRefresh refreshes one token pair many times at once. Only
+// one refresh may win, the others are a reuse of the token rather than
+// forks of the session.
+func testConcurrentRefresh(t *testing.T, hashRepo auth.TokenHashRepository, blacklist auth.TokenBlackList) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	service := newTestService(t, func(o *auth.AuthServiceOptions) {
+		o.RefreshTokenRepo = hashRepo
+		o.Blacklist = blacklist
+	})
+
+	u := user.User{Id: uuid.New(), UserAgent: TestUser.UserAgent}
+	pair, err := service.GenerateTokens(ctx, u)
+	assert.NoError(err)
+
+	const workers = 8
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := service.Refresh(ctx, u, pair)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	refreshed := 0
+	for err := range errs {
+		if err == nil {
+			refreshed++
+			continue
+		}
+		assert.Contains([]error{auth.ErrBlackListedToken, auth.ErrRefreshTokenReused}, err)
+	}
+	assert.Equal(1, refreshed)
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	log, err := audit.NewFileSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+	assert.NoError(err)
+	defer log.Close()
+
+	bus := events.NewSyncDispatcher()
+	var published []string
+	var suspicious []string
+	bus.Subscribe(func(_ context.Context, e events.Event) {
+		published = append(published, e.EventName())
+	})
+	events.On(bus, func(_ context.Context, e events.SuspiciousActivity) {
+		suspicious = append(suspicious, e.Kind)
+	})
+
+	service := newTestService(t, func(o *auth.AuthServiceOptions) {
+		o.Audit = log
+		o.Events = bus
+	})
+
+	u := TestUser
+	u.IP = "192.0.2.1"
+	first, err := service.GenerateTokens(ctx, u)
+	assert.NoError(err)
+	_, err = service.Refresh(ctx, TestUserAgentChanged, first)
+	assert.Equal(auth.ErrUserAgentChanged, err)
+	second, err := service.Refresh(ctx, u, first)
+	assert.NoError(err)
+
+	// a stolen refresh token replayed alongside a fresh access token
+	_, err = service.Refresh(ctx, u, auth.TokenPair{Access: second.Access, Refresh: first.Refresh})
+	assert.Equal(auth.ErrRefreshTokenReused, err)
+
+	// the legitimate session is revoked as well
+	_, err = service.Refresh(ctx, u, second)
+	assert.Equal(auth.ErrRefreshTokenReused, err)
+
+	entries, err := log.Query(ctx, audit.Filter{UserID: &u.Id})
+	assert.NoError(err)
+	assert.NoError(audit.Verify(entries))
+
+	var recorded []audit.Event
+	for _, e := range entries {
+		recorded = append(recorded, e.Event)
+	}
+	assert.Equal([]audit.Event{
+		audit.EventTokensIssued,
+		audit.EventUserAgentMismatch,
+		audit.EventTokensRefreshed,
+		audit.EventReuseDetected,
+		audit.EventSessionsRevoked,
+		audit.EventReuseDetected,
+		audit.EventSessionsRevoked,
+	}, recorded)
+	if assert.Len(entries, 7) {
+		assert.Equal(audit.OutcomeSuccess, entries[0].Outcome)
+		assert.Equal("192.0.2.1", entries[0].IP)
+		assert.Equal(TestUser.UserAgent, entries[0].UserAgent)
+		assert.NotEmpty(entries[0].IssuedJTI)
+		assert.Equal(entries[0].IssuedJTI, entries[2].JTI)
+		assert.Equal(audit.OutcomeFailure, entries[3].Outcome)
+		assert.Equal("refresh_token_reused", entries[3].ErrorCode)
+	}
+
+	assert.Equal([]string{
+		"tokens_issued",
+		"suspicious_activity",
+		"tokens_refreshed",
+		"session_revoked",
+		"suspicious_activity",
+		"session_revoked",
+		"suspicious_activity",
+	}, published)
+	assert.Equal([]string{
+		events.ActivityUserAgentMismatch,
+		events.ActivityRefreshTokenReuse,
+		events.ActivityRefreshTokenReuse,
+	}, suspicious)
+}
+
+func TestTokenTypeConfusion(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	service := newTestService(t, nil)
+
+	pair, err := service.GenerateTokens(ctx, TestUser)
+	assert.NoError(err)
+
+	// a refresh token isn't a bearer token
+	_, err = service.ExtractUserID(ctx, pair.Refresh)
+	assert.Equal(auth.ErrAccessTokenExpected, err)
+	err = service.RevokeTokens(ctx, TestUser, *pair.Refresh)
+	assert.Equal(auth.ErrAccessTokenExpected, err)
+
+	// an access token can't be refreshed, nor taken for a reused refresh
+	// token revoking the session
+	_, err = service.Refresh(ctx, TestUser, auth.TokenPair{Access: pair.Access, Refresh: pair.Access})
+	assert.Equal(auth.ErrRefreshTokenExpected, err)
+	_, err = service.Refresh(ctx, TestUser, auth.TokenPair{Access: pair.Refresh, Refresh: pair.Refresh})
+	assert.Equal(auth.ErrAccessTokenExpected, err)
+	_, err = service.Refresh(ctx, TestUser, pair)
+	assert.NoError(err)
+}
+
+func TestSessionLimit(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	bus := events.NewSyncDispatcher()
+	var revoked []events.SessionRevoked
+	events.On(bus, func(_ context.Context, e events.SessionRevoked) {
+		revoked = append(revoked, e)
+	})
+
+	newService := func(policy auth.SessionPolicy) *auth.AuthService {
+		return newTestService(t, func(o *auth.AuthServiceOptions) {
+			o.Events = bus
+			o.SessionLimit = &auth.SessionLimit{Max: 2, Policy: policy}
+		})
+	}
+
+	service := newService(auth.RejectNewSession)
+	for range 2 {
+		_, err := service.GenerateTokens(ctx, TestUser)
+		assert.NoError(err)
+	}
+	_, err := service.GenerateTokens(ctx, TestUser)
+	assert.Equal(auth.ErrTooManySessions, err)
+
+	service = newService(auth.EvictOldest)
+	first, err := service.GenerateTokens(ctx, TestUser)
+	assert.NoError(err)
+	_, err = service.GenerateTokens(ctx, TestUser)
+	assert.NoError(err)
+	third, err := service.GenerateTokens(ctx, TestUser)
+	assert.NoError(err)
+
+	if assert.Len(revoked, 1) {
+		assert.Equal(events.ReasonSessionLimit, revoked[0].Reason)
+		assert.Equal(TestUser.Id, revoked[0].UserID)
+	}
+	// the evicted session is rejected without revoking the others
+	_, err = service.Refresh(ctx, TestUser, first)
+	assert.Equal(auth.ErrBlackListedToken, err)
+	_, err = service.Refresh(ctx, TestUser, third)
+	assert.NoError(err)
+}
+
+func TestSessionLimitRefresh(t *testing.T) {
+	t.Run("Replace", func(t *testing.T) {
+		testSessionLimitRefresh(t,
+			memory.NewHashRepository(memory.Options{}),
+			memory.NewBlackListRepository(memory.Options{}),
+		)
+	})
+	t.Run("Rotate", func(t *testing.T) {
+		db := openSQLite(t)
+		testSessionLimitRefresh(t, sqlite.NewHashRepository(db), sqlite.NewBlackListRepository(db))
+	})
+}
+
+// testSessionLimitRefresh keeps as many sessions as the limit allows and
+// refreshes them in turn, none may end another.
+func testSessionLimitRefresh(t *testing.T, hashRepo auth.TokenHashRepository, blacklist auth.TokenBlackList) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	const max = 3
+
+	service := newTestService(t, func(o *auth.AuthServiceOptions) {
+		o.RefreshTokenRepo = hashRepo
+		o.Blacklist = blacklist
+		o.SessionLimit = &auth.SessionLimit{Max: max, Policy: auth.RejectNewSession}
+	})
+
+	u := user.User{Id: uuid.New(), UserAgent: TestUser.UserAgent}
+	sessions := make([]auth.TokenPair, max)
+	var err error
+	for i := range sessions {
+		sessions[i], err = service.GenerateTokens(ctx, u)
+		assert.NoError(err)
+	}
+	for range 2 {
+		for i := range sessions {
+			sessions[i], err = service.Refresh(ctx, u, sessions[i])
+			assert.NoError(err, "session %d", i)
+		}
+	}
+
+	// refreshing doesn't free a place for another session
+	_, err = service.GenerateTokens(ctx, u)
+	assert.Equal(auth.ErrTooManySessions, err)
+}
+
+func TestSessionLimitConcurrentRefresh(t *testing.T) {
+	t.Run("Replace", func(t *testing.T) {
+		hashes := memory.NewHashRepository(memory.Options{})
+		testSessionLimitConcurrentRefresh(t, hashes, memory.NewBlackListRepository(memory.Options{}))
+	})
+	t.Run("Rotate", func(t *testing.T) {
+		client := openRedis(t)
+		testSessionLimitConcurrentRefresh(t,
+			redis.NewHashRepository(client, ""),
+			redis.NewBlackListRepository(client, ""),
+		)
+	})
+}
+
+// testSessionLimitConcurrentRefresh refreshes every session of a user at
+// the limit while new ones are started, all at once. However they
+// interleave, no more than the limit may be live afterwards.
+func testSessionLimitConcurrentRefresh(t *testing.T, hashRepo auth.TokenHashRepository, blacklist auth.TokenBlackList) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	const max = 3
+
+	generator := &token.SHA512Generator{}
+	service := newTestService(t, func(o *auth.AuthServiceOptions) {
+		o.RefreshTokenRepo = hashRepo
+		o.Blacklist = blacklist
+		o.SessionLimit = &auth.SessionLimit{Max: max, Policy: auth.EvictOldest}
+	})
+
+	u := user.User{Id: uuid.New(), UserAgent: TestUser.UserAgent}
+	sessions := make([]auth.TokenPair, max)
+	var err error
+	for i := range sessions {
+		sessions[i], err = service.GenerateTokens(ctx, u)
+		assert.NoError(err)
+	}
+
+	issued := make(chan auth.TokenPair, 2*max)
+	var wg sync.WaitGroup
+	for _, pair := range sessions {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			// the session may be evicted before it is refreshed
+			if refreshed, err := service.Refresh(ctx, u, pair); err == nil {
+				issued <- refreshed
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			started, err := service.GenerateTokens(ctx, u)
+			if assert.NoError(err) {
+				issued <- started
+			}
+		}()
+	}
+	wg.Wait()
+	close(issued)
+
+	live := 0
+	for pair := range issued {
+		refresh, err := generator.Decode(pair.Refresh.String(), testSecret)
+		assert.NoError(err)
+		jti, err := refresh.JTI()
+		assert.NoError(err)
+		_, err = hashRepo.Get(ctx, jti)
+		if err == nil {
+			live++
+			continue
+		}
+		assert.Equal(auth.ErrRefreshTokenNotFound, err)
+	}
+	assert.LessOrEqual(live, max)
+}
+
+func TestSessionLifetime(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	hashes := memory.NewHashRepository(memory.Options{})
+	blacklist := memory.NewBlackListRepository(memory.Options{})
+	generator := &token.SHA512Generator{}
+	newService := func(lifetime, idle time.Duration) *auth.AuthService {
+		refreshTTL := 48 * time.Hour
+		return newTestService(t, func(o *auth.AuthServiceOptions) {
+			o.RefreshTokenRepo = hashes
+			o.Blacklist = blacklist
+			o.RefreshTTL = &refreshTTL
+			o.SessionLifetime = &lifetime
+			o.SessionIdleTimeout = &idle
+		})
+	}
+	sessionStart := func(pair auth.TokenPair) time.Time {
+		decoded, err := generator.Decode(pair.Refresh.String(), testSecret)
+		assert.NoError(err)
+		start, err := decoded.SessionStart()
+		assert.NoError(err)
+		return start
+	}
+
+	// refresh tokens expire by the idle timeout and session end
+	service := newService(24*time.Hour, time.Hour)
+	pair, err := service.GenerateTokens(ctx, TestUser)
+	assert.NoError(err)
+	assert.WithinDuration(time.Now().Add(time.Hour), pair.RefreshExpiresAt, 2*time.Second)
+	assert.WithinDuration(time.Now().Add(24*time.Hour), pair.SessionExpiresAt, 2*time.Second)
+
+	refreshed, err := service.Refresh(ctx, TestUser, pair)
+	assert.NoError(err)
+	assert.Equal(pair.SessionExpiresAt, refreshed.SessionExpiresAt, "refresh keeps the session start")
+	assert.Equal(sessionStart(pair), sessionStart(refreshed))
+
+	service = newService(time.Minute, 0)
+	pair, err = service.GenerateTokens(ctx, TestUser)
+	assert.NoError(err)
+	assert.WithinDuration(time.Now().Add(time.Minute), pair.RefreshExpiresAt, 2*time.Second)
+
+	// sessions issued before the limits were lowered end too
+	_, err = newService(time.Nanosecond, 0).Refresh(ctx, TestUser, pair)
+	assert.Equal(auth.ErrSessionExpired, err)
+	_, err = newService(0, time.Nanosecond).Refresh(ctx, TestUser, pair)
+	assert.Equal(auth.ErrSessionExpired, err)
+
+	pair, err = newService(0, 0).GenerateTokens(ctx, TestUser)
+	assert.NoError(err)
+	assert.True(pair.SessionExpiresAt.IsZero())
+	assert.WithinDuration(time.Now().Add(48*time.Hour), pair.RefreshExpiresAt, 2*time.Second)
+}
+
+func TestUserDirectory(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	bus := events.NewSyncDispatcher()
+	var revoked []events.SessionRevoked
+	events.On(bus, func(_ context.Context, e events.SessionRevoked) {
+		revoked = append(revoked, e)
+	})
+
+	hashes := memory.NewHashRepository(memory.Options{})
+	service := newTestService(t, func(o *auth.AuthServiceOptions) {
+		o.RefreshTokenRepo = hashes
+		o.Users = memory.NewUserRepository()
+		o.Events = bus
+	})
+
+	_, err := service.GenerateTokens(ctx, TestUser)
+	assert.Equal(auth.ErrUserNotFound, err)
+
+	account, err := service.CreateUser(ctx, TestUser.Id)
+	assert.NoError(err)
+	assert.Equal(user.StatusActive, account.Status)
+	_, err = service.CreateUser(ctx, TestUser.Id)
+	assert.Equal(auth.ErrUserExists, err)
+
+	pair, err := service.GenerateTokens(ctx, TestUser)
+	assert.NoError(err)
+
+	// disabling revokes the sessions right away
+	assert.NoError(service.DisableUser(ctx, TestUser.Id))
+	if assert.Len(revoked, 1) {
+		assert.Equal(events.ReasonUserDisabled, revoked[0].Reason)
+	}
+	_, err = service.Refresh(ctx, TestUser, pair)
+	assert.Equal(auth.ErrUserDisabled, err)
+	// and so are the access tokens already issued
+	_, err = service.ExtractUserID(ctx, pair.Access)
+	assert.Equal(auth.ErrUserDisabled, err)
+	refresh, err := (&token.SHA512Generator{}).Decode(pair.Refresh.String(), []byte("test_secret"))
+	assert.NoError(err)
+	refreshJTI, err := refresh.JTI()
+	assert.NoError(err)
+	_, err = hashes.Get(ctx, refreshJTI)
+	assert.Equal(auth.ErrRefreshTokenNotFound, err)
+	_, err = service.GenerateTokens(ctx, TestUser)
+	assert.Equal(auth.ErrUserDisabled, err)
+
+	assert.NoError(service.EnableUser(ctx, TestUser.Id))
+	pair, err = service.GenerateTokens(ctx, TestUser)
+	assert.NoError(err)
+
+	assert.NoError(service.DeleteUser(ctx, TestUser.Id))
+	_, err = service.GenerateTokens(ctx, TestUser)
+	assert.Equal(auth.ErrUserNotFound, err)
+	_, err = service.ExtractUserID(ctx, pair.Access)
+	assert.Equal(auth.ErrUserNotFound, err)
+	assert.Equal(auth.ErrUserNotFound, service.DisableUser(ctx, TestUser.Id))
+}
+
+func TestLogin(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	users := memory.NewUserRepository()
+	hashes := memory.NewHashRepository(memory.Options{})
+	blacklist := memory.NewBlackListRepository(memory.Options{})
+	newService := func(params password.Params) *auth.AuthService {
+		passwords, err := password.NewHasher(params)
+		assert.NoError(err)
+		return newTestService(t, func(o *auth.AuthServiceOptions) {
+			o.RefreshTokenRepo = hashes
+			o.Blacklist = blacklist
+			o.Users = users
+			o.Passwords = passwords
+		})
+	}
+	params := password.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	service := newService(params)
+
+	account, err := service.CreateUser(ctx, uuid.Nil)
+	assert.NoError(err)
+	assert.NoError(service.SetPassword(ctx, account.Id, " Alice@Example.com", "hunter2"))
+
+	client := user.User{UserAgent: TestUser.UserAgent}
+	_, err = service.Login(ctx, "alice@example.com", "wrong", client)
+	assert.Equal(auth.ErrInvalidCredentials, err)
+	_, err = service.Login(ctx, "bob@example.com", "hunter2", client)
+	assert.Equal(auth.ErrInvalidCredentials, err, "unknown logins fail like wrong passwords")
+
+	res, err := service.Login(ctx, "ALICE@example.com", "hunter2", client)
+	assert.NoError(err)
+	assert.Nil(res.MFAToken)
+	id, err := service.ExtractUserID(ctx, res.Tokens.Access)
+	assert.NoError(err)
+	assert.Equal(account.Id, id)
+
+	// raising the work factor rehashes on the next login
+	before, err := users.GetCredential(ctx, "alice@example.com")
+	assert.NoError(err)
+	upgraded := params
+	upgraded.Iterations = 2
+	_, err = newService(upgraded).Login(ctx, "alice@example.com", "hunter2", client)
+	assert.NoError(err)
+	after, err := users.GetCredential(ctx, "alice@example.com")
+	assert.NoError(err)
+	assert.NotEqual(before.Hash, after.Hash)
+	assert.Contains(after.Hash, "t=2")
+
+	assert.NoError(service.DisableUser(ctx, account.Id))
+	_, err = service.Login(ctx, "alice@example.com", "hunter2", client)
+	assert.Equal(auth.ErrUserDisabled, err)
+}
+
+func TestLockout(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	passwords, err := password.NewHasher(password.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	assert.NoError(err)
+	bus := events.NewSyncDispatcher()
+	var failed int
+	var locked []string
+	events.On(bus, func(_ context.Context, e events.LoginFailed) { failed++ })
+	events.On(bus, func(_ context.Context, e events.LockedOut) { locked = append(locked, e.Scope) })
+	store := memory.NewLockoutRepository(memory.Options{})
+	defer store.Close()
+	service := newTestService(t, func(o *auth.AuthServiceOptions) {
+		o.Users = memory.NewUserRepository()
+		o.Passwords = passwords
+		o.Events = bus
+		o.Lockout = &auth.LockoutOptions{
+			Store:   store,
+			Account: &lockout.Policy{MaxFailures: 3, Lockout: time.Hour, Delay: 20 * time.Millisecond, Decay: time.Hour},
+			IP:      &lockout.Policy{MaxFailures: 5, Lockout: time.Hour, Decay: time.Hour},
+		}
+	})
+
+	account, err := service.CreateUser(ctx, uuid.Nil)
+	assert.NoError(err)
+	assert.NoError(service.SetPassword(ctx, account.Id, "alice", "hunter2"))
+	client := user.User{UserAgent: TestUser.UserAgent, IP: "192.0.2.1"}
+
+	// each failure makes the account wait longer
+	_, err = service.Login(ctx, "alice", "wrong", client)
+	assert.Equal(auth.ErrInvalidCredentials, err)
+	_, err = service.Login(ctx, "alice", "hunter2", client)
+	assert.ErrorIs(err, auth.ErrLockedOut)
+	var lockedOut *auth.LockedOutError
+	if assert.ErrorAs(err, &lockedOut) {
+		assert.LessOrEqual(lockedOut.RetryAfter, 20*time.Millisecond)
+	}
+	assert.Equal("locked_out", auth.ErrorCode(err))
+	time.Sleep(25 * time.Millisecond)
+	_, err = service.Login(ctx, "alice", "wrong", client)
+	assert.Equal(auth.ErrInvalidCredentials, err)
+	time.Sleep(45 * time.Millisecond)
+	_, err = service.Login(ctx, "alice", "wrong", client)
+	assert.Equal(auth.ErrInvalidCredentials, err)
+
+	// until it is locked out, even with the right password
+	_, err = service.Login(ctx, "alice", "hunter2", client)
+	if assert.ErrorAs(err, &lockedOut) {
+		assert.Greater(lockedOut.RetryAfter, 59*time.Minute)
+	}
+	assert.Equal(3, failed, "attempts while locked out aren't failures")
+	assert.Equal([]string{events.LockoutScopeAccount}, locked)
+
+	assert.NoError(service.UnlockUser(ctx, account.Id))
+	res, err := service.Login(ctx, "alice", "hunter2", client)
+	assert.NoError(err)
+	assert.NotNil(res.Tokens.Access)
+
+	// unknown logins wait like known ones
+	_, err = service.Login(ctx, "bob", "hunter2", client)
+	assert.Equal(auth.ErrInvalidCredentials, err)
+	_, err = service.Login(ctx, "bob", "hunter2", client)
+	assert.ErrorIs(err, auth.ErrLockedOut)
+
+	// the IP is locked out by failures across logins, logging in doesn't
+	// reset them
+	_, err = service.Login(ctx, "carol", "hunter2", client)
+	assert.Equal(auth.ErrInvalidCredentials, err)
+	_, err = service.Login(ctx, "alice", "hunter2", client)
+	assert.ErrorIs(err, auth.ErrLockedOut)
+	assert.Equal([]string{events.LockoutScopeAccount, events.LockoutScopeIP}, locked)
+	_, err = service.Login(ctx, "alice", "hunter2", user.User{UserAgent: client.UserAgent, IP: "192.0.2.2"})
+	assert.NoError(err)
+
+	assert.NoError(service.UnlockIP(ctx, client.IP))
+	_, err = service.Login(ctx, "alice", "hunter2", client)
+	assert.NoError(err)
+	assert.Equal(auth.ErrUserNotFound, service.UnlockUser(ctx, uuid.New()))
+}
+
+func TestTOTP(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	passwords, err := password.NewHasher(password.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	assert.NoError(err)
+	generator := &token.SHA512Generator{}
+	service := newTestService(t, func(o *auth.AuthServiceOptions) {
+		o.Users = memory.NewUserRepository()
+		o.Passwords = passwords
+		o.TOTP = &auth.TOTPOptions{Issuer: "test"}
+	})
+	amr := func(enc *token.EncodedToken) []string {
+		decoded, err := generator.Decode(enc.String(), testSecret)
+		assert.NoError(err)
+		amr, err := decoded.AMR()
+		assert.NoError(err)
+		return amr
+	}
+
+	account, err := service.CreateUser(ctx, uuid.Nil)
+	assert.NoError(err)
+	assert.NoError(service.SetPassword(ctx, account.Id, "alice", "hunter2"))
+	client := user.User{UserAgent: TestUser.UserAgent}
+
+	// without a TOTP the password is enough
+	res, err := service.Login(ctx, "alice", "hunter2", client)
+	assert.NoError(err)
+	assert.Nil(res.MFAToken)
+	assert.Equal([]string{"pwd"}, amr(res.Tokens.Access))
+	access := *res.Tokens.Access
+
+	enrollment, err := service.EnrollTOTP(ctx, client, access)
+	assert.NoError(err)
+	assert.Contains(enrollment.URI, "secret="+enrollment.Secret)
+
+	// an enrollment isn't active before a code is verified
+	res, err = service.Login(ctx, "alice", "hunter2", client)
+	assert.NoError(err)
+	assert.Nil(res.MFAToken)
+
+	_, err = service.ActivateTOTP(ctx, client, access, "000000")
+	assert.Equal(auth.ErrInvalidMFACode, err)
+	step := totp.Step(time.Now())
+	code, err := totp.Code(enrollment.Secret, step)
+	assert.NoError(err)
+	recovery, err := service.ActivateTOTP(ctx, client, access, code)
+	assert.NoError(err)
+	assert.Len(recovery, 10)
+	_, err = service.EnrollTOTP(ctx, client, access)
+	assert.Equal(auth.ErrTOTPAlreadyActive, err)
+
+	res, err = service.Login(ctx, "alice", "hunter2", client)
+	assert.NoError(err)
+	assert.NotNil(res.MFAToken)
+	assert.Nil(res.Tokens.Access)
+	mfaToken := *res.MFAToken
+
+	// the MFA token is no access token, nor the other way around
+	_, err = service.ExtractUserID(ctx, &mfaToken)
+	assert.Equal(auth.ErrAccessTokenExpected, err)
+	_, err = service.VerifyMFA(ctx, client, access, code)
+	assert.Equal(auth.ErrMFATokenExpected, err)
+
+	_, err = service.VerifyMFA(ctx, client, mfaToken, "000000")
+	assert.Equal(auth.ErrInvalidMFACode, err)
+	_, err = service.VerifyMFA(ctx, client, mfaToken, code)
+	assert.Equal(auth.ErrInvalidMFACode, err, "the code used to activate can't be replayed")
+
+	next, err := totp.Code(enrollment.Secret, step+1)
+	assert.NoError(err)
+	pair, err := service.VerifyMFA(ctx, client, mfaToken, next)
+	assert.NoError(err)
+	assert.Equal([]string{"pwd", "otp", "mfa"}, amr(pair.Access))
+	_, err = service.VerifyMFA(ctx, client, mfaToken, recovery[0])
+	assert.Equal(auth.ErrBlackListedToken, err, "the MFA token is single use")
+
+	// refreshing keeps the methods the session was started with
+	refreshed, err := service.Refresh(ctx, user.User{Id: account.Id, UserAgent: client.UserAgent}, pair)
+	assert.NoError(err)
+	assert.Equal([]string{"pwd", "otp", "mfa"}, amr(refreshed.Access))
+
+	// recovery codes work once
+	res, err = service.Login(ctx, "alice", "hunter2", client)
+	assert.NoError(err)
+	_, err = service.VerifyMFA(ctx, client, *res.MFAToken, recovery[0])
+	assert.NoError(err)
+	res, err = service.Login(ctx, "alice", "hunter2", client)
+	assert.NoError(err)
+	_, err = service.VerifyMFA(ctx, client, *res.MFAToken, recovery[0])
+	assert.Equal(auth.ErrInvalidMFACode, err)
+
+	assert.NoError(service.ResetTOTP(ctx, account.Id))
+	assert.Equal(auth.ErrTOTPNotEnrolled, service.ResetTOTP(ctx, account.Id))
+	res, err = service.Login(ctx, "alice", "hunter2", client)
+	assert.NoError(err)
+	assert.Nil(res.MFAToken)
+}
+
+func TestPasskeys(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	passwords, err := password.NewHasher(password.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	assert.NoError(err)
+	generator := &token.SHA512Generator{}
+	service := newTestService(t, func(o *auth.AuthServiceOptions) {
+		o.Users = memory.NewUserRepository()
+		o.Passwords = passwords
+		o.WebAuthn = &webauthn.Config{
+			RPID:    "example.com",
+			RPName:  "Example",
+			Origins: []string{"https://example.com"},
+		}
+	})
+	amr := func(enc *token.EncodedToken) []string {
+		decoded, err := generator.Decode(enc.String(), testSecret)
+		assert.NoError(err)
+		amr, err := decoded.AMR()
+		assert.NoError(err)
+		return amr
+	}
+
+	account, err := service.CreateUser(ctx, uuid.Nil)
+	assert.NoError(err)
+	assert.NoError(service.SetPassword(ctx, account.Id, "alice", "hunter2"))
+	client := user.User{UserAgent: TestUser.UserAgent}
+	res, err := service.Login(ctx, "alice", "hunter2", client)
+	assert.NoError(err)
+	assert.Nil(res.MFAToken)
+	access := *res.Tokens.Access
+
+	authenticator := webauthntest.New("https://example.com")
+	creation, err := service.BeginPasskeyRegistration(ctx, client, access)
+	assert.NoError(err)
+	assert.Empty(creation.ExcludeCredentials)
+	registration, err := authenticator.Register(*creation)
+	assert.NoError(err)
+	passkey, err := service.FinishPasskeyRegistration(ctx, client, access, registration)
+	assert.NoError(err)
+	assert.Equal(account.Id, passkey.UserID)
+	assert.Equal([]string{"internal"}, passkey.Transports)
+
+	// the challenge of a ceremony is single use
+	_, err = service.FinishPasskeyRegistration(ctx, client, access, registration)
+	assert.Equal(auth.ErrChallengeNotFound, err)
+	creation, err = service.BeginPasskeyRegistration(ctx, client, access)
+	assert.NoError(err)
+	assert.Len(creation.ExcludeCredentials, 1)
+
+	// passkeys replace both factors
+	request, err := service.BeginPasskeyLogin(ctx)
+	assert.NoError(err)
+	assertion, err := authenticator.Assert(*request)
+	assert.NoError(err)
+	pair, err := service.FinishPasskeyLogin(ctx, client, assertion)
+	assert.NoError(err)
+	assert.Equal([]string{"hwk"}, amr(pair.Access))
+	id, err := service.ExtractUserID(ctx, pair.Access)
+	assert.NoError(err)
+	assert.Equal(account.Id, id)
+
+	// or are the second one after a password
+	res, err = service.Login(ctx, "alice", "hunter2", client)
+	assert.NoError(err)
+	assert.NotNil(res.MFAToken)
+	assert.Equal([]string{"hwk"}, res.MFAMethods)
+	mfaToken := *res.MFAToken
+
+	_, err = service.BeginPasskeyMFA(ctx, client, access)
+	assert.Equal(auth.ErrMFATokenExpected, err)
+	request, err = service.BeginPasskeyMFA(ctx, client, mfaToken)
+	assert.NoError(err)
+	assert.Len(request.AllowCredentials, 1)
+	// a login challenge doesn't complete a login that started with a password
+	loginRequest, err := service.BeginPasskeyLogin(ctx)
+	assert.NoError(err)
+	assertion, err = authenticator.Assert(*loginRequest)
+	assert.NoError(err)
+	_, err = service.FinishPasskeyMFA(ctx, client, mfaToken, assertion)
+	assert.Equal(auth.ErrChallengeNotFound, err)
+
+	assertion, err = authenticator.Assert(*request)
+	assert.NoError(err)
+	pair, err = service.FinishPasskeyMFA(ctx, client, mfaToken, assertion)
+	assert.NoError(err)
+	assert.Equal([]string{"pwd", "hwk", "mfa"}, amr(pair.Access))
+
+	// a counter going back means the authenticator was cloned
+	authenticator.SetSignCount(1)
+	request, err = service.BeginPasskeyLogin(ctx)
+	assert.NoError(err)
+	assertion, err = authenticator.Assert(*request)
+	assert.NoError(err)
+	_, err = service.FinishPasskeyLogin(ctx, client, assertion)
+	assert.Equal(auth.ErrPasskeySignCount, err)
+
+	// signatures are checked against the stored key
+	request, err = service.BeginPasskeyLogin(ctx)
+	assert.NoError(err)
+	other := webauthntest.New("https://example.com")
+	_, err = other.Register(webauthn.CreationOptions{RP: webauthn.RelyingParty{ID: "example.com"}, User: webauthn.UserEntity{ID: account.Id[:]}})
+	assert.NoError(err)
+	forged, err := other.Assert(*request)
+	assert.NoError(err)
+	forged.RawID = passkey.ID
+	_, err = service.FinishPasskeyLogin(ctx, client, forged)
+	assert.ErrorIs(err, auth.ErrInvalidPasskey)
+
+	// logging in with a passkey alone needs user verification
+	authenticator.UserVerified = false
+	authenticator.SetSignCount(100)
+	request, err = service.BeginPasskeyLogin(ctx)
+	assert.NoError(err)
+	assertion, err = authenticator.Assert(*request)
+	assert.NoError(err)
+	_, err = service.FinishPasskeyLogin(ctx, client, assertion)
+	assert.ErrorIs(err, auth.ErrInvalidPasskey)
+
+	assert.NoError(service.DisableUser(ctx, account.Id))
+	request, err = service.BeginPasskeyLogin(ctx)
+	assert.NoError(err)
+	authenticator.UserVerified = true
+	assertion, err = authenticator.Assert(*request)
+	assert.NoError(err)
+	_, err = service.FinishPasskeyLogin(ctx, client, assertion)
+	assert.Equal(auth.ErrUserDisabled, err)
+}
+
+func TestClientCredentials(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	generator := &token.SHA512Generator{}
+	service := newTestService(t, func(o *auth.AuthServiceOptions) {
+		o.Users = memory.NewUserRepository()
+		o.OAuth = &auth.OAuthOptions{Scopes: []string{"users:read", "users:write"}}
+	})
+
+	_, _, err := service.RegisterClient(ctx, auth.ClientRegistration{Scopes: []string{"admin"}})
+	assert.Equal(auth.ErrInvalidScope, err)
+	client, clientSecret, err := service.RegisterClient(ctx, auth.ClientRegistration{
+		Name:      "Billing",
+		Scopes:    []string{"users:read", "users:write"},
+		AccessTTL: 30 * time.Second,
+	})
+	assert.NoError(err)
+	assert.NotEmpty(client.ID)
+	assert.NotEmpty(clientSecret)
+	assert.NotContains(client.SecretHash, clientSecret)
+	_, _, err = service.RegisterClient(ctx, auth.ClientRegistration{ID: client.ID})
+	assert.Equal(auth.ErrClientExists, err)
+
+	// a wrong secret and an unknown client look the same
+	caller := user.User{UserAgent: "billing/1.0", IP: "192.0.2.1"}
+	_, err = service.ClientCredentials(ctx, client.ID, "wrong", "", caller)
+	assert.Equal(auth.ErrInvalidClient, err)
+	_, err = service.ClientCredentials(ctx, "unknown", clientSecret, "", caller)
+	assert.Equal(auth.ErrInvalidClient, err)
+	assert.Equal("invalid_client", auth.ErrorCode(err))
+
+	_, err = service.ClientCredentials(ctx, client.ID, clientSecret, "users:read admin", caller)
+	assert.Equal(auth.ErrInvalidScope, err)
+	issued, err := service.ClientCredentials(ctx, client.ID, clientSecret, "users:read users:read", caller)
+	assert.NoError(err)
+	assert.Equal("users:read", issued.Scope)
+	assert.WithinDuration(time.Now().Add(30*time.Second), issued.ExpiresAt, 2*time.Second)
+	all, err := service.ClientCredentials(ctx, client.ID, clientSecret, "", caller)
+	assert.NoError(err)
+	assert.Equal("users:read users:write", all.Scope)
+
+	id, err := service.ValidateClientToken(ctx, *issued.Access, "users:read")
+	assert.NoError(err)
+	assert.Equal(client.ID, id)
+	_, err = service.ValidateClientToken(ctx, *issued.Access, "users:write")
+	assert.Equal(auth.ErrInsufficientScope, err)
+
+	// client tokens are access tokens, nothing else of a client passes
+	for _, opts := range []token.Options{
+		{ClientID: client.ID, TTL: time.Minute},
+		{ClientID: client.ID, TTL: time.Minute, Type: token.TokenTypeRefresh},
+	} {
+		enc, err := generator.Encode(generator.Generate(opts), testSecret)
+		assert.NoError(err)
+		_, err = service.ValidateClientToken(ctx, token.EncodedToken(enc))
+		assert.Equal(auth.ErrClientTokenExpected, err, opts.Type)
+	}
+
+	// client tokens don't stand for a user, nor user tokens for a client
+	_, err = service.ExtractUserID(ctx, issued.Access)
+	assert.Equal(auth.ErrUserTokenExpected, err)
+	decoded, err := generator.Decode(issued.Access.String(), testSecret)
+	assert.NoError(err)
+	typ, err := decoded.Type()
+	assert.NoError(err)
+	assert.Equal(token.TokenTypeAccess, typ)
+	account, err := service.CreateUser(ctx, uuid.Nil)
+	assert.NoError(err)
+	alice := user.User{Id: account.Id, UserAgent: TestUser.UserAgent}
+	assert.Equal(auth.ErrUserTokenExpected, service.Validate(ctx, &alice, decoded))
+	pair, err := service.GenerateTokens(ctx, alice)
+	assert.NoError(err)
+	_, err = service.ValidateClientToken(ctx, *pair.Access)
+	assert.Equal(auth.ErrClientTokenExpected, err)
+
+	// deleting a client stops it from getting new tokens
+	assert.NoError(service.DeleteClient(ctx, client.ID))
+	_, err = service.GetClient(ctx, client.ID)
+	assert.Equal(auth.ErrClientNotFound, err)
+	_, err = service.ClientCredentials(ctx, client.ID, clientSecret, "", caller)
+	assert.Equal(auth.ErrInvalidClient, err)
+	assert.Equal(auth.ErrClientNotFound, service.DeleteClient(ctx, client.ID))
+}
+
+func TestAuthorizationCode(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	generator := &token.SHA512Generator{}
+	passwords, err := password.NewHasher(password.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	assert.NoError(err)
+	service := newTestService(t, func(o *auth.AuthServiceOptions) {
+		o.Users = memory.NewUserRepository()
+		o.Passwords = passwords
+		o.OAuth = &auth.OAuthOptions{}
+	})
+
+	_, _, err = service.RegisterClient(ctx, auth.ClientRegistration{RedirectURIs: []string{"https://app.example.com/cb#frag"}})
+	assert.Equal(auth.ErrInvalidRedirectURI, err)
+	client, clientSecret, err := service.RegisterClient(ctx, auth.ClientRegistration{
+		Name:         "Billing",
+		Scopes:       []string{"profile", "email"},
+		RedirectURIs: []string{"https://billing.example.com/cb", "https://billing.example.com/alt"},
+	})
+	assert.NoError(err)
+	account, err := service.CreateUser(ctx, uuid.Nil)
+	assert.NoError(err)
+	assert.NoError(service.SetPassword(ctx, account.Id, "alice", "hunter2"))
+
+	verifier := "dBjftJeZ4CVP-mJ92K9Ju4SHrLzKbD6RGBhoKlYFeHfnTyR5p2DyZ"
+	sum := sha256.Sum256([]byte(verifier))
+	req := auth.AuthorizeRequest{
+		ClientID:            client.ID,
+		RedirectURI:         "https://billing.example.com/cb",
+		Scope:               "profile",
+		CodeChallenge:       base64.RawURLEncoding.EncodeToString(sum[:]),
+		CodeChallengeMethod: "S256",
+	}
+
+	// errors that can't be sent back to the client
+	bad := req
+	bad.ClientID = "unknown"
+	_, _, err = service.CheckAuthorizeRequest(ctx, bad)
+	assert.Equal(auth.ErrInvalidClient, err)
+	bad = req
+	bad.RedirectURI = "https://evil.example.com/cb"
+	_, _, err = service.CheckAuthorizeRequest(ctx, bad)
+	assert.Equal(auth.ErrInvalidRedirectURI, err)
+	bad.RedirectURI = ""
+	_, _, err = service.CheckAuthorizeRequest(ctx, bad)
+	assert.Equal(auth.ErrInvalidRedirectURI, err, "two URIs are registered")
+	// and those that can
+	bad = req
+	bad.Scope = "admin"
+	_, redirectURI, err := service.CheckAuthorizeRequest(ctx, bad)
+	assert.Equal(auth.ErrInvalidScope, err)
+	assert.Equal(req.RedirectURI, redirectURI)
+	bad = req
+	bad.CodeChallengeMethod = "plain"
+	_, _, err = service.CheckAuthorizeRequest(ctx, bad)
+	assert.Equal(auth.ErrInvalidCodeChallenge, err)
+
+	// the login page of the service signs the user in and asks for consent
+	browser := user.User{UserAgent: TestUser.UserAgent, IP: "192.0.2.1"}
+	_, err = service.Authorize(ctx, browser, "", req, true)
+	assert.Equal(auth.ErrLoginRequired, err)
+	login, err := service.Login(ctx, "alice", "hunter2", browser)
+	assert.NoError(err)
+	_, err = service.Authorize(ctx, browser, *login.Tokens.Access, req, false)
+	assert.Equal(auth.ErrConsentRequired, err)
+	code, err := service.Authorize(ctx, browser, *login.Tokens.Access, req, true)
+	assert.NoError(err)
+	// consent is remembered
+	_, err = service.Authorize(ctx, browser, *login.Tokens.Access, req, false)
+	assert.NoError(err)
+	wider := req
+	wider.Scope = "profile email"
+	_, err = service.Authorize(ctx, browser, *login.Tokens.Access, wider, false)
+	assert.Equal(auth.ErrConsentRequired, err)
+
+	backend := user.User{UserAgent: "billing/1.0", IP: "192.0.2.2"}
+	_, err = service.ExchangeCode(ctx, client.ID, "wrong", code, req.RedirectURI, verifier, backend)
+	assert.Equal(auth.ErrInvalidClient, err)
+	granted, err := service.ExchangeCode(ctx, client.ID, clientSecret, code, req.RedirectURI, verifier, backend)
+	assert.NoError(err)
+	assert.Equal("profile", granted.Scope)
+	assert.WithinDuration(time.Now().Add(testAccessTTL), granted.AccessExpiresAt, 2*time.Second)
+	decoded, err := generator.Decode(granted.Access.String(), testSecret)
+	assert.NoError(err)
+	claims, err := decoded.GetClaims()
+	assert.NoError(err)
+	assert.Equal(client.ID, claims.ClientID)
+	assert.Equal("profile", claims.Scope)
+	assert.Equal([]string{"pwd"}, claims.AMR)
+	id, err := service.ExtractUserID(ctx, granted.Access)
+	assert.NoError(err)
+	assert.Equal(account.Id, id)
+
+	// codes are single use, and bound to the redirect URI and verifier
+	_, err = service.ExchangeCode(ctx, client.ID, clientSecret, code, req.RedirectURI, verifier, backend)
+	assert.Equal(auth.ErrInvalidGrant, err)
+	code, err = service.Authorize(ctx, browser, *login.Tokens.Access, req, false)
+	assert.NoError(err)
+	_, err = service.ExchangeCode(ctx, client.ID, clientSecret, code, req.RedirectURI, verifier[1:]+"x", backend)
+	assert.Equal(auth.ErrInvalidGrant, err)
+	code, err = service.Authorize(ctx, browser, *login.Tokens.Access, req, false)
+	assert.NoError(err)
+	_, err = service.ExchangeCode(ctx, client.ID, clientSecret, code, "https://billing.example.com/alt", verifier, backend)
+	assert.Equal(auth.ErrInvalidGrant, err)
+
+	// client tokens can't authorize on behalf of a user
+	_, err = service.Authorize(ctx, browser, *granted.Access, req, true)
+	assert.Equal(auth.ErrLoginRequired, err)
+
+	// refreshing may narrow the scope but not widen it
+	_, err = service.RefreshGrant(ctx, client.ID, clientSecret, *granted.Refresh, "profile email", backend)
+	assert.Equal(auth.ErrInvalidScope, err)
+	_, err = service.RefreshGrant(ctx, client.ID, clientSecret, *login.Tokens.Refresh, "", backend)
+	assert.Equal(auth.ErrInvalidGrant, err, "tokens of the service itself aren't the client's")
+	_, err = service.RefreshGrant(ctx, client.ID, clientSecret, *granted.Access, "", backend)
+	assert.Equal(auth.ErrInvalidGrant, err, "access tokens can't be refreshed")
+	refreshed, err := service.RefreshGrant(ctx, client.ID, clientSecret, *granted.Refresh, "", backend)
+	assert.NoError(err)
+	assert.Equal("profile", refreshed.Scope)
+	_, err = service.RefreshGrant(ctx, client.ID, clientSecret, *granted.Refresh, "", backend)
+	assert.Equal(auth.ErrRefreshTokenReused, err)
+
+	// public clients authenticate with PKCE alone
+	public, publicSecret, err := service.RegisterClient(ctx, auth.ClientRegistration{
+		Public:       true,
+		Scopes:       []string{"profile"},
+		RedirectURIs: []string{"com.example.app:/cb"},
+	})
+	assert.NoError(err)
+	assert.Empty(publicSecret)
+	_, err = service.ClientCredentials(ctx, public.ID, "", "", backend)
+	assert.Equal(auth.ErrUnauthorizedClient, err)
+	preq := req
+	preq.ClientID = public.ID
+	preq.RedirectURI = ""
+	preq.Scope = ""
+	code, err = service.Authorize(ctx, browser, *login.Tokens.Access, preq, true)
+	assert.NoError(err)
+	_, err = service.ExchangeCode(ctx, public.ID, "", code, "com.example.app:/cb", verifier, backend)
+	assert.Equal(auth.ErrInvalidGrant, err, "the request had no redirect URI")
+	code, err = service.Authorize(ctx, browser, *login.Tokens.Access, preq, false)
+	assert.NoError(err)
+	granted, err = service.ExchangeCode(ctx, public.ID, "", code, "", verifier, backend)
+	assert.NoError(err)
+	assert.Equal("profile", granted.Scope)
+}
+
+func TestDeviceAuthorization(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	generator := &token.SHA512Generator{}
+	passwords, err := password.NewHasher(password.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	assert.NoError(err)
+	interval := 50 * time.Millisecond
+	newService := func(ttl time.Duration) *auth.AuthService {
+		return newTestService(t, func(o *auth.AuthServiceOptions) {
+			o.Users = memory.NewUserRepository()
+			o.Passwords = passwords
+			o.OAuth = &auth.OAuthOptions{DeviceCodeTTL: ttl, DeviceInterval: interval}
+		})
+	}
+	service := newService(time.Minute)
+
+	tv, _, err := service.RegisterClient(ctx, auth.ClientRegistration{
+		Name:   "TV",
+		Public: true,
+		Scopes: []string{"profile", "email"},
+	})
+	assert.NoError(err)
+	account, err := service.CreateUser(ctx, uuid.Nil)
+	assert.NoError(err)
+	assert.NoError(service.SetPassword(ctx, account.Id, "alice", "hunter2"))
+
+	_, err = service.AuthorizeDevice(ctx, tv.ID, "", "admin")
+	assert.Equal(auth.ErrInvalidScope, err)
+	device, err := service.AuthorizeDevice(ctx, tv.ID, "", "profile")
+	assert.NoError(err)
+	assert.Regexp(`^[B-Z]{4}-[B-Z]{4}$`, device.UserCode)
+	assert.Equal(interval, device.Interval)
+	assert.WithinDuration(time.Now().Add(time.Minute), device.ExpiresAt, 2*time.Second)
+
+	// the device polls until the user decides, at most every interval
+	tvUser := user.User{UserAgent: "tv/1.0", IP: "192.0.2.3"}
+	_, err = service.PollDevice(ctx, tv.ID, "", "unknown", tvUser)
+	assert.Equal(auth.ErrInvalidGrant, err)
+	_, err = service.PollDevice(ctx, tv.ID, "", device.DeviceCode, tvUser)
+	assert.Equal(auth.ErrAuthorizationPending, err)
+	time.Sleep(interval)
+	_, err = service.PollDevice(ctx, tv.ID, "", device.DeviceCode, tvUser)
+	assert.Equal(auth.ErrAuthorizationPending, err)
+	_, err = service.PollDevice(ctx, tv.ID, "", device.DeviceCode, tvUser)
+	assert.Equal(auth.ErrSlowDown, err)
+	// which raises the interval by 5 seconds for the rest of its polls
+	time.Sleep(interval)
+	_, err = service.PollDevice(ctx, tv.ID, "", device.DeviceCode, tvUser)
+	assert.Equal(auth.ErrSlowDown, err)
+
+	// the user enters the code on another screen, as typed
+	typed := strings.ToLower(strings.ReplaceAll(device.UserCode, "-", " "))
+	_, _, err = service.DeviceRequest(ctx, "BCDF-GHJK")
+	assert.Equal(auth.ErrDeviceCodeNotFound, err)
+	d, client, err := service.DeviceRequest(ctx, typed)
+	assert.NoError(err)
+	assert.Equal("TV", client.Name)
+	assert.Equal("profile", d.Scope)
+
+	phone := user.User{UserAgent: TestUser.UserAgent, IP: "192.0.2.1"}
+	err = service.DecideDevice(ctx, phone, "", typed, true)
+	assert.Equal(auth.ErrLoginRequired, err)
+	login, err := service.Login(ctx, "alice", "hunter2", phone)
+	assert.NoError(err)
+	assert.NoError(service.DecideDevice(ctx, phone, *login.Tokens.Access, typed, true))
+	err = service.DecideDevice(ctx, phone, *login.Tokens.Access, typed, false)
+	assert.Equal(auth.ErrDeviceCodeNotFound, err, "codes are decided once")
+
+	time.Sleep(interval)
+	granted, err := service.PollDevice(ctx, tv.ID, "", device.DeviceCode, tvUser)
+	assert.NoError(err)
+	assert.Equal("profile", granted.Scope)
+	decoded, err := generator.Decode(granted.Access.String(), testSecret)
+	assert.NoError(err)
+	claims, err := decoded.GetClaims()
+	assert.NoError(err)
+	assert.Equal(tv.ID, claims.ClientID)
+	assert.Equal("profile", claims.Scope)
+	assert.Equal([]string{"pwd"}, claims.AMR)
+	id, err := service.ExtractUserID(ctx, granted.Access)
+	assert.NoError(err)
+	assert.Equal(account.Id, id)
+	_, err = service.PollDevice(ctx, tv.ID, "", device.DeviceCode, tvUser)
+	assert.Equal(auth.ErrInvalidGrant, err, "tokens are issued once")
+
+	// a denied device is told so, and only its client may poll
+	device, err = service.AuthorizeDevice(ctx, tv.ID, "", "")
+	assert.NoError(err)
+	other, _, err := service.RegisterClient(ctx, auth.ClientRegistration{Public: true})
+	assert.NoError(err)
+	_, err = service.PollDevice(ctx, other.ID, "", device.DeviceCode, tvUser)
+	assert.Equal(auth.ErrInvalidGrant, err)
+	assert.NoError(service.DecideDevice(ctx, phone, *login.Tokens.Access, device.UserCode, false))
+	_, err = service.PollDevice(ctx, tv.ID, "", device.DeviceCode, tvUser)
+	assert.Equal(auth.ErrAccessDenied, err)
+
+	// expired codes can't be decided and tell the device so
+	service = newService(interval)
+	tv, _, err = service.RegisterClient(ctx, auth.ClientRegistration{Public: true})
+	assert.NoError(err)
+	device, err = service.AuthorizeDevice(ctx, tv.ID, "", "")
+	assert.NoError(err)
+	time.Sleep(interval)
+	_, _, err = service.DeviceRequest(ctx, device.UserCode)
+	assert.Equal(auth.ErrDeviceCodeNotFound, err)
+	_, err = service.PollDevice(ctx, tv.ID, "", device.DeviceCode, tvUser)
+	assert.Equal(auth.ErrDeviceCodeExpired, err)
+}
+
+func TestIntrospection(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	generator := &token.SHA512Generator{}
+	service := newTestService(t, func(o *auth.AuthServiceOptions) {
+		o.Users = memory.NewUserRepository()
+		o.OAuth = &auth.OAuthOptions{}
+	})
+
+	api, apiSecret, err := service.RegisterClient(ctx, auth.ClientRegistration{Scopes: []string{"users:read"}})
+	assert.NoError(err)
+	public, _, err := service.RegisterClient(ctx, auth.ClientRegistration{Public: true})
+	assert.NoError(err)
+	account, err := service.CreateUser(ctx, uuid.Nil)
+	assert.NoError(err)
+	u := user.User{Id: account.Id, UserAgent: TestUser.UserAgent}
+	pair, err := service.GenerateTokens(ctx, u)
+	assert.NoError(err)
+
+	// only confidential clients may introspect
+	_, err = service.Introspect(ctx, api.ID, "wrong", *pair.Access)
+	assert.Equal(auth.ErrInvalidClient, err)
+	_, err = service.Introspect(ctx, public.ID, "", *pair.Access)
+	assert.Equal(auth.ErrUnauthorizedClient, err)
+
+	info, err := service.Introspect(ctx, api.ID, apiSecret, *pair.Access)
+	assert.NoError(err)
+	assert.True(info.Active)
+	assert.False(info.Refresh)
+	assert.Equal(account.Id.String(), info.Subject)
+	assert.WithinDuration(time.Now().Add(testAccessTTL), info.ExpiresAt, 2*time.Second)
+	assert.WithinDuration(time.Now(), info.IssuedAt, 2*time.Second)
+	assert.Empty(info.ClientID)
+	info, err = service.Introspect(ctx, api.ID, apiSecret, *pair.Refresh)
+	assert.NoError(err)
+	assert.True(info.Active)
+	assert.True(info.Refresh)
+
+	issued, err := service.ClientCredentials(ctx, api.ID, apiSecret, "", u)
+	assert.NoError(err)
+	info, err = service.Introspect(ctx, api.ID, apiSecret, *issued.Access)
+	assert.NoError(err)
+	assert.True(info.Active)
+	assert.Equal(api.ID, info.Subject)
+	assert.Equal(api.ID, info.ClientID)
+	assert.Equal("users:read", info.Scope)
+
+	// inactive tokens are described by nothing else
+	for _, bad := range []token.EncodedToken{"garbage", token.EncodedToken(pair.Access.String() + "x")} {
+		info, err = service.Introspect(ctx, api.ID, apiSecret, bad)
+		assert.NoError(err)
+		assert.Equal(auth.Introspection{}, info)
+	}
+	refreshed, err := service.Refresh(ctx, u, pair)
+	assert.NoError(err)
+	info, err = service.Introspect(ctx, api.ID, apiSecret, *pair.Access)
+	assert.NoError(err)
+	assert.False(info.Active, "blacklisted by the refresh")
+	info, err = service.Introspect(ctx, api.ID, apiSecret, *pair.Refresh)
+	assert.NoError(err)
+	assert.False(info.Active, "rotated away")
+
+	// tokens issued before they had a type are told apart by the record
+	legacy := generator.Generate(token.Options{User: u, TTL: testAccessTTL})
+	enc, err := generator.Encode(legacy, testSecret)
+	assert.NoError(err)
+	info, err = service.Introspect(ctx, api.ID, apiSecret, token.EncodedToken(enc))
+	assert.NoError(err)
+	assert.True(info.Active)
+	assert.False(info.Refresh)
+
+	assert.NoError(service.DisableUser(ctx, account.Id))
+	info, err = service.Introspect(ctx, api.ID, apiSecret, *refreshed.Access)
+	assert.NoError(err)
+	assert.False(info.Active)
+}
+
+func TestTokenRevocation(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	passwords, err := password.NewHasher(password.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	assert.NoError(err)
+	service := newTestService(t, func(o *auth.AuthServiceOptions) {
+		o.Users = memory.NewUserRepository()
+		o.Passwords = passwords
+		o.OAuth = &auth.OAuthOptions{}
+	})
+
+	client, clientSecret, err := service.RegisterClient(ctx, auth.ClientRegistration{
+		Scopes:       []string{"profile"},
+		RedirectURIs: []string{"https://app.example.com/cb"},
+	})
+	assert.NoError(err)
+	other, otherSecret, err := service.RegisterClient(ctx, auth.ClientRegistration{Scopes: []string{"profile"}})
+	assert.NoError(err)
+	account, err := service.CreateUser(ctx, uuid.Nil)
+	assert.NoError(err)
+	assert.NoError(service.SetPassword(ctx, account.Id, "alice", "hunter2"))
+	browser := user.User{UserAgent: TestUser.UserAgent, IP: "192.0.2.1"}
+	login, err := service.Login(ctx, "alice", "hunter2", browser)
+	assert.NoError(err)
+
+	verifier := "dBjftJeZ4CVP-mJ92K9Ju4SHrLzKbD6RGBhoKlYFeHfnTyR5p2DyZ"
+	sum := sha256.Sum256([]byte(verifier))
+	code, err := service.Authorize(ctx, browser, *login.Tokens.Access, auth.AuthorizeRequest{
+		ClientID:            client.ID,
+		CodeChallenge:       base64.RawURLEncoding.EncodeToString(sum[:]),
+		CodeChallengeMethod: "S256",
+	}, true)
+	assert.NoError(err)
+	backend := user.User{UserAgent: "app/1.0", IP: "192.0.2.2"}
+	granted, err := service.ExchangeCode(ctx, client.ID, clientSecret, code, "", verifier, backend)
+	assert.NoError(err)
+
+	// unknown tokens are fine, tokens of others are not
+	assert.NoError(service.RevokeToken(ctx, client.ID, clientSecret, "garbage", backend))
+	assert.Equal(auth.ErrInvalidClient, service.RevokeToken(ctx, client.ID, "wrong", *granted.Access, backend))
+	assert.Equal(auth.ErrUnauthorizedClient, service.RevokeToken(ctx, other.ID, otherSecret, *granted.Access, backend))
+	assert.Equal(auth.ErrUnauthorizedClient, service.RevokeToken(ctx, client.ID, clientSecret, *login.Tokens.Access, backend),
+		"tokens of the service itself aren't the client's")
+
+	// access tokens are blacklisted, the session lives on
+	assert.NoError(service.RevokeToken(ctx, client.ID, clientSecret, *granted.Access, backend))
+	_, err = service.ExtractUserID(ctx, granted.Access)
+	assert.Equal(auth.ErrBlackListedToken, err)
+	assert.NoError(service.RevokeToken(ctx, client.ID, clientSecret, *granted.Access, backend), "revoking twice is fine")
+	info, err := service.Introspect(ctx, client.ID, clientSecret, *granted.Refresh)
+	assert.NoError(err)
+	assert.True(info.Active)
+
+	// refresh tokens end their own session without counting as reuse, the
+	// other sessions of the user live on
+	assert.NoError(service.RevokeToken(ctx, client.ID, clientSecret, *granted.Refresh, backend))
+	_, err = service.RefreshGrant(ctx, client.ID, clientSecret, *granted.Refresh, "", backend)
+	assert.Equal(auth.ErrBlackListedToken, err)
+	info, err = service.Introspect(ctx, client.ID, clientSecret, *granted.Refresh)
+	assert.NoError(err)
+	assert.False(info.Active)
+	info, err = service.Introspect(ctx, client.ID, clientSecret, *login.Tokens.Refresh)
+	assert.NoError(err)
+	assert.True(info.Active)
+
+	issued, err := service.ClientCredentials(ctx, client.ID, clientSecret, "", backend)
+	assert.NoError(err)
+	assert.NoError(service.RevokeToken(ctx, client.ID, clientSecret, *issued.Access, backend))
+	_, err = service.ValidateClientToken(ctx, *issued.Access)
+	assert.Equal(auth.ErrBlackListedToken, err)
+}
+
+func TestOpenIDConnect(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	generator := &token.SHA512Generator{}
+	passwords, err := password.NewHasher(password.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	assert.NoError(err)
+	key, err := token.GenerateSigningKey()
+	assert.NoError(err)
+	service := newTestService(t, func(o *auth.AuthServiceOptions) {
+		o.Users = memory.NewUserRepository()
+		o.Passwords = passwords
+		o.OAuth = &auth.OAuthOptions{
+			Scopes:     []string{"invoices:read"},
+			Issuer:     "https://auth.example.com",
+			SigningKey: key,
+		}
+	})
+
+	// the openid scopes are allowed next to the configured ones
+	client, clientSecret, err := service.RegisterClient(ctx, auth.ClientRegistration{
+		Scopes:                 []string{"openid", "profile", "email", "invoices:read"},
+		RedirectURIs:           []string{"https://app.example.com/cb"},
+		PostLogoutRedirectURIs: []string{"https://app.example.com/"},
+	})
+	assert.NoError(err)
+	account, err := service.CreateUser(ctx, uuid.Nil)
+	assert.NoError(err)
+	assert.NoError(service.SetPassword(ctx, account.Id, "alice@example.com", "hunter2"))
+	browser := user.User{UserAgent: TestUser.UserAgent, IP: "192.0.2.1"}
+	login, err := service.Login(ctx, "alice@example.com", "hunter2", browser)
+	assert.NoError(err)
+
+	verifier := "dBjftJeZ4CVP-mJ92K9Ju4SHrLzKbD6RGBhoKlYFeHfnTyR5p2DyZ"
+	sum := sha256.Sum256([]byte(verifier))
+	authorize := func(scope, nonce string) auth.GrantedTokens {
+		t.Helper()
+		code, err := service.Authorize(ctx, browser, *login.Tokens.Access, auth.AuthorizeRequest{
+			ClientID:            client.ID,
+			Scope:               scope,
+			CodeChallenge:       base64.RawURLEncoding.EncodeToString(sum[:]),
+			CodeChallengeMethod: "S256",
+			Nonce:               nonce,
+		}, true)
+		assert.NoError(err)
+		granted, err := service.ExchangeCode(ctx, client.ID, clientSecret, code, "", verifier, user.User{UserAgent: "app/1.0"})
+		assert.NoError(err)
+		return granted
+	}
+
+	granted := authorize("openid profile", "n-0S6_WzA2Mj")
+	assert.NotEmpty(granted.IDToken)
+	// ID tokens are signed with the published key rather than the secret
+	_, err = generator.Decode(granted.IDToken.String(), testSecret)
+	assert.Error(err)
+	decoded, err := key.Verify(granted.IDToken.String())
+	assert.NoError(err)
+	claims, err := decoded.GetClaims()
+	assert.NoError(err)
+	assert.Equal(token.TokenTypeID, claims.TokenType)
+	assert.Equal("https://auth.example.com", claims.Issuer)
+	assert.Equal([]string{client.ID}, []string(claims.Audience))
+	assert.Equal(account.Id.String(), claims.Subject)
+	assert.Equal("n-0S6_WzA2Mj", claims.Nonce)
+	assert.Equal(auth.ACRSingleFactor, claims.ACR)
+	assert.Equal([]string{"pwd"}, claims.AMR)
+	assert.NotNil(claims.SessionStart)
+	atHash := sha256.Sum256([]byte(*granted.Access))
+	assert.Equal(base64.RawURLEncoding.EncodeToString(atHash[:16]), claims.AccessTokenHash)
+
+	// ID tokens are no bearer tokens
+	_, err = service.ExtractUserID(ctx, &granted.IDToken)
+	assert.Equal(auth.CodeInvalidToken, auth.ErrorCode(err))
+	_, err = service.UserInfo(ctx, granted.IDToken)
+	assert.Equal(auth.CodeInvalidToken, auth.ErrorCode(err))
+	info, err := service.Introspect(ctx, client.ID, clientSecret, granted.IDToken)
+	assert.NoError(err)
+	assert.False(info.Active)
+
+	// claims follow the scopes
+	userInfo, err := service.UserInfo(ctx, *granted.Access)
+	assert.NoError(err)
+	assert.Equal(&auth.UserInfo{Subject: account.Id, Login: "alice@example.com"}, userInfo)
+	withEmail := authorize("openid email", "")
+	userInfo, err = service.UserInfo(ctx, *withEmail.Access)
+	assert.NoError(err)
+	assert.Equal(&auth.UserInfo{Subject: account.Id, Email: "alice@example.com"}, userInfo)
+	decoded, err = key.Verify(withEmail.IDToken.String())
+	assert.NoError(err)
+	claims, err = decoded.GetClaims()
+	assert.NoError(err)
+	assert.Empty(claims.Nonce)
+
+	// without openid there is neither ID token nor userinfo
+	plain := authorize("invoices:read", "")
+	assert.Empty(plain.IDToken)
+	_, err = service.UserInfo(ctx, *plain.Access)
+	assert.Equal(auth.ErrInsufficientScope, err)
+	_, err = service.UserInfo(ctx, *login.Tokens.Access)
+	assert.Equal(auth.ErrInsufficientScope, err)
+	_, err = service.UserInfo(ctx, *granted.Refresh)
+	assert.Equal(auth.ErrAccessTokenExpected, err)
+
+	// refreshing issues a new ID token
+	refreshed, err := service.RefreshGrant(ctx, client.ID, clientSecret, *withEmail.Refresh, "", user.User{UserAgent: "app/1.0"})
+	assert.NoError(err)
+	assert.NotEmpty(refreshed.IDToken)
+
+	// logout needs a registered redirect and ends the sessions of the user
+	// with the client, not the others
+	err = service.EndSession(ctx, browser, granted.IDToken, "https://evil.example.com/")
+	assert.Equal(auth.ErrInvalidRedirectURI, err)
+	err = service.EndSession(ctx, browser, *refreshed.Access, "")
+	assert.Equal(auth.CodeInvalidToken, auth.ErrorCode(err))
+	notID, err := key.Sign(generator.Generate(token.Options{
+		User:     user.User{Id: account.Id},
+		TTL:      time.Minute,
+		Type:     token.TokenTypeAccess,
+		Audience: client.ID,
+	}))
+	assert.NoError(err)
+	err = service.EndSession(ctx, browser, token.EncodedToken(notID), "")
+	assert.Equal(auth.ErrIDTokenExpected, err)
+	assert.NoError(service.EndSession(ctx, browser, granted.IDToken, "https://app.example.com/"))
+	info, err = service.Introspect(ctx, client.ID, clientSecret, *refreshed.Refresh)
+	assert.NoError(err)
+	assert.False(info.Active)
+	info, err = service.Introspect(ctx, client.ID, clientSecret, *login.Tokens.Refresh)
+	assert.NoError(err)
+	assert.True(info.Active, "the user's own session lives on")
+
+	// expired hints are still accepted while their session may live, those
+	// of other keys or the secret are not
+	hint := generator.Generate(token.Options{
+		User:     user.User{Id: account.Id},
+		TTL:      -time.Minute,
+		Type:     token.TokenTypeID,
+		Audience: client.ID,
+	})
+	expired, err := key.Sign(hint)
+	assert.NoError(err)
+	assert.NoError(service.EndSession(ctx, browser, token.EncodedToken(expired), ""))
+	stale := generator.Generate(token.Options{
+		User:     user.User{Id: account.Id},
+		TTL:      -time.Minute,
+		Type:     token.TokenTypeID,
+		Audience: client.ID,
+	})
+	staleClaims, err := stale.GetClaims()
+	assert.NoError(err)
+	staleClaims.IssuedAt = jwt.NewNumericDate(time.Now().Add(-testRefreshTTL - time.Minute))
+	old, err := key.Sign(stale)
+	assert.NoError(err)
+	assert.Equal(auth.ErrTokenExpired, service.EndSession(ctx, browser, token.EncodedToken(old), ""))
+	other, err := token.GenerateSigningKey()
+	assert.NoError(err)
+	forged, err := other.Sign(hint)
+	assert.NoError(err)
+	assert.Error(service.EndSession(ctx, browser, token.EncodedToken(forged), ""))
+	forged, err = generator.Encode(hint, testSecret)
+	assert.NoError(err)
+	assert.Error(service.EndSession(ctx, browser, token.EncodedToken(forged), ""))
+
+	// a signing key is required with an issuer
+	_, err = auth.NewAuthService(testServiceOptions(func(o *auth.AuthServiceOptions) {
+		o.Users = memory.NewUserRepository()
+		o.OAuth = &auth.OAuthOptions{Issuer: "https://auth.example.com"}
+	}))
+	assert.Error(err)
+}
@@ -0,0 +1,390 @@
+package conformance
+
+import (
+	"context"
+	"medods-auth/service/auth"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ClientUserRepository is a user repository storing OAuth clients.
+type ClientUserRepository interface {
+	auth.UserRepository
+	auth.ClientRepository
+}
+
+type ClientRepositoryFactory func(t *testing.T) ClientUserRepository
+
+func RunClients(t *testing.T, factory ClientRepositoryFactory) {
+	t.Run("Clients", func(t *testing.T) {
+		t.Run("CreateGet", func(t *testing.T) { testClientCreateGet(t, factory(t)) })
+		t.Run("Duplicate", func(t *testing.T) { testClientDuplicate(t, factory(t)) })
+		t.Run("NoScopes", func(t *testing.T) { testClientNoScopes(t, factory(t)) })
+		t.Run("Delete", func(t *testing.T) { testClientDelete(t, factory(t)) })
+		t.Run("Public", func(t *testing.T) { testClientPublic(t, factory(t)) })
+		t.Run("AuthCode", func(t *testing.T) { testAuthCode(t, factory(t)) })
+		t.Run("ExpiredAuthCode", func(t *testing.T) { testExpiredAuthCode(t, factory(t)) })
+		t.Run("Consent", func(t *testing.T) { testConsent(t, factory(t)) })
+		t.Run("ConsentDeleteUser", func(t *testing.T) { testConsentDeleteUser(t, factory(t)) })
+		t.Run("ConsentUnknownUser", func(t *testing.T) { testConsentUnknownUser(t, factory(t)) })
+		t.Run("DeviceCode", func(t *testing.T) { testDeviceCode(t, factory(t)) })
+		t.Run("DeviceCodeDenied", func(t *testing.T) { testDeviceCodeDenied(t, factory(t)) })
+		t.Run("ExpiredDeviceCode", func(t *testing.T) { testExpiredDeviceCode(t, factory(t)) })
+	})
+}
+
+func newClient(id string) *auth.Client {
+	return &auth.Client{
+		ID:         id,
+		Name:       "Billing",
+		SecretHash: "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		Scopes:     []string{"users:read", "audit:read"},
+		RedirectURIs: []string{
+			"https://billing.example.com/callback",
+			"com.example.billing:/callback",
+		},
+		PostLogoutRedirectURIs: []string{"https://billing.example.com/"},
+		AccessTTL:              90 * time.Second,
+		CreatedAt:              time.Now().UTC().Truncate(time.Millisecond),
+	}
+}
+
+func testClientCreateGet(t *testing.T, repo ClientUserRepository) {
+	ctx := context.Background()
+
+	_, err := repo.GetClient(ctx, "billing")
+	assert.ErrorIs(t, err, auth.ErrClientNotFound)
+
+	client := newClient("billing")
+	require.NoError(t, repo.CreateClient(ctx, client))
+	got, err := repo.GetClient(ctx, "billing")
+	require.NoError(t, err)
+	assert.Equal(t, client.ID, got.ID)
+	assert.Equal(t, client.Name, got.Name)
+	assert.Equal(t, client.SecretHash, got.SecretHash)
+	assert.False(t, got.Public)
+	assert.Equal(t, client.Scopes, got.Scopes)
+	assert.Equal(t, client.RedirectURIs, got.RedirectURIs)
+	assert.Equal(t, client.PostLogoutRedirectURIs, got.PostLogoutRedirectURIs)
+	assert.Equal(t, client.AccessTTL, got.AccessTTL)
+	assert.True(t, client.CreatedAt.Equal(got.CreatedAt))
+}
+
+func testClientDuplicate(t *testing.T, repo ClientUserRepository) {
+	ctx := context.Background()
+	require.NoError(t, repo.CreateClient(ctx, newClient("billing")))
+
+	other := newClient("billing")
+	other.SecretHash = "fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9"
+	err := repo.CreateClient(ctx, other)
+	assert.ErrorIs(t, err, auth.ErrClientExists)
+
+	got, err := repo.GetClient(ctx, "billing")
+	require.NoError(t, err)
+	assert.NotEqual(t, other.SecretHash, got.SecretHash)
+}
+
+func testClientNoScopes(t *testing.T, repo ClientUserRepository) {
+	ctx := context.Background()
+	client := newClient("billing")
+	client.Scopes = nil
+	client.RedirectURIs = nil
+	client.PostLogoutRedirectURIs = nil
+	client.AccessTTL = 0
+	require.NoError(t, repo.CreateClient(ctx, client))
+
+	got, err := repo.GetClient(ctx, "billing")
+	require.NoError(t, err)
+	assert.Empty(t, got.Scopes)
+	assert.Empty(t, got.RedirectURIs)
+	assert.Empty(t, got.PostLogoutRedirectURIs)
+	assert.Zero(t, got.AccessTTL)
+}
+
+func testClientDelete(t *testing.T, repo ClientUserRepository) {
+	ctx := context.Background()
+	require.NoError(t, repo.CreateClient(ctx, newClient("billing")))
+
+	require.NoError(t, repo.DeleteClient(ctx, "billing"))
+	_, err := repo.GetClient(ctx, "billing")
+	assert.ErrorIs(t, err, auth.ErrClientNotFound)
+	assert.ErrorIs(t, repo.DeleteClient(ctx, "billing"), auth.ErrClientNotFound)
+
+	// the ID can be reused
+	require.NoError(t, repo.CreateClient(ctx, newClient("billing")))
+}
+
+func testClientPublic(t *testing.T, repo ClientUserRepository) {
+	ctx := context.Background()
+	client := newClient("spa")
+	client.SecretHash = ""
+	client.Public = true
+	require.NoError(t, repo.CreateClient(ctx, client))
+
+	got, err := repo.GetClient(ctx, "spa")
+	require.NoError(t, err)
+	assert.True(t, got.Public)
+	assert.Empty(t, got.SecretHash)
+}
+
+func newAuthCode(hash string, userID uuid.UUID) *auth.AuthCode {
+	return &auth.AuthCode{
+		Hash:          hash,
+		ClientID:      "billing",
+		UserID:        userID,
+		RedirectURI:   "https://billing.example.com/callback",
+		Scope:         "audit:read users:read",
+		CodeChallenge: "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		Nonce:         "n-0S6_WzA2Mj",
+		AMR:           []string{"pwd", "otp"},
+		AuthTime:      time.Now().Add(-time.Minute).UTC().Truncate(time.Millisecond),
+		ExpiresAt:     time.Now().Add(time.Minute).UTC().Truncate(time.Millisecond),
+	}
+}
+
+func testAuthCode(t *testing.T, repo ClientUserRepository) {
+	ctx := context.Background()
+	_, err := repo.TakeAuthCode(ctx, "code-1")
+	assert.ErrorIs(t, err, auth.ErrAuthCodeNotFound)
+
+	c := newAuthCode("code-1", uuid.New())
+	require.NoError(t, repo.PutAuthCode(ctx, c))
+	other := newAuthCode("code-2", uuid.New())
+	other.RedirectURI = ""
+	require.NoError(t, repo.PutAuthCode(ctx, other))
+
+	got, err := repo.TakeAuthCode(ctx, "code-1")
+	require.NoError(t, err)
+	assert.Equal(t, c.Hash, got.Hash)
+	assert.Equal(t, c.ClientID, got.ClientID)
+	assert.Equal(t, c.UserID, got.UserID)
+	assert.Equal(t, c.RedirectURI, got.RedirectURI)
+	assert.Equal(t, c.Scope, got.Scope)
+	assert.Equal(t, c.CodeChallenge, got.CodeChallenge)
+	assert.Equal(t, c.Nonce, got.Nonce)
+	assert.Equal(t, c.AMR, got.AMR)
+	assert.True(t, c.AuthTime.Equal(got.AuthTime))
+	assert.True(t, c.ExpiresAt.Equal(got.ExpiresAt))
+
+	// codes are single use
+	_, err = repo.TakeAuthCode(ctx, "code-1")
+	assert.ErrorIs(t, err, auth.ErrAuthCodeNotFound)
+
+	got, err = repo.TakeAuthCode(ctx, "code-2")
+	require.NoError(t, err)
+	assert.Empty(t, got.RedirectURI)
+}
+
+func testExpiredAuthCode(t *testing.T, repo ClientUserRepository) {
+	ctx := context.Background()
+	c := newAuthCode("code-1", uuid.New())
+	c.ExpiresAt = time.Now().Add(-time.Second)
+	require.NoError(t, repo.PutAuthCode(ctx, c))
+	_, err := repo.TakeAuthCode(ctx, "code-1")
+	assert.ErrorIs(t, err, auth.ErrAuthCodeNotFound)
+}
+
+func testConsent(t *testing.T, repo ClientUserRepository) {
+	ctx := context.Background()
+	id := createAccount(t, repo)
+	require.NoError(t, repo.CreateClient(ctx, newClient("billing")))
+	require.NoError(t, repo.CreateClient(ctx, newClient("crm")))
+
+	_, err := repo.GetConsent(ctx, id, "billing")
+	assert.ErrorIs(t, err, auth.ErrConsentNotFound)
+
+	consent := &auth.Consent{
+		UserID:    id,
+		ClientID:  "billing",
+		Scopes:    []string{"users:read"},
+		GrantedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	require.NoError(t, repo.PutConsent(ctx, consent))
+	got, err := repo.GetConsent(ctx, id, "billing")
+	require.NoError(t, err)
+	assert.Equal(t, id, got.UserID)
+	assert.Equal(t, "billing", got.ClientID)
+	assert.Equal(t, consent.Scopes, got.Scopes)
+	assert.True(t, consent.GrantedAt.Equal(got.GrantedAt))
+
+	// consents are per client
+	_, err = repo.GetConsent(ctx, id, "crm")
+	assert.ErrorIs(t, err, auth.ErrConsentNotFound)
+
+	consent.Scopes = []string{"audit:read", "users:read"}
+	consent.GrantedAt = consent.GrantedAt.Add(time.Second)
+	require.NoError(t, repo.PutConsent(ctx, consent))
+	got, err = repo.GetConsent(ctx, id, "billing")
+	require.NoError(t, err)
+	assert.Equal(t, consent.Scopes, got.Scopes)
+	assert.True(t, consent.GrantedAt.Equal(got.GrantedAt))
+}
+
+func testConsentDeleteUser(t *testing.T, repo ClientUserRepository) {
+	ctx := context.Background()
+	id := createAccount(t, repo)
+	require.NoError(t, repo.CreateClient(ctx, newClient("billing")))
+	require.NoError(t, repo.PutConsent(ctx, &auth.Consent{
+		UserID:    id,
+		ClientID:  "billing",
+		Scopes:    []string{"users:read"},
+		GrantedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}))
+
+	require.NoError(t, repo.Delete(ctx, id))
+	_, err := repo.GetConsent(ctx, id, "billing")
+	assert.ErrorIs(t, err, auth.ErrConsentNotFound)
+}
+
+func testConsentUnknownUser(t *testing.T, repo ClientUserRepository) {
+	ctx := context.Background()
+	require.NoError(t, repo.CreateClient(ctx, newClient("billing")))
+	err := repo.PutConsent(ctx, &auth.Consent{
+		UserID:    uuid.New(),
+		ClientID:  "billing",
+		GrantedAt: time.Now().UTC(),
+	})
+	assert.ErrorIs(t, err, auth.ErrUserNotFound)
+}
+
+func newDeviceCode(hash, userCode string) *auth.DeviceCode {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	return &auth.DeviceCode{
+		Hash:      hash,
+		UserCode:  userCode,
+		ClientID:  "billing",
+		Scope:     "audit:read users:read",
+		Status:    auth.DevicePending,
+		Interval:  5 * time.Second,
+		ExpiresAt: now.Add(time.Minute),
+		KeepUntil: now.Add(2 * time.Minute),
+	}
+}
+
+func testDeviceCode(t *testing.T, repo ClientUserRepository) {
+	ctx := context.Background()
+	_, err := repo.GetDeviceCode(ctx, "BCDFGHJK")
+	assert.ErrorIs(t, err, auth.ErrDeviceCodeNotFound)
+	_, err = repo.PollDeviceCode(ctx, "device-1", time.Now())
+	assert.ErrorIs(t, err, auth.ErrDeviceCodeNotFound)
+
+	d := newDeviceCode("device-1", "BCDFGHJK")
+	require.NoError(t, repo.PutDeviceCode(ctx, d))
+	err = repo.PutDeviceCode(ctx, newDeviceCode("device-2", "BCDFGHJK"))
+	assert.ErrorIs(t, err, auth.ErrUserCodeTaken)
+
+	got, err := repo.GetDeviceCode(ctx, "BCDFGHJK")
+	require.NoError(t, err)
+	assert.Equal(t, d.Hash, got.Hash)
+	assert.Equal(t, d.ClientID, got.ClientID)
+	assert.Equal(t, d.Scope, got.Scope)
+	assert.Equal(t, auth.DevicePending, got.Status)
+	assert.Equal(t, uuid.Nil, got.UserID)
+	assert.Empty(t, got.AMR)
+	assert.True(t, got.LastPolledAt.IsZero())
+	assert.Equal(t, d.Interval, got.Interval)
+	assert.True(t, d.ExpiresAt.Equal(got.ExpiresAt))
+	assert.True(t, d.KeepUntil.Equal(got.KeepUntil))
+
+	// a poll returns the code as it was and records the poll
+	polledAt := time.Now().UTC().Truncate(time.Millisecond)
+	got, err = repo.PollDeviceCode(ctx, "device-1", polledAt)
+	require.NoError(t, err)
+	assert.Equal(t, auth.DevicePending, got.Status)
+	assert.True(t, got.LastPolledAt.IsZero())
+	got, err = repo.PollDeviceCode(ctx, "device-1", polledAt.Add(time.Second))
+	require.NoError(t, err)
+	assert.True(t, polledAt.Equal(got.LastPolledAt))
+
+	// a device polling too early is slowed down for good
+	assert.ErrorIs(t, repo.SlowDownDeviceCode(ctx, "device-2", 10*time.Second), auth.ErrDeviceCodeNotFound)
+	require.NoError(t, repo.SlowDownDeviceCode(ctx, "device-1", 10*time.Second))
+	got, err = repo.PollDeviceCode(ctx, "device-1", polledAt.Add(2*time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, got.Interval)
+	assert.True(t, polledAt.Add(time.Second).Equal(got.LastPolledAt))
+
+	decided := *d
+	decided.Status = auth.DeviceApproved
+	decided.UserID = uuid.New()
+	decided.AMR = []string{"pwd", "otp"}
+	decided.AuthTime = polledAt.Add(-time.Minute)
+	require.NoError(t, repo.DecideDeviceCode(ctx, &decided))
+	// a code is decided once
+	denied := decided
+	denied.Status = auth.DeviceDenied
+	assert.ErrorIs(t, repo.DecideDeviceCode(ctx, &denied), auth.ErrDeviceCodeNotFound)
+
+	got, err = repo.GetDeviceCode(ctx, "BCDFGHJK")
+	require.NoError(t, err)
+	assert.Equal(t, auth.DeviceApproved, got.Status)
+
+	// and once decided, no longer slowed down but polled once
+	assert.ErrorIs(t, repo.SlowDownDeviceCode(ctx, "device-1", 15*time.Second), auth.ErrDeviceCodeNotFound)
+	got, err = repo.PollDeviceCode(ctx, "device-1", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, auth.DeviceApproved, got.Status)
+	assert.Equal(t, decided.UserID, got.UserID)
+	assert.Equal(t, decided.AMR, got.AMR)
+	assert.True(t, decided.AuthTime.Equal(got.AuthTime))
+	_, err = repo.PollDeviceCode(ctx, "device-1", time.Now())
+	assert.ErrorIs(t, err, auth.ErrDeviceCodeNotFound)
+	_, err = repo.GetDeviceCode(ctx, "BCDFGHJK")
+	assert.ErrorIs(t, err, auth.ErrDeviceCodeNotFound)
+
+	// which frees the user code
+	require.NoError(t, repo.PutDeviceCode(ctx, newDeviceCode("device-2", "BCDFGHJK")))
+}
+
+func testDeviceCodeDenied(t *testing.T, repo ClientUserRepository) {
+	ctx := context.Background()
+	require.NoError(t, repo.PutDeviceCode(ctx, newDeviceCode("device-1", "BCDFGHJK")))
+	assert.ErrorIs(t, repo.DecideDeviceCode(ctx, &auth.DeviceCode{
+		UserCode: "ZXWVTSRQ",
+		Status:   auth.DeviceDenied,
+		UserID:   uuid.New(),
+	}), auth.ErrDeviceCodeNotFound)
+	require.NoError(t, repo.DecideDeviceCode(ctx, &auth.DeviceCode{
+		UserCode: "BCDFGHJK",
+		Status:   auth.DeviceDenied,
+		UserID:   uuid.New(),
+	}))
+
+	got, err := repo.PollDeviceCode(ctx, "device-1", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, auth.DeviceDenied, got.Status)
+	_, err = repo.PollDeviceCode(ctx, "device-1", time.Now())
+	assert.ErrorIs(t, err, auth.ErrDeviceCodeNotFound)
+}
+
+func testExpiredDeviceCode(t *testing.T, repo ClientUserRepository) {
+	ctx := context.Background()
+	d := newDeviceCode("device-1", "BCDFGHJK")
+	d.ExpiresAt = time.Now().Add(-time.Second).UTC().Truncate(time.Millisecond)
+	require.NoError(t, repo.PutDeviceCode(ctx, d))
+	stale := newDeviceCode("device-2", "ZXWVTSRQ")
+	stale.ExpiresAt = time.Now().Add(-2 * time.Second)
+	stale.KeepUntil = time.Now().Add(-time.Second)
+	require.NoError(t, repo.PutDeviceCode(ctx, stale))
+
+	// expired codes are kept until KeepUntil but can't be decided
+	got, err := repo.GetDeviceCode(ctx, "BCDFGHJK")
+	require.NoError(t, err)
+	assert.True(t, d.ExpiresAt.Equal(got.ExpiresAt))
+	decided := *d
+	decided.Status = auth.DeviceApproved
+	decided.UserID = uuid.New()
+	assert.ErrorIs(t, repo.DecideDeviceCode(ctx, &decided), auth.ErrDeviceCodeNotFound)
+	got, err = repo.PollDeviceCode(ctx, "device-1", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, auth.DevicePending, got.Status)
+
+	_, err = repo.GetDeviceCode(ctx, "ZXWVTSRQ")
+	assert.ErrorIs(t, err, auth.ErrDeviceCodeNotFound)
+	_, err = repo.PollDeviceCode(ctx, "device-2", time.Now())
+	assert.ErrorIs(t, err, auth.ErrDeviceCodeNotFound)
+}
@@ -0,0 +1,534 @@
+// Package conformance is a test suite every storage backend of the auth
+// service is expected to pass.
+package conformance
+
+import (
+	"context"
+	"errors"
+	"medods-auth/service/auth"
+	"medods-auth/token"
+	"medods-auth/user"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factories return an empty repository. Cleanup is registered on t.
+type HashRepositoryFactory func(t *testing.T) auth.TokenHashRepository
+type BlacklistFactory func(t *testing.T) auth.TokenBlackList
+
+// RotatorFactory returns a rotator and the blacklist it writes to.
+type RotatorFactory func(t *testing.T) (auth.TokenRotator, auth.TokenHashRepository, auth.TokenBlackList)
+
+// Timestamps only have to survive a round trip with this precision.
+const timePrecision = time.Millisecond
+
+func Run(t *testing.T, hashes HashRepositoryFactory, blacklist BlacklistFactory) {
+	t.Run("HashRepository", func(t *testing.T) {
+		RunHashRepository(t, hashes)
+	})
+	t.Run("Blacklist", func(t *testing.T) {
+		RunBlacklist(t, blacklist)
+	})
+}
+
+func RunHashRepository(t *testing.T, factory HashRepositoryFactory) {
+	t.Run("StoreGet", func(t *testing.T) { testStoreGet(t, factory(t)) })
+	t.Run("GetMissing", func(t *testing.T) { testGetMissing(t, factory(t)) })
+	t.Run("DuplicateJTI", func(t *testing.T) { testDuplicateJTI(t, factory(t)) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, factory(t)) })
+	t.Run("DeleteByUserId", func(t *testing.T) { testDeleteByUserId(t, factory(t)) })
+	t.Run("DeleteByClient", func(t *testing.T) { testDeleteByClient(t, factory(t)) })
+	t.Run("Expiry", func(t *testing.T) { testRecordExpiry(t, factory(t)) })
+	t.Run("Concurrent", func(t *testing.T) { testConcurrentStore(t, factory(t)) })
+	t.Run("CanceledContext", func(t *testing.T) { testHashCanceledContext(t, factory(t)) })
+}
+
+func RunBlacklist(t *testing.T, factory BlacklistFactory) {
+	t.Run("AddContains", func(t *testing.T) { testAddContains(t, factory(t)) })
+	t.Run("AddTwice", func(t *testing.T) { testAddTwice(t, factory(t)) })
+	t.Run("Expiry", func(t *testing.T) { testBlacklistExpiry(t, factory(t)) })
+	t.Run("Concurrent", func(t *testing.T) { testConcurrentAdd(t, factory(t)) })
+	t.Run("CanceledContext", func(t *testing.T) { testBlacklistCanceledContext(t, factory(t)) })
+}
+
+func RunRotator(t *testing.T, factory RotatorFactory) {
+	t.Run("Rotate", func(t *testing.T) { testRotate(t, factory) })
+	t.Run("RotateDuplicateJTI", func(t *testing.T) { testRotateDuplicate(t, factory) })
+	t.Run("RotateMissing", func(t *testing.T) { testRotateMissing(t, factory) })
+	t.Run("RotateConcurrent", func(t *testing.T) { testRotateConcurrent(t, factory) })
+}
+
+func NewRecord(userID uuid.UUID, ttl time.Duration) *auth.RefreshTokenRecord {
+	now := time.Now().UTC()
+	return &auth.RefreshTokenRecord{
+		JTI: uuid.New(),
+		User: user.User{
+			Id:        userID,
+			UserAgent: "conformance/1.0",
+		},
+		Hash:      token.TokenHash("$2a$10$" + uuid.NewString()),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		StartedAt: now,
+	}
+}
+
+func assertSameRecord(t *testing.T, want, got *auth.RefreshTokenRecord) {
+	t.Helper()
+	assert.Equal(t, want.JTI, got.JTI)
+	assert.Equal(t, want.User, got.User)
+	assert.Equal(t, want.Hash, got.Hash)
+	assert.WithinDuration(t, want.CreatedAt, got.CreatedAt, timePrecision)
+	assert.WithinDuration(t, want.ExpiresAt, got.ExpiresAt, timePrecision)
+	assert.WithinDuration(t, want.StartedAt, got.StartedAt, timePrecision)
+	assert.Equal(t, want.ClientID, got.ClientID)
+}
+
+func testStoreGet(t *testing.T, repo auth.TokenHashRepository) {
+	ctx := context.Background()
+	rec := NewRecord(uuid.New(), time.Hour)
+	rec.ClientID = "client"
+	require.NoError(t, repo.Store(ctx, rec))
+
+	got, err := repo.Get(ctx, rec.JTI)
+	require.NoError(t, err)
+	assertSameRecord(t, rec, got)
+
+	// returned records must not alias repository state
+	got.Hash[0] ^= 0xff
+	again, err := repo.Get(ctx, rec.JTI)
+	require.NoError(t, err)
+	assert.Equal(t, rec.Hash, again.Hash)
+}
+
+func testGetMissing(t *testing.T, repo auth.TokenHashRepository) {
+	_, err := repo.Get(context.Background(), uuid.New())
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+}
+
+func testDuplicateJTI(t *testing.T, repo auth.TokenHashRepository) {
+	ctx := context.Background()
+	rec := NewRecord(uuid.New(), time.Hour)
+	require.NoError(t, repo.Store(ctx, rec))
+
+	dup := NewRecord(uuid.New(), time.Hour)
+	dup.JTI = rec.JTI
+	assert.Error(t, repo.Store(ctx, dup))
+
+	got, err := repo.Get(ctx, rec.JTI)
+	require.NoError(t, err)
+	assertSameRecord(t, rec, got)
+}
+
+func testDelete(t *testing.T, repo auth.TokenHashRepository) {
+	ctx := context.Background()
+	userID := uuid.New()
+	deleted := NewRecord(userID, time.Hour)
+	kept := NewRecord(userID, time.Hour)
+	require.NoError(t, repo.Store(ctx, deleted))
+	require.NoError(t, repo.Store(ctx, kept))
+
+	require.NoError(t, repo.Delete(ctx, deleted.JTI))
+	_, err := repo.Get(ctx, deleted.JTI)
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+	_, err = repo.Get(ctx, kept.JTI)
+	assert.NoError(t, err)
+
+	// a delete must tell whether it got to the record
+	assert.ErrorIs(t, repo.Delete(ctx, deleted.JTI), auth.ErrRefreshTokenNotFound)
+	assert.ErrorIs(t, repo.Delete(ctx, uuid.New()), auth.ErrRefreshTokenNotFound)
+
+	// so only one of concurrent deletes of a record does
+	contended := NewRecord(userID, time.Hour)
+	require.NoError(t, repo.Store(ctx, contended))
+	assert.Equal(t, 1, countSucceeded(t, 8, func() error { return repo.Delete(ctx, contended.JTI) }))
+
+	// the deleted record must not be left in the per-user index
+	require.NoError(t, repo.DeleteByUserId(ctx, userID))
+	_, err = repo.Get(ctx, kept.JTI)
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+}
+
+func testDeleteByUserId(t *testing.T, repo auth.TokenHashRepository) {
+	ctx := context.Background()
+	userID, otherID := uuid.New(), uuid.New()
+	first := NewRecord(userID, time.Hour)
+	second := NewRecord(userID, time.Hour)
+	other := NewRecord(otherID, time.Hour)
+	for _, rec := range []*auth.RefreshTokenRecord{first, second, other} {
+		require.NoError(t, repo.Store(ctx, rec))
+	}
+
+	require.NoError(t, repo.DeleteByUserId(ctx, userID))
+	_, err := repo.Get(ctx, first.JTI)
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+	_, err = repo.Get(ctx, second.JTI)
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+	_, err = repo.Get(ctx, other.JTI)
+	assert.NoError(t, err)
+
+	// deleting a user without records is not an error
+	assert.NoError(t, repo.DeleteByUserId(ctx, uuid.New()))
+}
+
+func testDeleteByClient(t *testing.T, repo auth.TokenHashRepository) {
+	ctx := context.Background()
+	userID := uuid.New()
+	granted := NewRecord(userID, time.Hour)
+	granted.ClientID = "client"
+	own := NewRecord(userID, time.Hour)
+	otherClient := NewRecord(userID, time.Hour)
+	otherClient.ClientID = "other"
+	otherUser := NewRecord(uuid.New(), time.Hour)
+	otherUser.ClientID = "client"
+	for _, rec := range []*auth.RefreshTokenRecord{granted, own, otherClient, otherUser} {
+		require.NoError(t, repo.Store(ctx, rec))
+	}
+
+	require.NoError(t, repo.DeleteByClient(ctx, userID, "client"))
+	_, err := repo.Get(ctx, granted.JTI)
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+	for _, rec := range []*auth.RefreshTokenRecord{own, otherClient, otherUser} {
+		_, err = repo.Get(ctx, rec.JTI)
+		assert.NoError(t, err)
+	}
+
+	// the deleted record must not be left in the per-user index
+	require.NoError(t, repo.DeleteByUserId(ctx, userID))
+	_, err = repo.Get(ctx, own.JTI)
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+	assert.NoError(t, repo.DeleteByClient(ctx, uuid.New(), "client"))
+}
+
+func testRecordExpiry(t *testing.T, repo auth.TokenHashRepository) {
+	ctx := context.Background()
+	expired := NewRecord(uuid.New(), -time.Second)
+	require.NoError(t, repo.Store(ctx, expired))
+	_, err := repo.Get(ctx, expired.JTI)
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+
+	short := NewRecord(uuid.New(), time.Second)
+	require.NoError(t, repo.Store(ctx, short))
+	_, err = repo.Get(ctx, short.JTI)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := repo.Get(ctx, short.JTI)
+		return errors.Is(err, auth.ErrRefreshTokenNotFound)
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func testConcurrentStore(t *testing.T, repo auth.TokenHashRepository) {
+	ctx := context.Background()
+	const workers = 16
+	const perWorker = 8
+	userID := uuid.New()
+
+	records := make([]*auth.RefreshTokenRecord, workers*perWorker)
+	for i := range records {
+		records[i] = NewRecord(userID, time.Hour)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(records))
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(batch []*auth.RefreshTokenRecord) {
+			defer wg.Done()
+			for _, rec := range batch {
+				if err := repo.Store(ctx, rec); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := repo.Get(ctx, rec.JTI); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(records[w*perWorker : (w+1)*perWorker])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	for _, rec := range records {
+		_, err := repo.Get(ctx, rec.JTI)
+		assert.NoError(t, err)
+	}
+	require.NoError(t, repo.DeleteByUserId(ctx, userID))
+	for _, rec := range records {
+		_, err := repo.Get(ctx, rec.JTI)
+		assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+	}
+}
+
+func testHashCanceledContext(t *testing.T, repo auth.TokenHashRepository) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	rec := NewRecord(uuid.New(), time.Hour)
+	assert.ErrorIs(t, repo.Store(ctx, rec), context.Canceled)
+	_, err := repo.Get(ctx, rec.JTI)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, repo.DeleteByUserId(ctx, rec.User.Id), context.Canceled)
+
+	_, err = repo.Get(context.Background(), rec.JTI)
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound, "canceled store must not persist")
+}
+
+func testAddContains(t *testing.T, bl auth.TokenBlackList) {
+	ctx := context.Background()
+	jti := uuid.New()
+
+	ok, err := bl.Contains(ctx, jti)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, bl.Add(ctx, jti, time.Now().Add(time.Hour)))
+	ok, err = bl.Contains(ctx, jti)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = bl.Contains(ctx, uuid.New())
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func testAddTwice(t *testing.T, bl auth.TokenBlackList) {
+	ctx := context.Background()
+	jti := uuid.New()
+	require.NoError(t, bl.Add(ctx, jti, time.Now().Add(time.Hour)))
+	assert.NoError(t, bl.Add(ctx, jti, time.Now().Add(time.Hour)))
+
+	ok, err := bl.Contains(ctx, jti)
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func testBlacklistExpiry(t *testing.T, bl auth.TokenBlackList) {
+	ctx := context.Background()
+
+	expired := uuid.New()
+	require.NoError(t, bl.Add(ctx, expired, time.Now().Add(-time.Second)))
+	ok, err := bl.Contains(ctx, expired)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	forever := uuid.New()
+	require.NoError(t, bl.Add(ctx, forever, time.Time{}))
+	ok, err = bl.Contains(ctx, forever)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	short := uuid.New()
+	require.NoError(t, bl.Add(ctx, short, time.Now().Add(time.Second)))
+	ok, err = bl.Contains(ctx, short)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Eventually(t, func() bool {
+		ok, err := bl.Contains(ctx, short)
+		return err == nil && !ok
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func testConcurrentAdd(t *testing.T, bl auth.TokenBlackList) {
+	ctx := context.Background()
+	jtis := make([]token.JTI, 64)
+	for i := range jtis {
+		jtis[i] = uuid.New()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*len(jtis))
+	for _, jti := range jtis {
+		// every jti is added twice concurrently
+		for range 2 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- bl.Add(ctx, jti, time.Now().Add(time.Hour))
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	for _, jti := range jtis {
+		ok, err := bl.Contains(ctx, jti)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+}
+
+func testBlacklistCanceledContext(t *testing.T, bl auth.TokenBlackList) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	jti := uuid.New()
+	assert.ErrorIs(t, bl.Add(ctx, jti, time.Now().Add(time.Hour)), context.Canceled)
+	_, err := bl.Contains(ctx, jti)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	ok, err := bl.Contains(context.Background(), jti)
+	require.NoError(t, err)
+	assert.False(t, ok, "canceled add must not persist")
+}
+
+func testRotate(t *testing.T, factory RotatorFactory) {
+	ctx := context.Background()
+	rotator, repo, bl := factory(t)
+	userID := uuid.New()
+	first := NewRecord(userID, time.Hour)
+	second := NewRecord(userID, time.Hour)
+	other := NewRecord(uuid.New(), time.Hour)
+	for _, rec := range []*auth.RefreshTokenRecord{first, second, other} {
+		require.NoError(t, repo.Store(ctx, rec))
+	}
+
+	next := NewRecord(userID, time.Hour)
+	revoked := uuid.New()
+	require.NoError(t, rotator.Rotate(ctx, auth.Rotation{
+		UserID:           userID,
+		Previous:         first.JTI,
+		Revoked:          revoked,
+		RevokedExpiresAt: time.Now().Add(time.Hour),
+		Next:             next,
+	}))
+
+	_, err := repo.Get(ctx, first.JTI)
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+	got, err := repo.Get(ctx, next.JTI)
+	require.NoError(t, err)
+	assertSameRecord(t, next, got)
+	// other sessions of the user survive the rotation
+	for _, rec := range []*auth.RefreshTokenRecord{second, other} {
+		_, err = repo.Get(ctx, rec.JTI)
+		assert.NoError(t, err)
+	}
+
+	ok, err := bl.Contains(ctx, revoked)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// the new record must be reachable for per-user revocation
+	require.NoError(t, repo.DeleteByUserId(ctx, userID))
+	for _, rec := range []*auth.RefreshTokenRecord{next, second} {
+		_, err = repo.Get(ctx, rec.JTI)
+		assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+	}
+}
+
+func testRotateDuplicate(t *testing.T, factory RotatorFactory) {
+	ctx := context.Background()
+	rotator, repo, _ := factory(t)
+	existing := NewRecord(uuid.New(), time.Hour)
+	require.NoError(t, repo.Store(ctx, existing))
+
+	previous := NewRecord(uuid.New(), time.Hour)
+	require.NoError(t, repo.Store(ctx, previous))
+
+	next := NewRecord(previous.User.Id, time.Hour)
+	next.JTI = existing.JTI
+	assert.Error(t, rotator.Rotate(ctx, auth.Rotation{
+		UserID:           previous.User.Id,
+		Previous:         previous.JTI,
+		Revoked:          uuid.New(),
+		RevokedExpiresAt: time.Now().Add(time.Hour),
+		Next:             next,
+	}))
+	// the failed rotation leaves the session it would have replaced
+	_, err := repo.Get(ctx, previous.JTI)
+	assert.NoError(t, err)
+}
+
+func testRotateMissing(t *testing.T, factory RotatorFactory) {
+	ctx := context.Background()
+	rotator, repo, _ := factory(t)
+	userID := uuid.New()
+	next := NewRecord(userID, time.Hour)
+	err := rotator.Rotate(ctx, auth.Rotation{
+		UserID:           userID,
+		Previous:         uuid.New(),
+		Revoked:          uuid.New(),
+		RevokedExpiresAt: time.Now().Add(time.Hour),
+		Next:             next,
+	})
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+	_, err = repo.Get(ctx, next.JTI)
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+}
+
+// testRotateConcurrent rotates one record from many goroutines, as
+// concurrent refreshes with the same token do. Only one may succeed, or
+// the session forks and reuse of the token goes unnoticed.
+func testRotateConcurrent(t *testing.T, factory RotatorFactory) {
+	ctx := context.Background()
+	rotator, repo, _ := factory(t)
+	userID := uuid.New()
+	previous := NewRecord(userID, time.Hour)
+	require.NoError(t, repo.Store(ctx, previous))
+
+	const workers = 8
+	next := make(chan *auth.RefreshTokenRecord, workers)
+	succeeded := countSucceeded(t, workers, func() error {
+		rec := NewRecord(userID, time.Hour)
+		err := rotator.Rotate(ctx, auth.Rotation{
+			UserID:           userID,
+			Previous:         previous.JTI,
+			Revoked:          uuid.New(),
+			RevokedExpiresAt: time.Now().Add(time.Hour),
+			Next:             rec,
+		})
+		next <- rec
+		return err
+	})
+	close(next)
+	assert.Equal(t, 1, succeeded)
+
+	stored := 0
+	for rec := range next {
+		if _, err := repo.Get(ctx, rec.JTI); err == nil {
+			stored++
+		}
+	}
+	assert.Equal(t, 1, stored, "only the winning rotation stores its record")
+}
+
+// countSucceeded runs fn from n goroutines at once and returns how many
+// calls succeeded. The others must fail with auth.ErrRefreshTokenNotFound.
+func countSucceeded(t *testing.T, n int, fn func() error) int {
+	t.Helper()
+	start := make(chan struct{})
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			errs <- fn()
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+	}
+	return succeeded
+}
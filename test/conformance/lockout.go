@@ -0,0 +1,146 @@
+package conformance
+
+import (
+	"context"
+	"medods-auth/service/lockout"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type LockoutStoreFactory func(t *testing.T) lockout.Store
+
+// RunLockout tests a lockout.Store backend.
+func RunLockout(t *testing.T, newStore LockoutStoreFactory) {
+	t.Run("Lockout", func(t *testing.T) {
+		t.Run("Missing", func(t *testing.T) { testLockoutMissing(t, newStore(t)) })
+		t.Run("Fail", func(t *testing.T) { testLockoutFail(t, newStore(t)) })
+		t.Run("Decay", func(t *testing.T) { testLockoutDecay(t, newStore(t)) })
+		t.Run("Reset", func(t *testing.T) { testLockoutReset(t, newStore(t)) })
+		t.Run("Keys", func(t *testing.T) { testLockoutKeys(t, newStore(t)) })
+		t.Run("Concurrent", func(t *testing.T) { testLockoutConcurrent(t, newStore(t)) })
+	})
+}
+
+var testLockoutPolicy = lockout.Policy{
+	MaxFailures: 3,
+	Lockout:     time.Hour,
+	Delay:       time.Second,
+	MaxDelay:    time.Minute,
+	Decay:       10 * time.Minute,
+}
+
+func testLockoutMissing(t *testing.T, store lockout.Store) {
+	state, err := store.Get(context.Background(), "missing")
+	require.NoError(t, err)
+	assert.Zero(t, state.Failures)
+	assert.Zero(t, state.RetryAfter(time.Now()))
+}
+
+func testLockoutFail(t *testing.T, store lockout.Store) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Millisecond)
+
+	state, err := store.Fail(ctx, "fail", testLockoutPolicy, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, state.Failures)
+	assert.Equal(t, time.Second, state.RetryAfter(now))
+	assert.False(t, testLockoutPolicy.LockedOut(state))
+
+	state, err = store.Fail(ctx, "fail", testLockoutPolicy, now)
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Second, state.RetryAfter(now))
+
+	state, err = store.Fail(ctx, "fail", testLockoutPolicy, now)
+	require.NoError(t, err)
+	assert.True(t, testLockoutPolicy.LockedOut(state))
+	assert.Equal(t, time.Hour, state.RetryAfter(now))
+
+	got, err := store.Get(ctx, "fail")
+	require.NoError(t, err)
+	assert.Equal(t, 3, got.Failures)
+	assert.True(t, state.UpdatedAt.Equal(got.UpdatedAt))
+	assert.True(t, state.LockedUntil.Equal(got.LockedUntil))
+}
+
+func testLockoutDecay(t *testing.T, store lockout.Store) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Millisecond)
+
+	for range 2 {
+		_, err := store.Fail(ctx, "decay", testLockoutPolicy, now)
+		require.NoError(t, err)
+	}
+	// one failure is forgotten by the next one
+	state, err := store.Fail(ctx, "decay", testLockoutPolicy, now.Add(testLockoutPolicy.Decay))
+	require.NoError(t, err)
+	assert.Equal(t, 2, state.Failures)
+	assert.False(t, testLockoutPolicy.LockedOut(state))
+}
+
+func testLockoutReset(t *testing.T, store lockout.Store) {
+	ctx := context.Background()
+	now := time.Now()
+
+	for range 3 {
+		_, err := store.Fail(ctx, "reset", testLockoutPolicy, now)
+		require.NoError(t, err)
+	}
+	require.NoError(t, store.Reset(ctx, "reset"))
+	state, err := store.Get(ctx, "reset")
+	require.NoError(t, err)
+	assert.Zero(t, state.Failures)
+	assert.Zero(t, state.RetryAfter(now))
+
+	// resetting a missing key is fine
+	assert.NoError(t, store.Reset(ctx, "reset"))
+}
+
+func testLockoutKeys(t *testing.T, store lockout.Store) {
+	ctx := context.Background()
+	now := time.Now()
+
+	for range 3 {
+		_, err := store.Fail(ctx, "user:a", testLockoutPolicy, now)
+		require.NoError(t, err)
+	}
+	state, err := store.Get(ctx, "user:b")
+	require.NoError(t, err)
+	assert.Zero(t, state.Failures)
+}
+
+func testLockoutConcurrent(t *testing.T, store lockout.Store) {
+	ctx := context.Background()
+	now := time.Now()
+	policy := testLockoutPolicy
+	policy.MaxFailures = 20
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		lockouts int
+	)
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state, err := store.Fail(ctx, "concurrent", policy, now)
+			assert.NoError(t, err)
+			if policy.LockedOut(state) {
+				mu.Lock()
+				lockouts++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	state, err := store.Get(ctx, "concurrent")
+	require.NoError(t, err)
+	assert.Equal(t, 20, state.Failures)
+	// exactly one failure reports the lockout
+	assert.Equal(t, 1, lockouts)
+}
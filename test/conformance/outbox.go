@@ -0,0 +1,224 @@
+package conformance
+
+import (
+	"context"
+	"medods-auth/service/auth"
+	"medods-auth/service/events"
+	"medods-auth/service/outbox"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// OutboxRepository is a token repository keeping an outbox.
+type OutboxRepository interface {
+	auth.TokenHashRepository
+	auth.TokenRotator
+	auth.OutboxWriter
+}
+
+// OutboxFactory returns a repository and the relay's view of its outbox.
+type OutboxFactory func(t *testing.T) (OutboxRepository, outbox.Store)
+
+func RunOutbox(t *testing.T, factory OutboxFactory) {
+	t.Run("StoreWithOutbox", func(t *testing.T) { testStoreWithOutbox(t, factory) })
+	t.Run("OutboxAtomic", func(t *testing.T) { testOutboxAtomic(t, factory) })
+	t.Run("RotateWithOutbox", func(t *testing.T) { testRotateWithOutbox(t, factory) })
+	t.Run("ClaimLease", func(t *testing.T) { testClaimLease(t, factory) })
+	t.Run("FailAndReplay", func(t *testing.T) { testFailAndReplay(t, factory) })
+}
+
+func newMessage(t *testing.T, userID uuid.UUID) outbox.Message {
+	m, err := outbox.NewMessage(events.TokensIssued{UserID: userID, At: time.Now()})
+	require.NoError(t, err)
+	return m
+}
+
+func claimAll(t *testing.T, store outbox.Store, now time.Time) []outbox.Message {
+	msgs, err := store.Claim(context.Background(), now, time.Minute, 100)
+	require.NoError(t, err)
+	return msgs
+}
+
+func testStoreWithOutbox(t *testing.T, factory OutboxFactory) {
+	ctx := context.Background()
+	repo, store := factory(t)
+	rec := NewRecord(uuid.New(), time.Hour)
+	msg := newMessage(t, rec.User.Id)
+
+	require.NoError(t, repo.StoreWithOutbox(ctx, rec, []outbox.Message{msg}))
+	_, err := repo.Get(ctx, rec.JTI)
+	assert.NoError(t, err)
+
+	claimed := claimAll(t, store, time.Now())
+	if assert.Len(t, claimed, 1) {
+		assert.Equal(t, msg.ID, claimed[0].ID)
+		assert.Equal(t, msg.Topic, claimed[0].Topic)
+		assert.JSONEq(t, string(msg.Payload), string(claimed[0].Payload))
+		assert.Equal(t, outbox.StatusPending, claimed[0].Status)
+	}
+
+	other := NewRecord(rec.User.Id, time.Hour)
+	require.NoError(t, repo.Store(ctx, other))
+	revoked := newMessage(t, rec.User.Id)
+	require.NoError(t, repo.DeleteWithOutbox(ctx, rec.JTI, []outbox.Message{revoked}))
+	_, err = repo.Get(ctx, rec.JTI)
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+	_, err = repo.Get(ctx, other.JTI)
+	assert.NoError(t, err, "other sessions of the user are left alone")
+	claimed = claimAll(t, store, time.Now())
+	if assert.Len(t, claimed, 1) {
+		assert.Equal(t, revoked.ID, claimed[0].ID)
+	}
+	// deleting it again publishes nothing
+	err = repo.DeleteWithOutbox(ctx, rec.JTI, []outbox.Message{newMessage(t, rec.User.Id)})
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+	assert.Empty(t, claimAll(t, store, time.Now()))
+
+	granted := NewRecord(rec.User.Id, time.Hour)
+	granted.ClientID = "client"
+	require.NoError(t, repo.Store(ctx, granted))
+	loggedOut := newMessage(t, rec.User.Id)
+	require.NoError(t, repo.DeleteByClientWithOutbox(ctx, rec.User.Id, "client", []outbox.Message{loggedOut}))
+	_, err = repo.Get(ctx, granted.JTI)
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+	_, err = repo.Get(ctx, other.JTI)
+	assert.NoError(t, err, "sessions of other clients are left alone")
+	claimed = claimAll(t, store, time.Now())
+	if assert.Len(t, claimed, 1) {
+		assert.Equal(t, loggedOut.ID, claimed[0].ID)
+	}
+
+	deleted := newMessage(t, rec.User.Id)
+	require.NoError(t, repo.DeleteByUserIdWithOutbox(ctx, rec.User.Id, []outbox.Message{deleted}))
+	_, err = repo.Get(ctx, other.JTI)
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+	claimed = claimAll(t, store, time.Now())
+	if assert.Len(t, claimed, 1) {
+		assert.Equal(t, deleted.ID, claimed[0].ID)
+	}
+}
+
+func testOutboxAtomic(t *testing.T, factory OutboxFactory) {
+	ctx := context.Background()
+	repo, store := factory(t)
+	rec := NewRecord(uuid.New(), time.Hour)
+	require.NoError(t, repo.Store(ctx, rec))
+
+	assert.Error(t, repo.StoreWithOutbox(ctx, rec, []outbox.Message{newMessage(t, rec.User.Id)}))
+	assert.Empty(t, claimAll(t, store, time.Now()), "message of a failed write must not be stored")
+}
+
+func testRotateWithOutbox(t *testing.T, factory OutboxFactory) {
+	ctx := context.Background()
+	repo, store := factory(t)
+	userID := uuid.New()
+	previous := NewRecord(userID, time.Hour)
+	require.NoError(t, repo.Store(ctx, previous))
+
+	msg := newMessage(t, userID)
+	require.NoError(t, repo.Rotate(ctx, auth.Rotation{
+		UserID:           userID,
+		Previous:         previous.JTI,
+		Revoked:          uuid.New(),
+		RevokedExpiresAt: time.Now().Add(time.Hour),
+		Next:             NewRecord(userID, time.Hour),
+		Outbox:           []outbox.Message{msg},
+	}))
+	claimed := claimAll(t, store, time.Now())
+	if assert.Len(t, claimed, 1) {
+		assert.Equal(t, msg.ID, claimed[0].ID)
+	}
+	require.NoError(t, store.Delete(ctx, msg.ID))
+
+	// a failed rotation leaves no message behind
+	existing := NewRecord(uuid.New(), time.Hour)
+	require.NoError(t, repo.Store(ctx, existing))
+	next := NewRecord(uuid.New(), time.Hour)
+	next.JTI = existing.JTI
+	assert.Error(t, repo.Rotate(ctx, auth.Rotation{
+		UserID:           next.User.Id,
+		Revoked:          uuid.New(),
+		RevokedExpiresAt: time.Now().Add(time.Hour),
+		Next:             next,
+		Outbox:           []outbox.Message{newMessage(t, next.User.Id)},
+	}))
+	assert.Empty(t, claimAll(t, store, time.Now().Add(time.Hour)))
+}
+
+func testClaimLease(t *testing.T, factory OutboxFactory) {
+	ctx := context.Background()
+	repo, store := factory(t)
+	userID := uuid.New()
+	first, second := newMessage(t, userID), newMessage(t, userID)
+	second.CreatedAt = first.CreatedAt.Add(time.Millisecond)
+	require.NoError(t, repo.StoreWithOutbox(ctx, NewRecord(userID, time.Hour), []outbox.Message{first, second}))
+
+	now := time.Now()
+	batch, err := store.Claim(ctx, now, time.Minute, 1)
+	require.NoError(t, err)
+	if assert.Len(t, batch, 1) {
+		assert.Equal(t, first.ID, batch[0].ID, "oldest message first")
+	}
+	batch = claimAll(t, store, now)
+	if assert.Len(t, batch, 1, "leased messages are not claimed twice") {
+		assert.Equal(t, second.ID, batch[0].ID)
+	}
+	assert.Empty(t, claimAll(t, store, now))
+
+	// an expired lease, e.g. of a crashed relay, makes messages claimable again
+	assert.Len(t, claimAll(t, store, now.Add(2*time.Minute)), 2)
+
+	require.NoError(t, store.Delete(ctx, first.ID))
+	assert.Len(t, claimAll(t, store, now.Add(4*time.Minute)), 1)
+}
+
+func testFailAndReplay(t *testing.T, factory OutboxFactory) {
+	ctx := context.Background()
+	repo, store := factory(t)
+	userID := uuid.New()
+	retried, dead, alsoDead := newMessage(t, userID), newMessage(t, userID), newMessage(t, userID)
+	require.NoError(t, repo.StoreWithOutbox(ctx, NewRecord(userID, time.Hour), []outbox.Message{retried, dead, alsoDead}))
+	now := time.Now()
+	require.Len(t, claimAll(t, store, now), 3)
+
+	retried.Attempts = 1
+	retried.LastError = "connection refused"
+	retried.NextAttemptAt = now.Add(time.Hour)
+	require.NoError(t, store.Fail(ctx, retried))
+	for _, m := range []outbox.Message{dead, alsoDead} {
+		m.Status = outbox.StatusDead
+		m.Attempts = 10
+		m.LastError = "gone"
+		require.NoError(t, store.Fail(ctx, m))
+	}
+
+	assert.Empty(t, claimAll(t, store, now.Add(time.Minute)), "not due yet")
+	batch := claimAll(t, store, now.Add(2*time.Hour))
+	if assert.Len(t, batch, 1, "dead messages are not claimed") {
+		assert.Equal(t, 1, batch[0].Attempts)
+		assert.Equal(t, "connection refused", batch[0].LastError)
+	}
+
+	listed, err := store.List(ctx, outbox.StatusDead, 10)
+	require.NoError(t, err)
+	assert.Len(t, listed, 2)
+
+	n, err := store.Replay(ctx, []uuid.UUID{dead.ID})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = store.Replay(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	listed, err = store.List(ctx, outbox.StatusDead, 10)
+	require.NoError(t, err)
+	assert.Empty(t, listed)
+	replayed := claimAll(t, store, time.Now().Add(time.Second))
+	if assert.Len(t, replayed, 2) {
+		assert.Equal(t, 0, replayed[0].Attempts)
+	}
+}
@@ -0,0 +1,181 @@
+package conformance
+
+import (
+	"context"
+	"medods-auth/service/auth"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// PasskeyUserRepository is a user repository storing passkeys.
+type PasskeyUserRepository interface {
+	auth.UserRepository
+	auth.PasskeyRepository
+}
+
+type PasskeyRepositoryFactory func(t *testing.T) PasskeyUserRepository
+
+func RunPasskeys(t *testing.T, factory PasskeyRepositoryFactory) {
+	t.Run("Passkeys", func(t *testing.T) {
+		t.Run("AddGet", func(t *testing.T) { testPasskeyAddGet(t, factory(t)) })
+		t.Run("Duplicate", func(t *testing.T) { testPasskeyDuplicate(t, factory(t)) })
+		t.Run("List", func(t *testing.T) { testPasskeyList(t, factory(t)) })
+		t.Run("SignCount", func(t *testing.T) { testPasskeySignCount(t, factory(t)) })
+		t.Run("DeleteUser", func(t *testing.T) { testPasskeyDeleteUser(t, factory(t)) })
+		t.Run("UnknownUser", func(t *testing.T) { testPasskeyUnknownUser(t, factory(t)) })
+		t.Run("Challenge", func(t *testing.T) { testChallenge(t, factory(t)) })
+		t.Run("ExpiredChallenge", func(t *testing.T) { testExpiredChallenge(t, factory(t)) })
+	})
+}
+
+func newPasskey(userID uuid.UUID, id string) *auth.Passkey {
+	return &auth.Passkey{
+		ID:         []byte(id),
+		UserID:     userID,
+		PublicKey:  []byte{0xa5, 0x01, 0x02},
+		SignCount:  1,
+		Transports: []string{"internal", "hybrid"},
+		CreatedAt:  time.Now().UTC().Truncate(time.Millisecond),
+	}
+}
+
+func testPasskeyAddGet(t *testing.T, repo PasskeyUserRepository) {
+	ctx := context.Background()
+	id := createAccount(t, repo)
+
+	_, err := repo.GetPasskey(ctx, []byte("cred-1"))
+	assert.ErrorIs(t, err, auth.ErrPasskeyNotFound)
+
+	passkey := newPasskey(id, "cred-1")
+	require.NoError(t, repo.AddPasskey(ctx, passkey))
+	got, err := repo.GetPasskey(ctx, passkey.ID)
+	require.NoError(t, err)
+	assert.Equal(t, passkey.ID, got.ID)
+	assert.Equal(t, id, got.UserID)
+	assert.Equal(t, passkey.PublicKey, got.PublicKey)
+	assert.Equal(t, uint32(1), got.SignCount)
+	assert.Equal(t, passkey.Transports, got.Transports)
+	assert.True(t, passkey.CreatedAt.Equal(got.CreatedAt))
+}
+
+func testPasskeyDuplicate(t *testing.T, repo PasskeyUserRepository) {
+	ctx := context.Background()
+	id := createAccount(t, repo)
+	require.NoError(t, repo.AddPasskey(ctx, newPasskey(id, "cred-1")))
+
+	// credential IDs are unique across users
+	other := createAccount(t, repo)
+	err := repo.AddPasskey(ctx, newPasskey(other, "cred-1"))
+	assert.ErrorIs(t, err, auth.ErrPasskeyExists)
+
+	got, err := repo.GetPasskey(ctx, []byte("cred-1"))
+	require.NoError(t, err)
+	assert.Equal(t, id, got.UserID)
+}
+
+func testPasskeyList(t *testing.T, repo PasskeyUserRepository) {
+	ctx := context.Background()
+	id := createAccount(t, repo)
+
+	passkeys, err := repo.ListPasskeys(ctx, id)
+	require.NoError(t, err)
+	assert.Empty(t, passkeys)
+
+	first := newPasskey(id, "cred-1")
+	second := newPasskey(id, "cred-2")
+	second.CreatedAt = first.CreatedAt.Add(time.Second)
+	require.NoError(t, repo.AddPasskey(ctx, second))
+	require.NoError(t, repo.AddPasskey(ctx, first))
+	require.NoError(t, repo.AddPasskey(ctx, newPasskey(createAccount(t, repo), "cred-3")))
+
+	passkeys, err = repo.ListPasskeys(ctx, id)
+	require.NoError(t, err)
+	require.Len(t, passkeys, 2)
+	assert.Equal(t, first.ID, passkeys[0].ID)
+	assert.Equal(t, second.ID, passkeys[1].ID)
+}
+
+func testPasskeySignCount(t *testing.T, repo PasskeyUserRepository) {
+	ctx := context.Background()
+	id := createAccount(t, repo)
+	passkey := newPasskey(id, "cred-1")
+	require.NoError(t, repo.AddPasskey(ctx, passkey))
+
+	require.NoError(t, repo.UpdateSignCount(ctx, passkey.ID, 1, 5))
+	// a concurrent assertion already moved the counter on
+	err := repo.UpdateSignCount(ctx, passkey.ID, 1, 3)
+	assert.ErrorIs(t, err, auth.ErrPasskeySignCount)
+
+	got, err := repo.GetPasskey(ctx, passkey.ID)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(5), got.SignCount)
+}
+
+func testPasskeyDeleteUser(t *testing.T, repo PasskeyUserRepository) {
+	ctx := context.Background()
+	id := createAccount(t, repo)
+	require.NoError(t, repo.AddPasskey(ctx, newPasskey(id, "cred-1")))
+
+	require.NoError(t, repo.Delete(ctx, id))
+	_, err := repo.GetPasskey(ctx, []byte("cred-1"))
+	assert.ErrorIs(t, err, auth.ErrPasskeyNotFound)
+	passkeys, err := repo.ListPasskeys(ctx, id)
+	require.NoError(t, err)
+	assert.Empty(t, passkeys)
+
+	// the ID is free again
+	assert.NoError(t, repo.AddPasskey(ctx, newPasskey(createAccount(t, repo), "cred-1")))
+}
+
+func testPasskeyUnknownUser(t *testing.T, repo PasskeyUserRepository) {
+	err := repo.AddPasskey(context.Background(), newPasskey(uuid.New(), "cred-1"))
+	assert.ErrorIs(t, err, auth.ErrUserNotFound)
+}
+
+func testChallenge(t *testing.T, repo PasskeyUserRepository) {
+	ctx := context.Background()
+	c := &auth.Challenge{
+		Value:     []byte("challenge-1"),
+		UserID:    uuid.New(),
+		Ceremony:  auth.CeremonyRegistration,
+		ExpiresAt: time.Now().Add(time.Minute).UTC().Truncate(time.Millisecond),
+	}
+	require.NoError(t, repo.PutChallenge(ctx, c))
+	require.NoError(t, repo.PutChallenge(ctx, &auth.Challenge{
+		Value:     []byte("challenge-2"),
+		Ceremony:  auth.CeremonyLogin,
+		ExpiresAt: c.ExpiresAt,
+	}))
+
+	got, err := repo.TakeChallenge(ctx, c.Value)
+	require.NoError(t, err)
+	assert.Equal(t, c.Value, got.Value)
+	assert.Equal(t, c.UserID, got.UserID)
+	assert.Equal(t, c.Ceremony, got.Ceremony)
+	assert.True(t, c.ExpiresAt.Equal(got.ExpiresAt))
+
+	// challenges are single use
+	_, err = repo.TakeChallenge(ctx, c.Value)
+	assert.ErrorIs(t, err, auth.ErrChallengeNotFound)
+
+	got, err = repo.TakeChallenge(ctx, []byte("challenge-2"))
+	require.NoError(t, err)
+	assert.Equal(t, uuid.Nil, got.UserID)
+	assert.Equal(t, auth.CeremonyLogin, got.Ceremony)
+}
+
+func testExpiredChallenge(t *testing.T, repo PasskeyUserRepository) {
+	ctx := context.Background()
+	err := repo.PutChallenge(ctx, &auth.Challenge{
+		Value:     []byte("challenge-1"),
+		Ceremony:  auth.CeremonyLogin,
+		ExpiresAt: time.Now().Add(-time.Second),
+	})
+	require.NoError(t, err)
+	_, err = repo.TakeChallenge(ctx, []byte("challenge-1"))
+	assert.ErrorIs(t, err, auth.ErrChallengeNotFound)
+}
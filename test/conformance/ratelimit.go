@@ -0,0 +1,115 @@
+package conformance
+
+import (
+	"context"
+	"medods-auth/service/ratelimit"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type LimiterFactory func(t *testing.T) ratelimit.Limiter
+
+// RunLimiter tests a ratelimit.Limiter backend.
+func RunLimiter(t *testing.T, newLimiter LimiterFactory) {
+	t.Run("Limiter", func(t *testing.T) {
+		t.Run("Burst", func(t *testing.T) { testLimiterBurst(t, newLimiter(t)) })
+		t.Run("Refill", func(t *testing.T) { testLimiterRefill(t, newLimiter(t)) })
+		t.Run("Keys", func(t *testing.T) { testLimiterKeys(t, newLimiter(t)) })
+		t.Run("Concurrent", func(t *testing.T) { testLimiterConcurrent(t, newLimiter(t)) })
+	})
+}
+
+func testLimiterBurst(t *testing.T, limiter ratelimit.Limiter) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	limit := ratelimit.Limit{Burst: 3, Period: time.Minute}
+	now := time.Now()
+
+	for i := range 3 {
+		res, err := limiter.Allow(ctx, "burst", limit, now)
+		assert.NoError(err)
+		assert.True(res.Allowed)
+		assert.Equal(3, res.Limit)
+		assert.Equal(2-i, res.Remaining)
+	}
+	res, err := limiter.Allow(ctx, "burst", limit, now)
+	assert.NoError(err)
+	assert.False(res.Allowed)
+	assert.Equal(0, res.Remaining)
+	assert.InDelta(20*time.Second, res.RetryAfter, float64(time.Millisecond))
+	assert.InDelta(time.Minute, res.Reset, float64(time.Millisecond))
+}
+
+func testLimiterRefill(t *testing.T, limiter ratelimit.Limiter) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	limit := ratelimit.Limit{Burst: 2, Period: 2 * time.Second}
+	now := time.Now()
+
+	for range 2 {
+		res, err := limiter.Allow(ctx, "refill", limit, now)
+		assert.NoError(err)
+		assert.True(res.Allowed)
+	}
+	res, err := limiter.Allow(ctx, "refill", limit, now.Add(500*time.Millisecond))
+	assert.NoError(err)
+	assert.False(res.Allowed)
+
+	res, err = limiter.Allow(ctx, "refill", limit, now.Add(1100*time.Millisecond))
+	assert.NoError(err)
+	assert.True(res.Allowed)
+	assert.Equal(0, res.Remaining)
+
+	// a bucket left alone is full again
+	res, err = limiter.Allow(ctx, "refill", limit, now.Add(time.Minute))
+	assert.NoError(err)
+	assert.True(res.Allowed)
+	assert.Equal(1, res.Remaining)
+}
+
+func testLimiterKeys(t *testing.T, limiter ratelimit.Limiter) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	limit := ratelimit.Limit{Burst: 1, Period: time.Minute}
+	now := time.Now()
+
+	res, err := limiter.Allow(ctx, "login:ip:192.0.2.1", limit, now)
+	assert.NoError(err)
+	assert.True(res.Allowed)
+	res, err = limiter.Allow(ctx, "login:ip:192.0.2.1", limit, now)
+	assert.NoError(err)
+	assert.False(res.Allowed)
+
+	res, err = limiter.Allow(ctx, "login:ip:192.0.2.2", limit, now)
+	assert.NoError(err)
+	assert.True(res.Allowed, "buckets are per key")
+}
+
+func testLimiterConcurrent(t *testing.T, limiter ratelimit.Limiter) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	limit := ratelimit.Limit{Burst: 5, Period: time.Hour}
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := limiter.Allow(ctx, "concurrent", limit, now)
+			assert.NoError(err)
+			if res.Allowed {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(5, allowed)
+}
@@ -0,0 +1,129 @@
+package conformance
+
+import (
+	"context"
+	"medods-auth/service/auth"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// SessionRepository is a token repository enforcing session limits.
+type SessionRepository interface {
+	auth.TokenHashRepository
+	auth.SessionLimiter
+}
+
+type SessionRepositoryFactory func(t *testing.T) SessionRepository
+
+func RunSessionLimiter(t *testing.T, factory SessionRepositoryFactory) {
+	t.Run("SessionLimit", func(t *testing.T) {
+		t.Run("Reject", func(t *testing.T) { testSessionReject(t, factory(t)) })
+		t.Run("EvictOldest", func(t *testing.T) { testSessionEvict(t, factory(t), auth.EvictOldest) })
+		t.Run("EvictLeastRecentlyUsed", func(t *testing.T) { testSessionEvict(t, factory(t), auth.EvictLeastRecentlyUsed) })
+		t.Run("IgnoresExpired", func(t *testing.T) { testSessionIgnoresExpired(t, factory(t)) })
+		t.Run("Concurrent", func(t *testing.T) { testSessionConcurrent(t, factory(t)) })
+	})
+}
+
+func storeSession(t *testing.T, repo SessionRepository, rec *auth.RefreshTokenRecord, limit auth.SessionLimit) []auth.RefreshTokenRecord {
+	t.Helper()
+	evicted, err := repo.StoreSession(context.Background(), auth.NewSession{Record: rec, Limit: limit})
+	require.NoError(t, err)
+	return evicted
+}
+
+func testSessionReject(t *testing.T, repo SessionRepository) {
+	ctx := context.Background()
+	limit := auth.SessionLimit{Max: 2, Policy: auth.RejectNewSession}
+	userID := uuid.New()
+
+	for range 2 {
+		assert.Empty(t, storeSession(t, repo, NewRecord(userID, time.Hour), limit))
+	}
+	rejected := NewRecord(userID, time.Hour)
+	_, err := repo.StoreSession(ctx, auth.NewSession{Record: rejected, Limit: limit})
+	assert.ErrorIs(t, err, auth.ErrTooManySessions)
+	_, err = repo.Get(ctx, rejected.JTI)
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+
+	// other users have their own limit
+	assert.Empty(t, storeSession(t, repo, NewRecord(uuid.New(), time.Hour), limit))
+}
+
+// testSessionEvict stores a session started first but refreshed last, so
+// that the two eviction policies pick different victims.
+func testSessionEvict(t *testing.T, repo SessionRepository, policy auth.SessionPolicy) {
+	ctx := context.Background()
+	limit := auth.SessionLimit{Max: 2, Policy: policy}
+	userID := uuid.New()
+	now := time.Now().UTC()
+
+	refreshed := NewRecord(userID, time.Hour)
+	refreshed.StartedAt = now.Add(-3 * time.Hour)
+	refreshed.CreatedAt = now.Add(-time.Minute)
+	idle := NewRecord(userID, time.Hour)
+	idle.StartedAt = now.Add(-2 * time.Hour)
+	idle.CreatedAt = now.Add(-2 * time.Hour)
+	storeSession(t, repo, refreshed, limit)
+	storeSession(t, repo, idle, limit)
+
+	next := NewRecord(userID, time.Hour)
+	evicted := storeSession(t, repo, next, limit)
+	want, kept := idle, refreshed
+	if policy == auth.EvictOldest {
+		want, kept = refreshed, idle
+	}
+	if assert.Len(t, evicted, 1) {
+		assertSameRecord(t, want, &evicted[0])
+	}
+	_, err := repo.Get(ctx, want.JTI)
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenNotFound)
+	for _, rec := range []*auth.RefreshTokenRecord{kept, next} {
+		got, err := repo.Get(ctx, rec.JTI)
+		if assert.NoError(t, err) {
+			assertSameRecord(t, rec, got)
+		}
+	}
+}
+
+func testSessionIgnoresExpired(t *testing.T, repo SessionRepository) {
+	limit := auth.SessionLimit{Max: 1, Policy: auth.RejectNewSession}
+	userID := uuid.New()
+
+	storeSession(t, repo, NewRecord(userID, time.Second), limit)
+	time.Sleep(1100 * time.Millisecond)
+	assert.Empty(t, storeSession(t, repo, NewRecord(userID, time.Hour), limit))
+}
+
+func testSessionConcurrent(t *testing.T, repo SessionRepository) {
+	limit := auth.SessionLimit{Max: 3, Policy: auth.RejectNewSession}
+	userID := uuid.New()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stored := 0
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := repo.StoreSession(context.Background(), auth.NewSession{
+				Record: NewRecord(userID, time.Hour),
+				Limit:  limit,
+			})
+			if err == nil {
+				mu.Lock()
+				stored++
+				mu.Unlock()
+				return
+			}
+			assert.ErrorIs(t, err, auth.ErrTooManySessions)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 3, stored)
+}
@@ -0,0 +1,110 @@
+package conformance
+
+import (
+	"context"
+	"medods-auth/service/auth"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TOTPUserRepository is a user repository storing TOTPs.
+type TOTPUserRepository interface {
+	auth.UserRepository
+	auth.TOTPRepository
+}
+
+type TOTPRepositoryFactory func(t *testing.T) TOTPUserRepository
+
+func RunTOTP(t *testing.T, factory TOTPRepositoryFactory) {
+	t.Run("TOTP", func(t *testing.T) {
+		t.Run("PutGet", func(t *testing.T) { testTOTPPutGet(t, factory(t)) })
+		t.Run("VersionConflict", func(t *testing.T) { testTOTPVersionConflict(t, factory(t)) })
+		t.Run("Delete", func(t *testing.T) { testTOTPDelete(t, factory(t)) })
+		t.Run("DeleteUser", func(t *testing.T) { testTOTPDeleteUser(t, factory(t)) })
+		t.Run("UnknownUser", func(t *testing.T) { testTOTPUnknownUser(t, factory(t)) })
+	})
+}
+
+func testTOTPPutGet(t *testing.T, repo TOTPUserRepository) {
+	ctx := context.Background()
+	id := createAccount(t, repo)
+
+	_, err := repo.GetTOTP(ctx, id)
+	assert.ErrorIs(t, err, auth.ErrTOTPNotEnrolled)
+
+	enrolled := &auth.TOTP{UserID: id, Secret: "JBSWY3DPEHPK3PXP", RecoveryCodes: []string{}, Version: 1}
+	require.NoError(t, repo.PutTOTP(ctx, enrolled))
+	got, err := repo.GetTOTP(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, enrolled.Secret, got.Secret)
+	assert.False(t, got.Active)
+	assert.Equal(t, int64(1), got.Version)
+	assert.Empty(t, got.RecoveryCodes)
+
+	active := &auth.TOTP{
+		UserID:        id,
+		Secret:        enrolled.Secret,
+		Active:        true,
+		LastStep:      57000000,
+		RecoveryCodes: []string{"hash-1", "hash-2"},
+		Version:       2,
+	}
+	require.NoError(t, repo.PutTOTP(ctx, active))
+	got, err = repo.GetTOTP(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, active, got)
+}
+
+func testTOTPVersionConflict(t *testing.T, repo TOTPUserRepository) {
+	ctx := context.Background()
+	id := createAccount(t, repo)
+	require.NoError(t, repo.PutTOTP(ctx, &auth.TOTP{UserID: id, Secret: "A", Version: 1}))
+
+	// another enrollment of the first version lost the race
+	err := repo.PutTOTP(ctx, &auth.TOTP{UserID: id, Secret: "B", Version: 1})
+	assert.ErrorIs(t, err, auth.ErrTOTPConflict)
+	err = repo.PutTOTP(ctx, &auth.TOTP{UserID: id, Secret: "B", Version: 3})
+	assert.ErrorIs(t, err, auth.ErrTOTPConflict)
+
+	// of two updates of the same version only the first is stored
+	require.NoError(t, repo.PutTOTP(ctx, &auth.TOTP{UserID: id, Secret: "A", LastStep: 1, Version: 2}))
+	err = repo.PutTOTP(ctx, &auth.TOTP{UserID: id, Secret: "A", LastStep: 2, Version: 2})
+	assert.ErrorIs(t, err, auth.ErrTOTPConflict)
+
+	got, err := repo.GetTOTP(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "A", got.Secret)
+	assert.Equal(t, int64(1), got.LastStep)
+}
+
+func testTOTPDelete(t *testing.T, repo TOTPUserRepository) {
+	ctx := context.Background()
+	id := createAccount(t, repo)
+
+	assert.ErrorIs(t, repo.DeleteTOTP(ctx, id), auth.ErrTOTPNotEnrolled)
+	require.NoError(t, repo.PutTOTP(ctx, &auth.TOTP{UserID: id, Secret: "A", Version: 1}))
+	require.NoError(t, repo.DeleteTOTP(ctx, id))
+	_, err := repo.GetTOTP(ctx, id)
+	assert.ErrorIs(t, err, auth.ErrTOTPNotEnrolled)
+
+	// enrolling starts over from the first version
+	assert.NoError(t, repo.PutTOTP(ctx, &auth.TOTP{UserID: id, Secret: "B", Version: 1}))
+}
+
+func testTOTPDeleteUser(t *testing.T, repo TOTPUserRepository) {
+	ctx := context.Background()
+	id := createAccount(t, repo)
+	require.NoError(t, repo.PutTOTP(ctx, &auth.TOTP{UserID: id, Secret: "A", Version: 1}))
+
+	require.NoError(t, repo.Delete(ctx, id))
+	_, err := repo.GetTOTP(ctx, id)
+	assert.ErrorIs(t, err, auth.ErrTOTPNotEnrolled)
+}
+
+func testTOTPUnknownUser(t *testing.T, repo TOTPUserRepository) {
+	err := repo.PutTOTP(context.Background(), &auth.TOTP{UserID: uuid.New(), Secret: "A", Version: 1})
+	assert.ErrorIs(t, err, auth.ErrUserNotFound)
+}
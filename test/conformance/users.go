@@ -0,0 +1,223 @@
+package conformance
+
+import (
+	"context"
+	"medods-auth/service/auth"
+	"medods-auth/user"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type UserRepositoryFactory func(t *testing.T) auth.UserRepository
+
+func RunUsers(t *testing.T, factory UserRepositoryFactory) {
+	t.Run("Users", func(t *testing.T) {
+		t.Run("CreateGet", func(t *testing.T) { testUserCreateGet(t, factory(t)) })
+		t.Run("Duplicate", func(t *testing.T) { testUserDuplicate(t, factory(t)) })
+		t.Run("SetStatus", func(t *testing.T) { testUserSetStatus(t, factory(t)) })
+		t.Run("Delete", func(t *testing.T) { testUserDelete(t, factory(t)) })
+		t.Run("NotFound", func(t *testing.T) { testUserNotFound(t, factory(t)) })
+	})
+}
+
+func newAccount() *user.Account {
+	return &user.Account{
+		Id:        uuid.New(),
+		Status:    user.StatusActive,
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+}
+
+func testUserCreateGet(t *testing.T, repo auth.UserRepository) {
+	ctx := context.Background()
+	account := newAccount()
+	require.NoError(t, repo.Create(ctx, account))
+
+	got, err := repo.Get(ctx, account.Id)
+	require.NoError(t, err)
+	assert.Equal(t, account.Id, got.Id)
+	assert.Equal(t, user.StatusActive, got.Status)
+	assert.True(t, account.CreatedAt.Equal(got.CreatedAt), "created_at %v, got %v", account.CreatedAt, got.CreatedAt)
+}
+
+func testUserDuplicate(t *testing.T, repo auth.UserRepository) {
+	ctx := context.Background()
+	account := newAccount()
+	require.NoError(t, repo.Create(ctx, account))
+
+	dup := *account
+	dup.Status = user.StatusDisabled
+	assert.ErrorIs(t, repo.Create(ctx, &dup), auth.ErrUserExists)
+
+	got, err := repo.Get(ctx, account.Id)
+	require.NoError(t, err)
+	assert.Equal(t, user.StatusActive, got.Status, "duplicate must not overwrite")
+}
+
+func testUserSetStatus(t *testing.T, repo auth.UserRepository) {
+	ctx := context.Background()
+	account := newAccount()
+	require.NoError(t, repo.Create(ctx, account))
+
+	for _, status := range []user.Status{user.StatusDisabled, user.StatusLocked, user.StatusActive} {
+		require.NoError(t, repo.SetStatus(ctx, account.Id, status))
+		got, err := repo.Get(ctx, account.Id)
+		require.NoError(t, err)
+		assert.Equal(t, status, got.Status)
+		assert.True(t, account.CreatedAt.Equal(got.CreatedAt))
+	}
+}
+
+func testUserDelete(t *testing.T, repo auth.UserRepository) {
+	ctx := context.Background()
+	account := newAccount()
+	other := newAccount()
+	require.NoError(t, repo.Create(ctx, account))
+	require.NoError(t, repo.Create(ctx, other))
+
+	require.NoError(t, repo.Delete(ctx, account.Id))
+	_, err := repo.Get(ctx, account.Id)
+	assert.ErrorIs(t, err, auth.ErrUserNotFound)
+	_, err = repo.Get(ctx, other.Id)
+	assert.NoError(t, err)
+
+	// the ID can be reused
+	assert.NoError(t, repo.Create(ctx, account))
+}
+
+func testUserNotFound(t *testing.T, repo auth.UserRepository) {
+	ctx := context.Background()
+	id := uuid.New()
+	_, err := repo.Get(ctx, id)
+	assert.ErrorIs(t, err, auth.ErrUserNotFound)
+	assert.ErrorIs(t, repo.SetStatus(ctx, id, user.StatusDisabled), auth.ErrUserNotFound)
+	assert.ErrorIs(t, repo.Delete(ctx, id), auth.ErrUserNotFound)
+}
+
+// CredentialUserRepository is a user repository storing credentials.
+type CredentialUserRepository interface {
+	auth.UserRepository
+	auth.CredentialRepository
+}
+
+type CredentialRepositoryFactory func(t *testing.T) CredentialUserRepository
+
+func RunCredentials(t *testing.T, factory CredentialRepositoryFactory) {
+	t.Run("Credentials", func(t *testing.T) {
+		t.Run("SetGet", func(t *testing.T) { testCredentialSetGet(t, factory(t)) })
+		t.Run("LoginTaken", func(t *testing.T) { testCredentialLoginTaken(t, factory(t)) })
+		t.Run("ChangeLogin", func(t *testing.T) { testCredentialChangeLogin(t, factory(t)) })
+		t.Run("UpdateHash", func(t *testing.T) { testCredentialUpdateHash(t, factory(t)) })
+		t.Run("DeleteUser", func(t *testing.T) { testCredentialDeleteUser(t, factory(t)) })
+		t.Run("UnknownUser", func(t *testing.T) { testCredentialUnknownUser(t, factory(t)) })
+	})
+}
+
+func createAccount(t *testing.T, repo auth.UserRepository) uuid.UUID {
+	t.Helper()
+	account := newAccount()
+	require.NoError(t, repo.Create(context.Background(), account))
+	return account.Id
+}
+
+func testCredentialSetGet(t *testing.T, repo CredentialUserRepository) {
+	ctx := context.Background()
+	id := createAccount(t, repo)
+
+	_, err := repo.GetCredential(ctx, "alice@example.com")
+	assert.ErrorIs(t, err, auth.ErrCredentialNotFound)
+	_, err = repo.GetUserCredential(ctx, id)
+	assert.ErrorIs(t, err, auth.ErrCredentialNotFound)
+
+	cred := auth.Credential{UserID: id, Login: "alice@example.com", Hash: "hash-1"}
+	require.NoError(t, repo.SetCredential(ctx, cred))
+	got, err := repo.GetCredential(ctx, "alice@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, cred, *got)
+	got, err = repo.GetUserCredential(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, cred, *got)
+
+	// setting it again replaces the hash
+	cred.Hash = "hash-2"
+	require.NoError(t, repo.SetCredential(ctx, cred))
+	got, err = repo.GetCredential(ctx, "alice@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "hash-2", got.Hash)
+}
+
+func testCredentialLoginTaken(t *testing.T, repo CredentialUserRepository) {
+	ctx := context.Background()
+	alice := createAccount(t, repo)
+	bob := createAccount(t, repo)
+
+	require.NoError(t, repo.SetCredential(ctx, auth.Credential{UserID: alice, Login: "alice", Hash: "a"}))
+	err := repo.SetCredential(ctx, auth.Credential{UserID: bob, Login: "alice", Hash: "b"})
+	assert.ErrorIs(t, err, auth.ErrLoginTaken)
+
+	got, err := repo.GetCredential(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, alice, got.UserID)
+}
+
+func testCredentialChangeLogin(t *testing.T, repo CredentialUserRepository) {
+	ctx := context.Background()
+	alice := createAccount(t, repo)
+	bob := createAccount(t, repo)
+
+	require.NoError(t, repo.SetCredential(ctx, auth.Credential{UserID: alice, Login: "alice", Hash: "a"}))
+	require.NoError(t, repo.SetCredential(ctx, auth.Credential{UserID: alice, Login: "alice2", Hash: "a"}))
+
+	_, err := repo.GetCredential(ctx, "alice")
+	assert.ErrorIs(t, err, auth.ErrCredentialNotFound)
+	got, err := repo.GetCredential(ctx, "alice2")
+	require.NoError(t, err)
+	assert.Equal(t, alice, got.UserID)
+	got, err = repo.GetUserCredential(ctx, alice)
+	require.NoError(t, err)
+	assert.Equal(t, "alice2", got.Login)
+
+	// the old login is free again
+	assert.NoError(t, repo.SetCredential(ctx, auth.Credential{UserID: bob, Login: "alice", Hash: "b"}))
+}
+
+func testCredentialUpdateHash(t *testing.T, repo CredentialUserRepository) {
+	ctx := context.Background()
+	id := createAccount(t, repo)
+	require.NoError(t, repo.SetCredential(ctx, auth.Credential{UserID: id, Login: "carol", Hash: "old"}))
+
+	require.NoError(t, repo.UpdateCredentialHash(ctx, id, "old", "rehashed"))
+	got, err := repo.GetCredential(ctx, "carol")
+	require.NoError(t, err)
+	assert.Equal(t, "rehashed", got.Hash)
+
+	// a stale rehash doesn't overwrite a newer password
+	require.NoError(t, repo.UpdateCredentialHash(ctx, id, "old", "stale"))
+	got, err = repo.GetCredential(ctx, "carol")
+	require.NoError(t, err)
+	assert.Equal(t, "rehashed", got.Hash)
+}
+
+func testCredentialDeleteUser(t *testing.T, repo CredentialUserRepository) {
+	ctx := context.Background()
+	id := createAccount(t, repo)
+	require.NoError(t, repo.SetCredential(ctx, auth.Credential{UserID: id, Login: "dave", Hash: "d"}))
+
+	require.NoError(t, repo.Delete(ctx, id))
+	_, err := repo.GetCredential(ctx, "dave")
+	assert.ErrorIs(t, err, auth.ErrCredentialNotFound)
+	_, err = repo.GetUserCredential(ctx, id)
+	assert.ErrorIs(t, err, auth.ErrCredentialNotFound)
+
+	other := createAccount(t, repo)
+	assert.NoError(t, repo.SetCredential(ctx, auth.Credential{UserID: other, Login: "dave", Hash: "e"}))
+}
+
+func testCredentialUnknownUser(t *testing.T, repo CredentialUserRepository) {
+	err := repo.SetCredential(context.Background(), auth.Credential{UserID: uuid.New(), Login: "erin", Hash: "e"})
+	assert.ErrorIs(t, err, auth.ErrUserNotFound)
+}
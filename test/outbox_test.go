@@ -0,0 +1,99 @@
+package auth_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"medods-auth/persistance/sqlite"
+	"medods-auth/service/auth"
+	"medods-auth/service/outbox"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// webhookReceiver records deliveries and fails while down is set.
+type webhookReceiver struct {
+	mu     sync.Mutex
+	down   bool
+	topics []string
+	ids    map[string]int
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	var d struct {
+		Topic string `json:"topic"`
+	}
+	json.Unmarshal(body, &d)
+	r.topics = append(r.topics, d.Topic)
+	r.ids[req.Header.Get(outbox.HeaderMessageID)]++
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *webhookReceiver) setDown(down bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.down = down
+}
+
+func TestOutboxRelay(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db := openSQLite(t)
+	store := sqlite.NewOutboxRepository(db)
+	service := newTestService(t, func(o *auth.AuthServiceOptions) {
+		o.RefreshTokenRepo = sqlite.NewHashRepository(db)
+		o.Blacklist = sqlite.NewBlackListRepository(db)
+		o.UseOutbox = true
+	})
+
+	receiver := &webhookReceiver{down: true, ids: map[string]int{}}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+	relay := outbox.NewRelay(store, []outbox.Sink{outbox.NewWebhookSink(srv.URL, nil, nil)}, outbox.RelayOptions{
+		Backoff: outbox.Backoff{Initial: time.Millisecond, Max: time.Millisecond, MaxAttempts: 2},
+	})
+
+	pair, err := service.GenerateTokens(ctx, TestUser)
+	assert.NoError(err)
+	_, err = service.Refresh(ctx, TestUser, pair)
+	assert.NoError(err)
+
+	// the receiver is down until the messages are dead-lettered
+	for range 2 {
+		_, err = relay.RunOnce(ctx)
+		assert.NoError(err)
+		time.Sleep(5 * time.Millisecond)
+	}
+	dead, err := store.List(ctx, outbox.StatusDead, 10)
+	assert.NoError(err)
+	assert.Len(dead, 2)
+	assert.Empty(receiver.topics)
+
+	receiver.setDown(false)
+	n, err := store.Replay(ctx, nil)
+	assert.NoError(err)
+	assert.Equal(2, n)
+	_, err = relay.RunOnce(ctx)
+	assert.NoError(err)
+
+	assert.Equal([]string{"tokens_issued", "tokens_refreshed"}, receiver.topics)
+	for id, count := range receiver.ids {
+		assert.Equal(1, count, id)
+	}
+	pending, err := store.List(ctx, outbox.StatusPending, 10)
+	assert.NoError(err)
+	assert.Empty(pending)
+}
@@ -0,0 +1,133 @@
+// Package pgtest provides a Postgres server for tests. It uses the server
+// described by TEST_POSTGRES_* variables when set, otherwise it spawns a
+// throwaway cluster if initdb and pg_ctl are found. Tests are skipped when
+// neither is possible.
+package pgtest
+
+import (
+	"fmt"
+	"medods-auth/persistance/postgres"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var (
+	once    sync.Once
+	conf    *postgres.PostgresConfig
+	dataDir string
+	pgCtl   string
+	reason  string
+)
+
+// Config returns a config for the test server, or skips t.
+func Config(t testing.TB) *postgres.PostgresConfig {
+	t.Helper()
+	once.Do(setup)
+	if conf == nil {
+		t.Skip("postgres unavailable: " + reason)
+	}
+	c := *conf
+	return &c
+}
+
+// Shutdown stops a spawned server. Call it from TestMain after m.Run.
+func Shutdown() {
+	if dataDir == "" {
+		return
+	}
+	exec.Command(pgCtl, "-D", dataDir, "-m", "immediate", "stop").Run()
+	os.RemoveAll(dataDir)
+}
+
+func setup() {
+	if host := os.Getenv("TEST_POSTGRES_HOST"); host != "" {
+		conf = &postgres.PostgresConfig{
+			Host:     host,
+			Port:     envOr("TEST_POSTGRES_PORT", "5432"),
+			User:     envOr("TEST_POSTGRES_USER", "postgres"),
+			Password: envOr("TEST_POSTGRES_PASSWORD", "postgres"),
+			Name:     envOr("TEST_POSTGRES_DB", "postgres"),
+			SkipSSL:  true,
+		}
+		return
+	}
+
+	if os.Geteuid() == 0 {
+		reason = "TEST_POSTGRES_HOST not set and postgres refuses to run as root"
+		return
+	}
+	initdb, err := lookPath("initdb")
+	if err != nil {
+		reason = "TEST_POSTGRES_HOST not set and initdb not found"
+		return
+	}
+	pgCtl, err = lookPath("pg_ctl")
+	if err != nil {
+		reason = "TEST_POSTGRES_HOST not set and pg_ctl not found"
+		return
+	}
+
+	dataDir, err = os.MkdirTemp("", "pgtest")
+	if err != nil {
+		reason = err.Error()
+		return
+	}
+	port, err := freePort()
+	if err != nil {
+		reason = err.Error()
+		return
+	}
+	out, err := exec.Command(initdb, "-D", dataDir, "-U", "postgres", "--auth=trust").CombinedOutput()
+	if err != nil {
+		reason = fmt.Sprintf("initdb: %v: %s", err, out)
+		return
+	}
+	out, err = exec.Command(pgCtl, "-D", dataDir, "-w", "-l", filepath.Join(dataDir, "log"),
+		"-o", fmt.Sprintf("-p %d -k %s -c listen_addresses=127.0.0.1 -c fsync=off", port, dataDir),
+		"start",
+	).CombinedOutput()
+	if err != nil {
+		reason = fmt.Sprintf("pg_ctl start: %v: %s", err, out)
+		return
+	}
+
+	conf = &postgres.PostgresConfig{
+		Host:     "127.0.0.1",
+		Port:     fmt.Sprint(port),
+		User:     "postgres",
+		Password: "postgres",
+		Name:     "postgres",
+		SkipSSL:  true,
+	}
+}
+
+func lookPath(name string) (string, error) {
+	if path, err := exec.LookPath(name); err == nil {
+		return path, nil
+	}
+	matches, _ := filepath.Glob("/usr/lib/postgresql/*/bin/" + name)
+	if len(matches) > 0 {
+		return matches[len(matches)-1], nil
+	}
+	return "", exec.ErrNotFound
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,364 @@
+package auth_test
+
+import (
+	"context"
+	"medods-auth/persistance/bolt"
+	"medods-auth/persistance/memory"
+	"medods-auth/persistance/postgres"
+	"medods-auth/persistance/redis"
+	"medods-auth/persistance/sqlite"
+	"medods-auth/service/audit"
+	"medods-auth/service/auth"
+	"medods-auth/service/lockout"
+	"medods-auth/service/outbox"
+	"medods-auth/service/ratelimit"
+	"medods-auth/test/conformance"
+	"medods-auth/test/pgtest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	pgtest.Shutdown()
+	os.Exit(code)
+}
+
+func TestMemoryStorage(t *testing.T) {
+	conformance.Run(t,
+		func(t *testing.T) auth.TokenHashRepository {
+			repo := memory.NewHashRepository(memory.Options{})
+			t.Cleanup(func() { repo.Close() })
+			return repo
+		},
+		func(t *testing.T) auth.TokenBlackList {
+			repo := memory.NewBlackListRepository(memory.Options{})
+			t.Cleanup(func() { repo.Close() })
+			return repo
+		},
+	)
+	conformance.RunSessionLimiter(t, func(t *testing.T) conformance.SessionRepository {
+		repo := memory.NewHashRepository(memory.Options{})
+		t.Cleanup(func() { repo.Close() })
+		return repo
+	})
+	conformance.RunUsers(t, func(t *testing.T) auth.UserRepository {
+		return memory.NewUserRepository()
+	})
+	conformance.RunCredentials(t, func(t *testing.T) conformance.CredentialUserRepository {
+		return memory.NewUserRepository()
+	})
+	conformance.RunTOTP(t, func(t *testing.T) conformance.TOTPUserRepository {
+		return memory.NewUserRepository()
+	})
+	conformance.RunPasskeys(t, func(t *testing.T) conformance.PasskeyUserRepository {
+		return memory.NewUserRepository()
+	})
+	conformance.RunClients(t, func(t *testing.T) conformance.ClientUserRepository {
+		return memory.NewUserRepository()
+	})
+	conformance.RunLimiter(t, func(t *testing.T) ratelimit.Limiter {
+		repo := memory.NewRateLimitRepository(memory.Options{})
+		t.Cleanup(func() { repo.Close() })
+		return repo
+	})
+	conformance.RunLockout(t, func(t *testing.T) lockout.Store {
+		repo := memory.NewLockoutRepository(memory.Options{})
+		t.Cleanup(func() { repo.Close() })
+		return repo
+	})
+}
+
+func openSQLite(t *testing.T) *sqlx.DB {
+	db, err := sqlite.InitDatabase(&sqlite.SQLiteConfig{Path: sqlite.InMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	conformance.Run(t,
+		func(t *testing.T) auth.TokenHashRepository {
+			return sqlite.NewHashRepository(openSQLite(t))
+		},
+		func(t *testing.T) auth.TokenBlackList {
+			return sqlite.NewBlackListRepository(openSQLite(t))
+		},
+	)
+	conformance.RunRotator(t,
+		func(t *testing.T) (auth.TokenRotator, auth.TokenHashRepository, auth.TokenBlackList) {
+			db := openSQLite(t)
+			repo := sqlite.NewHashRepository(db)
+			return repo, repo, sqlite.NewBlackListRepository(db)
+		},
+	)
+	conformance.RunOutbox(t,
+		func(t *testing.T) (conformance.OutboxRepository, outbox.Store) {
+			db := openSQLite(t)
+			return sqlite.NewHashRepository(db), sqlite.NewOutboxRepository(db)
+		},
+	)
+	conformance.RunSessionLimiter(t, func(t *testing.T) conformance.SessionRepository {
+		// a file, unlike :memory:, is shared by several connections
+		db, err := sqlite.InitDatabase(&sqlite.SQLiteConfig{Path: filepath.Join(t.TempDir(), "test.db")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return sqlite.NewHashRepository(db)
+	})
+	conformance.RunUsers(t, func(t *testing.T) auth.UserRepository {
+		return sqlite.NewUserRepository(openSQLite(t))
+	})
+	conformance.RunCredentials(t, func(t *testing.T) conformance.CredentialUserRepository {
+		return sqlite.NewUserRepository(openSQLite(t))
+	})
+	conformance.RunTOTP(t, func(t *testing.T) conformance.TOTPUserRepository {
+		return sqlite.NewUserRepository(openSQLite(t))
+	})
+	conformance.RunPasskeys(t, func(t *testing.T) conformance.PasskeyUserRepository {
+		return sqlite.NewUserRepository(openSQLite(t))
+	})
+	conformance.RunClients(t, func(t *testing.T) conformance.ClientUserRepository {
+		return sqlite.NewUserRepository(openSQLite(t))
+	})
+}
+
+func openPostgres(t *testing.T) *sqlx.DB {
+	conf := pgtest.Config(t)
+	conf.HashDatabase = true
+	conf.BlackListDatabase = true
+	conf.UserDatabase = true
+	db, err := postgres.InitDatabase(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE token, blacklist, outbox, oauth_device_codes, oauth_codes, oauth_consents, oauth_clients, webauthn_challenges, passkeys, totp, credentials, users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestPostgresStorage(t *testing.T) {
+	conformance.Run(t,
+		func(t *testing.T) auth.TokenHashRepository {
+			return postgres.NewHashRepository(openPostgres(t))
+		},
+		func(t *testing.T) auth.TokenBlackList {
+			return postgres.NewBlackListRepository(openPostgres(t))
+		},
+	)
+	conformance.RunRotator(t,
+		func(t *testing.T) (auth.TokenRotator, auth.TokenHashRepository, auth.TokenBlackList) {
+			db := openPostgres(t)
+			repo := postgres.NewHashRepository(db)
+			return repo, repo, postgres.NewBlackListRepository(db)
+		},
+	)
+	conformance.RunOutbox(t,
+		func(t *testing.T) (conformance.OutboxRepository, outbox.Store) {
+			db := openPostgres(t)
+			return postgres.NewHashRepository(db), postgres.NewOutboxRepository(db)
+		},
+	)
+	conformance.RunSessionLimiter(t, func(t *testing.T) conformance.SessionRepository {
+		return postgres.NewHashRepository(openPostgres(t))
+	})
+	conformance.RunUsers(t, func(t *testing.T) auth.UserRepository {
+		return postgres.NewUserRepository(openPostgres(t))
+	})
+	conformance.RunCredentials(t, func(t *testing.T) conformance.CredentialUserRepository {
+		return postgres.NewUserRepository(openPostgres(t))
+	})
+	conformance.RunTOTP(t, func(t *testing.T) conformance.TOTPUserRepository {
+		return postgres.NewUserRepository(openPostgres(t))
+	})
+	conformance.RunPasskeys(t, func(t *testing.T) conformance.PasskeyUserRepository {
+		return postgres.NewUserRepository(openPostgres(t))
+	})
+	conformance.RunClients(t, func(t *testing.T) conformance.ClientUserRepository {
+		return postgres.NewUserRepository(openPostgres(t))
+	})
+}
+
+func openRedis(t *testing.T) *goredis.Client {
+	srv := miniredis.RunT(t)
+	client, err := redis.Connect(&redis.RedisConfig{Addr: srv.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestRedisStorage(t *testing.T) {
+	conformance.Run(t,
+		func(t *testing.T) auth.TokenHashRepository {
+			return redis.NewHashRepository(openRedis(t), "")
+		},
+		func(t *testing.T) auth.TokenBlackList {
+			return redis.NewBlackListRepository(openRedis(t), "")
+		},
+	)
+	conformance.RunRotator(t,
+		func(t *testing.T) (auth.TokenRotator, auth.TokenHashRepository, auth.TokenBlackList) {
+			client := openRedis(t)
+			repo := redis.NewHashRepository(client, "test:")
+			return repo, repo, redis.NewBlackListRepository(client, "test:")
+		},
+	)
+	conformance.RunSessionLimiter(t, func(t *testing.T) conformance.SessionRepository {
+		return redis.NewHashRepository(openRedis(t), "")
+	})
+	conformance.RunUsers(t, func(t *testing.T) auth.UserRepository {
+		return redis.NewUserRepository(openRedis(t), "")
+	})
+	conformance.RunCredentials(t, func(t *testing.T) conformance.CredentialUserRepository {
+		return redis.NewUserRepository(openRedis(t), "")
+	})
+	conformance.RunTOTP(t, func(t *testing.T) conformance.TOTPUserRepository {
+		return redis.NewUserRepository(openRedis(t), "")
+	})
+	conformance.RunPasskeys(t, func(t *testing.T) conformance.PasskeyUserRepository {
+		return redis.NewUserRepository(openRedis(t), "")
+	})
+	conformance.RunClients(t, func(t *testing.T) conformance.ClientUserRepository {
+		return redis.NewUserRepository(openRedis(t), "")
+	})
+	conformance.RunLimiter(t, func(t *testing.T) ratelimit.Limiter {
+		return redis.NewRateLimitRepository(openRedis(t), "")
+	})
+	conformance.RunLockout(t, func(t *testing.T) lockout.Store {
+		return redis.NewLockoutRepository(openRedis(t), "")
+	})
+}
+
+func openBolt(t *testing.T) *bbolt.DB {
+	db, err := bolt.InitDatabase(&bolt.BoltConfig{Path: filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestBoltStorage(t *testing.T) {
+	conformance.Run(t,
+		func(t *testing.T) auth.TokenHashRepository {
+			return bolt.NewHashRepository(openBolt(t))
+		},
+		func(t *testing.T) auth.TokenBlackList {
+			return bolt.NewBlackListRepository(openBolt(t))
+		},
+	)
+	conformance.RunRotator(t,
+		func(t *testing.T) (auth.TokenRotator, auth.TokenHashRepository, auth.TokenBlackList) {
+			db := openBolt(t)
+			repo := bolt.NewHashRepository(db)
+			return repo, repo, bolt.NewBlackListRepository(db)
+		},
+	)
+	conformance.RunSessionLimiter(t, func(t *testing.T) conformance.SessionRepository {
+		return bolt.NewHashRepository(openBolt(t))
+	})
+	conformance.RunUsers(t, func(t *testing.T) auth.UserRepository {
+		return bolt.NewUserRepository(openBolt(t))
+	})
+	conformance.RunCredentials(t, func(t *testing.T) conformance.CredentialUserRepository {
+		return bolt.NewUserRepository(openBolt(t))
+	})
+	conformance.RunTOTP(t, func(t *testing.T) conformance.TOTPUserRepository {
+		return bolt.NewUserRepository(openBolt(t))
+	})
+	conformance.RunPasskeys(t, func(t *testing.T) conformance.PasskeyUserRepository {
+		return bolt.NewUserRepository(openBolt(t))
+	})
+	conformance.RunClients(t, func(t *testing.T) conformance.ClientUserRepository {
+		return bolt.NewUserRepository(openBolt(t))
+	})
+}
+
+func TestPostgresRateLimit(t *testing.T) {
+	conformance.RunLimiter(t, func(t *testing.T) ratelimit.Limiter {
+		conf := pgtest.Config(t)
+		conf.RateLimitDatabase = true
+		db, err := postgres.InitDatabase(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		_, err = db.Exec("TRUNCATE rate_limit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return postgres.NewRateLimitRepository(db)
+	})
+}
+
+func TestPostgresLockout(t *testing.T) {
+	conformance.RunLockout(t, func(t *testing.T) lockout.Store {
+		conf := pgtest.Config(t)
+		conf.LockoutDatabase = true
+		db, err := postgres.InitDatabase(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		_, err = db.Exec("TRUNCATE lockout")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return postgres.NewLockoutRepository(db)
+	})
+}
+
+func TestPostgresAudit(t *testing.T) {
+	conf := pgtest.Config(t)
+	conf.AuditDatabase = true
+	db, err := postgres.InitDatabase(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("TRUNCATE audit_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert := assert.New(t)
+	ctx := context.Background()
+	repo := postgres.NewAuditRepository(db)
+	userID := uuid.New()
+	for _, event := range []audit.Event{audit.EventTokensIssued, audit.EventTokensRefreshed, audit.EventLogout} {
+		assert.NoError(repo.Record(ctx, audit.Entry{Time: time.Now(), Event: event, UserID: userID}))
+	}
+	assert.NoError(repo.Record(ctx, audit.Entry{Time: time.Now(), Event: audit.EventTokensIssued, UserID: uuid.New()}))
+
+	all, err := repo.Query(ctx, audit.Filter{})
+	assert.NoError(err)
+	assert.Len(all, 4)
+	assert.NoError(audit.Verify(all))
+
+	own, err := repo.Query(ctx, audit.Filter{UserID: &userID, Limit: 2})
+	assert.NoError(err)
+	if assert.Len(own, 2) {
+		assert.Equal(audit.EventTokensIssued, own[0].Event)
+		assert.Equal(audit.EventTokensRefreshed, own[1].Event)
+	}
+
+	_, err = db.Exec("UPDATE audit_log SET outcome = 'success'")
+	assert.Error(err, "audit log should be append-only")
+}
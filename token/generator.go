@@ -15,9 +15,23 @@ const (
 	ClaimSubject  = "sub"
 	ClaimJWTID    = "jti"
 
-	ClaimUserAgent = "user_agent"
+	ClaimUserAgent    = "user_agent"
+	ClaimSessionStart = "auth_time"
+	ClaimAMR          = "amr"
+	ClaimSubjectType  = "sub_type"
+	ClaimClientID     = "client_id"
+	ClaimScope        = "scope"
+
+	ClaimNonce           = "nonce"
+	ClaimACR             = "acr"
+	ClaimAccessTokenHash = "at_hash"
 )
 
+// SubjectClient is the subject type of tokens issued to an OAuth client
+// on its own behalf, whose subject is the client ID. Tokens of users have
+// no subject type.
+const SubjectClient = "client"
+
 var ErrUnexpextedClaimType = errors.New("unexpected type for claims")
 var ErrNoClaimsInToken = errors.New("no claims in decoded token")
 var ErrParsingTokenId = errors.New("err parsing token id")
@@ -28,6 +42,12 @@ const (
 	TokenTypeUnknown tokenType = "unknown"
 	TokenTypeAccess  tokenType = "access"
 	TokenTypeRefresh tokenType = "refresh"
+	// TokenTypeMFAPending proves the first factor of a login and is only
+	// accepted to complete it.
+	TokenTypeMFAPending tokenType = "mfa_pending"
+	// TokenTypeID is an OpenID Connect ID token. It tells a client who
+	// signed in and is not accepted as an access token.
+	TokenTypeID tokenType = "id"
 )
 
 type Token struct {
@@ -39,6 +59,21 @@ type Claims struct {
 	jwt.RegisteredClaims
 	UserAgent string
 	TokenType tokenType
+	// SessionStart is when the session the token belongs to was started.
+	SessionStart *jwt.NumericDate `json:"auth_time,omitempty"`
+	// AMR lists the authentication methods of RFC 8176 the session was
+	// started with.
+	AMR []string `json:"amr,omitempty"`
+
+	SubjectType string `json:"sub_type,omitempty"`
+	ClientID    string `json:"client_id,omitempty"`
+	// Scope is space separated, as in OAuth.
+	Scope string `json:"scope,omitempty"`
+
+	// Nonce, ACR and AccessTokenHash are only set on ID tokens.
+	Nonce           string `json:"nonce,omitempty"`
+	ACR             string `json:"acr,omitempty"`
+	AccessTokenHash string `json:"at_hash,omitempty"`
 }
 
 type JTI = uuid.UUID
@@ -51,6 +86,31 @@ func (t *Token) Expires() (time.Time, error) {
 	return exp.Time, nil
 }
 
+// SessionStart returns the zero time for tokens issued without it.
+func (t *Token) SessionStart() (time.Time, error) {
+	if t.claims == nil {
+		return time.Time{}, ErrNoClaimsInToken
+	}
+	if t.claims.SessionStart == nil {
+		return time.Time{}, nil
+	}
+	return t.claims.SessionStart.Time, nil
+}
+
+func (t *Token) AMR() ([]string, error) {
+	if t.claims == nil {
+		return nil, ErrNoClaimsInToken
+	}
+	return t.claims.AMR, nil
+}
+
+func (t *Token) SubjectType() (string, error) {
+	if t.claims == nil {
+		return "", ErrNoClaimsInToken
+	}
+	return t.claims.SubjectType, nil
+}
+
 func (t *Token) JTI() (JTI, error) {
 	if t.claims == nil {
 		return JTI(uuid.Nil), ErrNoClaimsInToken
@@ -96,6 +156,22 @@ type Options struct {
 	User user.User
 	TTL  time.Duration
 	Type tokenType
+	// SessionStart is optional.
+	SessionStart time.Time
+	// AMR is optional.
+	AMR []string
+	// ClientID is optional. Without a User the token is issued to the
+	// client on its own behalf.
+	ClientID string
+	// Scope is optional.
+	Scope string
+
+	// Issuer and Audience are optional, set on ID tokens with the rest.
+	Issuer          string
+	Audience        string
+	Nonce           string
+	ACR             string
+	AccessTokenHash string
 }
 
 type Generator interface {
@@ -118,6 +194,24 @@ func (g *SHA512Generator) Generate(opts Options) *Token {
 		},
 		UserAgent: opts.User.UserAgent,
 		TokenType: opts.Type,
+		AMR:       opts.AMR,
+		ClientID:  opts.ClientID,
+		Scope:     opts.Scope,
+
+		Nonce:           opts.Nonce,
+		ACR:             opts.ACR,
+		AccessTokenHash: opts.AccessTokenHash,
+	}
+	c.Issuer = opts.Issuer
+	if opts.Audience != "" {
+		c.Audience = jwt.ClaimStrings{opts.Audience}
+	}
+	if opts.User.Id == uuid.Nil && opts.ClientID != "" {
+		c.Subject = opts.ClientID
+		c.SubjectType = SubjectClient
+	}
+	if !opts.SessionStart.IsZero() {
+		c.SessionStart = jwt.NewNumericDate(opts.SessionStart)
 	}
 
 	return &Token{
@@ -130,18 +224,26 @@ func (g *SHA512Generator) Encode(t *Token, secret []byte) (string, error) {
 	return t.t.SignedString(secret)
 }
 
+// Decode returns tokens that are valid but for having expired along with
+// an error wrapping jwt.ErrTokenExpired, for the few callers accepting them.
 func (g *SHA512Generator) Decode(t string, secret []byte) (*Token, error) {
+	return parse(t, func(token *jwt.Token) (any, error) {
+		return secret, nil
+	}, jwt.SigningMethodHS512)
+}
+
+// parse decodes t signed with method and the key of keyFunc.
+func parse(t string, keyFunc jwt.Keyfunc, method jwt.SigningMethod) (*Token, error) {
 	decoded, err := jwt.ParseWithClaims(
 		t,
 		&Claims{},
-		func(token *jwt.Token) (any, error) {
-			return secret, nil
-		},
+		keyFunc,
 		jwt.WithValidMethods([]string{
-			jwt.SigningMethodHS512.Alg(),
+			method.Alg(),
 		}),
 	)
-	if err != nil {
+	expired := errors.Is(err, jwt.ErrTokenExpired)
+	if err != nil && !expired {
 		return nil, err
 	}
 
@@ -152,6 +254,9 @@ func (g *SHA512Generator) Decode(t string, secret []byte) (*Token, error) {
 	if err != nil {
 		return nil, err
 	}
+	if expired {
+		return token, jwt.ErrTokenExpired
+	}
 	return token, nil
 }
 
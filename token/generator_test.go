@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
@@ -48,3 +49,145 @@ func TestGenerate(t *testing.T) {
 	assert.Nil(err)
 	assert.Equal(TokenTypeAccess, ttype)
 }
+
+func TestSessionStart(t *testing.T) {
+	assert := assert.New(t)
+	generator := &SHA512Generator{}
+	u := user.User{Id: uuid.New()}
+
+	started := time.Now().Add(-time.Hour).Truncate(time.Second)
+	encoding, err := generator.Encode(generator.Generate(Options{
+		User:         u,
+		TTL:          time.Minute,
+		SessionStart: started,
+	}), testSecret)
+	assert.Nil(err)
+	parsed, err := generator.Decode(encoding, testSecret)
+	assert.Nil(err)
+	start, err := parsed.SessionStart()
+	assert.Nil(err)
+	assert.True(started.Equal(start))
+
+	encoding, err = generator.Encode(generator.Generate(Options{
+		User: u,
+		TTL:  time.Minute,
+	}), testSecret)
+	assert.Nil(err)
+	parsed, err = generator.Decode(encoding, testSecret)
+	assert.Nil(err)
+	start, err = parsed.SessionStart()
+	assert.Nil(err)
+	assert.True(start.IsZero())
+}
+
+func TestAMR(t *testing.T) {
+	assert := assert.New(t)
+	generator := &SHA512Generator{}
+
+	encoding, err := generator.Encode(generator.Generate(Options{
+		User: user.User{Id: uuid.New()},
+		TTL:  time.Minute,
+		Type: TokenTypeMFAPending,
+		AMR:  []string{"pwd", "otp"},
+	}), testSecret)
+	assert.Nil(err)
+	parsed, err := generator.Decode(encoding, testSecret)
+	assert.Nil(err)
+	amr, err := parsed.AMR()
+	assert.Nil(err)
+	assert.Equal([]string{"pwd", "otp"}, amr)
+	ttype, err := parsed.Type()
+	assert.Nil(err)
+	assert.Equal(TokenTypeMFAPending, ttype)
+}
+
+func TestClientToken(t *testing.T) {
+	assert := assert.New(t)
+	generator := &SHA512Generator{}
+
+	encoding, err := generator.Encode(generator.Generate(Options{
+		TTL:      time.Minute,
+		ClientID: "billing",
+		Scope:    "invoices:read invoices:write",
+	}), testSecret)
+	assert.Nil(err)
+	parsed, err := generator.Decode(encoding, testSecret)
+	assert.Nil(err)
+	subjectType, err := parsed.SubjectType()
+	assert.Nil(err)
+	assert.Equal(SubjectClient, subjectType)
+	claims, err := parsed.GetClaims()
+	assert.Nil(err)
+	assert.Equal("billing", claims.Subject)
+	assert.Equal("billing", claims.ClientID)
+	assert.Equal("invoices:read invoices:write", claims.Scope)
+	_, err = parsed.UserID()
+	assert.Equal(ErrParsingTokenId, err)
+
+	// tokens of users keep their subject when issued through a client
+	id := uuid.New()
+	encoding, err = generator.Encode(generator.Generate(Options{
+		User:     user.User{Id: id},
+		TTL:      time.Minute,
+		ClientID: "spa",
+	}), testSecret)
+	assert.Nil(err)
+	parsed, err = generator.Decode(encoding, testSecret)
+	assert.Nil(err)
+	subjectType, err = parsed.SubjectType()
+	assert.Nil(err)
+	assert.Empty(subjectType)
+	userID, err := parsed.UserID()
+	assert.Nil(err)
+	assert.Equal(id, userID)
+}
+
+func TestIDToken(t *testing.T) {
+	assert := assert.New(t)
+	generator := &SHA512Generator{}
+
+	encoding, err := generator.Encode(generator.Generate(Options{
+		User:            user.User{Id: uuid.New()},
+		TTL:             time.Minute,
+		Type:            TokenTypeID,
+		Issuer:          "https://auth.example.com",
+		Audience:        "spa",
+		Nonce:           "n-0S6_WzA2Mj",
+		ACR:             "2",
+		AccessTokenHash: "77QmUPtjPfzWtF2AnpK9RQ",
+	}), testSecret)
+	assert.Nil(err)
+	parsed, err := generator.Decode(encoding, testSecret)
+	assert.Nil(err)
+	claims, err := parsed.GetClaims()
+	assert.Nil(err)
+	assert.Equal(TokenTypeID, claims.TokenType)
+	assert.Equal("https://auth.example.com", claims.Issuer)
+	assert.Equal([]string{"spa"}, []string(claims.Audience))
+	assert.Equal("n-0S6_WzA2Mj", claims.Nonce)
+	assert.Equal("2", claims.ACR)
+	assert.Equal("77QmUPtjPfzWtF2AnpK9RQ", claims.AccessTokenHash)
+	assert.Empty(claims.ClientID)
+}
+
+func TestDecodeExpired(t *testing.T) {
+	assert := assert.New(t)
+	generator := &SHA512Generator{}
+	id := uuid.New()
+
+	encoding, err := generator.Encode(generator.Generate(Options{
+		User: user.User{Id: id},
+		TTL:  -time.Minute,
+	}), testSecret)
+	assert.Nil(err)
+	parsed, err := generator.Decode(encoding, testSecret)
+	assert.ErrorIs(err, jwt.ErrTokenExpired)
+	userID, err := parsed.UserID()
+	assert.Nil(err)
+	assert.Equal(id, userID)
+
+	// the signature is still checked
+	parsed, err = generator.Decode(encoding, []byte("other_secret"))
+	assert.ErrorIs(err, jwt.ErrTokenSignatureInvalid)
+	assert.Nil(parsed)
+}
@@ -2,6 +2,7 @@ package token
 
 import (
 	"crypto/sha256"
+	"log/slog"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -22,6 +23,15 @@ func (enc EncodedToken) Bytes() []byte {
 	return []byte(enc)
 }
 
+// LogValue keeps tokens out of logs.
+func (enc EncodedToken) LogValue() slog.Value {
+	return slog.StringValue("[REDACTED]")
+}
+
+func (h TokenHash) LogValue() slog.Value {
+	return slog.StringValue("[REDACTED]")
+}
+
 type BcryptHasher struct{}
 
 func (h BcryptHasher) Hash(t EncodedToken) (TokenHash, error) {
@@ -0,0 +1,143 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrUnsupportedKey = errors.New("signing key must be an ECDSA P-256 private key")
+var ErrUnknownKeyID = errors.New("token signed with an unknown key")
+
+// SigningKey signs tokens clients verify on their own, such as ID tokens,
+// with ES256. Unlike the secret of the other tokens its public half is
+// published as a JWK.
+type SigningKey struct {
+	// ID is the kid of the tokens, the JWK thumbprint of RFC 7638 of the
+	// public key, so replicas sharing the key agree on it.
+	ID  string
+	key *ecdsa.PrivateKey
+	jwk JWK
+}
+
+// JWK is the public half of a SigningKey, as in RFC 7517.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+}
+
+func NewSigningKey(key *ecdsa.PrivateKey) (*SigningKey, error) {
+	if key == nil || key.Curve != elliptic.P256() {
+		return nil, ErrUnsupportedKey
+	}
+	pub, err := key.PublicKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	// uncompressed point, 0x04 || x || y
+	point := pub.Bytes()
+	size := (len(point) - 1) / 2
+	x := base64.RawURLEncoding.EncodeToString(point[1 : 1+size])
+	y := base64.RawURLEncoding.EncodeToString(point[1+size:])
+
+	// the required members in lexicographic order, as RFC 7638 has it
+	thumbprint, err := json.Marshal(struct {
+		Curve   string `json:"crv"`
+		KeyType string `json:"kty"`
+		X       string `json:"x"`
+		Y       string `json:"y"`
+	}{"P-256", "EC", x, y})
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(thumbprint)
+	id := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return &SigningKey{
+		ID:  id,
+		key: key,
+		jwk: JWK{
+			KeyType:   "EC",
+			Use:       "sig",
+			Algorithm: jwt.SigningMethodES256.Alg(),
+			KeyID:     id,
+			Curve:     "P-256",
+			X:         x,
+			Y:         y,
+		},
+	}, nil
+}
+
+// GenerateSigningKey returns a new random key.
+func GenerateSigningKey() (*SigningKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigningKey(key)
+}
+
+// ParseSigningKey reads a PEM encoded P-256 private key, either PKCS #8
+// ("PRIVATE KEY") or SEC 1 ("EC PRIVATE KEY") as written by openssl.
+func ParseSigningKey(data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM block found", ErrUnsupportedKey)
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%w: unexpected PEM block %q", ErrUnsupportedKey, block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, ErrUnsupportedKey
+	}
+	return NewSigningKey(ecKey)
+}
+
+// JWK returns the public key to publish.
+func (k *SigningKey) JWK() JWK {
+	return k.jwk
+}
+
+// Sign encodes t with k, whatever generator made it.
+func (k *SigningKey) Sign(t *Token) (string, error) {
+	signed := jwt.NewWithClaims(jwt.SigningMethodES256, t.claims)
+	signed.Header["kid"] = k.ID
+	return signed.SignedString(k.key)
+}
+
+// Verify decodes a token signed by k. Like Decode, it returns tokens that
+// are valid but for having expired along with an error wrapping
+// jwt.ErrTokenExpired.
+func (k *SigningKey) Verify(t string) (*Token, error) {
+	return parse(t, func(token *jwt.Token) (any, error) {
+		if kid, _ := token.Header["kid"].(string); kid != k.ID {
+			return nil, ErrUnknownKeyID
+		}
+		return &k.key.PublicKey, nil
+	}, jwt.SigningMethodES256)
+}
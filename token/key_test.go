@@ -0,0 +1,95 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"medods-auth/user"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigningKey(t *testing.T) {
+	assert := assert.New(t)
+	generator := &SHA512Generator{}
+	key, err := GenerateSigningKey()
+	assert.NoError(err)
+	assert.NotEmpty(key.ID)
+
+	id := uuid.New()
+	signed, err := key.Sign(generator.Generate(Options{
+		User:     user.User{Id: id},
+		TTL:      time.Minute,
+		Type:     TokenTypeID,
+		Audience: "client",
+	}))
+	assert.NoError(err)
+	parsed, err := key.Verify(signed)
+	assert.NoError(err)
+	assert.Equal(jwt.SigningMethodES256, parsed.t.Method)
+	assert.Equal(key.ID, parsed.t.Header["kid"])
+	subject, err := parsed.UserID()
+	assert.NoError(err)
+	assert.Equal(id, subject)
+	ttype, err := parsed.Type()
+	assert.NoError(err)
+	assert.Equal(TokenTypeID, ttype)
+
+	// neither the secret nor another key verifies it, nor it the others
+	_, err = generator.Decode(signed, testSecret)
+	assert.ErrorIs(err, jwt.ErrTokenSignatureInvalid)
+	other, err := GenerateSigningKey()
+	assert.NoError(err)
+	_, err = other.Verify(signed)
+	assert.ErrorIs(err, ErrUnknownKeyID)
+	hs512, err := generator.Encode(generator.Generate(Options{User: user.User{Id: id}, TTL: time.Minute}), testSecret)
+	assert.NoError(err)
+	_, err = key.Verify(hs512)
+	assert.ErrorIs(err, jwt.ErrTokenSignatureInvalid)
+
+	expired, err := key.Sign(generator.Generate(Options{User: user.User{Id: id}, TTL: -time.Minute}))
+	assert.NoError(err)
+	parsed, err = key.Verify(expired)
+	assert.ErrorIs(err, jwt.ErrTokenExpired)
+	assert.NotNil(parsed)
+
+	jwk := key.JWK()
+	assert.Equal("EC", jwk.KeyType)
+	assert.Equal("ES256", jwk.Algorithm)
+	assert.Equal("P-256", jwk.Curve)
+	assert.Equal(key.ID, jwk.KeyID)
+	assert.Len(jwk.X, 43)
+	assert.Len(jwk.Y, 43)
+}
+
+func TestParseSigningKey(t *testing.T) {
+	assert := assert.New(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(err)
+	key, err := NewSigningKey(ecKey)
+	assert.NoError(err)
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	assert.NoError(err)
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	assert.NoError(err)
+	for _, block := range []*pem.Block{{Type: "PRIVATE KEY", Bytes: pkcs8}, {Type: "EC PRIVATE KEY", Bytes: sec1}} {
+		parsed, err := ParseSigningKey(pem.EncodeToMemory(block))
+		if assert.NoError(err, block.Type) {
+			assert.Equal(key.ID, parsed.ID, "the key ID only depends on the key")
+		}
+	}
+
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(err)
+	_, err = NewSigningKey(p384)
+	assert.ErrorIs(err, ErrUnsupportedKey)
+	_, err = ParseSigningKey([]byte("not a key"))
+	assert.ErrorIs(err, ErrUnsupportedKey)
+}
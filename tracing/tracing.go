@@ -0,0 +1,111 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+	ExporterMemory = "memory"
+)
+
+type Config struct {
+	Exporter    string
+	ServiceName string
+
+	// OTLPEndpoint overrides OTEL_EXPORTER_OTLP_ENDPOINT, e.g. "collector:4318".
+	OTLPEndpoint string
+	OTLPInsecure bool
+
+	// SampleRatio of root spans, incoming sampled parents are always followed.
+	SampleRatio float64
+}
+
+type Provider struct {
+	*sdktrace.TracerProvider
+	memory *tracetest.InMemoryExporter
+}
+
+// Setup installs a global tracer provider and the W3C trace context
+// propagator. With ExporterNone spans are still propagated but not exported.
+func Setup(ctx context.Context, conf *Config) (*Provider, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(conf.ServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Provider{}
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+	}
+	switch conf.Exporter {
+	case ExporterNone, "":
+	case ExporterStdout:
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	case ExporterOTLP:
+		var otlpOpts []otlptracehttp.Option
+		if conf.OTLPEndpoint != "" {
+			otlpOpts = append(otlpOpts, otlptracehttp.WithEndpoint(conf.OTLPEndpoint))
+		}
+		if conf.OTLPInsecure {
+			otlpOpts = append(otlpOpts, otlptracehttp.WithInsecure())
+		}
+		exp, err := otlptracehttp.New(ctx, otlpOpts...)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	case ExporterMemory:
+		p.memory = tracetest.NewInMemoryExporter()
+		opts = append(opts, sdktrace.WithSyncer(p.memory))
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter: %s", conf.Exporter)
+	}
+
+	p.TracerProvider = sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(p.TracerProvider)
+	return p, nil
+}
+
+var ErrNoMemoryExporter = errors.New("tracing provider has no in-memory exporter")
+
+// Spans returns the spans recorded by ExporterMemory.
+func (p *Provider) Spans() (tracetest.SpanStubs, error) {
+	if p.memory == nil {
+		return nil, ErrNoMemoryExporter
+	}
+	return p.memory.GetSpans(), nil
+}
+
+func (p *Provider) Reset() {
+	if p.memory != nil {
+		p.memory.Reset()
+	}
+}
@@ -0,0 +1,110 @@
+package tracing
+
+import (
+	"context"
+	"medods-auth/persistance/memory"
+	"medods-auth/service/auth"
+	"medods-auth/token"
+	"medods-auth/user"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanByName(spans tracetest.SpanStubs, name string) *tracetest.SpanStub {
+	for i := range spans {
+		if spans[i].Name == name {
+			return &spans[i]
+		}
+	}
+	return nil
+}
+
+func attr(span *tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestMiddlewarePropagation(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.TestMode)
+
+	tp, err := Setup(context.Background(), &Config{Exporter: ExporterMemory, ServiceName: "test", SampleRatio: 0})
+	require.NoError(t, err)
+	defer tp.Shutdown(context.Background())
+
+	accessTTL, refreshTTL := time.Minute, time.Hour
+	svc, err := auth.NewAuthService(auth.AuthServiceOptions{
+		RefreshTokenRepo: memory.NewHashRepository(memory.Options{}),
+		Blacklist:        memory.NewBlackListRepository(memory.Options{}),
+		Generator:        &token.SHA512Generator{},
+		Hasher:           token.BcryptHasher{},
+		Secret:           []byte("test_secret"),
+		AccessTTL:        &accessTTL,
+		RefreshTTL:       &refreshTTL,
+	})
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/login", func(c *gin.Context) {
+		_, err := svc.GenerateTokens(c.Request.Context(), user.User{Id: uuid.New()})
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	router.GET("/me", func(c *gin.Context) {
+		enc := token.EncodedToken("garbage")
+		_, err := svc.ExtractUserID(c.Request.Context(), &enc)
+		c.Error(err)
+		c.Status(http.StatusUnauthorized)
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/login", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans, err := tp.Spans()
+	require.NoError(t, err)
+	server := spanByName(spans, "GET /login")
+	generate := spanByName(spans, "AuthService.GenerateTokens")
+	hash := spanByName(spans, "Hasher.Hash")
+	require.NotNil(t, server)
+	require.NotNil(t, generate)
+	require.NotNil(t, hash)
+
+	// sampled remote parent is honoured despite a zero sample ratio
+	assert.Equal(traceID, server.SpanContext.TraceID().String())
+	assert.Equal("00f067aa0ba902b7", server.Parent.SpanID().String())
+	assert.Equal(server.SpanContext.SpanID(), generate.Parent.SpanID())
+	assert.Equal(generate.SpanContext.SpanID(), hash.Parent.SpanID())
+	assert.Equal(int64(http.StatusOK), attr(server, "http.response.status_code").AsInt64())
+	assert.Len(attr(generate, "auth.user_id_hash").AsString(), 16)
+
+	tp.Reset()
+	req = httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans, err = tp.Spans()
+	require.NoError(t, err)
+	extract := spanByName(spans, "AuthService.ExtractUserID")
+	require.NotNil(t, extract)
+	assert.Equal(auth.CodeInvalidToken, attr(extract, "auth.error_code").AsString())
+	assert.Equal(auth.CodeInvalidToken, attr(spanByName(spans, "GET /me"), "auth.error_code").AsString())
+}
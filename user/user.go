@@ -1,8 +1,40 @@
 package user
 
-import "github.com/google/uuid"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
 
 type User struct {
 	Id        uuid.UUID
 	UserAgent string
+
+	// IP is the client address of the current request. It is recorded in
+	// the audit log and is not part of the issued tokens.
+	IP string
+}
+
+type Status string
+
+const (
+	StatusActive   Status = "active"
+	StatusDisabled Status = "disabled"
+	StatusLocked   Status = "locked"
+)
+
+func (s Status) Valid() bool {
+	switch s {
+	case StatusActive, StatusDisabled, StatusLocked:
+		return true
+	}
+	return false
+}
+
+// Account is a user registered in the directory. Only active accounts
+// are issued tokens.
+type Account struct {
+	Id        uuid.UUID
+	Status    Status
+	CreatedAt time.Time
 }